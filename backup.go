@@ -0,0 +1,85 @@
+package clover
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// backupEntry holds the snapshot of a collection inside a backup, in the same format used to store collections on disk.
+type backupEntry struct {
+	Name     string          `json:"name"`
+	Snapshot json.RawMessage `json:"snapshot"`
+}
+
+// Backup writes to w a consistent copy of all the collections of the database, as they were when Backup was called.
+// Since collections are never modified in place, the database is locked only while the backup is started: writes
+// applied while the copy is being written are allowed, and are not included in it. The backup contains documents
+// and indexes, while settings which are not stored on disk (such as validators and hooks) are not part of it.
+// Corrupted collections are skipped. Use Restore to rebuild a database from a backup.
+func (db *DB) Backup(w io.Writer) error {
+	db.ensureLoaded()
+
+	db.mu.RLock()
+	collections := make([]*collection, 0, len(db.collections))
+	for _, c := range db.collections {
+		collections = append(collections, c)
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(collections, func(i, j int) bool {
+		return collections[i].name < collections[j].name
+	})
+
+	encoder := json.NewEncoder(w)
+	for _, c := range collections {
+		data, err := db.encodeCollection(c)
+		if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(&backupEntry{Name: c.name, Snapshot: data}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore rebuilds in dir the database contained in the backup read from r (see DB.Backup), which can then be opened
+// with Open. The directory is created if it doesn't exist, but it must not contain a database already.
+// Collection files are written to stable storage before Restore returns.
+func Restore(r io.Reader, dir string) error {
+	storage, err := newFileStorage(dir, 0)
+	if err != nil {
+		return err
+	}
+
+	names, err := storage.List()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dir + "/" + walFileName); len(names) > 0 || err == nil {
+		return fmt.Errorf("%w: directory %s already contains a database", ErrInvalidArgument, dir)
+	}
+
+	decoder := json.NewDecoder(r)
+	for {
+		entry := &backupEntry{}
+		if err := decoder.Decode(entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if entry.Name == "" {
+			return fmt.Errorf("%w: backup entry without collection name", ErrInvalidArgument)
+		}
+
+		if err := storage.Save(entry.Name, entry.Snapshot, true); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package clover
+
+import "fmt"
+
+type writeOpKind int
+
+const (
+	writeInsert writeOpKind = iota
+	writeUpdate
+	writeReplace
+	writeDelete
+)
+
+// WriteOp is a single operation of a bulk write (see DB.BulkWrite).
+type WriteOp struct {
+	kind    writeOpKind
+	id      string
+	doc     *Document
+	updates map[string]interface{}
+}
+
+// InsertOp inserts doc, as by DB.Insert.
+func InsertOp(doc *Document) *WriteOp {
+	return &WriteOp{kind: writeInsert, doc: doc}
+}
+
+// UpdateByIdOp applies the supplied updates to the document having the given id, as by DB.UpdateById.
+func UpdateByIdOp(id string, updates map[string]interface{}) *WriteOp {
+	return &WriteOp{kind: writeUpdate, id: id, updates: updates}
+}
+
+// ReplaceByIdOp replaces (or inserts) the document having the given id, as by DB.ReplaceById.
+func ReplaceByIdOp(id string, doc *Document) *WriteOp {
+	return &WriteOp{kind: writeReplace, id: id, doc: doc}
+}
+
+// DeleteByIdOp removes the document having the given id, as by DB.DeleteById.
+func DeleteByIdOp(id string) *WriteOp {
+	return &WriteOp{kind: writeDelete, id: id}
+}
+
+// WriteResult describes the outcome of an operation of a bulk write.
+type WriteResult struct {
+	// Op is the change applied by the operation: in particular, it is OpInsert for a ReplaceByIdOp if the document didn't exist.
+	Op ChangeOp
+
+	// Id is the id of the affected document, which is the newly assigned one for inserted documents without an id.
+	Id string
+}
+
+// BulkWrite applies the supplied operations, in order, to a collection, and commits them as a single write: the
+// collection is saved (or logged, see WithWriteAheadLog) only once, and watchers and hooks receive one event per
+// operation. Each operation sees the effects of the previous ones, so that, for example, a document inserted by the
+// batch can be updated by a later operation. The batch is atomic: if any operation fails (for example, with
+// ErrDuplicateKey or ErrDocumentNotFound), nothing is written and the returned error reports the position of the
+// failed operation. On success, the returned results are in the same order as ops.
+func (db *DB) BulkWrite(collectionName string, ops []*WriteOp) ([]WriteResult, error) {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return nil, collectionNotExistError(collectionName)
+	}
+
+	newCollection := c.clone()
+	results := make([]WriteResult, 0, len(ops))
+	events := make([]ChangeEvent, 0, len(ops))
+	for i, op := range ops {
+		event, err := db.applyWriteOp(newCollection, op)
+		if err != nil {
+			return nil, fmt.Errorf("bulk write operation %d: %w", i, err)
+		}
+		results = append(results, WriteResult{Op: event.Op, Id: event.Id})
+		events = append(events, event)
+	}
+
+	if len(events) == 0 {
+		return results, nil
+	}
+
+	if err := db.commit(newCollection, events...); err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		if op.kind == writeInsert {
+			op.doc.idField = db.idField
+			op.doc.Set(db.idField, results[i].Id)
+		}
+	}
+	return results, nil
+}
+
+// applyWriteOp applies op to c, which must not be committed yet, returning the event describing the change.
+func (db *DB) applyWriteOp(c *collection, op *WriteOp) (ChangeEvent, error) {
+	if op == nil {
+		return ChangeEvent{}, ErrInvalidArgument
+	}
+
+	switch op.kind {
+	case writeInsert, writeReplace:
+		if op.doc == nil {
+			return ChangeEvent{}, ErrInvalidArgument
+		}
+
+		id, err := db.explicitId(op.doc)
+		if err != nil {
+			return ChangeEvent{}, err
+		}
+
+		if op.kind == writeReplace {
+			if op.id == "" || (id != "" && id != op.id) {
+				return ChangeEvent{}, fmt.Errorf("%w: cannot replace document %q with document %q", ErrInvalidArgument, op.id, id)
+			}
+			id = op.id
+		} else if id == "" && c.idGenerator != nil {
+			id = c.idGenerator()
+		} else if id == "" {
+			id = db.idGenerator()
+		}
+
+		changeOp := OpInsert
+		if _, exists := c.docs[id]; exists {
+			if op.kind == writeInsert {
+				return ChangeEvent{}, duplicateKeyError(c.name, id)
+			}
+			changeOp = OpUpdate
+		}
+
+		fields, err := db.codecs.normalize(op.doc.fields, db.preserveInts)
+		if err != nil {
+			return ChangeEvent{}, err
+		}
+
+		newDoc := db.newDocument()
+		newDoc.fields = fields.(map[string]interface{})
+		newDoc.Set(db.idField, id)
+
+		c.put(newDoc)
+		return newChangeEvent(changeOp, c.name, newDoc), nil
+	case writeUpdate:
+		doc, ok := c.docs[op.id]
+		if !ok {
+			return ChangeEvent{}, documentNotFoundError(c.name, op.id)
+		}
+
+		updates, err := db.normalizeUpdates(op.updates)
+		if err != nil {
+			return ChangeEvent{}, err
+		}
+
+		updateDoc := applyUpdates(doc, updates)
+		c.put(updateDoc)
+		return newChangeEvent(OpUpdate, c.name, updateDoc), nil
+	case writeDelete:
+		doc, ok := c.docs[op.id]
+		if !ok {
+			return ChangeEvent{}, documentNotFoundError(c.name, op.id)
+		}
+
+		c.remove(op.id)
+		return newChangeEvent(OpDelete, c.name, doc), nil
+	}
+	return ChangeEvent{}, ErrInvalidArgument
+}
@@ -0,0 +1,193 @@
+package clover
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// default maximum number of cached query results
+const defaultQueryCacheSize = 128
+
+type cacheEntry struct {
+	key        string
+	query      *Query      // query the entry has been created for, which is kept alive while its address is a key
+	collection *collection // version of the collection the results have been computed on
+
+	docs     []*Document // selected documents, before being projected
+	hasDocs  bool
+	count    int
+	hasCount bool
+}
+
+// queryCache memoizes the results of cached queries, evicting the least recently used entry when full.
+type queryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	lru        *list.List
+	entries    map[string]*list.Element
+}
+
+func newQueryCache(maxEntries int) *queryCache {
+	return &queryCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// cacheKey returns the key of the cached results of q, made of its serialized criteria (see Criteria.MarshalJSON),
+// sort options, skip and limit, so that equal queries built separately share their results. Projections don't take
+// part in the key, since cached documents are projected when returned. Queries whose criteria can't be serialized, or
+// contain values without a JSON type of their own (such as times, which would be confused with strings), are instead
+// identified by their address.
+func cacheKey(q *Query) string {
+	var spec map[string]interface{}
+	if q.criteria != nil {
+		spec = q.criteria.spec
+		if spec == nil || !isJSONValue(spec) {
+			return fmt.Sprintf("%p", q)
+		}
+	}
+
+	key, err := json.Marshal(struct {
+		Collection  string
+		Filter      map[string]interface{}
+		Sort        []SortOption
+		Skip        int
+		Limit       int
+		SortByScore bool
+	}{q.collection.name, spec, q.sortOpts, q.skip, q.limit, q.sortByScore})
+	if err != nil {
+		return fmt.Sprintf("%p", q)
+	}
+	return string(key)
+}
+
+// isJSONValue reports whether v is only made of maps, arrays, nulls, booleans, numbers and strings, whose JSON
+// representation is unambiguous.
+func isJSONValue(v interface{}) bool {
+	switch value := v.(type) {
+	case nil, bool, string, float64, float32, int, int64, int32, int16, int8, uint, uint64, uint32, uint16, uint8:
+		return true
+	case []interface{}:
+		for _, item := range value {
+			if !isJSONValue(item) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		for _, item := range value {
+			if !isJSONValue(item) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// entry returns the cache entry of q, provided that it has been computed on the supplied collection version.
+// If no such entry exists, a new empty one is created.
+func (cache *queryCache) entry(q *Query, c *collection) *cacheEntry {
+	key := cacheKey(q)
+	if elem, ok := cache.entries[key]; ok {
+		e := elem.Value.(*cacheEntry)
+		if e.collection == c {
+			cache.lru.MoveToFront(elem)
+			return e
+		}
+		cache.remove(elem)
+	}
+
+	e := &cacheEntry{key: key, query: q, collection: c}
+	cache.entries[key] = cache.lru.PushFront(e)
+	for cache.lru.Len() > cache.maxEntries {
+		cache.remove(cache.lru.Back())
+	}
+	return e
+}
+
+func (cache *queryCache) remove(elem *list.Element) {
+	e := cache.lru.Remove(elem).(*cacheEntry)
+	delete(cache.entries, e.key)
+}
+
+func (cache *queryCache) findAll(q *Query) []*Document {
+	current := q.current()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.maxEntries <= 0 {
+		return current.findAll()
+	}
+
+	e := cache.entry(q, current.collection)
+	if !e.hasDocs {
+		e.docs, e.hasDocs = current.selectAll(), true
+	}
+	docs := make([]*Document, 0, len(e.docs))
+	for _, doc := range e.docs {
+		docs = append(docs, q.project(doc))
+	}
+	return docs
+}
+
+func (cache *queryCache) count(q *Query) int {
+	current := q.current()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.maxEntries <= 0 {
+		return current.count()
+	}
+
+	e := cache.entry(q, current.collection)
+	if !e.hasCount {
+		e.count, e.hasCount = current.count(), true
+	}
+	return e.count
+}
+
+// invalidate discards the cached results of all the queries over the collection with the given name.
+func (cache *queryCache) invalidate(collectionName string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, elem := range cache.entries {
+		if elem.Value.(*cacheEntry).collection.name == collectionName {
+			cache.remove(elem)
+		}
+	}
+}
+
+func (cache *queryCache) clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.lru.Init()
+	cache.entries = make(map[string]*list.Element)
+}
+
+// Cached returns a new Query whose FindAll and Count results are memoized, and reused by subsequent calls until the
+// underlying collection is modified. Unlike other queries, a cached query always refers to the most recent version of
+// its collection. Results are shared by all the cached queries with the same criteria, sort options, skip and limit,
+// even if built separately, since they are identified by the JSON representation of their criteria (see
+// Criteria.MarshalJSON). Criteria built from functions (such as Func) can't be serialized: the results of such queries
+// are cached per Query object, so keep a reference to the returned query in order to benefit from the cache.
+//
+// The number of cached results is bounded (see WithQueryCacheSize): the least recently used entries are evicted first.
+func (q *Query) Cached() *Query {
+	newQuery := q.copy()
+	newQuery.cached = true
+	return newQuery
+}
+
+// ClearQueryCache discards all the results memoized by cached queries.
+func (db *DB) ClearQueryCache() {
+	db.queryCache.clear()
+}
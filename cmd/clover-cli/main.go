@@ -0,0 +1,286 @@
+// Command clover-cli inspects and modifies a clover database stored in a directory.
+//
+// Usage:
+//
+//	clover-cli [-dir path] [-wal] command [arguments]
+//
+// The commands are:
+//
+//	collections                     list the collections of the database, with their size
+//	create <collection>             create an empty collection
+//	drop <collection>               drop a collection
+//	query [-skip n] [-limit n] [-sort field] <collection> [filter...]
+//	                                print the matching documents, one JSON object per line
+//	count <collection> [filter...]  print the number of matching documents
+//	insert <collection> <json>      insert a JSON object, or an array of objects ("-" reads from stdin)
+//	delete <collection> [filter...] delete the matching documents
+//	export <collection> <file>      write the documents of a collection to a JSON file
+//	import <collection> <file>      insert the documents of a JSON file into a collection
+//
+// Each filter has the form <field><op><value>, where op is one of =, !=, >, >=, <, <= and ~ (which matches a Like pattern).
+// Values are parsed as JSON, falling back to plain strings, so that age>=18, name=alice and active=true work as expected.
+// Multiple filters must all be satisfied. Sorting is ascending, unless the field is prefixed by a minus sign.
+//
+// The collections, query, count and export commands open the database in read-only mode (see clover.OpenReadOnly),
+// so that they can run while the database is being inspected by other processes, but not while it is open for writing.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	c "github.com/ostafen/clover"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "database directory")
+	wal := flag.Bool("wal", false, "open the database with a write-ahead log")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := run(os.Stdout, *dir, *wal, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "clover-cli:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: clover-cli [-dir path] [-wal] collections|create|drop|query|count|insert|delete|export|import [arguments]")
+	flag.PrintDefaults()
+}
+
+var errUsage = errors.New("wrong number of arguments")
+
+// readOnlyCommands are the commands which don't modify the database.
+var readOnlyCommands = map[string]bool{"collections": true, "query": true, "count": true, "export": true}
+
+// run executes command on the database stored in dir, printing its output to out.
+func run(out io.Writer, dir string, wal bool, command string, args []string) (err error) {
+	opts := make([]c.Option, 0)
+	if wal {
+		opts = append(opts, c.WithWriteAheadLog())
+	}
+
+	open := c.Open
+	if readOnlyCommands[command] {
+		open = c.OpenReadOnly
+	}
+
+	db, err := open(dir, opts...)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	switch command {
+	case "collections":
+		return listCollections(out, db)
+	case "create":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return db.CreateCollection(args[0])
+	case "drop":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return db.DropCollection(args[0])
+	case "query":
+		return query(out, db, args)
+	case "count":
+		q, err := filteredQuery(db, args)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, q.Count())
+		return nil
+	case "insert":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return insert(out, db, args[0], args[1])
+	case "delete":
+		q, err := filteredQuery(db, args)
+		if err != nil {
+			return err
+		}
+
+		n := q.Count()
+		if err := q.Delete(); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d documents deleted\n", n)
+		return nil
+	case "export":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return db.ExportCollection(args[0], args[1])
+	case "import":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return db.ImportCollection(args[0], args[1])
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func listCollections(out io.Writer, db *c.DB) error {
+	for _, name := range db.ListCollections() {
+		stats, err := db.CollectionStats(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\t%d documents\t%d bytes\n", name, stats.Documents, stats.Size)
+	}
+	return nil
+}
+
+func query(out io.Writer, db *c.DB, args []string) error {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	skip := flags.Int("skip", 0, "number of documents to skip")
+	limit := flags.Int("limit", -1, "maximum number of documents to print")
+	sortField := flags.String("sort", "", "field to sort by (prefix with - for descending order)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	q, err := filteredQuery(db, flags.Args())
+	if err != nil {
+		return err
+	}
+
+	if *sortField != "" {
+		opt := c.SortOption{Field: *sortField, Direction: 1}
+		if strings.HasPrefix(*sortField, "-") {
+			opt = c.SortOption{Field: (*sortField)[1:], Direction: -1}
+		}
+		q = q.Sort(opt)
+	}
+
+	encoder := json.NewEncoder(out)
+	for _, doc := range q.Skip(*skip).Limit(*limit).FindAll() {
+		if err := encoder.Encode(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filteredQuery returns a query over the collection named by args[0], selecting the documents which satisfy all the filters in args[1:].
+func filteredQuery(db *c.DB, args []string) (*c.Query, error) {
+	if len(args) == 0 {
+		return nil, errUsage
+	}
+
+	q := db.Query(args[0])
+	if q == nil {
+		return nil, fmt.Errorf("%w: %s", c.ErrCollectionNotExist, args[0])
+	}
+
+	for _, filter := range args[1:] {
+		criteria, err := parseFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Where(criteria)
+	}
+	return q, nil
+}
+
+// operators are sorted so that each operator is tried before the ones it has as prefix.
+var operators = []string{"!=", ">=", "<=", "=", ">", "<", "~"}
+
+func parseFilter(filter string) (*c.Criteria, error) {
+	pos, op := -1, ""
+	for _, candidate := range operators {
+		if i := strings.Index(filter, candidate); i > 0 && (pos < 0 || i < pos) {
+			pos, op = i, candidate
+		}
+	}
+
+	if pos < 0 {
+		return nil, fmt.Errorf("invalid filter %q", filter)
+	}
+
+	field := c.Field(filter[:pos])
+	value := parseValue(filter[pos+len(op):])
+
+	switch op {
+	case "=":
+		return field.Eq(value), nil
+	case "!=":
+		return field.Neq(value), nil
+	case ">":
+		return field.Gt(value), nil
+	case ">=":
+		return field.GtEq(value), nil
+	case "<":
+		return field.Lt(value), nil
+	case "<=":
+		return field.LtEq(value), nil
+	}
+	return field.Like(filter[pos+len(op):]), nil
+}
+
+func parseValue(s string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(s), &value); err != nil {
+		return s
+	}
+	return value
+}
+
+func insert(out io.Writer, db *c.DB, collectionName string, data string) error {
+	if data == "-" {
+		content, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		data = string(content)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return err
+	}
+
+	objects, isArray := value.([]interface{})
+	if !isArray {
+		objects = []interface{}{value}
+	}
+
+	docs := make([]*c.Document, 0, len(objects))
+	for _, obj := range objects {
+		fields, isMap := obj.(map[string]interface{})
+		if !isMap {
+			return fmt.Errorf("%w: expected a JSON object, got %T", c.ErrInvalidArgument, obj)
+		}
+		docs = append(docs, c.NewDocumentOf(fields))
+	}
+
+	if err := db.Insert(collectionName, docs...); err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		fmt.Fprintln(out, doc.ObjectId())
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	c "github.com/ostafen/clover"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFilter(t *testing.T) {
+	db, err := c.Open("", c.WithStorage(c.NewMemoryStorage()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.CreateCollection("users"))
+	require.NoError(t, db.Insert("users",
+		c.NewDocumentOf(map[string]interface{}{"name": "alice", "age": 30, "active": true}),
+		c.NewDocumentOf(map[string]interface{}{"name": "bob", "age": 17, "active": false}),
+		c.NewDocumentOf(map[string]interface{}{"name": "a=b", "age": 45}),
+	))
+
+	cases := []struct {
+		filter  string
+		matches []string
+	}{
+		{"name=alice", []string{"alice"}},
+		{"name!=alice", []string{"bob", "a=b"}},
+		{"age>30", []string{"a=b"}},
+		{"age>=30", []string{"alice", "a=b"}},
+		{"age<30", []string{"bob"}},
+		{"age<=30", []string{"alice", "bob"}},
+		{"active=true", []string{"alice"}},
+		{"name~a%", []string{"alice", "a=b"}},
+		{"name=a=b", []string{"a=b"}},
+		{`name="30"`, nil},
+	}
+
+	for _, test := range cases {
+		criteria, err := parseFilter(test.filter)
+		require.NoError(t, err, test.filter)
+
+		var matches []string
+		for _, doc := range db.Query("users").Where(criteria).FindAll() {
+			matches = append(matches, doc.Get("name").(string))
+		}
+		require.ElementsMatch(t, test.matches, matches, test.filter)
+	}
+
+	for _, filter := range []string{"name", "=alice", ""} {
+		_, err := parseFilter(filter)
+		require.Error(t, err, filter)
+	}
+}
+
+func runCommand(t *testing.T, dir string, command string, args ...string) (string, error) {
+	out := &bytes.Buffer{}
+	err := run(out, dir, false, command, args)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-cli")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = runCommand(t, dir, "create", "users")
+	require.NoError(t, err)
+
+	_, err = runCommand(t, dir, "create", "users")
+	require.ErrorIs(t, err, c.ErrCollectionExist)
+
+	out, err := runCommand(t, dir, "insert", "users",
+		`[{"name": "alice", "age": 30}, {"name": "bob", "age": 17}, {"name": "carl", "age": 45}]`)
+	require.NoError(t, err)
+	require.Len(t, strings.Fields(out), 3)
+
+	out, err = runCommand(t, dir, "collections")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(out, "users\t3 documents\t"))
+
+	out, err = runCommand(t, dir, "count", "users", "age>=18")
+	require.NoError(t, err)
+	require.Equal(t, "2\n", out)
+
+	out, err = runCommand(t, dir, "query", "-sort", "-age", "-limit", "2", "users")
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+
+	names := make([]string, 0, len(lines))
+	for _, line := range lines {
+		fields := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal([]byte(line), &fields))
+		names = append(names, fields["name"].(string))
+	}
+	require.Equal(t, []string{"carl", "alice"}, names)
+
+	_, err = runCommand(t, dir, "query", "missing")
+	require.ErrorIs(t, err, c.ErrCollectionNotExist)
+
+	exportDir, err := ioutil.TempDir("", "clover-cli-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(exportDir)
+
+	exportPath := filepath.Join(exportDir, "users.json")
+	_, err = runCommand(t, dir, "export", "users", exportPath)
+	require.NoError(t, err)
+
+	out, err = runCommand(t, dir, "delete", "users", "age<18")
+	require.NoError(t, err)
+	require.Equal(t, "1 documents deleted\n", out)
+
+	_, err = runCommand(t, dir, "import", "people", exportPath)
+	require.NoError(t, err)
+
+	out, err = runCommand(t, dir, "count", "people")
+	require.NoError(t, err)
+	require.Equal(t, "3\n", out)
+
+	_, err = runCommand(t, dir, "drop", "people")
+	require.NoError(t, err)
+
+	_, err = runCommand(t, dir, "count", "people")
+	require.ErrorIs(t, err, c.ErrCollectionNotExist)
+
+	_, err = runCommand(t, dir, "create")
+	require.ErrorIs(t, err, errUsage)
+
+	_, err = runCommand(t, dir, "unknown")
+	require.Error(t, err)
+}
+
+func TestReadOnlyCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-cli")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("users"))
+	require.NoError(t, db.Insert("users", c.NewDocumentOf(map[string]interface{}{"name": "alice"})))
+
+	// the database is open for writing, so it can't even be inspected
+	_, err = runCommand(t, dir, "count", "users")
+	require.ErrorIs(t, err, c.ErrDatabaseLocked)
+	require.NoError(t, db.Close())
+
+	db, err = c.OpenReadOnly(dir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the database is being inspected, so it can only be inspected
+	out, err := runCommand(t, dir, "count", "users")
+	require.NoError(t, err)
+	require.Equal(t, "1\n", out)
+
+	out, err = runCommand(t, dir, "query", "users", "name=alice")
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 1)
+
+	_, err = runCommand(t, dir, "collections")
+	require.NoError(t, err)
+
+	_, err = runCommand(t, dir, "insert", "users", `{"name": "bob"}`)
+	require.ErrorIs(t, err, c.ErrDatabaseLocked)
+}
@@ -0,0 +1,182 @@
+package clover
+
+import (
+	"encoding/base64"
+	"reflect"
+	"time"
+)
+
+// names of the fields of the JSON object storing a value encoded by a codec
+const (
+	codecTypeField  = "$type"
+	codecValueField = "$value"
+)
+
+type codec struct {
+	name   string
+	encode func(v interface{}) (interface{}, error)
+	decode func(data interface{}) (interface{}, error)
+}
+
+// codecs maps Go types to the codecs used to store their values. A nil *codecs performs plain JSON normalization.
+type codecs struct {
+	byType       map[reflect.Type]*codec
+	byName       map[string]*codec
+	preserveInts bool
+}
+
+func newCodecs(list []codecOption, preserveInts bool) *codecs {
+	if len(list) == 0 {
+		return nil
+	}
+
+	cs := &codecs{
+		byType:       make(map[reflect.Type]*codec),
+		byName:       make(map[string]*codec),
+		preserveInts: preserveInts,
+	}
+	for _, opt := range list {
+		cs.byType[opt.typ] = opt.codec
+		cs.byName[opt.codec.name] = opt.codec
+	}
+	return cs
+}
+
+// encode returns a copy of v where each value having a registered type is replaced by its tagged encoded form.
+func (cs *codecs) encode(v interface{}) (interface{}, error) {
+	if cs == nil || v == nil {
+		return v, nil
+	}
+
+	if c, ok := cs.byType[reflect.TypeOf(v)]; ok {
+		data, err := c.encode(v)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{codecTypeField: c.name, codecValueField: data}, nil
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		encoded := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			encodedItem, err := cs.encode(item)
+			if err != nil {
+				return nil, err
+			}
+			encoded[k] = encodedItem
+		}
+		return encoded, nil
+	case []interface{}:
+		encoded := make([]interface{}, len(value))
+		for i, item := range value {
+			encodedItem, err := cs.encode(item)
+			if err != nil {
+				return nil, err
+			}
+			encoded[i] = encodedItem
+		}
+		return encoded, nil
+	}
+	return v, nil
+}
+
+// decode replaces, in place, each tagged value contained in the normalized value v with the Go value it encodes.
+func (cs *codecs) decode(v interface{}) (interface{}, error) {
+	if cs == nil {
+		return v, nil
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if name, isStr := value[codecTypeField].(string); isStr && len(value) == 2 {
+			if c, ok := cs.byName[name]; ok {
+				data := value[codecValueField]
+				// criteria values are always normalized preserving integers
+				if !cs.preserveInts {
+					data = intsToFloats(data)
+				}
+				return c.decode(data)
+			}
+		}
+
+		for k, item := range value {
+			decoded, err := cs.decode(item)
+			if err != nil {
+				return nil, err
+			}
+			value[k] = decoded
+		}
+	case []interface{}:
+		for i, item := range value {
+			decoded, err := cs.decode(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = decoded
+		}
+	}
+	return v, nil
+}
+
+// normalize behaves like the normalize function, except that values having a registered type are preserved.
+func (cs *codecs) normalize(value interface{}, preserveInts bool) (interface{}, error) {
+	encoded, err := cs.encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	normValue, err := normalize(encoded, preserveInts)
+	if err != nil {
+		return nil, err
+	}
+	return cs.decode(normValue)
+}
+
+type codecOption struct {
+	typ   reflect.Type
+	codec *codec
+}
+
+// WithCodec registers a codec for the type of sample. Values of such type are kept as they are when inserted in
+// documents (or used in criteria), rather than being converted through their JSON representation, and are stored using
+// the return value of encode, which must be JSON serializable. When a collection is loaded, decode receives the
+// normalized JSON form of the encoded value (where objects are maps and numbers are float64, unless WithPreserveIntegers
+// is used) and must return the original value. The name identifies the codec inside the stored collections, so it must
+// not change across reopens.
+//
+// Values are recognized at any nesting level of maps and slices, but not inside structs, which are always converted to JSON.
+// Criteria can test values of custom types for equality, while ordering comparisons are only supported for time.Time and []byte.
+func WithCodec(name string, sample interface{}, encode func(v interface{}) (interface{}, error), decode func(data interface{}) (interface{}, error)) Option {
+	return func(opts *options) {
+		opts.codecs = append(opts.codecs, codecOption{
+			typ:   reflect.TypeOf(sample),
+			codec: &codec{name: name, encode: encode, decode: decode},
+		})
+	}
+}
+
+// WithTimeCodec registers a codec preserving time.Time values, which are stored in RFC3339 format with nanoseconds.
+// Times can be compared by criteria (Eq, Gt, Lt, ...) and sorted chronologically.
+func WithTimeCodec() Option {
+	return WithCodec("time", time.Time{},
+		func(v interface{}) (interface{}, error) {
+			return v.(time.Time).Format(time.RFC3339Nano), nil
+		},
+		func(data interface{}) (interface{}, error) {
+			s, _ := data.(string)
+			return time.Parse(time.RFC3339Nano, s)
+		})
+}
+
+// WithBytesCodec registers a codec preserving []byte values, which are stored in base64 format.
+func WithBytesCodec() Option {
+	return WithCodec("bytes", []byte{},
+		func(v interface{}) (interface{}, error) {
+			return base64.StdEncoding.EncodeToString(v.([]byte)), nil
+		},
+		func(data interface{}) (interface{}, error) {
+			s, _ := data.(string)
+			return base64.StdEncoding.DecodeString(s)
+		})
+}
@@ -1,9 +1,16 @@
 package clover
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"math/rand"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -16,21 +23,77 @@ type predicate func(doc *Document) bool
 // It follows a fluent API style so that you can easily chain together multiple criteria.
 type Criteria struct {
 	p predicate
+
+	// conds holds simple field comparisons which are necessary conditions for the criteria to be satisfied.
+	// They are used to select an index to answer a query.
+	conds []fieldCond
+
+	// searches holds the Search criteria which are necessary conditions, usable with text indexes and to score documents.
+	searches []textSearch
+
+	// geoSearches holds the Near and Within criteria which are necessary conditions, usable with geo indexes.
+	geoSearches []geoSearch
+
+	// spec is the JSON representation of the criteria (see MarshalJSON), or nil if it can't be serialized.
+	spec map[string]interface{}
 }
 
 // collection represents a set of documents. It contains methods to add, select or delete documents.
 type collection struct {
-	db       *DB
-	name     string
-	docs     map[string]*Document
-	criteria *Criteria
+	db          *DB
+	name        string
+	docs        map[string]*Document
+	indexes     []*index
+	textIndexes []*textIndex
+	geoIndexes  []*geoIndex
+	criteria    *Criteria
+	validator   func(doc *Document) error
+	hooks       Hooks
+
+	// compressed is true if the collection is stored compressed, whatever the settings of the database
+	compressed bool
+
+	// versioned is true if documents carry a version number (see WithVersioning)
+	versioned bool
+
+	// idGenerator overrides the id generator of the database, if not nil
+	idGenerator func() string
+
+	// source, if not nil, provides the documents of the collection, which are then not held in docs (see WithPagedReads)
+	source *pagedSource
 }
 
 // Count returns the number of documents stored in the given collection.
 func (c *collection) Count() int {
+	if c.source != nil {
+		return c.source.count
+	}
 	return len(c.docs)
 }
 
+// get returns the document of c with the given id, if any.
+func (c *collection) get(id string) (*Document, bool) {
+	if c.source != nil {
+		return c.source.get(id)
+	}
+	doc, ok := c.docs[id]
+	return doc, ok
+}
+
+// forEachDoc calls fn on each document of c, in no particular order, until fn returns false.
+func (c *collection) forEachDoc(fn func(doc *Document) bool) {
+	if c.source != nil {
+		c.source.forEach(fn)
+		return
+	}
+
+	for _, doc := range c.docs {
+		if !fn(doc) {
+			return
+		}
+	}
+}
+
 func newCollection(db *DB, name string, docs []*Document) *collection {
 	c := &collection{
 		db:       db,
@@ -44,7 +107,100 @@ func newCollection(db *DB, name string, docs []*Document) *collection {
 
 func (c *collection) addDocuments(docs ...*Document) {
 	for _, doc := range docs {
-		c.docs[doc.Get(objectIdField).(string)] = doc
+		c.put(doc)
+	}
+}
+
+// put adds doc to the collection, replacing any document with the same id.
+func (c *collection) put(doc *Document) {
+	c.remove(doc.ObjectId())
+
+	c.docs[doc.ObjectId()] = doc
+	for _, idx := range c.indexes {
+		idx.add(doc)
+	}
+
+	for _, idx := range c.textIndexes {
+		idx.add(doc)
+	}
+
+	for _, idx := range c.geoIndexes {
+		idx.add(doc)
+	}
+}
+
+func (c *collection) remove(id string) {
+	doc, ok := c.docs[id]
+	if !ok {
+		return
+	}
+
+	delete(c.docs, id)
+	for _, idx := range c.indexes {
+		idx.remove(doc)
+	}
+
+	for _, idx := range c.textIndexes {
+		idx.remove(doc)
+	}
+
+	for _, idx := range c.geoIndexes {
+		idx.remove(doc)
+	}
+}
+
+// clone returns a new version of c, sharing the same documents, which can be modified without affecting c.
+// Collections are never modified once committed: each write operates on a clone, which then replaces the original one.
+func (c *collection) clone() *collection {
+	docs := make(map[string]*Document, len(c.docs))
+	for id, doc := range c.docs {
+		docs[id] = doc
+	}
+
+	indexes := make([]*index, 0, len(c.indexes))
+	for _, idx := range c.indexes {
+		indexes = append(indexes, idx.clone())
+	}
+
+	textIndexes := make([]*textIndex, 0, len(c.textIndexes))
+	for _, idx := range c.textIndexes {
+		textIndexes = append(textIndexes, idx.clone())
+	}
+
+	geoIndexes := make([]*geoIndex, 0, len(c.geoIndexes))
+	for _, idx := range c.geoIndexes {
+		geoIndexes = append(geoIndexes, idx.clone())
+	}
+
+	return &collection{
+		db:          c.db,
+		name:        c.name,
+		docs:        docs,
+		indexes:     indexes,
+		textIndexes: textIndexes,
+		geoIndexes:  geoIndexes,
+		criteria:    c.criteria,
+		validator:   c.validator,
+		hooks:       c.hooks,
+		idGenerator: c.idGenerator,
+		compressed:  c.compressed,
+		versioned:   c.versioned,
+		source:      c.source,
+	}
+}
+
+func (c *collection) truncate() {
+	c.docs = make(map[string]*Document)
+	for _, idx := range c.indexes {
+		idx.entries = idx.entries[:0]
+	}
+
+	for _, idx := range c.textIndexes {
+		idx.truncate()
+	}
+
+	for _, idx := range c.geoIndexes {
+		idx.truncate()
 	}
 }
 
@@ -52,6 +208,83 @@ func (c *collection) addDocuments(docs ...*Document) {
 type Query struct {
 	collection *collection
 	criteria   *Criteria
+	sortOpts   []SortOption
+	skip       int
+	limit      int
+	transforms []func(doc *Document) *Document
+	readOnly   bool
+	snapshot   bool
+	cached     bool
+	tx         *Tx
+
+	sortByScore bool
+
+	// ctx, if not nil, interrupts scans as soon as it is done (see FindAllContext)
+	ctx context.Context
+}
+
+func newQuery(c *collection) *Query {
+	return &Query{collection: c, criteria: nil, limit: -1}
+}
+
+func (q *Query) copy() *Query {
+	return &Query{
+		collection: q.collection,
+		criteria:   q.criteria,
+		sortOpts:   q.sortOpts,
+		skip:       q.skip,
+		limit:      q.limit,
+		transforms: q.transforms,
+		readOnly:   q.readOnly,
+		snapshot:   q.snapshot,
+		cached:     q.cached,
+		tx:         q.tx,
+
+		sortByScore: q.sortByScore,
+		ctx:         q.ctx,
+	}
+}
+
+// current returns a copy of q bound to the most recent version of its collection, unless q belongs to a snapshot.
+// If the collection has been dropped, q is returned unchanged.
+func (q *Query) current() *Query {
+	db := q.collection.db
+	db.mu.RLock()
+	c, ok := db.collections[q.collection.name]
+	db.mu.RUnlock()
+
+	if q.snapshot || !ok {
+		return q
+	}
+
+	newQuery := q.copy()
+	newQuery.collection = c
+	return newQuery
+}
+
+// committer returns the transaction q belongs to, if any, or the database otherwise.
+func (q *Query) committer() committer {
+	if q.tx != nil {
+		return q.tx
+	}
+	return q.collection.db
+}
+
+// latest returns a copy of q bound to the most recent version of its collection, so that writes never operate on stale data.
+// For queries belonging to a transaction, the most recent version is the one written by the transaction.
+func (q *Query) latest() (*Query, error) {
+	if q.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	c, ok := q.committer().getCollection(q.collection.name)
+	if !ok {
+		return nil, collectionNotExistError(q.collection.name)
+	}
+
+	newQuery := q.copy()
+	newQuery.collection = c
+	return newQuery, nil
 }
 
 func (q *Query) satisfy(doc *Document) bool {
@@ -61,20 +294,165 @@ func (q *Query) satisfy(doc *Document) bool {
 	return q.criteria.p(doc)
 }
 
+// forEach calls fn on each document selected by q, taking into account sort, skip and limit options, until fn returns false.
+func (q *Query) forEach(fn func(doc *Document) bool) {
+	if q.limit == 0 {
+		return
+	}
+
+	if searches := q.scoreSearches(); len(searches) > 0 || len(q.sortOpts) > 0 {
+		docs := make([]*Document, 0)
+		if len(searches) > 0 {
+			q.scan(func(doc *Document) bool {
+				if q.satisfy(doc) {
+					docs = append(docs, doc)
+				}
+				return true
+			})
+			q.sortDocumentsByScore(docs, searches)
+		} else if q.limit > 0 && addInts(q.skip, q.limit) < q.collection.Count() {
+			// only the first skip+limit documents are needed, so there is no need to sort all of them
+			top := newTopDocuments(q.skip+q.limit, q.sortOpts)
+			q.scan(func(doc *Document) bool {
+				if q.satisfy(doc) {
+					top.add(doc)
+				}
+				return true
+			})
+			docs = top.sorted()
+		} else {
+			q.scan(func(doc *Document) bool {
+				if q.satisfy(doc) {
+					docs = append(docs, doc)
+				}
+				return true
+			})
+			sortDocuments(docs, q.sortOpts)
+		}
+
+		if q.skip >= len(docs) {
+			return
+		}
+		docs = docs[q.skip:]
+		if q.limit > 0 && q.limit < len(docs) {
+			docs = docs[:q.limit]
+		}
+
+		for _, doc := range docs {
+			if !fn(doc) {
+				return
+			}
+		}
+		return
+	}
+
+	skipped, consumed := 0, 0
+	q.scan(func(doc *Document) bool {
+		if !q.satisfy(doc) {
+			return true
+		}
+
+		if skipped < q.skip {
+			skipped++
+			return true
+		}
+
+		consumed++
+		return fn(doc) && consumed != q.limit
+	})
+}
+
+// scan calls fn on each candidate document for q, until fn returns false.
+// Candidates are obtained from an index, if the query can be answered using one, or from the whole collection otherwise.
+func (q *Query) scan(fn func(doc *Document) bool) {
+	if q.ctx != nil {
+		fn = q.cancellable(fn)
+	}
+
+	if plan := q.plan(); plan != nil {
+		for _, id := range plan.index.scan(plan.lower, plan.upper) {
+			if !fn(q.collection.docs[id]) {
+				return
+			}
+		}
+		return
+	}
+
+	if idx, search := q.textPlan(); idx != nil {
+		for _, id := range idx.search(search.terms) {
+			if !fn(q.collection.docs[id]) {
+				return
+			}
+		}
+		return
+	}
+
+	if idx, search := q.geoPlan(); idx != nil {
+		for _, id := range idx.search(search.box) {
+			if !fn(q.collection.docs[id]) {
+				return
+			}
+		}
+		return
+	}
+
+	q.collection.forEachDoc(fn)
+}
+
+// project applies the transformations of q (projections and maps) to doc, in the order they were added to the query.
+func (q *Query) project(doc *Document) *Document {
+	for _, transform := range q.transforms {
+		doc = transform(doc)
+	}
+	return doc.share()
+}
+
+func (q *Query) addTransform(transform func(doc *Document) *Document) *Query {
+	newQuery := q.copy()
+	newQuery.transforms = append(append([]func(doc *Document) *Document{}, q.transforms...), transform)
+	return newQuery
+}
+
 // Count returns the number of documents which satisfy the query (i.e. len(q.FindAll()) == q.Count()).
+// Counting never sorts nor projects documents: if the query has no criteria, the result is computed from the size of
+// the collection, while otherwise the scan (which can use an index) stops as soon as skip+limit documents are found.
 func (q *Query) Count() int {
+	if q.cached {
+		return q.collection.db.queryCache.count(q)
+	}
+	return q.count()
+}
+
+func (q *Query) count() int {
+	if q.limit == 0 {
+		return 0
+	}
+
 	n := 0
-	for _, doc := range q.collection.docs {
-		if q.satisfy(doc) {
-			n++
-		}
+	if q.criteria == nil {
+		n = q.collection.Count()
+	} else {
+		q.scan(func(doc *Document) bool {
+			if q.satisfy(doc) {
+				n++
+			}
+			return q.limit < 0 || n < addInts(q.skip, q.limit)
+		})
+	}
+
+	n -= q.skip
+	if n < 0 {
+		n = 0
+	}
+	if q.limit > 0 && n > q.limit {
+		n = q.limit
 	}
 	return n
 }
 
 // MatchPredicate selects all the documents which satisfy the supplied predicate function.
 func (q *Query) MatchPredicate(p func(doc *Document) bool) *Query {
-	return q.Where(&Criteria{p})
+	return q.Where(Func(p))
 }
 
 // Where returns a new Query which select all the documents fullfilling both the base query and the provided Criteria.
@@ -86,94 +464,657 @@ func (q *Query) Where(c *Criteria) *Query {
 		newCriteria = newCriteria.And(c)
 	}
 
-	return &Query{
-		collection: q.collection,
-		criteria:   newCriteria,
+	newQuery := q.copy()
+	newQuery.criteria = newCriteria
+	return newQuery
+}
+
+// Sort returns a new Query which sorts the selected documents according to the supplied options.
+// Options are applied in order, each one breaking the ties left by the previous ones.
+func (q *Query) Sort(opts ...SortOption) *Query {
+	newQuery := q.copy()
+	newQuery.sortOpts = append(append([]SortOption{}, q.sortOpts...), opts...)
+	if len(newQuery.sortOpts) == 0 {
+		newQuery.sortOpts = []SortOption{{Field: q.collection.db.idField, Direction: 1}}
 	}
+	return newQuery
+}
+
+// Skip returns a new Query which discards the first n selected documents.
+func (q *Query) Skip(n int) *Query {
+	if n < 0 {
+		n = 0
+	}
+
+	newQuery := q.copy()
+	newQuery.skip = n
+	return newQuery
+}
+
+// Limit returns a new Query which selects at most n documents. A negative value means no limit.
+func (q *Query) Limit(n int) *Query {
+	newQuery := q.copy()
+	newQuery.limit = n
+	return newQuery
+}
+
+// Select returns a new Query whose result documents only contain the supplied fields.
+func (q *Query) Select(fields ...string) *Query {
+	return q.addTransform(func(doc *Document) *Document {
+		projected := q.collection.db.newDocument()
+		for _, field := range fields {
+			if doc.Has(field) {
+				projected.Set(field, doc.Get(field))
+			}
+		}
+		return projected
+	})
+}
+
+// Exclude returns a new Query whose result documents contain all the fields except the supplied ones (including the id
+// field, if listed). Nested fields can be excluded using dot, while array elements cannot. Select, Exclude and Map are
+// applied in the order they are called.
+func (q *Query) Exclude(excluded ...string) *Query {
+	return q.addTransform(func(doc *Document) *Document {
+		// the top-level object is always copied, so that result documents are never shared with the collection
+		fields := make(map[string]interface{}, len(doc.fields))
+		for k, v := range doc.fields {
+			fields[k] = v
+		}
+
+		var container interface{} = fields
+		for _, field := range excluded {
+			container, _ = withoutField(container, splitFieldPath(field))
+		}
+
+		projected := q.collection.db.newDocument()
+		projected.fields = container.(map[string]interface{})
+		return projected
+	})
+}
+
+// Map returns a new Query whose result documents are obtained by applying fn to each selected document, after filtering and sorting.
+// The function receives a copy of each document, so it is free to modify it. Map, Select and Exclude are applied in the order they are called.
+// Count, Update and Delete are not affected by Map.
+func (q *Query) Map(fn func(doc *Document) *Document) *Query {
+	return q.addTransform(func(doc *Document) *Document {
+		return fn(doc.Copy())
+	})
 }
 
 // FindById returns the document with the given id, if such a document exists and satisfies the underlying query, or null.
 func (q *Query) FindById(id string) *Document {
-	doc, ok := q.collection.docs[id]
+	doc, ok := q.collection.get(id)
 	if ok && q.satisfy(doc) {
-		return doc
+		return q.project(doc)
 	}
 	return nil
 }
 
 // FindAll selects all the documents satisfying q.
+// The returned documents are copy-on-write: they share their content with the collection until they are first changed
+// through Set, so they can be freely modified without affecting the stored documents. However, nested objects and
+// arrays returned by Get are shared as well, and must not be modified in place: use Document.Clone to obtain a
+// document whose values can all be safely modified.
 func (q *Query) FindAll() []*Document {
+	if q.cached {
+		return q.collection.db.queryCache.findAll(q)
+	}
+	return q.findAll()
+}
+
+// FindFirst returns the first document selected by q, or nil if there is no such document. The scan stops at the first
+// match, and only the top document is kept when the query is sorted. Without a sort, any matching document may be returned.
+func (q *Query) FindFirst() *Document {
+	if q.limit != 0 {
+		q = q.Limit(1)
+	}
+
+	docs := q.FindAll()
+	if len(docs) == 0 {
+		return nil
+	}
+	return docs[0]
+}
+
+func (q *Query) findAll() []*Document {
+	docs := make([]*Document, 0)
+	q.forEach(func(doc *Document) bool {
+		docs = append(docs, q.project(doc))
+		return true
+	})
+	return docs
+}
+
+// selectAll returns the documents selected by q, without projecting them.
+func (q *Query) selectAll() []*Document {
 	docs := make([]*Document, 0)
-	for _, doc := range q.collection.docs {
-		if q.satisfy(doc) {
-			docs = append(docs, doc)
+	q.forEach(func(doc *Document) bool {
+		docs = append(docs, doc)
+		return true
+	})
+	return docs
+}
+
+// ForEach calls fn on each document selected by q, until fn returns false. Documents are passed to fn as they are found,
+// without collecting the results in memory first (except for the document pointers needed to sort them).
+// As for FindAll, documents are copy-on-write.
+func (q *Query) ForEach(fn func(doc *Document) bool) {
+	if q.cached {
+		for _, doc := range q.FindAll() {
+			if !fn(doc) {
+				return
+			}
 		}
+		return
 	}
-	return docs
+
+	q.forEach(func(doc *Document) bool {
+		return fn(q.project(doc))
+	})
+}
+
+// forEachResult calls fn on each (projected) document selected by q, stopping at the first error.
+func (q *Query) forEachResult(fn func(doc *Document) error) error {
+	if q.cached {
+		for _, doc := range q.FindAll() {
+			if err := fn(doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	q.forEach(func(doc *Document) bool {
+		err = fn(q.project(doc))
+		return err == nil
+	})
+	return err
+}
+
+// Distinct returns the distinct values of the given field among the documents selected by q, sorted in ascending order
+// (see SortOption). Documents not having the field are ignored, while null is a value. Numbers are compared by value,
+// regardless of their type: for each distinct number, the value found first is returned.
+func (q *Query) Distinct(field string) ([]interface{}, error) {
+	if field == "" {
+		return nil, ErrInvalidArgument
+	}
+
+	values := make([]interface{}, 0)
+	keys := make(map[string]struct{})
+	err := q.forEachResult(func(doc *Document) error {
+		if !doc.Has(field) {
+			return nil
+		}
+
+		value := doc.Get(field)
+		key, err := valueKey(value)
+		if err != nil {
+			return err
+		}
+
+		if _, seen := keys[key]; !seen {
+			keys[key] = struct{}{}
+			values = append(values, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return compareOrdered(values[i], true, values[j], true) < 0
+	})
+	return values, nil
 }
 
-// Update updates all the document selected by q using the provided updateMap.
-// Each update is specified by a mapping fieldName -> newValue.
+// CountDistinct returns the number of distinct values of the given field among the documents selected by q.
+// Documents not having the field are ignored, while null is counted as a value. Numbers are compared by value,
+// regardless of their type. Unlike Distinct, values are neither collected nor sorted: only their keys are kept.
+func (q *Query) CountDistinct(field string) (int, error) {
+	if field == "" {
+		return 0, ErrInvalidArgument
+	}
+
+	keys := make(map[string]struct{})
+	err := q.forEachResult(func(doc *Document) error {
+		if !doc.Has(field) {
+			return nil
+		}
+
+		key, err := valueKey(doc.Get(field))
+		if err != nil {
+			return err
+		}
+		keys[key] = struct{}{}
+		return nil
+	})
+	return len(keys), err
+}
+
+// First returns the first n documents selected by q. If q selects less than n documents, all of them are returned.
+func (q *Query) First(n int) ([]*Document, error) {
+	if n < 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	docs := make([]*Document, 0)
+	if n == 0 {
+		return docs, nil
+	}
+
+	q.forEach(func(doc *Document) bool {
+		docs = append(docs, q.project(doc))
+		return len(docs) < n
+	})
+	return docs, nil
+}
+
+// Last returns the last n documents selected by q. If q selects less than n documents, all of them are returned.
+func (q *Query) Last(n int) ([]*Document, error) {
+	if n < 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	// only keep track of the last n documents, using a circular buffer, which never needs to be larger than the collection
+	if size := q.collection.Count(); n > size {
+		n = size
+	}
+	tail := make([]*Document, n)
+	seen := 0
+	if n > 0 {
+		q.forEach(func(doc *Document) bool {
+			tail[seen%n] = doc
+			seen++
+			return true
+		})
+	}
+
+	size := seen
+	if size > n {
+		size = n
+	}
+
+	docs := make([]*Document, 0, size)
+	for i := seen - size; i < seen; i++ {
+		docs = append(docs, q.project(tail[i%n]))
+	}
+	return docs, nil
+}
+
+// Sample returns up to n documents chosen uniformly at random among the ones selected by q.
+// Documents are sampled in a single pass, using reservoir sampling, without materializing the whole result set.
+func (q *Query) Sample(n int) ([]*Document, error) {
+	return q.sample(n, rand.New(rand.NewSource(time.Now().UnixNano())))
+}
+
+// SampleWithSeed is like Sample, but it uses the supplied seed to make the result reproducible.
+// To guarantee that the same documents are returned for the same seed, documents are visited in id order when q is not sorted.
+func (q *Query) SampleWithSeed(n int, seed int64) ([]*Document, error) {
+	if len(q.sortOpts) == 0 {
+		q = q.Sort()
+	}
+	return q.sample(n, rand.New(rand.NewSource(seed)))
+}
+
+func (q *Query) sample(n int, r *rand.Rand) ([]*Document, error) {
+	if n < 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	capacity := n
+	if size := q.collection.Count(); capacity > size {
+		capacity = size
+	}
+
+	reservoir := make([]*Document, 0, capacity)
+	if n == 0 {
+		return reservoir, nil
+	}
+
+	seen := 0
+	q.forEach(func(doc *Document) bool {
+		seen++
+		if len(reservoir) < n {
+			reservoir = append(reservoir, doc)
+		} else if i := r.Intn(seen); i < n {
+			reservoir[i] = doc
+		}
+		return true
+	})
+
+	for i, doc := range reservoir {
+		reservoir[i] = q.project(doc)
+	}
+	return reservoir, nil
+}
+
+// Update updates all the document selected by q using the provided updateMap, and persists the collection.
+// Each update is specified by a mapping fieldName -> newValue, where nested fields can be accessed using dot.
+// The id field cannot be updated: attempting to do so fails with ErrInvalidArgument.
 func (q *Query) Update(updateMap map[string]interface{}) error {
-	for _, doc := range q.collection.docs {
-		if q.criteria.p(doc) {
-			updateDoc := doc.Copy()
-			for updateField, updateValue := range updateMap {
-				updateDoc.Set(updateField, updateValue)
+	defer q.committer().lock()()
+
+	q, err := q.latest()
+	if err != nil {
+		return err
+	}
+
+	updates, err := q.collection.db.normalizeUpdates(updateMap)
+	if err != nil {
+		return err
+	}
+
+	newCollection := q.collection.clone()
+	events := make([]ChangeEvent, 0)
+	q.forEach(func(doc *Document) bool {
+		updateDoc := applyUpdates(doc, updates)
+		newCollection.put(updateDoc)
+		events = append(events, newChangeEvent(OpUpdate, q.collection.name, updateDoc))
+		return true
+	})
+
+	if err := q.contextErr(); err != nil {
+		return err
+	}
+	return q.committer().commit(newCollection, events...)
+}
+
+// Upsert atomically inserts doc into the underlying collection, if q selects no document, or merges the fields of doc
+// into each selected document otherwise: top-level fields of doc replace the corresponding ones, while the other fields
+// of the selected documents are preserved. The id of doc, if any, is only used when doc is inserted.
+func (q *Query) Upsert(doc *Document) error {
+	defer q.committer().lock()()
+
+	q, err := q.latest()
+	if err != nil {
+		return err
+	}
+
+	db := q.collection.db
+	fields, err := db.codecs.normalize(doc.fields, db.preserveInts)
+	if err != nil {
+		return err
+	}
+
+	newCollection := q.collection.clone()
+	events := make([]ChangeEvent, 0)
+	q.forEach(func(selected *Document) bool {
+		updateDoc := selected.Copy()
+		for key, value := range fields.(map[string]interface{}) {
+			if key != db.idField {
+				updateDoc.fields[key] = value
 			}
-			q.collection.docs[updateDoc.Get(objectIdField).(string)] = updateDoc
 		}
+		newCollection.put(updateDoc)
+		events = append(events, newChangeEvent(OpUpdate, q.collection.name, updateDoc))
+		return true
+	})
+
+	if len(events) == 0 {
+		return db.insert(q.committer(), q.collection.name, []*Document{doc})
 	}
-	return q.collection.db.save(q.collection)
+	return q.committer().commit(newCollection, events...)
 }
 
 // DeleteById removes the document with the given id from the underlying collection, provided that such a document exists and satisfies the underlying query.
 func (q *Query) DeleteById(id string) error {
-	doc, ok := q.collection.docs[id]
+	defer q.committer().lock()()
+
+	q, err := q.latest()
+	if err != nil {
+		return err
+	}
+
+	doc, ok := q.collection.get(id)
 	if ok && q.satisfy(doc) {
-		delete(q.collection.docs, doc.Get(objectIdField).(string))
-		return q.collection.db.save(q.collection)
+		newCollection := q.collection.clone()
+		newCollection.remove(doc.ObjectId())
+		return q.committer().commit(newCollection, newChangeEvent(OpDelete, q.collection.name, doc))
 	}
 	return nil
 }
 
-// Delete removes all the documents selected by q from the underlying collection.
-func (q *Query) Delete() error {
-	for _, doc := range q.collection.docs {
-		if q.satisfy(doc) {
-			delete(q.collection.docs, doc.Get(objectIdField).(string))
-		}
-	}
-	return q.collection.db.save(q.collection)
+// Delete removes all the documents selected by q from the underlying collection.
+func (q *Query) Delete() error {
+	defer q.committer().lock()()
+
+	q, err := q.latest()
+	if err != nil {
+		return err
+	}
+
+	newCollection := q.collection.clone()
+	events := make([]ChangeEvent, 0)
+	q.forEach(func(doc *Document) bool {
+		newCollection.remove(doc.ObjectId())
+		events = append(events, newChangeEvent(OpDelete, q.collection.name, doc))
+		return true
+	})
+
+	if err := q.contextErr(); err != nil {
+		return err
+	}
+	return q.committer().commit(newCollection, events...)
+}
+
+// ForEachBatch calls fn on the documents selected by q, in batches of at most batchSize documents, and writes back the
+// documents returned by each call before moving to the next batch. Each returned document replaces the document with the
+// same id, or is inserted if no such document exists. Since each batch is committed separately, an error returned by fn
+// stops the iteration without undoing the writes of the previous batches.
+//
+// The selected documents are determined when the iteration starts. Each batch contains copies of the documents, which
+// fn is free to modify, and doesn't take projections (Select and Map) into account.
+func (q *Query) ForEachBatch(batchSize int, fn func(batch []*Document) ([]*Document, error)) error {
+	if batchSize <= 0 {
+		return ErrInvalidArgument
+	}
+
+	unlock := q.committer().lock()
+	q, err := q.latest()
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	docs := make([]*Document, 0)
+	q.forEach(func(doc *Document) bool {
+		docs = append(docs, doc)
+		return true
+	})
+
+	for start := 0; start < len(docs); start += batchSize {
+		end := start + batchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+
+		batch := make([]*Document, 0, end-start)
+		for i := start; i < end; i++ {
+			batch = append(batch, docs[i].Clone())
+			docs[i] = nil
+		}
+
+		updatedDocs, err := fn(batch)
+		if err != nil {
+			return err
+		}
+
+		if len(updatedDocs) == 0 {
+			continue
+		}
+
+		if err := q.writeBatch(updatedDocs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatch replaces (or inserts) the supplied documents in the latest version of the collection of q.
+func (q *Query) writeBatch(docs []*Document) error {
+	defer q.committer().lock()()
+
+	c, ok := q.committer().getCollection(q.collection.name)
+	if !ok {
+		return collectionNotExistError(q.collection.name)
+	}
+
+	db := q.collection.db
+	newCollection := c.clone()
+	events := make([]ChangeEvent, 0, len(docs))
+	for _, doc := range docs {
+		id, _ := doc.Get(db.idField).(string)
+		if id == "" {
+			return ErrInvalidArgument
+		}
+
+		fields, err := db.codecs.normalize(doc.fields, db.preserveInts)
+		if err != nil {
+			return err
+		}
+
+		updateDoc := db.newDocument()
+		updateDoc.fields = fields.(map[string]interface{})
+
+		op := OpUpdate
+		if _, exists := c.docs[id]; !exists {
+			op = OpInsert
+		}
+		newCollection.put(updateDoc)
+		events = append(events, newChangeEvent(op, c.name, updateDoc))
+	}
+	return q.committer().commit(newCollection, events...)
+}
+
+// Func returns a new Criteria which selects the documents satisfying the supplied predicate function.
+// The returned criteria can be combined with any other criteria.
+func Func(fn func(doc *Document) bool) *Criteria {
+	return &Criteria{p: fn}
+}
+
+type field struct {
+	name string
+}
+
+// Field represents a document field. It is used to create a new criteria.
+func Field(name string) *field {
+	return &field{name: name}
+}
+
+func (r *field) Exists() *Criteria {
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			return doc.Has(r.name)
+		},
+	}).withSpec(r.name, "$exists", true)
+}
+
+// NotExists matches documents where the field is absent. Documents containing the field with a null value are not matched.
+func (r *field) NotExists() *Criteria {
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			return !doc.Has(r.name)
+		},
+	}).withSpec(r.name, "$exists", false)
+}
+
+// IsNull matches documents containing the field with an explicit null value.
+// Documents where the field is absent are not matched: use Exists().Not() to select them.
+func (r *field) IsNull() *Criteria {
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			return doc.Has(r.name) && doc.Get(r.name) == nil
+		},
+	}).withSpec(r.name, "$isNull", true)
+}
+
+// IsNotNull matches documents containing the field with a non-null value.
+// Together with IsNull, it partitions the documents selected by Exists(), so that:
+//
+//	field absent         -> Exists: false, IsNull: false, IsNotNull: false
+//	field set to null    -> Exists: true,  IsNull: true,  IsNotNull: false
+//	field set to a value -> Exists: true,  IsNull: false, IsNotNull: true
+func (r *field) IsNotNull() *Criteria {
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			return doc.Has(r.name) && doc.Get(r.name) != nil
+		},
+	}).withSpec(r.name, "$isNull", false)
 }
 
-type field struct {
-	name string
+// IsNil is an alias for IsNull.
+func (r *field) IsNil() *Criteria {
+	return r.IsNull()
 }
 
-// Field represents a document field. It is used to create a new criteria.
-func Field(name string) *field {
-	return &field{name: name}
+// Kind identifies the type of a stored value (see IsType).
+type Kind string
+
+const (
+	KindNull   Kind = "null"
+	KindBool   Kind = "bool"
+	KindNumber Kind = "number"
+	KindString Kind = "string"
+	KindArray  Kind = "array"
+	KindObject Kind = "object"
+
+	// KindTime and KindBytes identify the values preserved by WithTimeCodec and WithBytesCodec.
+	KindTime  Kind = "time"
+	KindBytes Kind = "bytes"
+)
+
+// kindOf returns the kind of a stored value, or the empty kind if the value has none of the known kinds.
+func kindOf(v interface{}) Kind {
+	switch v.(type) {
+	case nil:
+		return KindNull
+	case bool:
+		return KindBool
+	case int64, float64:
+		return KindNumber
+	case string:
+		return KindString
+	case []interface{}:
+		return KindArray
+	case map[string]interface{}:
+		return KindObject
+	case time.Time:
+		return KindTime
+	case []byte:
+		return KindBytes
+	}
+	return ""
 }
 
-func (r *field) Exists() *Criteria {
-	return &Criteria{
+// IsType matches documents containing the field with a value of the given kind. Integers and floating point numbers
+// have the same kind, KindNumber, and a field set to null has kind KindNull: so, together with NotExists, IsType
+// distinguishes between a field being absent, explicitly null or of a given type.
+func (r *field) IsType(kind Kind) *Criteria {
+	return (&Criteria{
 		p: func(doc *Document) bool {
-			return doc.Has(r.name)
+			return doc.Has(r.name) && kindOf(doc.Get(r.name)) == kind
 		},
-	}
+	}).withSpec(r.name, "$type", string(kind))
 }
 
 func (r *field) Eq(value interface{}) *Criteria {
-	return &Criteria{
+	return (&Criteria{
 		p: func(doc *Document) bool {
-			normValue, err := normalize(value)
+			if res, isTime := compareStoredTime(doc.Get(r.name), value); isTime {
+				return res == 0
+			}
+
+			normValue, err := doc.normalize(value)
 			if err != nil {
 				return false
 			}
-			return reflect.DeepEqual(doc.Get(r.name), normValue)
+			return equalValues(doc.Get(r.name), normValue)
 		},
-	}
+		conds: newFieldConds(r.name, opEq, value),
+	}).withSpec(r.name, "$eq", value)
 }
 
 func boolToInt(v bool) int {
@@ -183,13 +1124,39 @@ func boolToInt(v bool) int {
 	return 0
 }
 
+// compareField compares the value of the field of doc with value, which is normalized first.
+func compareField(doc *Document, name string, value interface{}) (int, bool) {
+	if res, isTime := compareStoredTime(doc.Get(name), value); isTime {
+		return res, true
+	}
+
+	normValue, err := doc.normalize(value)
+	if err != nil {
+		return 0, false
+	}
+	return compareValues(doc.Get(name), normValue)
+}
+
+// compareStoredTime compares chronologically stored and value, provided that value is a time.Time and stored is a
+// string in RFC3339 format, which is the JSON encoding of times used when WithTimeCodec is not enabled.
+// Comparing such strings directly would give wrong results for times with different offsets or precisions.
+func compareStoredTime(stored interface{}, value interface{}) (int, bool) {
+	t, isTime := value.(time.Time)
+	s, isStr := stored.(string)
+	if !isTime || !isStr {
+		return 0, false
+	}
+
+	storedTime, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, false
+	}
+	return compareValues(storedTime, t)
+}
+
 func compareValues(v1 interface{}, v2 interface{}) (int, bool) {
-	v1Float, isFloat := v1.(float64)
-	if isFloat {
-		v2Float, isFloat := v2.(float64)
-		if isFloat {
-			return int(v1Float - v2Float), true
-		}
+	if isNumber(v1) && isNumber(v2) {
+		return compareNumbers(v1, v2)
 	}
 
 	v1Str, isStr := v1.(string)
@@ -208,71 +1175,82 @@ func compareValues(v1 interface{}, v2 interface{}) (int, bool) {
 		}
 	}
 
+	// values preserved by codecs
+	v1Time, isTime := v1.(time.Time)
+	if isTime {
+		v2Time, isTime := v2.(time.Time)
+		if isTime {
+			switch {
+			case v1Time.Before(v2Time):
+				return -1, true
+			case v1Time.After(v2Time):
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	v1Bytes, isBytes := v1.([]byte)
+	if isBytes {
+		v2Bytes, isBytes := v2.([]byte)
+		if isBytes {
+			return bytes.Compare(v1Bytes, v2Bytes), true
+		}
+	}
+
 	return 0, false
 }
 
 func (r *field) Gt(value interface{}) *Criteria {
-	return &Criteria{
+	return (&Criteria{
 		p: func(doc *Document) bool {
-			normValue, err := normalize(value)
-			if err != nil {
-				return false
-			}
-			v, ok := compareValues(doc.Get(r.name), normValue)
+			v, ok := compareField(doc, r.name, value)
 			if !ok {
 				return false
 			}
 			return v > 0
 		},
-	}
+		conds: newFieldConds(r.name, opGt, value),
+	}).withSpec(r.name, "$gt", value)
 }
 
 func (r *field) GtEq(value interface{}) *Criteria {
-	return &Criteria{
+	return (&Criteria{
 		p: func(doc *Document) bool {
-			normValue, err := normalize(value)
-			if err != nil {
-				return false
-			}
-			v, ok := compareValues(doc.Get(r.name), normValue)
+			v, ok := compareField(doc, r.name, value)
 			if !ok {
 				return false
 			}
 			return v >= 0
 		},
-	}
+		conds: newFieldConds(r.name, opGtEq, value),
+	}).withSpec(r.name, "$gte", value)
 }
 
 func (r *field) Lt(value interface{}) *Criteria {
-	return &Criteria{
+	return (&Criteria{
 		p: func(doc *Document) bool {
-			normValue, err := normalize(value)
-			if err != nil {
-				return false
-			}
-			v, ok := compareValues(doc.Get(r.name), normValue)
+			v, ok := compareField(doc, r.name, value)
 			if !ok {
 				return false
 			}
 			return v < 0
 		},
-	}
+		conds: newFieldConds(r.name, opLt, value),
+	}).withSpec(r.name, "$lt", value)
 }
 
 func (r *field) LtEq(value interface{}) *Criteria {
-	return &Criteria{
+	return (&Criteria{
 		p: func(doc *Document) bool {
-			normValue, err := normalize(value)
-			if err != nil {
-				return false
-			}
-			v, ok := compareValues(doc.Get(r.name), normValue)
+			v, ok := compareField(doc, r.name, value)
 			if !ok {
 				return false
 			}
 			return v <= 0
 		},
-	}
+		conds: newFieldConds(r.name, opLtEq, value),
+	}).withSpec(r.name, "$lte", value)
 }
 
 func (r *field) Neq(value interface{}) *Criteria {
@@ -281,22 +1259,264 @@ func (r *field) Neq(value interface{}) *Criteria {
 }
 
 func (r *field) In(values ...interface{}) *Criteria {
-	return &Criteria{
+	return (&Criteria{
 		p: func(doc *Document) bool {
 			docValue := doc.Get(r.name)
 			for _, value := range values {
-				normValue, err := normalize(value)
+				normValue, err := doc.normalize(value)
 				if err == nil {
-					if reflect.DeepEqual(normValue, docValue) {
+					if equalValues(normValue, docValue) {
 						return true
 					}
 				}
 			}
 			return false
 		},
+	}).withSpec(r.name, "$in", values)
+}
+
+// ElemMatch matches documents whose field is an array containing at least one object satisfying the supplied criteria.
+// The fields referenced by the criteria are evaluated relative to each element. Elements which are not objects are ignored.
+func (r *field) ElemMatch(c *Criteria) *Criteria {
+	criteria := &Criteria{
+		p: func(doc *Document) bool {
+			elems, isSlice := doc.Get(r.name).([]interface{})
+			if !isSlice {
+				return false
+			}
+
+			for _, elem := range elems {
+				fields, isMap := elem.(map[string]interface{})
+				if isMap && c.p(&Document{idField: doc.idField, codecs: doc.codecs, fields: fields}) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+
+	if c.spec != nil {
+		criteria.withSpec(r.name, "$elemMatch", c.spec)
+	}
+	return criteria
+}
+
+// Matches selects the documents whose field satisfies the supplied predicate function, which receives the stored value
+// of the field (for example, numbers are passed as float64, unless WithPreserveIntegers is used). Documents where the field
+// is absent are not matched, and fn is not called for them. Like Func, the returned criteria can't be serialized.
+func (r *field) Matches(fn func(value interface{}) bool) *Criteria {
+	return &Criteria{
+		p: func(doc *Document) bool {
+			return doc.Has(r.name) && fn(doc.Get(r.name))
+		},
+	}
+}
+
+// arrayContains reports whether elems contains an element equal to value, which is normalized as a criteria value.
+func arrayContains(doc *Document, elems []interface{}, value interface{}) bool {
+	normValue, err := doc.normalize(value)
+	if err != nil {
+		return false
+	}
+
+	for _, elem := range elems {
+		if equalValues(elem, normValue) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *field) containsCriteria(values []interface{}, all bool) *Criteria {
+	op := "$containsAny"
+	if all {
+		op = "$containsAll"
+	}
+
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			elems, isSlice := doc.Get(r.name).([]interface{})
+			if !isSlice {
+				return false
+			}
+
+			for _, value := range values {
+				if arrayContains(doc, elems, value) != all {
+					return !all
+				}
+			}
+			return all
+		},
+	}).withSpec(r.name, op, values)
+}
+
+// Contains matches documents whose field is an array containing an element equal to value. Non-array fields are never matched.
+func (r *field) Contains(value interface{}) *Criteria {
+	return r.containsCriteria([]interface{}{value}, true)
+}
+
+// ContainsAll matches documents whose field is an array containing all the supplied values, in any order.
+// Non-array fields are never matched, while any array is matched if no value is supplied.
+func (r *field) ContainsAll(values ...interface{}) *Criteria {
+	return r.containsCriteria(values, true)
+}
+
+// ContainsAny matches documents whose field is an array containing at least one of the supplied values.
+// Non-array fields are never matched.
+func (r *field) ContainsAny(values ...interface{}) *Criteria {
+	return r.containsCriteria(values, false)
+}
+
+// StringOption customizes the way string criteria compare values.
+type StringOption int
+
+// Supported string options
+const (
+	// IgnoreCase makes string comparisons case-insensitive.
+	IgnoreCase StringOption = iota + 1
+)
+
+func hasStringOption(opts []StringOption, opt StringOption) bool {
+	for _, o := range opts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *field) stringCriteria(op string, s string, match func(value, s string) bool, opts []StringOption) *Criteria {
+	spec := s
+	ignoreCase := hasStringOption(opts, IgnoreCase)
+	if ignoreCase {
+		s = strings.ToLower(s)
+	}
+
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			value, isString := doc.Get(r.name).(string)
+			if !isString {
+				return false
+			}
+
+			if ignoreCase {
+				value = strings.ToLower(value)
+			}
+			return match(value, s)
+		},
+	}).withSpec(r.name, op, spec).withStringOptions(r.name, opts)
+}
+
+// StartsWith matches documents whose field is a string beginning with prefix. Non-string values are never matched.
+func (r *field) StartsWith(prefix string, opts ...StringOption) *Criteria {
+	return r.stringCriteria("$startsWith", prefix, strings.HasPrefix, opts)
+}
+
+// EndsWith matches documents whose field is a string ending with suffix. Non-string values are never matched.
+func (r *field) EndsWith(suffix string, opts ...StringOption) *Criteria {
+	return r.stringCriteria("$endsWith", suffix, strings.HasSuffix, opts)
+}
+
+// EqIgnoreCase matches documents whose field is a string equal to s, ignoring case. Non-string values are never matched.
+// Unlike Eq, the returned criteria can't be answered using an index.
+func (r *field) EqIgnoreCase(s string) *Criteria {
+	return r.stringCriteria("$eq", s, func(value, s string) bool { return value == s }, []StringOption{IgnoreCase})
+}
+
+// InIgnoreCase matches documents whose field is a string equal to any of the supplied values, ignoring case.
+// Non-string values are never matched.
+func (r *field) InIgnoreCase(values ...string) *Criteria {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[strings.ToLower(value)] = true
+	}
+
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			value, isString := doc.Get(r.name).(string)
+			return isString && set[strings.ToLower(value)]
+		},
+	}).withSpec(r.name, "$in", values).withStringOptions(r.name, []StringOption{IgnoreCase})
+}
+
+// Like matches documents whose field is a string matching the SQL-like pattern, where "%" stands for any sequence of
+// characters and "_" for any single character (precede them with a backslash to match them literally). The pattern
+// must match the whole string, and is compiled once, when the criteria is created. Non-string values are never matched.
+func (r *field) Like(pattern string, opts ...StringOption) *Criteria {
+	var expr strings.Builder
+	expr.WriteString("^")
+	if hasStringOption(opts, IgnoreCase) {
+		expr.WriteString("(?i)")
+	}
+
+	escaped := false
+	for _, ch := range pattern {
+		switch {
+		case escaped:
+			expr.WriteString(regexp.QuoteMeta(string(ch)))
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case ch == '%':
+			expr.WriteString("(?s:.*)")
+		case ch == '_':
+			expr.WriteString("(?s:.)")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	expr.WriteString("$")
+	return r.regexCriteria(regexp.MustCompile(expr.String())).withSpec(r.name, "$like", pattern).withStringOptions(r.name, opts)
+}
+
+// Regex matches documents whose field is a string containing a match of the regular expression pattern, using the
+// syntax of the regexp package (anchors must be explicit). The pattern is compiled once, when the criteria is created:
+// Regex panics if it is not a valid regular expression. Non-string values are never matched.
+func (r *field) Regex(pattern string) *Criteria {
+	return r.regexCriteria(regexp.MustCompile(pattern)).withSpec(r.name, "$regex", pattern)
+}
+
+func (r *field) regexCriteria(re *regexp.Regexp) *Criteria {
+	return &Criteria{
+		p: func(doc *Document) bool {
+			value, isString := doc.Get(r.name).(string)
+			return isString && re.MatchString(value)
+		},
+	}
+}
+
+func sliceLen(v interface{}) (int, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return 0, false
+	}
+	return rv.Len(), true
+}
+
+func (r *field) sizeCriteria(cmp func(size int) bool) *Criteria {
+	return &Criteria{
+		p: func(doc *Document) bool {
+			size, isSlice := sliceLen(doc.Get(r.name))
+			return isSlice && cmp(size)
+		},
 	}
 }
 
+// SizeEq matches documents whose field is an array containing exactly n elements. Non-array fields are never matched.
+func (r *field) SizeEq(n int) *Criteria {
+	return r.sizeCriteria(func(size int) bool { return size == n }).withSpec(r.name, "$size", n)
+}
+
+// SizeGt matches documents whose field is an array containing more than n elements. Non-array fields are never matched.
+func (r *field) SizeGt(n int) *Criteria {
+	return r.sizeCriteria(func(size int) bool { return size > n }).withSpec(r.name, "$sizeGt", n)
+}
+
+// SizeLt matches documents whose field is an array containing less than n elements. Non-array fields are never matched.
+func (r *field) SizeLt(n int) *Criteria {
+	return r.sizeCriteria(func(size int) bool { return size < n }).withSpec(r.name, "$sizeLt", n)
+}
+
 func negatePredicate(p predicate) predicate {
 	return func(doc *Document) bool {
 		return !p(doc)
@@ -317,100 +1537,338 @@ func orPredicates(p1 predicate, p2 predicate) predicate {
 
 // And returns a new Criteria obtained by combining the predicates of the provided criteria with the AND logical operator.
 func (q *Criteria) And(other *Criteria) *Criteria {
+	conds := make([]fieldCond, 0, len(q.conds)+len(other.conds))
+	searches := make([]textSearch, 0, len(q.searches)+len(other.searches))
+	geoSearches := make([]geoSearch, 0, len(q.geoSearches)+len(other.geoSearches))
 	return &Criteria{
-		p: andPredicates(q.p, other.p),
+		p:           andPredicates(q.p, other.p),
+		conds:       append(append(conds, q.conds...), other.conds...),
+		searches:    append(append(searches, q.searches...), other.searches...),
+		geoSearches: append(append(geoSearches, q.geoSearches...), other.geoSearches...),
+		spec:        combineSpecs("$and", q.spec, other.spec),
 	}
 }
 
 // Or returns a new Criteria obtained by combining the predicates of the provided criteria with the OR logical operator.
+// Field comparisons required by both criteria, such as Eq("a", 1) in (a = 1 AND b = 2) OR (a = 1 AND c = 3),
+// remain available to the index planner.
 func (q *Criteria) Or(other *Criteria) *Criteria {
+	conds := make([]fieldCond, 0)
+	for _, cond := range q.conds {
+		for _, otherCond := range other.conds {
+			if cond == otherCond {
+				conds = append(conds, cond)
+				break
+			}
+		}
+	}
+
 	return &Criteria{
-		p: orPredicates(q.p, other.p),
+		p:     orPredicates(q.p, other.p),
+		conds: conds,
+		spec:  combineSpecs("$or", q.spec, other.spec),
 	}
 }
 
 // Not returns a new Criteria which negate the predicate of the original criterion.
+// Negations can be freely combined with And and Or, so that De Morgan's laws hold: for instance, (a OR b).Not() selects
+// the same documents as a.Not().And(b.Not()). Negated criteria are never answered using indexes, since a document
+// where a field is missing satisfies both Lt(v).Not() and Gt(v).Not().
 func (q *Criteria) Not() *Criteria {
+	var spec map[string]interface{}
+	if q.spec != nil {
+		spec = map[string]interface{}{"$not": q.spec}
+	}
+
 	return &Criteria{
-		p: negatePredicate(q.p),
+		p:    negatePredicate(q.p),
+		spec: spec,
 	}
 }
 
 // Document represents a document as a map.
 type Document struct {
-	fields map[string]interface{}
+	idField string
+	codecs  *codecs
+	fields  map[string]interface{}
+
+	// shared is true if fields belong to a stored document (see share), so that they must be copied before any change
+	shared bool
 }
 
 // ObjectId returns the id of the document, provided that the document belongs to some collection. Otherwise, it returns the empty string.
 func (doc *Document) ObjectId() string {
-	id := doc.Get(objectIdField)
-	if id == nil {
-		return ""
-	}
-	return id.(string)
+	id, _ := doc.Get(doc.idField).(string)
+	return id
 }
 
 // NewDocument creates a new empty document.
 func NewDocument() *Document {
 	return &Document{
-		fields: make(map[string]interface{}),
+		idField: objectIdField,
+		fields:  make(map[string]interface{}),
+	}
+}
+
+// NewDocumentOf creates a new document whose fields are obtained from the JSON representation of v, which is usually
+// a struct or a map (json struct tags are taken into account). It returns nil if v is not represented as a JSON object.
+func NewDocumentOf(v interface{}) *Document {
+	normValue, err := normalize(v, true)
+	if err != nil {
+		return nil
+	}
+
+	fields, isMap := normValue.(map[string]interface{})
+	if !isMap {
+		return nil
 	}
+
+	doc := NewDocument()
+	doc.fields = fields
+	return doc
 }
 
 // Copy returns a shallow copy of the underlying document.
 func (doc *Document) Copy() *Document {
 	return &Document{
-		fields: copyMap(doc.fields),
+		idField: doc.idField,
+		codecs:  doc.codecs,
+		fields:  copyMap(doc.fields),
+	}
+}
+
+// share returns a document with the same content as doc, which is copied the first time the returned document is
+// modified. Documents returned by queries are shared, so that changing them never affects the stored documents.
+func (doc *Document) share() *Document {
+	return &Document{idField: doc.idField, codecs: doc.codecs, fields: doc.fields, shared: true}
+}
+
+// Clone returns a deep copy of the document, where nested objects and arrays are copied as well.
+// The clone can be freely modified (and inserted again) without affecting the original document.
+func (doc *Document) Clone() *Document {
+	return &Document{
+		idField: doc.idField,
+		codecs:  doc.codecs,
+		fields:  deepCopy(doc.fields).(map[string]interface{}),
 	}
 }
 
-func lookupField(name string, fieldMap map[string]interface{}, force bool) (map[string]interface{}, interface{}, string) {
-	fields := strings.Split(name, ".")
+// splitFieldPath splits a field name into its components, which are separated by dots.
+// A dot (or a backslash) preceded by a backslash is considered part of the component.
+func splitFieldPath(name string) []string {
+	if !strings.ContainsRune(name, '\\') {
+		return strings.Split(name, ".")
+	}
+
+	path := make([]string, 0)
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name) && (name[i+1] == '.' || name[i+1] == '\\'):
+			i++
+			sb.WriteByte(name[i])
+		case name[i] == '.':
+			path = append(path, sb.String())
+			sb.Reset()
+		default:
+			sb.WriteByte(name[i])
+		}
+	}
+	return append(path, sb.String())
+}
+
+// arrayIndex returns the array index denoted by a path component, if any.
+func arrayIndex(component string) (int, bool) {
+	i, err := strconv.Atoi(component)
+	return i, err == nil && i >= 0
+}
+
+func lookupField(value interface{}, path []string) (interface{}, bool) {
+	for _, component := range path {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			v, ok := container[component]
+			if !ok {
+				return nil, false
+			}
+			value = v
+		case []interface{}:
+			i, ok := arrayIndex(component)
+			if !ok || i >= len(container) {
+				return nil, false
+			}
+			value = container[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// setField sets the field denoted by path inside container, returning the updated container.
+// Missing objects are created along the path, as well as any value which is not a container. A top-level object is
+// modified in place, while nested objects and arrays are copied before being modified (see setNestedField).
+func setField(container interface{}, path []string, value interface{}) interface{} {
+	if c, ok := container.(map[string]interface{}); ok {
+		if len(path) == 1 {
+			c[path[0]] = value
+		} else {
+			c[path[0]] = setNestedField(c[path[0]], path[1:], value)
+		}
+		return c
+	}
+	return setNestedField(container, path, value)
+}
 
-	var exists bool
-	var f interface{}
-	currMap := fieldMap
-	for i, field := range fields {
-		f, exists = currMap[field]
+// setNestedField behaves like setField, but it copies each object and array along the path (extending arrays with
+// nulls, if needed), since they may be shared with other versions of the document.
+func setNestedField(container interface{}, path []string, value interface{}) interface{} {
+	component := path[0]
+
+	switch c := container.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(c)+1)
+		for k, v := range c {
+			m[k] = v
+		}
 
-		m, isMap := f.(map[string]interface{})
+		if len(path) == 1 {
+			m[component] = value
+		} else {
+			m[component] = setNestedField(c[component], path[1:], value)
+		}
+		return m
+	case []interface{}:
+		if i, ok := arrayIndex(component); ok {
+			size := len(c)
+			if i >= size {
+				size = i + 1
+			}
 
-		if force {
-			if (!exists || !isMap) && i < len(fields)-1 {
-				m = make(map[string]interface{})
-				currMap[field] = m
-				f = m
+			arr := make([]interface{}, size)
+			copy(arr, c)
+			if len(path) == 1 {
+				arr[i] = value
+			} else {
+				arr[i] = setNestedField(arr[i], path[1:], value)
 			}
-		} else if !exists {
-			return nil, nil, ""
+			return arr
+		}
+	}
+	return setNestedField(make(map[string]interface{}), path, value)
+}
+
+// withoutField returns a copy of container lacking the field denoted by path, and true, or container itself and false
+// if there is no such field. Only the containers along the path are copied. Array elements can be traversed, but not removed.
+func withoutField(container interface{}, path []string) (interface{}, bool) {
+	component := path[0]
+
+	switch c := container.(type) {
+	case map[string]interface{}:
+		value, ok := c[component]
+		if !ok {
+			return c, false
+		}
+
+		m := make(map[string]interface{}, len(c))
+		for k, v := range c {
+			m[k] = v
+		}
+
+		if len(path) == 1 {
+			delete(m, component)
+			return m, true
+		}
+
+		child, removed := withoutField(value, path[1:])
+		if !removed {
+			return c, false
+		}
+		m[component] = child
+		return m, true
+	case []interface{}:
+		i, ok := arrayIndex(component)
+		if !ok || i >= len(c) || len(path) == 1 {
+			return c, false
 		}
 
-		if i < len(fields)-1 {
-			currMap = m
+		child, removed := withoutField(c[i], path[1:])
+		if !removed {
+			return c, false
 		}
+
+		arr := make([]interface{}, len(c))
+		copy(arr, c)
+		arr[i] = child
+		return arr, true
 	}
-	return currMap, f, fields[len(fields)-1]
+	return container, false
 }
 
 // Has tells returns true if the document contains a field with the supplied name.
 func (doc *Document) Has(name string) bool {
-	fieldMap, _, _ := lookupField(name, doc.fields, false)
-	return fieldMap != nil
+	_, ok := lookupField(doc.fields, splitFieldPath(name))
+	return ok
 }
 
-// Get retrieves the value of a field. Nested fields can be accessed using dot.
+// Get retrieves the value of a field. Nested fields can be accessed using dot, both inside objects and arrays
+// (for example, "tags.0" is the first element of the "tags" array). Dots which are part of a key must be escaped
+// with a backslash: for example, the Go string "a\\.b" refers to the key "a.b".
 func (doc *Document) Get(name string) interface{} {
-	_, v, _ := lookupField(name, doc.fields, false)
+	v, _ := lookupField(doc.fields, splitFieldPath(name))
 	return v
 }
 
-// Set maps a field to a value. Nested fields can be accessed using dot.
+// GetInt returns the value of a field as an int64, and true, provided that the field contains an integer number.
+// Integers are stored as int64 when WithPreserveIntegers is enabled, and as float64 otherwise: in this case, the result
+// is exact only for integers up to 2^53. If the field doesn't contain an integer, GetInt returns 0 and false.
+func (doc *Document) GetInt(name string) (int64, bool) {
+	switch v := doc.Get(name).(type) {
+	case int64:
+		return v, true
+	case float64:
+		if isIntegral(v) {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+// GetFloat returns the value of a numeric field as a float64, and true, or 0 and false if the field is not a number.
+func (doc *Document) GetFloat(name string) (float64, bool) {
+	return toFloat64(doc.Get(name))
+}
+
+// GetTime returns the time stored in a field, and true, or the zero time and false if the field doesn't contain a time.
+// Times are recognized both when preserved by WithTimeCodec and when stored as strings in RFC3339 format, which is
+// how time.Time values are encoded otherwise.
+func (doc *Document) GetTime(name string) (time.Time, bool) {
+	switch v := doc.Get(name).(type) {
+	case time.Time:
+		return v, true
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// Set maps a field to a value. Nested fields can be accessed using dot, as for Get.
 func (doc *Document) Set(name string, value interface{}) {
-	m, _, fieldName := lookupField(name, doc.fields, true)
-	m[fieldName] = value
+	// setField copies nested objects and arrays, so only the top-level object must be copied
+	if doc.shared {
+		fields := make(map[string]interface{}, len(doc.fields)+1)
+		for k, v := range doc.fields {
+			fields[k] = v
+		}
+		doc.fields = fields
+		doc.shared = false
+	}
+	setField(doc.fields, splitFieldPath(name), value)
 }
 
-// Unmarshal stores the document in the value pointed by v.
+// Unmarshal stores the document in the value pointed by v, which is usually a pointer to a struct, following the rules of json.Unmarshal.
+// Numbers can be decoded into any integer or floating point field.
 func (doc *Document) Unmarshal(v interface{}) error {
 	bytes, err := json.Marshal(doc.fields)
 	if err != nil {
@@ -419,12 +1877,53 @@ func (doc *Document) Unmarshal(v interface{}) error {
 	return json.Unmarshal(bytes, v)
 }
 
-func normalize(value interface{}) (interface{}, error) {
-	var normalized interface{}
-	bytes, err := json.Marshal(value)
+// MarshalJSON encodes the fields of the document (including its id) as a JSON object.
+func (doc *Document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(doc.fields)
+}
+
+// UnmarshalJSON replaces the content of the document with the fields of the supplied JSON object.
+// As for inserted documents, numbers are decoded as float64.
+func (doc *Document) UnmarshalJSON(data []byte) error {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	if doc.idField == "" {
+		doc.idField = objectIdField
+	}
+	doc.fields = fields
+	doc.shared = false
+	return nil
+}
+
+// normalize converts a value supplied to a criteria to the representation used by the document fields.
+func (doc *Document) normalize(value interface{}) (interface{}, error) {
+	return doc.codecs.normalize(value, true)
+}
+
+// normalize converts value to its JSON representation, made of maps, slices, strings, booleans and numbers.
+// Numbers are represented as float64, unless preserveInts is true, in which case integers are represented as int64.
+func normalize(value interface{}, preserveInts bool) (interface{}, error) {
+	data, err := json.Marshal(value)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(bytes, &normalized)
-	return normalized, err
+	return decodeJSON(data, preserveInts)
+}
+
+func decodeJSON(data []byte, preserveInts bool) (interface{}, error) {
+	var decoded interface{}
+	if !preserveInts {
+		err := json.Unmarshal(data, &decoded)
+		return decoded, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return convertNumbers(decoded), nil
 }
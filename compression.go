@@ -0,0 +1,81 @@
+package clover
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+)
+
+// gzipMagic is the header of gzip streams, which can't be confused with the beginning of a JSON snapshot.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// WithCompression makes the database compress the snapshots of all its collections with gzip before storing them.
+// Compressed and uncompressed snapshots can be freely mixed, since each snapshot is decompressed on load only if needed:
+// existing collections are compressed the next time they are written, and a database can be opened again without this
+// option. Use WithCollectionCompression to compress only some collections.
+//
+// Snapshots are compressed with gzip, rather than with faster codecs such as snappy or zstd, since gzip is provided by
+// the standard library: compression adds no dependencies, and snapshots can be inspected with common tools (such as
+// zcat). Since snapshots are rewritten as a whole, the fastest compression level is used.
+func WithCompression() Option {
+	return func(opts *options) {
+		opts.compression = true
+	}
+}
+
+// WithCollectionCompression makes the collection be stored compressed (see WithCompression), even if the database doesn't
+// compress all its collections. Unlike validators, the setting is stored along with the collection.
+func WithCollectionCompression() CollectionOption {
+	return func(opts *collectionOptions) {
+		opts.compressed = true
+	}
+}
+
+// encodeSnapshot returns the snapshot of c which is stored, compressed if required by the settings of c or of the database.
+func (db *DB) encodeSnapshot(c *collection) ([]byte, error) {
+	data, err := db.encodeCollection(c)
+	if err != nil || (!db.compression && !c.compressed) {
+		return data, err
+	}
+
+	buf := &bytes.Buffer{}
+	w, _ := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// snapshotContent returns a reader of the JSON content of the stored snapshot read from r, decompressing it if needed.
+func snapshotContent(r *bufio.Reader) (io.Reader, error) {
+	header, err := r.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !bytes.Equal(header, gzipMagic) {
+		return r, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// decodeSnapshot returns the JSON content of a stored snapshot, decompressing it if needed. If a compressed snapshot is
+// damaged, the content decompressed up to the damaged point is returned along with the error.
+func decodeSnapshot(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,91 @@
+package clover
+
+import "context"
+
+// withContext returns a copy of q whose scans are interrupted as soon as ctx is done. The returned query never uses
+// the query cache, which must not store the partial results of an interrupted scan.
+func (q *Query) withContext(ctx context.Context) *Query {
+	newQuery := q.copy()
+	newQuery.ctx = ctx
+	newQuery.cached = false
+	return newQuery
+}
+
+// cancellable wraps fn so that a scan stops as soon as the context of q is done.
+func (q *Query) cancellable(fn func(doc *Document) bool) func(doc *Document) bool {
+	done := q.ctx.Done()
+	return func(doc *Document) bool {
+		select {
+		case <-done:
+			return false
+		default:
+			return fn(doc)
+		}
+	}
+}
+
+// contextErr returns the error of the context of q, if any, which is not nil if a scan could have been interrupted.
+func (q *Query) contextErr() error {
+	if q.ctx == nil {
+		return nil
+	}
+	return q.ctx.Err()
+}
+
+// FindAllContext behaves like FindAll, but the scan stops as soon as ctx is done: in this case, the partial results are
+// discarded and the error of ctx is returned. The query cache (see Cached) is not used.
+func (q *Query) FindAllContext(ctx context.Context) ([]*Document, error) {
+	q = q.withContext(ctx)
+	docs := q.findAll()
+	if err := q.contextErr(); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// CountContext behaves like Count, but the scan stops as soon as ctx is done, returning the error of ctx.
+// The query cache (see Cached) is not used.
+func (q *Query) CountContext(ctx context.Context) (int, error) {
+	q = q.withContext(ctx)
+	n := q.count()
+	if err := q.contextErr(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ForEachContext behaves like ForEach, but the iteration stops as soon as ctx is done, returning the error of ctx.
+// Documents already passed to fn are not affected. The query cache (see Cached) is not used.
+func (q *Query) ForEachContext(ctx context.Context, fn func(doc *Document) bool) error {
+	q = q.withContext(ctx)
+	q.ForEach(fn)
+	return q.contextErr()
+}
+
+// UpdateContext behaves like Update, but it stops selecting documents as soon as ctx is done: in this case, nothing
+// is updated and the error of ctx is returned. Once the documents have been selected, the update is committed
+// regardless of ctx.
+func (q *Query) UpdateContext(ctx context.Context, updateMap map[string]interface{}) error {
+	return q.withContext(ctx).Update(updateMap)
+}
+
+// DeleteContext behaves like Delete, but it stops selecting documents as soon as ctx is done: in this case, nothing
+// is deleted and the error of ctx is returned. Once the documents have been selected, the deletion is committed
+// regardless of ctx.
+func (q *Query) DeleteContext(ctx context.Context) error {
+	return q.withContext(ctx).Delete()
+}
+
+// InsertContext behaves like Insert, but it fails with the error of ctx, without inserting anything, if ctx is done
+// by the time the write lock is acquired.
+func (db *DB) InsertContext(ctx context.Context, collectionName string, docs ...*Document) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.insert(db, collectionName, docs)
+}
@@ -0,0 +1,50 @@
+package clover
+
+import "sync"
+
+// Cursor iterates over the documents selected by a query, one at a time.
+//
+// A cursor is bound to the version of the collection the query refers to: writes committed while iterating
+// are not visible through it, so an iteration never observes partial writes. Different cursors are independent
+// of each other, and Next is safe to call from multiple goroutines.
+type Cursor struct {
+	mu   sync.Mutex
+	q    *Query
+	docs []*Document
+	pos  int
+}
+
+// Cursor returns a new Cursor over the documents selected by q, taking into account criteria, sort, skip and limit.
+// Close should be called as soon as the cursor is no longer needed, so that the documents it refers to can be reclaimed.
+func (q *Query) Cursor() *Cursor {
+	docs := make([]*Document, 0)
+	q.forEach(func(doc *Document) bool {
+		docs = append(docs, doc)
+		return true
+	})
+	return &Cursor{q: q, docs: docs}
+}
+
+// Next returns the next document of the cursor, and true, or nil and false if the cursor is exhausted or closed.
+func (cur *Cursor) Next() (*Document, bool) {
+	cur.mu.Lock()
+	defer cur.mu.Unlock()
+
+	if cur.pos >= len(cur.docs) {
+		return nil, false
+	}
+
+	doc := cur.docs[cur.pos]
+	cur.docs[cur.pos] = nil
+	cur.pos++
+	return cur.q.project(doc), true
+}
+
+// Close releases the snapshot held by the cursor. Subsequent calls to Next return false.
+func (cur *Cursor) Close() {
+	cur.mu.Lock()
+	defer cur.mu.Unlock()
+
+	cur.docs = nil
+	cur.pos = 0
+}
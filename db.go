@@ -1,173 +1,1238 @@
 package clover
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"sync"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
 
-// Collection creation errors
-var (
-	ErrCollectionExist    = errors.New("collection already exist")
-	ErrCollectionNotExist = errors.New("no such collection")
-)
-
 // DB represents the entry point of each clover database.
+//
+// A DB is safe for concurrent use by multiple goroutines. Collections are never modified in place: each write produces
+// a new version of the collection, which replaces the previous one when the write is committed. Queries are bound to the
+// version of the collection which was current when they were created (see Query), so readers never block writers and
+// never observe partial writes. Writes are serialized by a database-wide lock, held while the new version is computed
+// and persisted, so that concurrent writes are never lost and collection files are never written concurrently.
 type DB struct {
-	dir         string
-	collections map[string]*collection
+	// mu guards collections, views, corrupted, unloaded and afterHooks. It is held for writing during each write
+	// operation, and released through unlock, which runs the after hooks of the committed writes (see Hooks).
+	mu         sync.RWMutex
+	afterHooks []func()
+
+	storage      Storage
+	idField      string
+	idGenerator  func() string
+	preserveInts bool
+	collections  map[string]*collection
+	views        map[string]*view
+	corrupted    map[string]error
+	unloaded     map[string]bool // stored collections which have not been loaded yet (see WithLazyLoading)
+	lazy         bool
+	paged        bool // collections are read from storage on each scan (see WithPagedReads)
+	watchers     watchers
+	syncMode     SyncMode
+	syncer       syncer
+	janitor      janitor
+	wal          *wal
+	queryCache   *queryCache
+	codecs       *codecs
+	logger       *log.Logger
+	readOnly     bool
+	compression  bool
+
+	// dirLock, if not nil, keeps the database directory locked until the database is closed (see Open)
+	dirLock *os.File
+
+	// followers are the replicas of the database (see ServeReplication), while replica, if not nil, connects
+	// the database to its primary (see OpenReplica)
+	followers followers
+	replica   *replica
+
+	maxDocumentSize   int
+	maxCollectionSize int
 }
 
 type jsonFile struct {
 	LastUpdate time.Time                `json:"last_update"`
+	Metadata   *collectionMetadata      `json:"metadata,omitempty"`
 	Rows       []map[string]interface{} `json:"rows"`
 }
 
-func rowsToDocuments(rows []map[string]interface{}) []*Document {
+func (db *DB) rowsToDocuments(rows []map[string]interface{}) []*Document {
 	docs := make([]*Document, 0, len(rows))
 	for _, r := range rows {
-		doc := NewDocument()
+		doc := db.newDocument()
 		doc.fields = r
 		docs = append(docs, doc)
 	}
 	return docs
 }
 
+// decodeJSONFile decodes the JSON content of a snapshot, as read from r. Rows are decoded one at a time, so that
+// decoding never requires the whole content of the snapshot to be held in memory besides the decoded documents.
+func (db *DB) decodeJSONFile(r io.Reader, jFile *jsonFile) error {
+	return db.scanJSONFile(r, jFile, func(row map[string]interface{}) error {
+		jFile.Rows = append(jFile.Rows, row)
+		return nil
+	})
+}
+
+// scanJSONFile behaves like decodeJSONFile, but it passes each row to fn, as soon as it is decoded, instead of
+// collecting the rows in jFile. Decoding stops at the first error returned by fn.
+func (db *DB) scanJSONFile(r io.Reader, jFile *jsonFile, fn func(row map[string]interface{}) error) error {
+	decoder := json.NewDecoder(r)
+	if db.preserveInts {
+		decoder.UseNumber()
+	}
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "last_update":
+			err = decoder.Decode(&jFile.LastUpdate)
+		case "metadata":
+			err = decoder.Decode(&jFile.Metadata)
+		case "rows":
+			err = db.scanJSONRows(decoder, fn)
+		default:
+			var value json.RawMessage
+			err = decoder.Decode(&value)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := expectDelim(decoder, '}'); err != nil {
+		return err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
+
+func (db *DB) scanJSONRows(decoder *json.Decoder, fn func(row map[string]interface{}) error) error {
+	tok, err := decoder.Token()
+	if err != nil || tok == nil {
+		return err
+	}
+
+	if tok != json.Delim('[') {
+		return fmt.Errorf("unexpected %v while decoding rows", tok)
+	}
+
+	for decoder.More() {
+		row := make(map[string]interface{})
+		if err := decoder.Decode(&row); err != nil {
+			return err
+		}
+
+		if db.preserveInts {
+			convertNumbers(row)
+		}
+
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, ']')
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	tok, err := decoder.Token()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	if err == nil && tok != delim {
+		err = fmt.Errorf("unexpected %v, expecting %v", tok, delim)
+	}
+	return err
+}
+
+func (db *DB) decodeRows(rows []map[string]interface{}) error {
+	for _, row := range rows {
+		if _, err := db.codecs.decode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (db *DB) readCollection(name string) (*collection, error) {
-	data, err := ioutil.ReadFile(db.dir + "/" + name + ".json")
+	if opener, ok := db.storage.(snapshotOpener); ok {
+		if db.paged {
+			return db.openPagedCollection(name, opener)
+		}
+
+		r, err := opener.open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return db.readCollectionFrom(name, bufio.NewReaderSize(r, snapshotBufferSize))
+	}
+
+	data, err := db.storage.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	return db.decodeCollection(name, data)
+}
+
+// decodeCollection builds the collection with the given name from its stored snapshot.
+func (db *DB) decodeCollection(name string, data []byte) (*collection, error) {
+	return db.readCollectionFrom(name, bufio.NewReader(bytes.NewReader(data)))
+}
+
+// readCollectionFrom builds the collection with the given name from its stored snapshot, as read from r.
+func (db *DB) readCollectionFrom(name string, r *bufio.Reader) (*collection, error) {
+	content, err := snapshotContent(r)
 	if err != nil {
 		return nil, err
 	}
 
 	jFile := &jsonFile{}
-	if err := json.Unmarshal(data, jFile); err != nil {
+	if err := db.decodeJSONFile(content, jFile); err != nil {
 		return nil, err
 	}
 
-	return newCollection(db, name, rowsToDocuments(jFile.Rows)), nil
+	if err := db.decodeRows(jFile.Rows); err != nil {
+		return nil, err
+	}
+
+	c := newCollection(db, name, db.rowsToDocuments(jFile.Rows))
+	c.applyMetadata(jFile.Metadata)
+	return c, nil
 }
 
-// Query simply returns the collection with the supplied name. Use it to initialize a new query.
+// Query simply returns the collection (or view) with the supplied name. Use it to initialize a new query.
+//
+// Since collections are copy-on-write, the returned query (and any query derived from it, through Where, Sort and so
+// on) is bound to the version of the collection existing when Query is called: all its results reflect exactly the
+// documents which existed at that time, even while other writes proceed, and running it never blocks writers. Call
+// Query again to observe the most recent writes. Cached queries (see Query.Cached) are the exception, since they
+// always refer to the most recent version. Use DB.Snapshot to freeze multiple collections at the same time.
 func (db *DB) Query(name string) *Query {
+	db.ensureLoaded(name)
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.query(name)
+}
+
+func (db *DB) query(name string) *Query {
+	if v, ok := db.views[name]; ok {
+		return db.queryView(v)
+	}
+
 	c, ok := db.collections[name]
 	if !ok {
 		return nil
 	}
-	return &Query{collection: c, criteria: nil}
+	return newQuery(c)
 }
 
-func (db *DB) save(c *collection) error {
+// FindOptions describes a query in a declarative way, as an alternative to chaining Query methods.
+// The zero value selects all the documents of a collection.
+type FindOptions struct {
+	Criteria   *Criteria
+	Sort       []SortOption
+	Skip       int
+	Limit      int // zero means no limit
+	Projection []string
+}
+
+// Find returns the documents of the given collection selected by opts.
+func (db *DB) Find(collectionName string, opts FindOptions) ([]*Document, error) {
+	q := db.Query(collectionName)
+	if q == nil {
+		return nil, collectionNotExistError(collectionName)
+	}
+
+	if opts.Criteria != nil {
+		q = q.Where(opts.Criteria)
+	}
+	if len(opts.Sort) > 0 {
+		q = q.Sort(opts.Sort...)
+	}
+	if opts.Limit > 0 {
+		q = q.Limit(opts.Limit)
+	}
+	if len(opts.Projection) > 0 {
+		q = q.Select(opts.Projection...)
+	}
+	return q.Skip(opts.Skip).FindAll(), nil
+}
+
+// encodeCollection returns the snapshot of c, made of its documents and its metadata.
+func (db *DB) encodeCollection(c *collection) ([]byte, error) {
+	if c.source != nil {
+		return c.source.content()
+	}
+
 	docs := make([]map[string]interface{}, 0, c.Count())
 
 	for _, d := range c.docs {
-		docs = append(docs, d.fields)
+		fields, err := db.codecs.encode(d.fields)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, fields.(map[string]interface{}))
 	}
+	return json.Marshal(&jsonFile{LastUpdate: time.Now(), Metadata: c.metadata(), Rows: docs})
+}
 
-	jsonBytes, err := json.Marshal(&jsonFile{LastUpdate: time.Now(), Rows: docs})
+func (db *DB) save(c *collection) error {
+	jsonBytes, err := db.encodeSnapshot(c)
 	if err != nil {
 		return err
 	}
-	return saveToFile(db.dir, c.name+".json", jsonBytes)
+	sync := db.syncMode == SyncAlways
+	if err := db.storage.Save(c.name, jsonBytes, sync); err != nil {
+		return err
+	}
+
+	if !sync {
+		return db.markDirty(c.name)
+	}
+	return nil
+}
+
+// committer gives access to the collections and applies writes to them, either directly on the database or inside a transaction.
+type committer interface {
+	// lock prevents other writes from being applied until the returned function is called.
+	lock() (unlock func())
+	getCollection(name string) (*collection, bool)
+	commit(c *collection, events ...ChangeEvent) error
+}
+
+func (db *DB) lock() func() {
+	db.mu.Lock()
+	return db.unlock
+}
+
+// getCollection returns the current version of the collection with the given name. It must be called holding db.mu.
+func (db *DB) getCollection(name string) (*collection, bool) {
+	c, ok := db.collections[name]
+	return c, ok
+}
+
+// commit runs the hooks of c, checks its constraints, saves it and, if successful, replaces the previous version of the collection and notifies watchers about the supplied events.
+func (db *DB) commit(c *collection, events ...ChangeEvent) error {
+	if err := c.runBeforeHooks(events); err != nil {
+		return err
+	}
+	c.assignVersions(db.collections[c.name], events)
+
+	if err := c.checkConstraints(db.collections[c.name]); err != nil {
+		return err
+	}
+
+	if err := db.persist(c); err != nil {
+		return err
+	}
+	db.collections[c.name] = c
+	db.queryCache.invalidate(c.name)
+	db.notify(events...)
+	db.queueAfterHooks(events)
+	db.maybeCheckpoint()
+	return nil
 }
 
+// readCollections lists the stored collections, loading all of them unless lazy loading is enabled (see WithLazyLoading).
+// Collections which cannot be loaded are skipped and recorded as corrupted.
 func (db *DB) readCollections() error {
-	filenames, err := listDir(db.dir)
+	names, err := db.storage.List()
 	if err != nil {
 		return err
 	}
 
-	for _, filename := range filenames {
-		collectionName := getBasename(filename)
-		c, err := db.readCollection(collectionName)
-		if err != nil {
-			return err
+	for _, collectionName := range names {
+		db.unloaded[collectionName] = true
+	}
+
+	if !db.lazy {
+		for _, collectionName := range names {
+			db.loadCollection(collectionName)
 		}
-		db.collections[collectionName] = c
 	}
 	return nil
 }
 
-// CreateCollection creates a new empty collection with the given name.
-func (db *DB) CreateCollection(name string) error {
-	if _, ok := db.collections[name]; ok {
-		return ErrCollectionExist
+// CollectionOption configures a collection when it is created (see CreateCollection).
+type CollectionOption func(opts *collectionOptions)
+
+type collectionOptions struct {
+	validator   func(doc *Document) error
+	idGenerator func() string
+	hooks       Hooks
+	compressed  bool
+	versioned   bool
+}
+
+// WithValidator makes the collection check each inserted or modified document using fn: any write adding or changing
+// a document for which fn returns a non-nil error fails with ErrInvalidDocument, and nothing is written. The function
+// receives the document as it would be stored, and must not modify it. As for views, validators are not stored on disk,
+// so they must be registered again (see SetValidator) each time the database is opened.
+func WithValidator(fn func(doc *Document) error) CollectionOption {
+	return func(opts *collectionOptions) {
+		opts.validator = fn
+	}
+}
+
+// WithCollectionIDGenerator makes the collection generate the ids of inserted documents using fn, instead of the
+// generator of the database (see WithIDGenerator). Documents inserted with an explicit id keep it. As for validators,
+// generators are not stored on disk, so they must be registered again (see SetIDGenerator) each time the database is opened.
+func WithCollectionIDGenerator(fn func() string) CollectionOption {
+	return func(opts *collectionOptions) {
+		opts.idGenerator = fn
+	}
+}
+
+// SetIDGenerator replaces the id generator of an existing collection (see WithCollectionIDGenerator).
+// If fn is nil, the collection goes back to using the generator of the database.
+func (db *DB) SetIDGenerator(collectionName string, fn func() string) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	newCollection := c.clone()
+	newCollection.idGenerator = fn
+	db.collections[collectionName] = newCollection
+	return nil
+}
+
+// SetValidator replaces the validator of an existing collection (see WithValidator), or removes it if fn is nil.
+// Documents already stored in the collection are not validated.
+func (db *DB) SetValidator(collectionName string, fn func(doc *Document) error) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	newCollection := c.clone()
+	newCollection.validator = fn
+	db.collections[collectionName] = newCollection
+	return nil
+}
+
+// CreateCollection creates a new empty collection with the given name, configured by the supplied options.
+func (db *DB) CreateCollection(name string, opts ...CollectionOption) error {
+	db.mu.Lock()
+	defer db.unlock()
+
+	if db.hasCollection(name) || db.hasView(name) {
+		return collectionExistError(name)
+	}
+
+	if err, ok := db.corrupted[name]; ok {
+		return err
+	}
+
+	collOpts := collectionOptions{}
+	for _, opt := range opts {
+		opt(&collOpts)
 	}
 
 	c := newCollection(db, name, nil)
-	err := db.save(c)
+	c.validator = collOpts.validator
+	c.idGenerator = collOpts.idGenerator
+	c.hooks = collOpts.hooks
+	c.compressed = collOpts.compressed
+	c.versioned = collOpts.versioned
+	if err := db.persist(c); err != nil {
+		return err
+	}
 
 	db.collections[name] = c
-	return err
+	return nil
 }
 
 // DropCollection removes the collection with the given name, deleting any content on disk.
+// Corrupted collections (see CorruptedCollections) can be dropped as well.
 func (db *DB) DropCollection(name string) error {
-	if _, ok := db.collections[name]; !ok {
-		return ErrCollectionNotExist
+	db.ensureLoaded(name)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	return db.dropCollection(name)
+}
+
+func (db *DB) dropCollection(name string) error {
+	if db.readOnly {
+		return readOnlyDatabaseError()
+	}
+
+	if _, ok := db.corrupted[name]; ok {
+		delete(db.corrupted, name)
+		db.forgetSkipped(name)
+		return db.storage.Delete(name)
+	}
+
+	c, ok := db.collections[name]
+	if !ok {
+		return collectionNotExistError(name)
+	}
+
+	if db.wal != nil {
+		if err := db.logDrop(name); err != nil {
+			return err
+		}
 	}
 
 	delete(db.collections, name)
-	return os.Remove(db.dir + "/" + name + ".json")
+	db.queryCache.invalidate(name)
+	db.forgetDirty(name)
+	if db.wal == nil {
+		if err := db.storage.Delete(name); err != nil {
+			return err
+		}
+	}
+
+	events := make([]ChangeEvent, 0, len(c.docs))
+	for _, doc := range c.docs {
+		events = append(events, newChangeEvent(OpDelete, name, doc))
+	}
+	db.notify(events...)
+	return nil
+}
+
+// DropCollectionIfExists behaves like DropCollection, but it doesn't fail if the collection doesn't exist.
+// It returns true if the collection existed and has been removed.
+func (db *DB) DropCollectionIfExists(name string) (bool, error) {
+	db.ensureLoaded(name)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	if !db.hasCollection(name) {
+		return false, nil
+	}
+	return true, db.dropCollection(name)
+}
+
+// TruncateCollection removes all the documents of the collection with the given name, leaving the collection itself in place.
+func (db *DB) TruncateCollection(name string) error {
+	db.ensureLoaded(name)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[name]
+	if !ok {
+		return collectionNotExistError(name)
+	}
+
+	events := make([]ChangeEvent, 0, len(c.docs))
+	for _, doc := range c.docs {
+		events = append(events, newChangeEvent(OpDelete, name, doc))
+	}
+
+	newCollection := c.clone()
+	newCollection.truncate()
+	return db.commit(newCollection, events...)
+}
+
+// RenameCollection atomically renames a collection, keeping its documents, indexes and settings. Views defined
+// on the collection follow it. The new name must not be used by another collection or view. Watchers of the old
+// name are not notified, and receive no further events.
+func (db *DB) RenameCollection(oldName string, newName string) error {
+	db.ensureLoaded(oldName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	if db.readOnly {
+		return readOnlyDatabaseError()
+	}
+
+	if newName == "" {
+		return ErrInvalidArgument
+	}
+
+	c, ok := db.collections[oldName]
+	if !ok {
+		return collectionNotExistError(oldName)
+	}
+
+	if db.hasCollection(newName) || db.hasView(newName) {
+		return collectionExistError(newName)
+	}
+
+	if err, ok := db.corrupted[newName]; ok {
+		return err
+	}
+
+	newCollection := c.clone()
+	newCollection.name = newName
+
+	if db.wal != nil {
+		// a single record, so that the rename is never half applied when the log is replayed
+		entry, err := db.walEntry(newCollection)
+		if err != nil {
+			return err
+		}
+
+		if err := db.wal.append(&walRecord{Collections: []walEntry{entry}, Dropped: []string{oldName}}); err != nil {
+			return err
+		}
+		db.wal.dirty[newName] = true
+		db.wal.dirty[oldName] = true
+	} else {
+		// the snapshot of the new name is written first: a failure can leave both names on disk, but never lose documents
+		if err := db.save(newCollection); err != nil {
+			return err
+		}
+		db.forgetDirty(oldName)
+		if err := db.storage.Delete(oldName); err != nil {
+			return err
+		}
+	}
+
+	delete(db.collections, oldName)
+	db.collections[newName] = newCollection
+	db.queryCache.invalidate(oldName)
+	db.queryCache.invalidate(newName)
+
+	for _, v := range db.views {
+		if v.source == oldName {
+			v.source = newName
+		}
+	}
+	db.maybeCheckpoint()
+	return nil
 }
 
 // HasCollection returns true if and only if the database contains a collection with the given name.
 func (db *DB) HasCollection(name string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.hasCollection(name)
+}
+
+func (db *DB) hasCollection(name string) bool {
 	_, ok := db.collections[name]
-	return ok
+	return ok || db.unloaded[name]
 }
 
 func newObjectId() string {
 	return uuid.NewV4().String()
 }
 
-// Insert adds the supplied documents to a collection.
-func (db *DB) Insert(collectionName string, docs ...*Document) error {
-	c, ok := db.collections[collectionName]
+func (db *DB) newDocument() *Document {
+	doc := NewDocument()
+	doc.idField = db.idField
+	doc.codecs = db.codecs
+	return doc
+}
+
+// insertWithIds adds docs to the collection, assigning to each document the id at the same position in ids.
+// Nothing is inserted if any id is duplicated, either inside the batch or in the collection.
+func (db *DB) insertWithIds(w committer, collectionName string, docs []*Document, ids []string) error {
+	c, ok := w.getCollection(collectionName)
 	if !ok {
-		return ErrCollectionNotExist
+		return collectionNotExistError(collectionName)
 	}
 
 	insertDocs := make([]*Document, 0, len(docs))
-	for _, doc := range docs {
-		insertDoc := NewDocument()
+	insertIds := make(map[string]bool, len(docs))
+	for i, doc := range docs {
+		insertDoc := db.newDocument()
 
-		fields, err := normalize(doc.fields)
+		fields, err := db.codecs.normalize(doc.fields, db.preserveInts)
 		if err != nil {
 			return err
 		}
 		insertDoc.fields = fields.(map[string]interface{})
 
-		objectId := newObjectId()
-		insertDoc.Set(objectIdField, objectId)
-		doc.Set(objectIdField, objectId)
+		objectId := ids[i]
+		if _, exists := c.docs[objectId]; exists || insertIds[objectId] {
+			return duplicateKeyError(collectionName, objectId)
+		}
+		insertIds[objectId] = true
+		insertDoc.Set(db.idField, objectId)
 
 		insertDocs = append(insertDocs, insertDoc)
 	}
 
-	c.addDocuments(insertDocs...)
+	newCollection := c.clone()
+	newCollection.addDocuments(insertDocs...)
+
+	events := make([]ChangeEvent, 0, len(insertDocs))
+	for _, doc := range insertDocs {
+		events = append(events, newChangeEvent(OpInsert, collectionName, doc))
+	}
+
+	if err := w.commit(newCollection, events...); err != nil {
+		return err
+	}
+
+	// the supplied documents are only given their ids once they have been inserted
+	for i, doc := range docs {
+		doc.idField = db.idField
+		doc.Set(db.idField, ids[i])
+	}
+	return nil
+}
+
+// Insert adds the supplied documents to a collection.
+// Documents which already carry an id keep it, while the other ones are assigned a newly generated id.
+// If any id is already used, either by another document of the batch or by a document of the collection,
+// the whole batch is rejected with ErrDuplicateKey and nothing is inserted.
+// The batch is committed as a single write: the collection is saved (or logged, see WithWriteAheadLog) only once.
+func (db *DB) Insert(collectionName string, docs ...*Document) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	return db.insert(db, collectionName, docs)
+}
+
+// InsertBatch inserts the supplied documents into a collection in batches of at most batchSize documents, each one
+// committed separately as by Insert. This bounds the size of each write when loading large amounts of documents.
+// If a batch fails, the next ones are not inserted, while the previous ones are kept.
+func (db *DB) InsertBatch(collectionName string, batchSize int, docs ...*Document) error {
+	if batchSize <= 0 {
+		return ErrInvalidArgument
+	}
+
+	for start := 0; start < len(docs); start += batchSize {
+		end := start + batchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+
+		if err := db.Insert(collectionName, docs[start:end]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) insert(w committer, collectionName string, docs []*Document) error {
+	c, ok := w.getCollection(collectionName)
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	generateId := db.idGenerator
+	if c.idGenerator != nil {
+		generateId = c.idGenerator
+	}
+
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		id, err := db.explicitId(doc)
+		if err != nil {
+			return err
+		}
+
+		if id == "" {
+			id = generateId()
+		}
+		ids = append(ids, id)
+	}
+	return db.insertWithIds(w, collectionName, docs, ids)
+}
+
+// explicitId returns the id carried by doc, or the empty string if doc has no id.
+func (db *DB) explicitId(doc *Document) (string, error) {
+	value := doc.Get(db.idField)
+	if value == nil {
+		return "", nil
+	}
+
+	id, isString := value.(string)
+	if !isString {
+		return "", fmt.Errorf("%w: document id must be a string, got %T", ErrInvalidArgument, value)
+	}
+	return id, nil
+}
+
+// InsertWithId adds the supplied document to a collection, using id as its identifier.
+// It returns ErrDuplicateKey if the collection already contains a document with the same id, and ErrInvalidArgument
+// if id is empty. The id is only set on doc once it has been inserted.
+func (db *DB) InsertWithId(collectionName string, id string, doc *Document) error {
+	db.ensureLoaded(collectionName)
+
+	if id == "" {
+		return fmt.Errorf("%w: empty document id", ErrInvalidArgument)
+	}
+
+	db.mu.Lock()
+	defer db.unlock()
 
-	return db.save(c)
+	return db.insertWithIds(db, collectionName, []*Document{doc}, []string{id})
 }
 
 // InsertOne inserts a single document to an existing collection. It returns the id of the inserted document.
 func (db *DB) InsertOne(collectionName string, doc *Document) (string, error) {
 	err := db.Insert(collectionName, doc)
-	return doc.Get(objectIdField).(string), err
+	return doc.ObjectId(), err
+}
+
+// InsertStruct inserts the JSON representation of v (see NewDocumentOf) as a document of an existing collection,
+// returning the id of the inserted document. If v carries an id field, its value is used as the document id.
+func (db *DB) InsertStruct(collectionName string, v interface{}) (string, error) {
+	doc := NewDocumentOf(v)
+	if doc == nil {
+		return "", fmt.Errorf("%w: %T is not represented as a JSON object", ErrInvalidArgument, v)
+	}
+	return db.InsertOne(collectionName, doc)
+}
+
+// FindById returns the document of the given collection (or view) having the supplied id.
+// Unlike Query.FindById, it fails with ErrDocumentNotFound if no such document exists.
+func (db *DB) FindById(collectionName string, id string) (*Document, error) {
+	q := db.Query(collectionName)
+	if q == nil {
+		return nil, collectionNotExistError(collectionName)
+	}
+
+	doc := q.FindById(id)
+	if doc == nil {
+		return nil, documentNotFoundError(collectionName, id)
+	}
+	return doc, nil
+}
+
+func (db *DB) normalizeUpdates(updateMap map[string]interface{}) (map[string]interface{}, error) {
+	updates := make(map[string]interface{}, len(updateMap))
+	for updateField, updateValue := range updateMap {
+		// changing the id would detach the document from its entry in the collection
+		if updateField == "" || updateField == db.idField {
+			return nil, ErrInvalidArgument
+		}
+
+		normValue, err := db.codecs.normalize(updateValue, db.preserveInts)
+		if err != nil {
+			return nil, err
+		}
+		updates[updateField] = normValue
+	}
+	return updates, nil
+}
+
+// applyUpdates returns a copy of doc where each field of updates has been set to the corresponding value.
+func applyUpdates(doc *Document, updates map[string]interface{}) *Document {
+	updateDoc := doc.Copy()
+	for updateField, updateValue := range updates {
+		updateDoc.Set(updateField, updateValue)
+	}
+	return updateDoc
+}
+
+// UpdateByIds applies the same updates to all the documents of a collection whose id belongs to ids, saving the collection only once.
+// Ids not matching any document are skipped: the returned value is the number of documents which have actually been updated.
+func (db *DB) UpdateByIds(collectionName string, ids []string, updateMap map[string]interface{}) (int, error) {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return 0, collectionNotExistError(collectionName)
+	}
+
+	updates, err := db.normalizeUpdates(updateMap)
+	if err != nil {
+		return 0, err
+	}
+
+	newCollection := c.clone()
+	events := make([]ChangeEvent, 0, len(ids))
+	for _, id := range ids {
+		// a document already replaced in newCollection means that its id is duplicated in ids
+		doc, ok := c.get(id)
+		if !ok || newCollection.docs[id] != doc {
+			continue
+		}
+
+		updateDoc := applyUpdates(doc, updates)
+		newCollection.put(updateDoc)
+		events = append(events, newChangeEvent(OpUpdate, collectionName, updateDoc))
+	}
+
+	if len(events) == 0 {
+		return 0, nil
+	}
+	return len(events), db.commit(newCollection, events...)
 }
 
-// Open opens a new clover database on the supplied path. If such a folder doesn't exist, it is automatically created.
-func Open(dir string) (*DB, error) {
-	if err := makeDirIfNotExists(dir); err != nil {
+// UpdateById applies the supplied updates (see Query.Update) to the document of a collection having the given id.
+// The document is looked up directly by its id, without scanning the collection. It fails with ErrDocumentNotFound
+// if no such document exists. Use WithExpectedVersion to update the document only if it has not been modified since it was read.
+func (db *DB) UpdateById(collectionName string, id string, updateMap map[string]interface{}, opts ...WriteOption) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	doc, ok := c.get(id)
+	if !ok {
+		return documentNotFoundError(collectionName, id)
+	}
+
+	if err := c.checkVersion(id, doc, opts); err != nil {
+		return err
+	}
+
+	updates, err := db.normalizeUpdates(updateMap)
+	if err != nil {
+		return err
+	}
+
+	updateDoc := applyUpdates(doc, updates)
+	newCollection := c.clone()
+	newCollection.put(updateDoc)
+	return db.commit(newCollection, newChangeEvent(OpUpdate, collectionName, updateDoc))
+}
+
+// DeleteById removes the document of a collection having the given id, without scanning the collection.
+// It fails with ErrDocumentNotFound if no such document exists. As for UpdateById, WithExpectedVersion can be supplied.
+func (db *DB) DeleteById(collectionName string, id string, opts ...WriteOption) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	doc, ok := c.get(id)
+	if !ok {
+		return documentNotFoundError(collectionName, id)
+	}
+
+	if err := c.checkVersion(id, doc, opts); err != nil {
+		return err
+	}
+
+	newCollection := c.clone()
+	newCollection.remove(id)
+	return db.commit(newCollection, newChangeEvent(OpDelete, collectionName, doc))
+}
+
+type deleteKey struct{}
+
+// DeleteKey is a sentinel value which, when used inside a patch, removes the corresponding key from the document.
+var DeleteKey = deleteKey{}
+
+func (db *DB) mergePatch(target map[string]interface{}, patch map[string]interface{}) error {
+	for key, value := range patch {
+		if value == DeleteKey {
+			delete(target, key)
+			continue
+		}
+
+		if patchMap, isMap := value.(map[string]interface{}); isMap {
+			targetMap, isMap := target[key].(map[string]interface{})
+			if !isMap {
+				targetMap = make(map[string]interface{})
+			}
+			if err := db.mergePatch(targetMap, patchMap); err != nil {
+				return err
+			}
+			target[key] = targetMap
+			continue
+		}
+
+		normValue, err := db.codecs.normalize(value, db.preserveInts)
+		if err != nil {
+			return err
+		}
+		target[key] = normValue
+	}
+	return nil
+}
+
+// ReplaceById atomically replaces the whole content of the document with the given id, or inserts doc using such id
+// if the collection doesn't contain it. If doc carries an id, it must be equal to id. As for UpdateById,
+// WithExpectedVersion can be supplied.
+func (db *DB) ReplaceById(collectionName string, id string, doc *Document, opts ...WriteOption) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	docId, err := db.explicitId(doc)
+	if err != nil {
+		return err
+	}
+
+	if id == "" || (docId != "" && docId != id) {
+		return fmt.Errorf("%w: cannot replace document %q with document %q", ErrInvalidArgument, id, docId)
+	}
+
+	fields, err := db.codecs.normalize(doc.fields, db.preserveInts)
+	if err != nil {
+		return err
+	}
+
+	newDoc := db.newDocument()
+	newDoc.fields = fields.(map[string]interface{})
+	newDoc.Set(db.idField, id)
+
+	op := OpInsert
+	if oldDoc, exists := c.get(id); exists {
+		if err := c.checkVersion(id, oldDoc, opts); err != nil {
+			return err
+		}
+		op = OpUpdate
+	} else if err := c.checkVersion(id, nil, opts); err != nil {
+		return err
+	}
+
+	newCollection := c.clone()
+	newCollection.put(newDoc)
+	return db.commit(newCollection, newChangeEvent(op, collectionName, newDoc))
+}
+
+// PatchById recursively merges the supplied patch into the document with the given id, following JSON Merge Patch semantics:
+// nested maps are merged, any other value overwrites the existing one, and keys mapped to DeleteKey are removed.
+// The id of the document cannot be modified.
+func (db *DB) PatchById(collectionName string, id string, patch map[string]interface{}) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	doc, ok := c.get(id)
+	if !ok {
+		return documentNotFoundError(collectionName, id)
+	}
+
+	patchedDoc := doc.Copy()
+	if err := db.mergePatch(patchedDoc.fields, patch); err != nil {
+		return err
+	}
+	patchedDoc.Set(db.idField, id)
+
+	newCollection := c.clone()
+	newCollection.put(patchedDoc)
+	return db.commit(newCollection, newChangeEvent(OpUpdate, collectionName, patchedDoc))
+}
+
+// Open opens a new clover database on the supplied path. If such a folder doesn't exist, it is automatically created,
+// unless the database is opened in read-only mode (see OpenReadOnly).
+// The behaviour of the database can be customized by supplying one or more options. When a custom storage
+// is supplied (see WithStorage), dir is ignored.
+//
+// The directory is locked until the database is closed, so that it can't be opened by other processes, which would
+// otherwise overwrite each other's changes, or read them while in progress: in this case, Open fails with
+// ErrDatabaseLocked. Databases opened in read-only mode take a shared lock instead, so that any number of them can be
+// open at the same time, but not while the database is open for writing (see OpenReadOnly). Directories are locked
+// with flock(2): on platforms which don't provide it, such as Windows, directories are never locked, as if
+// WithNoDirectoryLock was supplied, so the caller must make sure that the database is never used by multiple processes
+// at the same time.
+//
+// The documents of a collection are held in memory once it has been loaded, and queries are always served from
+// memory, so the loaded collections must fit in the available RAM. By default, Open loads all the collections, while
+// with WithLazyLoading each collection is only loaded the first time it is accessed. Collection files are decoded
+// while being read, one document at a time, so loading a collection needs little memory besides the one taken by its
+// documents. Read-only databases can instead be opened with WithPagedReads, which keeps the documents on disk and reads
+// them again on each query, so that collections larger than the available RAM can be queried.
+func Open(dir string, opts ...Option) (*DB, error) {
+	dbOpts := defaultOptions()
+	for _, opt := range opts {
+		opt(&dbOpts)
+	}
+
+	if err := dbOpts.checkPagedReads(); err != nil {
 		return nil, err
 	}
 
+	var dirLock *os.File
+	storage := dbOpts.storage
+	if storage == nil {
+		if dbOpts.readOnly {
+			// the directory must not be created
+			if _, err := os.Stat(dir); err != nil {
+				return nil, err
+			}
+			storage = &fileStorage{dir: dir}
+		} else {
+			var err error
+			if storage, err = newFileStorage(dir, dbOpts.fileMode); err != nil {
+				return nil, err
+			}
+		}
+
+		if !dbOpts.noLock {
+			var err error
+			if dirLock, err = lockDir(dir, !dbOpts.readOnly); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	db := &DB{
-		dir:         dir,
-		collections: make(map[string]*collection),
+		storage:      storage,
+		idField:      dbOpts.idField,
+		idGenerator:  dbOpts.idGenerator,
+		preserveInts: dbOpts.preserveInts,
+		collections:  make(map[string]*collection),
+		views:        make(map[string]*view),
+		corrupted:    make(map[string]error),
+		unloaded:     make(map[string]bool),
+		lazy:         dbOpts.lazy,
+		paged:        dbOpts.paged,
+		syncMode:     dbOpts.syncMode,
+		queryCache:   newQueryCache(dbOpts.cacheSize),
+		codecs:       newCodecs(dbOpts.codecs, dbOpts.preserveInts),
+		logger:       dbOpts.logger,
+		readOnly:     dbOpts.readOnly,
+		compression:  dbOpts.compression,
+
+		maxDocumentSize:   dbOpts.maxDocumentSize,
+		maxCollectionSize: dbOpts.maxCollectionSize,
+
+		dirLock: dirLock,
+	}
+
+	if err := db.readCollections(); err != nil {
+		db.unlockDir()
+		return nil, err
 	}
-	return db, db.readCollections()
+
+	if db.readOnly {
+		if dbOpts.wal {
+			if err := db.loadWAL(dir); err != nil {
+				return nil, err
+			}
+		}
+
+		// nothing is ever written, so there is no need for background flushes
+		db.syncMode = SyncNever
+		db.startSyncer(dbOpts.syncInterval)
+		return db, nil
+	}
+
+	if dbOpts.wal {
+		if err := db.recoverWAL(dir, dbOpts.checkpointWrites, dbOpts.fileMode); err != nil {
+			db.unlockDir()
+			return nil, err
+		}
+	}
+
+	db.startSyncer(dbOpts.syncInterval)
+	db.startJanitor(dbOpts.expirationInterval)
+	return db, nil
+}
+
+// OpenReadOnly opens an existing database without modifying it in any way, so that it can be safely inspected, even by
+// multiple processes at the same time. The database reflects the content of the collections at the time it is opened.
+// Any attempt to write to it, such as creating a collection or inserting documents, fails with ErrReadOnly.
+// If the database uses a write-ahead log, WithWriteAheadLog must be supplied, so that the log is replayed (in memory).
+//
+// The directory is locked in shared mode until the database is closed (see Open): OpenReadOnly fails with
+// ErrDatabaseLocked while the database is open for writing, and, conversely, the database can't be opened for writing
+// while it is open in read-only mode, so that writers may need to retry. With WithNoDirectoryLock, the database can be
+// read while being written by another process, but it is then only guaranteed to be consistent if no write is in
+// progress: collections are read at different times, so that, for example, a transaction spanning several collections
+// may be observed only in part, and with a write-ahead log, a checkpoint occurring while the database is being opened
+// may cause the last writes to be missed.
+func OpenReadOnly(dir string, opts ...Option) (*DB, error) {
+	return Open(dir, append(opts, WithReadOnly())...)
+}
+
+// logf reports an error occurred in background, if the database has a logger (see WithLogger).
+func (db *DB) logf(format string, args ...interface{}) {
+	if db.logger != nil {
+		db.logger.Printf("clover: "+format, args...)
+	}
+}
+
+// OpenInMemory opens a new empty database which keeps all its collections in memory, without touching the file system.
+// It is equivalent to opening a database with a storage returned by NewMemoryStorage.
+func OpenInMemory(opts ...Option) (*DB, error) {
+	return Open("", append(opts, WithStorage(NewMemoryStorage()))...)
+}
+
+// Close releases the resources held by the database, flushing any pending write to stable storage.
+// The database must not be used after Close returns.
+func (db *DB) Close() error {
+	db.stopJanitor()
+	db.stopSyncer()
+	db.stopReplica()
+	db.followers.removeAll()
+
+	db.mu.Lock()
+	defer db.unlock()
+	defer db.unlockDir()
+
+	if err := db.sync(); err != nil {
+		return err
+	}
+
+	if db.wal != nil {
+		if db.checkpointBlocked() == nil {
+			if err := db.checkpoint(); err != nil {
+				return err
+			}
+		}
+
+		if err := db.wal.close(); err != nil {
+			return err
+		}
+	}
+
+	if closer, ok := db.storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
@@ -1,10 +1,22 @@
 package clover_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"log"
 	"math/rand"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	c "github.com/ostafen/clover"
 	"github.com/stretchr/testify/require"
@@ -21,6 +33,7 @@ func runCloverTest(t *testing.T, dir string, test func(t *testing.T, db *c.DB))
 	}
 	db, err := c.Open(dir)
 	require.NoError(t, err)
+	defer db.Close()
 
 	test(t, db)
 }
@@ -34,7 +47,7 @@ func TestCreateCollectionAndDrop(t *testing.T) {
 		require.True(t, db.HasCollection("myCollection"))
 
 		err = db.CreateCollection("myCollection")
-		require.Equal(t, err, c.ErrCollectionExist)
+		require.ErrorIs(t, err, c.ErrCollectionExist)
 
 		err = db.DropCollection("myCollection")
 		require.NoError(t, err)
@@ -42,10 +55,160 @@ func TestCreateCollectionAndDrop(t *testing.T) {
 		require.False(t, db.HasCollection("myCollection"))
 
 		err = db.DropCollection("myOtherCollection")
-		require.Equal(t, err, c.ErrCollectionNotExist)
+		require.ErrorIs(t, err, c.ErrCollectionNotExist)
 	})
 }
 
+func TestDropCollectionIfExists(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		dropped, err := db.DropCollectionIfExists("myCollection")
+		require.NoError(t, err)
+		require.True(t, dropped)
+		require.False(t, db.HasCollection("myCollection"))
+
+		dropped, err = db.DropCollectionIfExists("myCollection")
+		require.NoError(t, err)
+		require.False(t, dropped)
+	})
+}
+
+func TestListCollectionsAndStats(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.Empty(t, db.ListCollections())
+
+		require.NoError(t, db.CreateCollection("b"))
+		require.NoError(t, db.CreateCollection("a"))
+		require.NoError(t, db.CreateView("v", "a", nil))
+		require.Equal(t, []string{"a", "b"}, db.ListCollections())
+
+		stats, err := db.CollectionStats("b")
+		require.NoError(t, err)
+		require.Equal(t, 0, stats.Documents)
+		require.Empty(t, stats.Indexes)
+		emptySize := stats.Size
+
+		for i := 0; i < 10; i++ {
+			doc := c.NewDocument()
+			doc.Set("n", i)
+			doc.Set("text", "some words")
+			_, err := db.InsertOne("b", doc)
+			require.NoError(t, err)
+		}
+		require.NoError(t, db.CreateUniqueIndex("b", "n"))
+		require.NoError(t, db.CreateTextIndex("b", "text"))
+
+		stats, err = db.CollectionStats("b")
+		require.NoError(t, err)
+		require.Equal(t, "b", stats.Name)
+		require.Equal(t, 10, stats.Documents)
+		require.Greater(t, stats.Size, emptySize)
+		require.Equal(t, []c.IndexInfo{{Fields: []string{"n"}, Unique: true}, {Fields: []string{"text"}, Text: true}}, stats.Indexes)
+
+		require.NoError(t, db.DropCollection("b"))
+		require.Equal(t, []string{"a"}, db.ListCollections())
+
+		_, err = db.CollectionStats("b")
+		require.ErrorIs(t, err, c.ErrCollectionNotExist)
+	})
+
+	db, err := c.OpenInMemory()
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.CreateCollection("myCollection"))
+	require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+	stats, err := db.CollectionStats("myCollection")
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Documents)
+	require.Greater(t, stats.Size, int64(0))
+}
+
+func TestErrors(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		err := db.Insert("myCollection", c.NewDocument())
+		require.True(t, errors.Is(err, c.ErrCollectionNotExist))
+		require.Contains(t, err.Error(), "myCollection")
+
+		require.NoError(t, db.CreateCollection("myCollection"))
+		err = db.CreateCollection("myCollection")
+		require.True(t, errors.Is(err, c.ErrCollectionExist))
+		require.False(t, errors.Is(err, c.ErrCollectionNotExist))
+
+		require.NoError(t, db.InsertWithId("myCollection", "my-id", c.NewDocument()))
+		err = db.InsertWithId("myCollection", "my-id", c.NewDocument())
+		require.True(t, errors.Is(err, c.ErrDuplicateKey))
+		require.Contains(t, err.Error(), "my-id")
+
+		err = db.PatchById("myCollection", "missing-id", map[string]interface{}{})
+		require.True(t, errors.Is(err, c.ErrDocumentNotFound))
+		require.Contains(t, err.Error(), "missing-id")
+	})
+}
+
+func TestTruncateCollection(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.ErrorIs(t, db.TruncateCollection("myCollection"), c.ErrCollectionNotExist)
+
+		require.NoError(t, db.CreateCollection("myCollection"))
+		require.NoError(t, db.CreateIndex("myCollection", "n"))
+		require.NoError(t, db.Insert("myCollection", c.NewDocument(), c.NewDocument()))
+		require.Equal(t, db.Query("myCollection").Count(), 2)
+
+		require.NoError(t, db.TruncateCollection("myCollection"))
+		require.True(t, db.HasCollection("myCollection"))
+		require.Equal(t, db.Query("myCollection").Count(), 0)
+		require.Equal(t, []string{"n"}, db.Query("myCollection").Where(c.Field("n").Eq(1)).Explain().IndexFields)
+
+		require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+		require.Equal(t, db.Query("myCollection").Count(), 1)
+	})
+}
+
+func TestRenameCollection(t *testing.T) {
+	for _, opts := range [][]c.Option{nil, {c.WithWriteAheadLog()}} {
+		dir, err := ioutil.TempDir("", "clover-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		db, err := c.Open(dir, opts...)
+		require.NoError(t, err)
+
+		require.ErrorIs(t, db.RenameCollection("myCollection", "renamed"), c.ErrCollectionNotExist)
+
+		require.NoError(t, db.CreateCollection("myCollection"))
+		require.NoError(t, db.CreateCollection("other"))
+		require.NoError(t, db.CreateIndex("myCollection", "n"))
+		for i := 0; i < 3; i++ {
+			doc := c.NewDocument()
+			doc.Set("n", i)
+			require.NoError(t, db.Insert("myCollection", doc))
+		}
+		require.NoError(t, db.CreateView("myView", "myCollection", c.Field("n").Gt(0)))
+
+		require.ErrorIs(t, db.RenameCollection("myCollection", "other"), c.ErrCollectionExist)
+		require.ErrorIs(t, db.RenameCollection("myCollection", "myView"), c.ErrCollectionExist)
+		require.ErrorIs(t, db.RenameCollection("myCollection", ""), c.ErrInvalidArgument)
+
+		require.NoError(t, db.RenameCollection("myCollection", "renamed"))
+		require.False(t, db.HasCollection("myCollection"))
+		require.Nil(t, db.Query("myCollection"))
+		require.Equal(t, 3, db.Query("renamed").Count())
+		require.Equal(t, 2, db.Query("myView").Count())
+		require.Equal(t, []string{"n"}, db.Query("renamed").Where(c.Field("n").Eq(1)).Explain().IndexFields)
+		require.NoError(t, db.Insert("renamed", c.NewDocument()))
+		require.NoError(t, db.Close())
+
+		db, err = c.Open(dir, opts...)
+		require.NoError(t, err)
+		require.Equal(t, []string{"other", "renamed"}, db.ListCollections())
+		require.Equal(t, 4, db.Query("renamed").Count())
+		require.Equal(t, []string{"n"}, db.Query("renamed").Where(c.Field("n").Eq(1)).Explain().IndexFields)
+		require.NoError(t, db.Close())
+	}
+}
+
 func TestInsertOneAndDelete(t *testing.T) {
 	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
 		err := db.CreateCollection("myCollection")
@@ -71,6 +234,145 @@ func TestInsertOneAndDelete(t *testing.T) {
 	})
 }
 
+func TestOpenWithIDField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir, c.WithIDField("key"))
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("myCollection"))
+
+	doc := c.NewDocument()
+	doc.Set("_id", "my-own-id")
+
+	docId, err := db.InsertOne("myCollection", doc)
+	require.NoError(t, err)
+	require.Equal(t, docId, doc.Get("key"))
+
+	doc = db.Query("myCollection").FindById(docId)
+	require.NotNil(t, doc)
+	require.Equal(t, doc.ObjectId(), docId)
+	require.Equal(t, doc.Get("_id"), "my-own-id")
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir, c.WithIDField("key"))
+	require.NoError(t, err)
+	require.NotNil(t, db.Query("myCollection").FindById(docId))
+
+	require.NoError(t, db.Query("myCollection").DeleteById(docId))
+	require.Equal(t, db.Query("myCollection").Count(), 0)
+}
+
+func TestOpenWithIDGenerator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	nextId := 0
+	db, err := c.Open(dir, c.WithIDGenerator(func() string {
+		nextId++
+		return strconv.Itoa(nextId % 3)
+	}))
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("myCollection"))
+
+	docs := []*c.Document{c.NewDocument(), c.NewDocument()}
+	require.NoError(t, db.Insert("myCollection", docs...))
+	require.Equal(t, nextId, 2)
+	require.Equal(t, docs[0].ObjectId(), "1")
+	require.Equal(t, docs[1].ObjectId(), "2")
+
+	docs = []*c.Document{c.NewDocument(), c.NewDocument()}
+	require.ErrorIs(t, db.Insert("myCollection", docs...), c.ErrDuplicateKey)
+	require.Equal(t, db.Query("myCollection").Count(), 2)
+	require.Empty(t, docs[0].ObjectId())
+}
+
+func TestOpenWithPreserveIntegers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir, c.WithPreserveIntegers())
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("myCollection"))
+
+	bigInt := int64(1<<60 + 1)
+	for _, v := range []interface{}{bigInt, bigInt + 1, 1.5} {
+		doc := c.NewDocument()
+		doc.Set("value", v)
+		require.NoError(t, db.Insert("myCollection", doc))
+	}
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir, c.WithPreserveIntegers())
+	require.NoError(t, err)
+
+	doc := db.Query("myCollection").Where(c.Field("value").Eq(bigInt)).FindAll()
+	require.Len(t, doc, 1)
+	require.Equal(t, doc[0].Get("value"), bigInt)
+
+	n := db.Query("myCollection").Where(c.Field("value").Gt(bigInt)).Count()
+	require.Equal(t, n, 1)
+
+	n = db.Query("myCollection").Where(c.Field("value").Lt(2)).Count()
+	require.Equal(t, n, 1)
+
+	n = db.Query("myCollection").Where(c.Field("value").In(1.5, uint64(bigInt))).Count()
+	require.Equal(t, n, 2)
+
+	docs := db.Query("myCollection").Sort(c.SortOption{Field: "value", Direction: -1}).FindAll()
+	require.Equal(t, docs[0].Get("value"), bigInt+1)
+	require.Equal(t, docs[2].Get("value"), 1.5)
+}
+
+func TestOpenWithSyncMode(t *testing.T) {
+	for _, mode := range []c.SyncMode{c.SyncNever, c.SyncAlways, c.SyncBatch} {
+		dir, err := ioutil.TempDir("", "clover-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		db, err := c.Open(dir, c.WithSyncMode(mode), c.WithSyncInterval(time.Millisecond))
+		require.NoError(t, err)
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		for i := 0; i < 200; i++ {
+			require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+		}
+		require.NoError(t, db.Sync())
+
+		require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+		require.NoError(t, db.Close())
+
+		// temporary files are created inside the database directory, and never left behind
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		require.Equal(t, "myCollection.json", files[0].Name())
+
+		db, err = c.Open(dir)
+		require.NoError(t, err)
+		require.Equal(t, db.Query("myCollection").Count(), 201)
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	for _, mode := range []c.SyncMode{c.SyncNever, c.SyncAlways, c.SyncBatch} {
+		storage := &mapStorage{snapshots: make(map[string][]byte), synced: make(map[string]bool)}
+
+		db, err := c.Open("", c.WithStorage(storage), c.WithSyncMode(mode), c.WithSyncInterval(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, db.CreateCollection("myCollection"))
+		require.Equal(t, mode == c.SyncAlways, storage.synced["myCollection"])
+
+		require.NoError(t, db.Sync())
+		require.True(t, storage.synced["myCollection"])
+		require.NoError(t, db.Close())
+	}
+}
+
 func TestInsert(t *testing.T) {
 	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
 		err := db.CreateCollection("myCollection")
@@ -80,7 +382,96 @@ func TestInsert(t *testing.T) {
 		doc.Set("hello", "clover")
 
 		require.NoError(t, db.Insert("myCollection", doc))
-		require.Equal(t, db.Insert("myOtherCollection"), c.ErrCollectionNotExist)
+		require.ErrorIs(t, db.Insert("myOtherCollection"), c.ErrCollectionNotExist)
+	})
+}
+
+func TestInsertWithExplicitIds(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		doc := c.NewDocument()
+		doc.Set("_id", "my-id")
+		require.NoError(t, db.Insert("myCollection", doc, c.NewDocument()))
+		require.NotNil(t, db.Query("myCollection").FindById("my-id"))
+		require.Equal(t, db.Query("myCollection").Count(), 2)
+
+		doc1, doc2 := c.NewDocument(), c.NewDocument()
+		doc1.Set("_id", "other-id")
+		doc2.Set("_id", "other-id")
+		require.ErrorIs(t, db.Insert("myCollection", c.NewDocument(), doc1, doc2), c.ErrDuplicateKey)
+		require.Equal(t, db.Query("myCollection").Count(), 2)
+
+		doc1.Set("_id", "new-id")
+		doc2.Set("_id", "my-id")
+		require.ErrorIs(t, db.Insert("myCollection", doc1, doc2), c.ErrDuplicateKey)
+		require.Equal(t, db.Query("myCollection").Count(), 2)
+
+		doc1.Set("_id", 10)
+		require.ErrorIs(t, db.Insert("myCollection", doc1), c.ErrInvalidArgument)
+		require.Equal(t, db.Query("myCollection").Count(), 2)
+	})
+}
+
+func TestInsertWithId(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		doc := c.NewDocument()
+		doc.Set("hello", "clover")
+		require.NoError(t, db.InsertWithId("myCollection", "my-id", doc))
+		require.Equal(t, doc.ObjectId(), "my-id")
+
+		doc = db.Query("myCollection").FindById("my-id")
+		require.NotNil(t, doc)
+		require.Equal(t, doc.Get("hello"), "clover")
+
+		require.ErrorIs(t, db.InsertWithId("myCollection", "my-id", c.NewDocument()), c.ErrDuplicateKey)
+		require.Equal(t, db.Query("myCollection").Count(), 1)
+
+		require.ErrorIs(t, db.InsertWithId("myOtherCollection", "my-id", c.NewDocument()), c.ErrCollectionNotExist)
+		require.ErrorIs(t, db.InsertWithId("myCollection", "", c.NewDocument()), c.ErrInvalidArgument)
+
+		// documents which fail to be inserted are not given an id
+		require.NoError(t, db.CreateCollection("validated", c.WithValidator(func(doc *c.Document) error {
+			return errors.New("rejected")
+		})))
+
+		doc = c.NewDocument()
+		require.ErrorIs(t, db.InsertWithId("validated", "other-id", doc), c.ErrInvalidDocument)
+		require.False(t, doc.Has("_id"))
+
+		docs := []*c.Document{c.NewDocument(), c.NewDocument()}
+		require.ErrorIs(t, db.Insert("validated", docs...), c.ErrInvalidDocument)
+		for _, doc := range docs {
+			require.False(t, doc.Has("_id"))
+		}
+	})
+}
+
+func TestFindById(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		doc := c.NewDocument()
+		doc.Set("hello", "clover")
+		docId, err := db.InsertOne("myCollection", doc)
+		require.NoError(t, err)
+		require.NotEmpty(t, docId)
+
+		found, err := db.FindById("myCollection", docId)
+		require.NoError(t, err)
+		require.Equal(t, docId, found.ObjectId())
+		require.Equal(t, docId, found.Get("_id"))
+		require.Equal(t, "clover", found.Get("hello"))
+
+		require.Nil(t, db.Query("myCollection").Where(c.Field("hello").Eq("world")).FindById(docId))
+
+		_, err = db.FindById("myCollection", "missing-id")
+		require.ErrorIs(t, err, c.ErrDocumentNotFound)
+
+		_, err = db.FindById("myOtherCollection", docId)
+		require.ErrorIs(t, err, c.ErrCollectionNotExist)
 	})
 }
 
@@ -111,6 +502,107 @@ func TestInsertAndGet(t *testing.T) {
 	})
 }
 
+func TestPatchById(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		doc := c.NewDocument()
+		doc.Set("name", "clover")
+		doc.Set("address.city", "Rome")
+		doc.Set("address.zip", "00100")
+		doc.Set("tags", []string{"a", "b"})
+
+		docId, err := db.InsertOne("myCollection", doc)
+		require.NoError(t, err)
+
+		patch := map[string]interface{}{
+			"_id":  "another-id",
+			"tags": []string{"c"},
+			"address": map[string]interface{}{
+				"city": "Milan",
+				"zip":  c.DeleteKey,
+			},
+			"stars": 5,
+		}
+		require.NoError(t, db.PatchById("myCollection", docId, patch))
+
+		doc = db.Query("myCollection").FindById(docId)
+		require.NotNil(t, doc)
+		require.Equal(t, doc.Get("name"), "clover")
+		require.Equal(t, doc.Get("address.city"), "Milan")
+		require.False(t, doc.Has("address.zip"))
+		require.Equal(t, doc.Get("tags"), []interface{}{"c"})
+		require.Equal(t, doc.Get("stars"), float64(5))
+
+		require.ErrorIs(t, db.PatchById("myCollection", "missing", patch), c.ErrDocumentNotFound)
+		require.ErrorIs(t, db.PatchById("myOtherCollection", docId, patch), c.ErrCollectionNotExist)
+	})
+}
+
+func TestUpdateAndDeleteById(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		id, err := db.InsertOne("myCollection", c.NewDocumentOf(map[string]interface{}{"name": "a", "n": 1}))
+		require.NoError(t, err)
+		otherId, err := db.InsertOne("myCollection", c.NewDocumentOf(map[string]interface{}{"name": "b", "n": 1}))
+		require.NoError(t, err)
+
+		require.NoError(t, db.UpdateById("myCollection", id, map[string]interface{}{"n": 2, "nested.field": true}))
+
+		doc, err := db.FindById("myCollection", id)
+		require.NoError(t, err)
+		require.Equal(t, float64(2), doc.Get("n"))
+		require.Equal(t, true, doc.Get("nested.field"))
+		require.Equal(t, "a", doc.Get("name"))
+
+		other, err := db.FindById("myCollection", otherId)
+		require.NoError(t, err)
+		require.Equal(t, float64(1), other.Get("n"))
+
+		require.ErrorIs(t, db.UpdateById("myCollection", id, map[string]interface{}{"_id": "x"}), c.ErrInvalidArgument)
+		require.ErrorIs(t, db.UpdateById("myCollection", "missing", map[string]interface{}{"n": 3}), c.ErrDocumentNotFound)
+		require.ErrorIs(t, db.UpdateById("missing", id, map[string]interface{}{"n": 3}), c.ErrCollectionNotExist)
+
+		require.NoError(t, db.DeleteById("myCollection", id))
+		require.Equal(t, 1, db.Query("myCollection").Count())
+		require.ErrorIs(t, db.DeleteById("myCollection", id), c.ErrDocumentNotFound)
+		require.ErrorIs(t, db.DeleteById("missing", otherId), c.ErrCollectionNotExist)
+	})
+}
+
+func TestUpdateByIds(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		ids := make([]string, 0)
+		for i := 0; i < 10; i++ {
+			doc := c.NewDocument()
+			doc.Set("value", i)
+			docId, err := db.InsertOne("myCollection", doc)
+			require.NoError(t, err)
+			ids = append(ids, docId)
+		}
+
+		updateIds := append([]string{"missing-id", ids[0]}, ids[:5]...)
+		n, err := db.UpdateByIds("myCollection", updateIds, map[string]interface{}{"updated": true})
+		require.NoError(t, err)
+		require.Equal(t, n, 5)
+
+		require.Equal(t, db.Query("myCollection").Where(c.Field("updated").Eq(true)).Count(), 5)
+		for _, id := range ids[:5] {
+			require.Equal(t, db.Query("myCollection").FindById(id).Get("updated"), true)
+		}
+
+		n, err = db.UpdateByIds("myCollection", []string{"missing-id"}, map[string]interface{}{"updated": true})
+		require.NoError(t, err)
+		require.Equal(t, n, 0)
+
+		_, err = db.UpdateByIds("myOtherCollection", ids, map[string]interface{}{"updated": true})
+		require.ErrorIs(t, err, c.ErrCollectionNotExist)
+	})
+}
+
 func copyCollection(db *c.DB, src, dst string) error {
 	if err := db.CreateCollection(dst); err != nil {
 		return err
@@ -137,6 +629,16 @@ func TestUpdateCollection(t *testing.T) {
 
 		n := db.Query("todos-temp").Where(criteria).Count()
 		require.Equal(t, n, 0)
+
+		err = db.Query("todos-temp").Update(map[string]interface{}{"_id": "newId"})
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+
+		_, err = db.UpdateByIds("todos-temp", []string{"newId"}, map[string]interface{}{"": 1})
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+
+		err = db.Query("todos-temp").Where(c.Field("userId").Eq(1)).Update(map[string]interface{}{"meta.reviewed": true})
+		require.NoError(t, err)
+		require.Equal(t, db.Query("todos-temp").Where(c.Field("userId").Eq(1)).Count(), db.Query("todos-temp").Where(c.Field("meta.reviewed").Eq(true)).Count())
 	})
 }
 
@@ -208,6 +710,82 @@ func TestExistsCriteria(t *testing.T) {
 	})
 }
 
+func TestNullCriteria(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		total := db.Query("todos").Count()
+
+		n := db.Query("todos").Where(c.Field("completed_date").IsNull()).Count()
+		require.Equal(t, n, 1)
+
+		n = db.Query("todos").Where(c.Field("completed_date").IsNotNull()).Count()
+		require.Equal(t, n, 0)
+
+		n = db.Query("todos").Where(c.Field("completed_date").Exists().Not()).Count()
+		require.Equal(t, n, total-1)
+
+		n = db.Query("todos").Where(c.Field("title").IsNotNull()).Count()
+		require.Equal(t, n, total)
+	})
+}
+
+func TestSizeCriteria(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		for i := 0; i < 5; i++ {
+			doc := c.NewDocument()
+			doc.Set("tags", make([]string, i))
+			require.NoError(t, db.Insert("myCollection", doc))
+		}
+
+		doc := c.NewDocument()
+		doc.Set("tags", "not-an-array")
+		require.NoError(t, db.Insert("myCollection", doc))
+
+		n := db.Query("myCollection").Where(c.Field("tags").SizeEq(2)).Count()
+		require.Equal(t, n, 1)
+
+		n = db.Query("myCollection").Where(c.Field("tags").SizeGt(2)).Count()
+		require.Equal(t, n, 2)
+
+		n = db.Query("myCollection").Where(c.Field("tags").SizeLt(2)).Count()
+		require.Equal(t, n, 2)
+
+		n = db.Query("myCollection").Where(c.Field("tags").SizeLt(100)).Count()
+		require.Equal(t, n, 5)
+	})
+}
+
+func TestElemMatchCriteria(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("orders"))
+
+		items := [][]map[string]interface{}{
+			{{"sku": "ABC", "qty": 3}, {"sku": "XYZ", "qty": 1}},
+			{{"sku": "ABC", "qty": 1}, {"sku": "XYZ", "qty": 5}},
+			{},
+		}
+		for _, orderItems := range items {
+			doc := c.NewDocument()
+			doc.Set("items", orderItems)
+			require.NoError(t, db.Insert("orders", doc))
+		}
+
+		doc := c.NewDocument()
+		doc.Set("items", []interface{}{"ABC", 3})
+		require.NoError(t, db.Insert("orders", doc))
+
+		criteria := c.Field("items").ElemMatch(c.Field("qty").Gt(2).And(c.Field("sku").Eq("ABC")))
+		require.Equal(t, db.Query("orders").Where(criteria).Count(), 1)
+
+		criteria = c.Field("items").ElemMatch(c.Field("qty").Gt(2))
+		require.Equal(t, db.Query("orders").Where(criteria).Count(), 2)
+
+		criteria = c.Field("sku").ElemMatch(c.Field("qty").Gt(2))
+		require.Equal(t, db.Query("orders").Where(criteria).Count(), 0)
+	})
+}
+
 func TestEqCriteria(t *testing.T) {
 	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
 		require.True(t, db.HasCollection("todos"))
@@ -260,22 +838,223 @@ func TestCompareString(t *testing.T) {
 	})
 }
 
-func TestEqCriteriaWithDifferentTypes(t *testing.T) {
+func TestStartsWithAndEndsWithCriteria(t *testing.T) {
 	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
-		require.True(t, db.HasCollection("todos"))
-		require.NotNil(t, db.Query("todos"))
+		docs := db.Query("todos").Where(c.Field("title").StartsWith("delectus")).FindAll()
+		require.Greater(t, len(docs), 0)
+		for _, doc := range docs {
+			require.True(t, strings.HasPrefix(doc.Get("title").(string), "delectus"))
+		}
 
-		count1 := db.Query("todos").Where(c.Field("userId").Eq(int(1))).Count()
-		count2 := db.Query("todos").Where(c.Field("userId").Eq(int8(1))).Count()
-		count3 := db.Query("todos").Where(c.Field("userId").Eq(int16(1))).Count()
-		count4 := db.Query("todos").Where(c.Field("userId").Eq(int32(1))).Count()
-		count5 := db.Query("todos").Where(c.Field("userId").Eq(int64(1))).Count()
+		n := db.Query("todos").Where(c.Field("title").StartsWith("DELECTUS")).Count()
+		require.Equal(t, n, 0)
 
-		count6 := db.Query("todos").Where(c.Field("userId").Eq(uint(1))).Count()
-		count7 := db.Query("todos").Where(c.Field("userId").Eq(uint8(1))).Count()
-		count8 := db.Query("todos").Where(c.Field("userId").Eq(uint16(1))).Count()
-		count9 := db.Query("todos").Where(c.Field("userId").Eq(uint32(1))).Count()
-		count10 := db.Query("todos").Where(c.Field("userId").Eq(uint64(1))).Count()
+		n = db.Query("todos").Where(c.Field("title").StartsWith("DELECTUS", c.IgnoreCase)).Count()
+		require.Equal(t, n, len(docs))
+
+		docs = db.Query("todos").Where(c.Field("title").EndsWith("autem")).FindAll()
+		require.Greater(t, len(docs), 0)
+		for _, doc := range docs {
+			require.True(t, strings.HasSuffix(doc.Get("title").(string), "autem"))
+		}
+
+		n = db.Query("todos").Where(c.Field("title").EndsWith("AUTEM", c.IgnoreCase)).Count()
+		require.Equal(t, n, len(docs))
+
+		n = db.Query("todos").Where(c.Field("userId").StartsWith("1")).Count()
+		require.Equal(t, n, 0)
+	})
+}
+
+func TestLikeAndRegexCriteria(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		n := db.Query("todos").Where(c.Field("title").StartsWith("delectus")).Count()
+		require.Greater(t, n, 0)
+
+		require.Equal(t, n, db.Query("todos").Where(c.Field("title").Like("delectus%")).Count())
+		require.Equal(t, n, db.Query("todos").Where(c.Field("title").Like("DELECTUS%", c.IgnoreCase)).Count())
+		require.Equal(t, 0, db.Query("todos").Where(c.Field("title").Like("DELECTUS%")).Count())
+		require.Equal(t, n, db.Query("todos").Where(c.Field("title").Regex("^delectus")).Count())
+
+		docs := db.Query("todos").Where(c.Field("title").Like("%delect%")).FindAll()
+		require.Greater(t, len(docs), n)
+		for _, doc := range docs {
+			require.Contains(t, doc.Get("title"), "delect")
+		}
+
+		require.Equal(t, len(docs), db.Query("todos").Where(c.Field("title").Regex("delect")).Count())
+		require.Equal(t, 0, db.Query("todos").Where(c.Field("userId").Like("%")).Count())
+
+		require.Panics(t, func() { c.Field("name").Regex("(") })
+	})
+}
+
+func TestLikeEscapes(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("files"))
+		for _, name := range []string{"100%.txt", "1000.txt", "a_b.txt", "axb.txt"} {
+			_, err := db.InsertOne("files", c.NewDocumentOf(map[string]interface{}{"name": name}))
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, 2, db.Query("files").Where(c.Field("name").Like("100%")).Count())
+		require.Equal(t, 1, db.Query("files").Where(c.Field("name").Like("100\\%%")).Count())
+		require.Equal(t, 2, db.Query("files").Where(c.Field("name").Like("a_b.txt")).Count())
+		require.Equal(t, 1, db.Query("files").Where(c.Field("name").Like("a\\_b.txt")).Count())
+		require.Equal(t, 0, db.Query("files").Where(c.Field("name").Like("a_b")).Count())
+		require.Equal(t, 2, db.Query("files").Where(c.Field("name").Regex(`^a.b\.txt$`)).Count())
+
+	})
+}
+
+func TestContainsCriteria(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("tasks"))
+
+		tasks := []map[string]interface{}{
+			{"name": "a", "tags": []interface{}{"urgent", "home"}},
+			{"name": "b", "tags": []interface{}{"work", 1}},
+			{"name": "c", "tags": []interface{}{"urgent", "work", map[string]interface{}{"owner": "bob"}}},
+			{"name": "d", "tags": "urgent"},
+			{"name": "e"},
+		}
+		for _, task := range tasks {
+			_, err := db.InsertOne("tasks", c.NewDocumentOf(task))
+			require.NoError(t, err)
+		}
+
+		names := func(criteria *c.Criteria) []string {
+			res := make([]string, 0)
+			for _, doc := range db.Query("tasks").Where(criteria).Sort(c.SortOption{Field: "name", Direction: 1}).FindAll() {
+				res = append(res, doc.Get("name").(string))
+			}
+			return res
+		}
+
+		require.Equal(t, []string{"a", "c"}, names(c.Field("tags").Contains("urgent")))
+		require.Equal(t, []string{"b"}, names(c.Field("tags").Contains(1.0)))
+		require.Equal(t, []string{"b"}, names(c.Field("tags").Contains(int64(1))))
+		require.Equal(t, []string{"c"}, names(c.Field("tags").Contains(map[string]interface{}{"owner": "bob"})))
+
+		require.Equal(t, []string{"c"}, names(c.Field("tags").ContainsAll("work", "urgent")))
+		require.Equal(t, []string{"a", "b", "c"}, names(c.Field("tags").ContainsAll()))
+		require.Equal(t, []string{"a", "b", "c"}, names(c.Field("tags").ContainsAny("home", "work")))
+		require.Equal(t, []string{}, names(c.Field("tags").ContainsAny()))
+
+		require.Equal(t, []string{"b", "d", "e"}, names(c.Field("tags").Contains("urgent").Not()))
+	})
+}
+
+func TestOrAndNotComposition(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("items"))
+		for i := 0; i < 20; i++ {
+			fields := map[string]interface{}{"group": i % 4, "n": i}
+			if i%5 != 0 {
+				fields["even"] = i%2 == 0
+			}
+			_, err := db.InsertOne("items", c.NewDocumentOf(fields))
+			require.NoError(t, err)
+		}
+
+		q := db.Query("items")
+		a := c.Field("group").Eq(1)
+		b := c.Field("even").Eq(true)
+
+		require.Equal(t, q.Where(a).Count()+q.Where(b).Count()-q.Where(a.And(b)).Count(), q.Where(a.Or(b)).Count())
+
+		// De Morgan's laws
+		require.Equal(t, q.Where(a.Not().And(b.Not())).Count(), q.Where(a.Or(b).Not()).Count())
+		require.Equal(t, q.Where(a.Not().Or(b.Not())).Count(), q.Where(a.And(b).Not()).Count())
+		require.Equal(t, q.Count(), q.Where(a.Or(b)).Count()+q.Where(a.Or(b).Not()).Count())
+
+		require.NoError(t, db.CreateIndex("items", "group"))
+
+		q = db.Query("items")
+		common := c.Field("group").Eq(2)
+		criteria := common.And(c.Field("n").Lt(10)).Or(c.Field("n").Gt(15).And(common))
+		require.Equal(t, []string{"group"}, q.Where(criteria).Explain().IndexFields)
+		require.Nil(t, q.Where(a.Or(b)).Explain().IndexFields)
+		require.Nil(t, q.Where(common.Not()).Explain().IndexFields)
+
+		n := 0
+		for _, doc := range q.FindAll() {
+			group, num := doc.Get("group").(float64), doc.Get("n").(float64)
+			if group == 2 && (num < 10 || num > 15) {
+				n++
+			}
+		}
+		require.Greater(t, n, 0)
+		require.Equal(t, n, q.Where(criteria).Count())
+	})
+}
+
+func TestFindFirst(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		q := db.Query("todos").Where(c.Field("completed").Eq(true))
+
+		doc := q.FindFirst()
+		require.NotNil(t, doc)
+		require.Equal(t, true, doc.Get("completed"))
+
+		sorted := q.Sort(c.SortOption{Field: "id", Direction: -1})
+		require.Equal(t, sorted.FindAll()[0], sorted.FindFirst())
+		require.Equal(t, sorted.FindAll()[2], sorted.Skip(2).FindFirst())
+
+		projected := sorted.Select("title").FindFirst()
+		require.Equal(t, sorted.FindAll()[0].Get("title"), projected.Get("title"))
+		require.False(t, projected.Has("completed"))
+
+		require.Nil(t, q.Limit(0).FindFirst())
+		require.Nil(t, db.Query("todos").Where(c.Field("completed").Eq("maybe")).FindFirst())
+	})
+}
+
+func TestForEach(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		q := db.Query("todos").Where(c.Field("completed").Eq(true)).Sort(c.SortOption{Field: "id", Direction: 1})
+
+		docs := make([]*c.Document, 0)
+		q.ForEach(func(doc *c.Document) bool {
+			docs = append(docs, doc)
+			return true
+		})
+		require.Equal(t, q.FindAll(), docs)
+
+		n := 0
+		db.Query("todos").ForEach(func(doc *c.Document) bool {
+			n++
+			return n < 5
+		})
+		require.Equal(t, 5, n)
+
+		titles := make([]interface{}, 0)
+		q.Limit(3).Select("title").ForEach(func(doc *c.Document) bool {
+			require.False(t, doc.Has("completed"))
+			titles = append(titles, doc.Get("title"))
+			return true
+		})
+		require.Len(t, titles, 3)
+		require.Equal(t, docs[1].Get("title"), titles[1])
+	})
+}
+
+func TestEqCriteriaWithDifferentTypes(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		require.True(t, db.HasCollection("todos"))
+		require.NotNil(t, db.Query("todos"))
+
+		count1 := db.Query("todos").Where(c.Field("userId").Eq(int(1))).Count()
+		count2 := db.Query("todos").Where(c.Field("userId").Eq(int8(1))).Count()
+		count3 := db.Query("todos").Where(c.Field("userId").Eq(int16(1))).Count()
+		count4 := db.Query("todos").Where(c.Field("userId").Eq(int32(1))).Count()
+		count5 := db.Query("todos").Where(c.Field("userId").Eq(int64(1))).Count()
+
+		count6 := db.Query("todos").Where(c.Field("userId").Eq(uint(1))).Count()
+		count7 := db.Query("todos").Where(c.Field("userId").Eq(uint8(1))).Count()
+		count8 := db.Query("todos").Where(c.Field("userId").Eq(uint16(1))).Count()
+		count9 := db.Query("todos").Where(c.Field("userId").Eq(uint32(1))).Count()
+		count10 := db.Query("todos").Where(c.Field("userId").Eq(uint64(1))).Count()
 
 		count11 := db.Query("todos").Where(c.Field("userId").Eq(float32(1))).Count()
 		count12 := db.Query("todos").Where(c.Field("userId").Eq(float64(1))).Count()
@@ -444,47 +1223,3583 @@ func TestOrCriteria(t *testing.T) {
 	})
 }
 
-func genRandomFieldName() string {
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+func TestSort(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		docs := db.Query("todos").Sort(c.SortOption{Field: "userId", Direction: 1}, c.SortOption{Field: "id", Direction: -1}).FindAll()
+		require.Len(t, docs, db.Query("todos").Count())
 
-	size := rand.Intn(100) + 1
+		for i := 1; i < len(docs); i++ {
+			prevUser, user := docs[i-1].Get("userId").(float64), docs[i].Get("userId").(float64)
+			require.LessOrEqual(t, prevUser, user)
+			if prevUser == user {
+				require.Greater(t, docs[i-1].Get("id").(float64), docs[i].Get("id").(float64))
+			}
+		}
 
-	fName := ""
-	for i := 0; i < size; i++ {
-		fName += "." + string(letters[rand.Intn(len(letters))])
-	}
-	return fName
+		ids := make([]string, 0, len(docs))
+		for _, doc := range db.Query("todos").Sort().FindAll() {
+			ids = append(ids, doc.ObjectId())
+		}
+		require.True(t, sort.StringsAreSorted(ids))
+	})
+
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		values := []interface{}{true, []interface{}{1}, map[string]interface{}{"a": 1}, "a", 2, 1.5, nil}
+		for _, v := range values {
+			doc := c.NewDocument()
+			doc.Set("value", v)
+			require.NoError(t, db.Insert("myCollection", doc))
+		}
+		require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+
+		docs := db.Query("myCollection").Sort(c.SortOption{Field: "value", Direction: 1}).FindAll()
+		require.Len(t, docs, len(values)+1)
+		require.False(t, docs[0].Has("value"))
+		require.True(t, docs[1].Has("value"))
+		require.Nil(t, docs[1].Get("value"))
+		require.Equal(t, 1.5, docs[2].Get("value"))
+		require.Equal(t, float64(2), docs[3].Get("value"))
+		require.Equal(t, "a", docs[4].Get("value"))
+		require.Equal(t, map[string]interface{}{"a": float64(1)}, docs[5].Get("value"))
+		require.Equal(t, []interface{}{float64(1)}, docs[6].Get("value"))
+		require.Equal(t, true, docs[7].Get("value"))
+
+		reversed := db.Query("myCollection").Sort(c.SortOption{Field: "value", Direction: -1}).FindAll()
+		for i := range docs {
+			require.Equal(t, docs[i].ObjectId(), reversed[len(reversed)-1-i].ObjectId())
+		}
+	})
 }
 
-func TestDocument(t *testing.T) {
-	doc := c.NewDocument()
+func TestSkipAndLimit(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		criteria := c.Field("completed").Eq(false)
+		sortOpt := c.SortOption{Field: "title", Direction: -1}
 
-	nTests := 1000
-	for i := 0; i < nTests; i++ {
-		fieldName := genRandomFieldName()
-		doc.Set(fieldName, i)
-		require.True(t, doc.Has(fieldName))
-		require.Equal(t, doc.Get(fieldName), i)
-	}
+		all := db.Query("todos").Where(criteria).Sort(sortOpt).FindAll()
+		n := len(all)
+
+		for _, skip := range []int{0, 1, 7, n - 1, n, n + 5} {
+			for _, limit := range []int{-1, 0, 1, 10, n} {
+				docs := db.Query("todos").Where(criteria).Sort(sortOpt).Skip(skip).Limit(limit).FindAll()
+
+				expected := all
+				if skip < len(expected) {
+					expected = expected[skip:]
+				} else {
+					expected = nil
+				}
+				if limit >= 0 && limit < len(expected) {
+					expected = expected[:limit]
+				}
+
+				require.Len(t, docs, len(expected))
+				for i := range docs {
+					require.Equal(t, expected[i].ObjectId(), docs[i].ObjectId())
+				}
+
+				count := db.Query("todos").Where(criteria).Skip(skip).Limit(limit).Count()
+				require.Equal(t, len(expected), count)
+			}
+		}
+
+		// skip+limit overflows
+		maxInt := int(^uint(0) >> 1)
+		docs := db.Query("todos").Where(criteria).Sort(sortOpt).Skip(10).Limit(maxInt).FindAll()
+		require.Len(t, docs, n-10)
+		require.Equal(t, all[10].ObjectId(), docs[0].ObjectId())
+
+		visited := 0
+		db.Query("todos").MatchPredicate(func(doc *c.Document) bool {
+			visited++
+			return true
+		}).Skip(2).Limit(3).FindAll()
+		require.Equal(t, 5, visited)
+	})
 }
 
-func TestDocumentUnmarshal(t *testing.T) {
+func TestFind(t *testing.T) {
 	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
-		require.True(t, db.HasCollection("todos"))
-		require.NotNil(t, db.Query("todos"))
+		docs, err := db.Find("todos", c.FindOptions{})
+		require.NoError(t, err)
+		require.Equal(t, len(docs), db.Query("todos").Count())
 
-		docs := db.Query("todos").FindAll()
+		docs, err = db.Find("todos", c.FindOptions{
+			Criteria:   c.Field("completed").Eq(true),
+			Sort:       []c.SortOption{{Field: "id", Direction: -1}},
+			Skip:       2,
+			Limit:      10,
+			Projection: []string{"id", "userId"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, len(docs), 10)
 
-		todo := &struct {
-			Completed bool   `json:"completed"`
-			Title     string `json:"title"`
-			UserId    int    `json:"userId"`
-		}{}
+		expected := db.Query("todos").Where(c.Field("completed").Eq(true)).Sort(c.SortOption{Field: "id", Direction: -1}).Skip(2).Limit(10).FindAll()
+		for i, doc := range docs {
+			require.Equal(t, doc.Get("id"), expected[i].Get("id"))
+			require.True(t, doc.Has("userId"))
+			require.False(t, doc.Has("title"))
+		}
 
-		require.Greater(t, len(docs), 0)
-		for _, doc := range docs {
-			err := doc.Unmarshal(todo)
+		for i := 1; i < len(docs); i++ {
+			require.Greater(t, docs[i-1].Get("id"), docs[i].Get("id"))
+		}
+
+		_, err = db.Find("myCollection", c.FindOptions{})
+		require.ErrorIs(t, err, c.ErrCollectionNotExist)
+	})
+}
+
+func TestPipeline(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		criteria := c.Field("completed").Eq(true)
+
+		groups := db.Query("todos").Pipeline().Match(criteria).Group("userId").Count()
+		require.Greater(t, len(groups), 0)
+
+		total := 0
+		for i, group := range groups {
+			userId := group.Get("userId")
+			n := db.Query("todos").Where(criteria.And(c.Field("userId").Eq(userId))).Count()
+			require.Equal(t, group.Get("count"), float64(n))
+			total += n
+
+			if i > 0 {
+				require.Less(t, groups[i-1].Get("userId"), userId)
+			}
+		}
+		require.Equal(t, total, db.Query("todos").Where(criteria).Count())
+
+		docs := db.Query("todos").Pipeline().Match(criteria).Sort(c.SortOption{Field: "id", Direction: -1}).Limit(5).FindAll()
+		require.Equal(t, len(docs), 5)
+		for i := 1; i < len(docs); i++ {
+			require.Equal(t, docs[i].Get("completed"), true)
+			require.Greater(t, docs[i-1].Get("id"), docs[i].Get("id"))
+		}
+	})
+}
+
+func TestPipelineLookup(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("users"))
+		require.NoError(t, db.CreateCollection("orders"))
+
+		userIds := make([]string, 0)
+		for _, name := range []string{"alice", "bob"} {
+			doc := c.NewDocument()
+			doc.Set("name", name)
+			id, err := db.InsertOne("users", doc)
+			require.NoError(t, err)
+			userIds = append(userIds, id)
+		}
+
+		for i, userId := range []interface{}{userIds[0], userIds[0], userIds[1], "missing", []interface{}{userIds[0], userIds[1]}} {
+			doc := c.NewDocument()
+			doc.Set("n", i)
+			doc.Set("userId", userId)
+			require.NoError(t, db.Insert("orders", doc))
+		}
+
+		docs := db.Query("orders").Sort(c.SortOption{Field: "n"}).Pipeline().Lookup("users", "userId", "_id", "user").FindAll()
+		require.Len(t, docs, 5)
+
+		names := func(doc *c.Document) []string {
+			result := make([]string, 0)
+			for _, user := range doc.Get("user").([]interface{}) {
+				result = append(result, user.(map[string]interface{})["name"].(string))
+			}
+			sort.Strings(result)
+			return result
+		}
+		require.Equal(t, []string{"alice"}, names(docs[0]))
+		require.Equal(t, []string{"alice"}, names(docs[1]))
+		require.Equal(t, []string{"bob"}, names(docs[2]))
+		require.Empty(t, names(docs[3]))
+		require.Equal(t, []string{"alice", "bob"}, names(docs[4]))
+
+		// the original documents are not modified
+		require.False(t, db.Query("orders").FindFirst().Has("user"))
+
+		docs = db.Query("users").Sort(c.SortOption{Field: "name"}).Pipeline().Lookup("orders", "_id", "userId", "orders.list").FindAll()
+		require.Len(t, docs[0].Get("orders.list"), 2)
+		require.Len(t, docs[1].Get("orders.list"), 1)
+
+		docs = db.Query("users").Pipeline().Lookup("missing", "_id", "userId", "orders").FindAll()
+		require.Empty(t, docs[0].Get("orders"))
+	})
+}
+
+func TestWatch(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		events, cancel := db.Watch("myCollection")
+
+		doc := c.NewDocument()
+		doc.Set("hello", "clover")
+		docId, err := db.InsertOne("myCollection", doc)
+		require.NoError(t, err)
+
+		require.NoError(t, db.Query("myCollection").Update(map[string]interface{}{"hello": "world"}))
+		require.NoError(t, db.Query("myCollection").DeleteById(docId))
+
+		expectedOps := []c.ChangeOp{c.OpInsert, c.OpUpdate, c.OpDelete}
+		for _, op := range expectedOps {
+			e := <-events
+			require.Equal(t, e.Op, op)
+			require.Equal(t, e.Collection, "myCollection")
+			require.Equal(t, e.Id, docId)
+			require.Equal(t, e.Dropped, 0)
+		}
+
+		cancel()
+		_, ok := <-events
+		require.False(t, ok)
+		cancel()
+
+		require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+	})
+}
+
+func TestWatchSlowConsumer(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		events, cancel := db.Watch("myCollection")
+		defer cancel()
+
+		nInserts := 1000
+		docs := make([]*c.Document, 0, nInserts)
+		for i := 0; i < nInserts; i++ {
+			docs = append(docs, c.NewDocument())
+		}
+		require.NoError(t, db.Insert("myCollection", docs...))
+
+		received := 0
+		for len(events) > 0 {
+			<-events
+			received++
+		}
+		require.Less(t, received, nInserts)
+
+		require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+		e := <-events
+		require.Equal(t, e.Dropped, nInserts-received)
+	})
+}
+
+func TestFirstAndLast(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		q := db.Query("todos").Where(c.Field("completed").Eq(true)).Sort(c.SortOption{Field: "id", Direction: 1})
+		all := q.FindAll()
+		require.Greater(t, len(all), 5)
+
+		first, err := q.First(5)
+		require.NoError(t, err)
+		require.Equal(t, first, all[:5])
+
+		last, err := q.Last(5)
+		require.NoError(t, err)
+		require.Equal(t, last, all[len(all)-5:])
+
+		first, err = q.First(len(all) + 10)
+		require.NoError(t, err)
+		require.Equal(t, first, all)
+
+		last, err = q.Last(len(all) + 10)
+		require.NoError(t, err)
+		require.Equal(t, last, all)
+
+		maxInt := int(^uint(0) >> 1)
+		last, err = q.Last(maxInt)
+		require.NoError(t, err)
+		require.Equal(t, last, all)
+
+		last, err = q.Last(0)
+		require.NoError(t, err)
+		require.Empty(t, last)
+
+		_, err = q.First(-1)
+		require.Equal(t, err, c.ErrInvalidArgument)
+		_, err = q.Last(-1)
+		require.Equal(t, err, c.ErrInvalidArgument)
+	})
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+		require.NoError(t, db.CreateCollection("empty"))
+		require.NoError(t, db.CreateIndex("myCollection", "n"))
+		for i := 0; i < 100; i++ {
+			doc := c.NewDocument()
+			doc.Set("n", i)
+			require.NoError(t, db.Insert("myCollection", doc))
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				doc := c.NewDocument()
+				doc.Set("n", -1)
+				if err := db.Insert("myCollection", doc); err != nil {
+					return
+				}
+			}
+		}()
+
+		buf := &bytes.Buffer{}
+		require.NoError(t, db.Backup(buf))
+		<-done
+
+		dir, err := ioutil.TempDir("", "clover-restore")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		require.NoError(t, c.Restore(bytes.NewReader(buf.Bytes()), dir))
+		require.ErrorIs(t, c.Restore(bytes.NewReader(buf.Bytes()), dir), c.ErrInvalidArgument)
+
+		restored, err := c.Open(dir)
+		require.NoError(t, err)
+		defer restored.Close()
+
+		require.Equal(t, []string{"empty", "myCollection"}, restored.ListCollections())
+		require.Equal(t, 100, restored.Query("myCollection").Where(c.Field("n").GtEq(0)).Count())
+		require.Equal(t, []string{"n"}, restored.Query("myCollection").Where(c.Field("n").Eq(1)).Explain().IndexFields)
+
+		// the backup is a snapshot: insertions are either entirely included or not included at all
+		n := restored.Query("myCollection").Count()
+		require.GreaterOrEqual(t, n, 100)
+		for _, doc := range restored.Query("myCollection").FindAll() {
+			original, err := db.FindById("myCollection", doc.ObjectId())
 			require.NoError(t, err)
+			require.Equal(t, original.Get("n"), doc.Get("n"))
 		}
 	})
 }
+
+func TestContextVariants(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+		for i := 0; i < 100; i++ {
+			doc := c.NewDocument()
+			doc.Set("n", i)
+			require.NoError(t, db.InsertContext(context.Background(), "myCollection", doc))
+		}
+
+		ctx := context.Background()
+		docs, err := db.Query("myCollection").Where(c.Field("n").Lt(10)).FindAllContext(ctx)
+		require.NoError(t, err)
+		require.Len(t, docs, 10)
+
+		n, err := db.Query("myCollection").Where(c.Field("n").GtEq(10)).CountContext(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 90, n)
+
+		canceled, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err = db.Query("myCollection").FindAllContext(canceled)
+		require.ErrorIs(t, err, context.Canceled)
+
+		_, err = db.Query("myCollection").Where(c.Field("n").Lt(10)).Cached().CountContext(canceled)
+		require.ErrorIs(t, err, context.Canceled)
+
+		require.ErrorIs(t, db.Query("myCollection").DeleteContext(canceled), context.Canceled)
+		require.ErrorIs(t, db.Query("myCollection").UpdateContext(canceled, map[string]interface{}{"n": 0}), context.Canceled)
+		require.ErrorIs(t, db.InsertContext(canceled, "myCollection", c.NewDocument()), context.Canceled)
+		require.Equal(t, 100, db.Query("myCollection").Count())
+		require.Equal(t, 1, db.Query("myCollection").Where(c.Field("n").Eq(0)).Count())
+
+		ctx, cancel = context.WithCancel(context.Background())
+		visited := 0
+		err = db.Query("myCollection").ForEachContext(ctx, func(doc *c.Document) bool {
+			visited++
+			if visited == 5 {
+				cancel()
+			}
+			return true
+		})
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, 5, visited)
+
+		require.NoError(t, db.Query("myCollection").Where(c.Field("n").Lt(50)).DeleteContext(context.Background()))
+		require.Equal(t, 50, db.Query("myCollection").Count())
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+		require.NoError(t, db.Insert("myCollection", c.NewDocument(), c.NewDocument()))
+
+		snapshot, err := db.Snapshot()
+		require.NoError(t, err)
+		require.True(t, snapshot.HasCollection("myCollection"))
+
+		require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+		require.NoError(t, db.CreateCollection("myOtherCollection"))
+
+		n, err := snapshot.Count("myCollection")
+		require.NoError(t, err)
+		require.Equal(t, n, 2)
+		require.Equal(t, snapshot.Query("myCollection").Count(), 2)
+		require.False(t, snapshot.HasCollection("myOtherCollection"))
+
+		require.NoError(t, db.Query("myCollection").Delete())
+		require.Equal(t, db.Query("myCollection").Count(), 0)
+		require.Equal(t, snapshot.Query("myCollection").Count(), 2)
+
+		require.Equal(t, snapshot.Query("myCollection").Delete(), c.ErrReadOnly)
+
+		_, err = snapshot.Count("myOtherCollection")
+		require.ErrorIs(t, err, c.ErrCollectionNotExist)
+
+		snapshot.Release()
+		require.Nil(t, snapshot.Query("myCollection"))
+	})
+}
+
+func TestFuncCriteria(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		shortTitle := c.Func(func(doc *c.Document) bool {
+			return len(doc.Get("title").(string)) < 20
+		})
+
+		criteria := c.Field("completed").Eq(true).And(shortTitle)
+		docs := db.Query("todos").Where(criteria).FindAll()
+		require.Greater(t, len(docs), 0)
+
+		for _, doc := range docs {
+			require.Equal(t, doc.Get("completed"), true)
+			require.Less(t, len(doc.Get("title").(string)), 20)
+		}
+
+		n := db.Query("todos").Where(shortTitle.Not().Or(criteria)).Count()
+		require.Equal(t, n, db.Query("todos").Count()-db.Query("todos").Where(shortTitle.And(c.Field("completed").Eq(false))).Count())
+	})
+}
+
+func TestMap(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		q := db.Query("todos").Where(c.Field("completed").Eq(true))
+
+		docs := q.Map(func(doc *c.Document) *c.Document {
+			doc.Set("author", doc.Get("userId"))
+			doc.Set("done", true)
+			return doc
+		}).Select("author", "title").FindAll()
+		require.Equal(t, len(docs), q.Count())
+
+		for _, doc := range docs {
+			require.True(t, doc.Has("author"))
+			require.True(t, doc.Has("title"))
+			require.False(t, doc.Has("done"))
+			require.False(t, doc.Has("userId"))
+		}
+
+		// original documents must not be affected
+		require.Equal(t, db.Query("todos").Where(c.Field("author").Exists()).Count(), 0)
+	})
+}
+
+func TestSample(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		q := db.Query("todos").Where(c.Field("completed").Eq(true))
+
+		docs, err := q.Sample(10)
+		require.NoError(t, err)
+		require.Len(t, docs, 10)
+
+		ids := make(map[string]bool)
+		for _, doc := range docs {
+			require.Equal(t, doc.Get("completed"), true)
+			ids[doc.ObjectId()] = true
+		}
+		require.Len(t, ids, 10)
+
+		docs, err = q.Sample(q.Count() + 10)
+		require.NoError(t, err)
+		require.Len(t, docs, q.Count())
+
+		docs, err = q.Sample(int(^uint(0) >> 1))
+		require.NoError(t, err)
+		require.Len(t, docs, q.Count())
+
+		docs1, err := q.SampleWithSeed(5, 42)
+		require.NoError(t, err)
+		docs2, err := q.SampleWithSeed(5, 42)
+		require.NoError(t, err)
+		require.Equal(t, docs1, docs2)
+
+		_, err = q.Sample(-1)
+		require.Equal(t, err, c.ErrInvalidArgument)
+	})
+}
+
+func TestView(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		err := copyCollection(db, "todos", "todos-temp")
+		require.NoError(t, err)
+
+		defer func() {
+			require.NoError(t, db.DropCollection("todos-temp"))
+		}()
+
+		criteria := c.Field("completed").Eq(false)
+		require.NoError(t, db.CreateView("active-todos", "todos-temp", criteria))
+		require.True(t, db.HasView("active-todos"))
+		require.False(t, db.HasCollection("active-todos"))
+
+		require.NoError(t, db.CreateView("active-todos-user-1", "active-todos", c.Field("userId").Eq(1)))
+
+		n := db.Query("todos-temp").Where(criteria).Count()
+		require.Equal(t, db.Query("active-todos").Count(), n)
+
+		m := db.Query("todos-temp").Where(criteria.And(c.Field("userId").Eq(1))).Count()
+		require.Equal(t, db.Query("active-todos-user-1").Count(), m)
+
+		require.NoError(t, db.Query("todos-temp").Where(c.Field("userId").Eq(1)).Delete())
+		require.Equal(t, db.Query("active-todos").Count(), n-m)
+		require.Equal(t, db.Query("active-todos-user-1").Count(), 0)
+
+		require.ErrorIs(t, db.Query("active-todos").Delete(), c.ErrReadOnly)
+		require.ErrorIs(t, db.CreateView("active-todos", "todos-temp", criteria), c.ErrCollectionExist)
+		require.ErrorIs(t, db.CreateCollection("active-todos"), c.ErrCollectionExist)
+		require.ErrorIs(t, db.CreateView("my-view", "myCollection", criteria), c.ErrCollectionNotExist)
+
+		require.NoError(t, db.DropView("active-todos-user-1"))
+		require.Nil(t, db.Query("active-todos-user-1"))
+		require.Equal(t, db.DropView("active-todos-user-1"), c.ErrViewNotExist)
+	})
+}
+
+func TestCachedQuery(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+		require.NoError(t, db.Insert("myCollection", c.NewDocument(), c.NewDocument()))
+
+		evaluations := 0
+		q := db.Query("myCollection").MatchPredicate(func(doc *c.Document) bool {
+			evaluations++
+			return true
+		}).Cached()
+
+		require.Equal(t, q.Count(), 2)
+		require.Len(t, q.FindAll(), 2)
+		require.Equal(t, evaluations, 4)
+
+		require.Equal(t, q.Count(), 2)
+		require.Len(t, q.FindAll(), 2)
+		require.Equal(t, evaluations, 4)
+
+		require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+		require.Equal(t, q.Count(), 3)
+		require.Len(t, q.FindAll(), 3)
+		require.Equal(t, evaluations, 10)
+
+		db.ClearQueryCache()
+		require.Equal(t, q.Count(), 3)
+		require.Equal(t, evaluations, 13)
+
+		// queries built separately share their results only if they select the same documents
+		require.NoError(t, db.CreateCollection("items"))
+		at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Insert("items", c.NewDocumentOf(map[string]interface{}{"n": i, "at": at})))
+		}
+		require.NoError(t, db.Insert("items", c.NewDocumentOf(map[string]interface{}{"n": 10, "at": at.Format(time.RFC3339Nano)})))
+
+		byN := c.SortOption{Field: "n"}
+		docs := db.Query("items").Where(c.Field("n").Gt(4)).Sort(byN).Cached().FindAll()
+		require.Len(t, docs, 6)
+		require.True(t, docs[0].Has("_id"))
+
+		docs = db.Query("items").Where(c.Field("n").Gt(4)).Sort(byN).Select("n").Cached().FindAll()
+		require.Len(t, docs, 6)
+		require.False(t, docs[0].Has("_id"))
+		require.Equal(t, float64(5), docs[0].Get("n"))
+
+		docs = db.Query("items").Where(c.Field("n").Gt(4)).Sort(byN).Skip(1).Limit(2).Cached().FindAll()
+		require.Len(t, docs, 2)
+		require.Equal(t, float64(6), docs[0].Get("n"))
+
+		for _, value := range []interface{}{at, at.Format(time.RFC3339Nano)} {
+			q := db.Query("items").Where(c.Field("at").Eq(value))
+			require.Equal(t, q.Count(), q.Cached().Count())
+		}
+
+		require.NoError(t, db.Query("items").Where(c.Field("n").Eq(5)).Delete())
+		require.Len(t, db.Query("items").Where(c.Field("n").Gt(4)).Sort(byN).Cached().FindAll(), 5)
+	})
+}
+
+func TestExplain(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("items"))
+		for i := 0; i < 100; i++ {
+			doc := c.NewDocument()
+			doc.Set("n", i)
+			doc.Set("even", i%2 == 0)
+			doc.Set("text", "item "+strconv.Itoa(i%10))
+			require.NoError(t, db.Insert("items", doc))
+		}
+
+		criteria := c.Field("n").Lt(20).And(c.Field("even").Eq(true))
+		plan := db.Query("items").Where(criteria).Explain()
+		require.False(t, plan.IndexUsed())
+		require.Equal(t, 100, plan.Candidates)
+		require.Zero(t, plan.Documents)
+
+		require.NoError(t, db.CreateIndex("items", "n"))
+		require.NoError(t, db.CreateTextIndex("items", "text"))
+
+		plan = db.Query("items").Where(criteria).Explain()
+		require.True(t, plan.IndexUsed())
+		require.Equal(t, []string{"n"}, plan.IndexFields)
+		require.Equal(t, 20, plan.Candidates)
+
+		plan = db.Query("items").Where(c.Field("text").Search("item 3")).Explain()
+		require.Equal(t, "text", plan.TextIndexField)
+		require.Equal(t, 10, plan.Candidates)
+
+		plan = db.Query("items").Where(criteria).Limit(5).ExplainAnalyze()
+		require.Equal(t, 20, plan.Candidates)
+		require.Equal(t, 5, plan.Documents)
+	})
+}
+
+func TestGeoCriteria(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, db.CreateCollection("places"))
+	docs := make([]*c.Document, 0)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		doc := c.NewDocument()
+		doc.Set("location", c.GeoPoint{Lat: r.Float64()*180 - 90, Lon: r.Float64()*360 - 180})
+		docs = append(docs, doc)
+	}
+
+	// points close to the antimeridian and to the north pole
+	for _, p := range []c.GeoPoint{{Lat: 10, Lon: 179.99}, {Lat: 10, Lon: -179.99}, {Lat: 89.99, Lon: 0}, {Lat: 89.99, Lon: 180}} {
+		doc := c.NewDocument()
+		doc.Set("location", p)
+		docs = append(docs, doc)
+	}
+
+	invalid := c.NewDocument()
+	invalid.Set("location", map[string]interface{}{"lat": 100, "lon": 0})
+	require.NoError(t, db.Insert("places", append(docs, invalid, c.NewDocument())...))
+
+	rome := c.GeoPoint{Lat: 41.9, Lon: 12.5}
+	square := []c.GeoPoint{{Lat: 0, Lon: 0}, {Lat: 0, Lon: 30}, {Lat: 30, Lon: 30}, {Lat: 30, Lon: 0}}
+	queries := []*c.Criteria{
+		c.Field("location").Near(rome.Lat, rome.Lon, 1000000),
+		c.Field("location").Near(rome.Lat, rome.Lon, 5000000),
+		c.Field("location").Near(10, 180, 10000),
+		c.Field("location").Near(89.99, 90, 10000),
+		c.Field("location").Near(0, 0, -1),
+		c.Field("location").Within(square),
+		c.Field("location").Within(square[:2]),
+	}
+
+	expected := make([]int, 0, len(queries))
+	for _, criteria := range queries {
+		require.False(t, db.Query("places").Where(criteria).Explain().IndexUsed())
+		expected = append(expected, db.Query("places").Where(criteria).Count())
+	}
+	require.Equal(t, 2, expected[2])
+	require.Equal(t, 2, expected[3])
+	require.Equal(t, 0, expected[4])
+	require.Equal(t, 0, expected[6])
+
+	for _, doc := range db.Query("places").Where(queries[0]).FindAll() {
+		p := doc.Get("location").(map[string]interface{})
+		require.LessOrEqual(t, rome.Distance(c.GeoPoint{Lat: p["lat"].(float64), Lon: p["lon"].(float64)}), 1000000.0)
+	}
+
+	require.NoError(t, db.CreateGeoIndex("places", "location"))
+	require.ErrorIs(t, db.CreateGeoIndex("places", "location"), c.ErrIndexExist)
+
+	check := func(db *c.DB) {
+		for i, criteria := range queries {
+			plan := db.Query("places").Where(criteria).Explain()
+			require.Equal(t, "location", plan.GeoIndexField)
+			require.GreaterOrEqual(t, plan.Candidates, expected[i])
+			require.Equal(t, expected[i], db.Query("places").Where(criteria).Count())
+		}
+	}
+	check(db)
+	require.Less(t, db.Query("places").Where(queries[0]).Explain().Candidates, 2000/4)
+
+	doc := db.Query("places").Where(queries[2]).FindFirst()
+	require.NoError(t, db.UpdateById("places", doc.ObjectId(), map[string]interface{}{"location": c.GeoPoint{Lat: 0, Lon: 0}}))
+	require.Equal(t, 1, db.Query("places").Where(queries[2]).Count())
+	require.NoError(t, db.UpdateById("places", doc.ObjectId(), map[string]interface{}{"location": c.GeoPoint{Lat: 10, Lon: 179.99}}))
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	check(db)
+	require.NoError(t, db.DropGeoIndex("places", "location"))
+	require.ErrorIs(t, db.DropGeoIndex("places", "location"), c.ErrIndexNotExist)
+	require.False(t, db.Query("places").Where(queries[0]).Explain().IndexUsed())
+}
+
+func TestCompoundIndex(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		err := copyCollection(db, "todos", "todos-temp")
+		require.NoError(t, err)
+
+		defer func() {
+			require.NoError(t, db.DropCollection("todos-temp"))
+		}()
+
+		queries := []*c.Criteria{
+			c.Field("userId").Eq(1),
+			c.Field("userId").Eq(1).And(c.Field("completed").Eq(true)),
+			c.Field("userId").Eq(2).And(c.Field("completed").Gt(false)),
+			c.Field("userId").Gt(5),
+			c.Field("userId").GtEq(5).And(c.Field("userId").Lt(8)),
+			c.Field("userId").LtEq(3),
+			c.Field("completed").Eq(true),
+			c.Field("userId").Eq(1).Or(c.Field("userId").Eq(2)),
+		}
+
+		expected := make([]int, 0, len(queries))
+		for _, criteria := range queries {
+			n := db.Query("todos-temp").Where(criteria).Count()
+			require.Nil(t, db.Query("todos-temp").Where(criteria).Explain().IndexFields)
+			expected = append(expected, n)
+		}
+
+		require.NoError(t, db.CreateIndex("todos-temp", "userId", "completed"))
+		err = db.CreateIndex("todos-temp", "userId", "completed")
+		require.ErrorIs(t, err, c.ErrIndexExist)
+		require.EqualError(t, err, "index already exist: userId,completed in collection todos-temp")
+		require.ErrorIs(t, db.CreateIndex("myCollection", "userId"), c.ErrCollectionNotExist)
+
+		for i, criteria := range queries {
+			q := db.Query("todos-temp").Where(criteria)
+			require.Equal(t, q.Count(), expected[i])
+
+			if i < 6 {
+				require.Equal(t, q.Explain().IndexFields, []string{"userId", "completed"})
+			} else {
+				require.Nil(t, q.Explain().IndexFields)
+			}
+		}
+
+		require.NoError(t, db.Query("todos-temp").Where(c.Field("userId").Eq(1)).Update(map[string]interface{}{"userId": 2}))
+		require.NoError(t, db.Query("todos-temp").Where(c.Field("userId").Eq(3)).Delete())
+
+		require.Equal(t, db.Query("todos-temp").Where(c.Field("userId").Eq(1)).Count(), 0)
+		require.Equal(t, db.Query("todos-temp").Where(c.Field("userId").Eq(3)).Count(), 0)
+		require.Equal(t, db.Query("todos-temp").Where(c.Field("userId").Eq(2)).Count(), expected[0]*2)
+		n := db.Query("todos-temp").MatchPredicate(func(doc *c.Document) bool {
+			return doc.Get("userId") == float64(2)
+		}).Count()
+		require.Equal(t, n, expected[0]*2)
+
+		require.NoError(t, db.DropIndex("todos-temp", "userId", "completed"))
+		require.ErrorIs(t, db.DropIndex("todos-temp", "userId", "completed"), c.ErrIndexNotExist)
+		require.Nil(t, db.Query("todos-temp").Where(c.Field("userId").Eq(2)).Explain().IndexFields)
+	})
+}
+
+func TestSingleFieldIndex(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("myCollection"))
+
+		values := []interface{}{nil, true, false, "a", "b", "ab", []interface{}{1}, map[string]interface{}{"a": 1}}
+		for i := 0; i < 50; i++ {
+			values = append(values, i, float64(i)+0.5)
+		}
+
+		docs := make([]*c.Document, 0, len(values)+1)
+		for _, v := range values {
+			doc := c.NewDocument()
+			doc.Set("value", v)
+			docs = append(docs, doc)
+		}
+		docs = append(docs, c.NewDocument())
+		require.NoError(t, db.Insert("myCollection", docs...))
+
+		queries := []*c.Criteria{
+			c.Field("value").Eq(10),
+			c.Field("value").Eq("a"),
+			c.Field("value").Eq(true),
+			c.Field("value").Gt(40),
+			c.Field("value").GtEq(40.5),
+			c.Field("value").Lt(3),
+			c.Field("value").LtEq(3),
+			c.Field("value").Gt(10).And(c.Field("value").Lt(20)),
+			c.Field("value").GtEq("a"),
+			c.Field("value").Lt("b"),
+			c.Field("value").Gt(false),
+		}
+
+		expected := make([]int, 0, len(queries))
+		for _, criteria := range queries {
+			expected = append(expected, db.Query("myCollection").Where(criteria).Count())
+		}
+
+		require.NoError(t, db.CreateIndex("myCollection", "value"))
+		require.ErrorIs(t, db.CreateIndex("myCollection"), c.ErrInvalidArgument)
+
+		for i, criteria := range queries {
+			q := db.Query("myCollection").Where(criteria)
+			require.Equal(t, []string{"value"}, q.Explain().IndexFields)
+			require.Equal(t, expected[i], q.Count())
+		}
+	})
+}
+
+func TestUniqueIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("users"))
+
+	newUser := func(email string) *c.Document {
+		doc := c.NewDocument()
+		if email != "" {
+			doc.Set("email", email)
+		}
+		return doc
+	}
+
+	require.NoError(t, db.Insert("users", newUser("a@clover.db"), newUser("b@clover.db"), newUser(""), newUser("")))
+	require.NoError(t, db.CreateUniqueIndex("users", "email"))
+
+	err = db.Insert("users", newUser("c@clover.db"), newUser("a@clover.db"))
+	require.ErrorIs(t, err, c.ErrDuplicateKey)
+	require.Contains(t, err.Error(), "email")
+	require.Equal(t, 4, db.Query("users").Count())
+
+	require.NoError(t, db.Insert("users", newUser("c@clover.db"), newUser("")))
+
+	err = db.Query("users").Where(c.Field("email").Eq("b@clover.db")).Update(map[string]interface{}{"email": "c@clover.db"})
+	require.ErrorIs(t, err, c.ErrDuplicateKey)
+	require.Equal(t, 1, db.Query("users").Where(c.Field("email").Eq("b@clover.db")).Count())
+
+	require.NoError(t, db.Query("users").Where(c.Field("email").Eq("c@clover.db")).Delete())
+	require.NoError(t, db.Query("users").Where(c.Field("email").Eq("b@clover.db")).Update(map[string]interface{}{"email": "c@clover.db"}))
+
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	require.ErrorIs(t, db.Insert("users", newUser("c@clover.db")), c.ErrDuplicateKey)
+
+	require.NoError(t, db.CreateCollection("others"))
+	require.NoError(t, db.Insert("others", newUser("a@clover.db"), newUser("a@clover.db")))
+	require.ErrorIs(t, db.CreateUniqueIndex("others", "email"), c.ErrDuplicateKey)
+	require.Nil(t, db.Query("others").Where(c.Field("email").Eq("a@clover.db")).Explain().IndexFields)
+}
+
+func TestTransactions(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("accounts"))
+		require.NoError(t, db.CreateCollection("transfers"))
+
+		for _, name := range []string{"alice", "bob"} {
+			doc := c.NewDocument()
+			doc.Set("balance", 100)
+			require.NoError(t, db.InsertWithId("accounts", name, doc))
+		}
+
+		transfer := func(tx *c.Tx, from, to string, amount float64) error {
+			fromDoc := tx.Query("accounts").FindById(from)
+			if fromDoc.Get("balance").(float64) < amount {
+				return errors.New("insufficient balance")
+			}
+			toDoc := tx.Query("accounts").FindById(to)
+
+			if err := tx.Query("accounts").Where(c.Field("_id").Eq(from)).Update(map[string]interface{}{"balance": fromDoc.Get("balance").(float64) - amount}); err != nil {
+				return err
+			}
+			if err := tx.Query("accounts").Where(c.Field("_id").Eq(to)).Update(map[string]interface{}{"balance": toDoc.Get("balance").(float64) + amount}); err != nil {
+				return err
+			}
+
+			doc := c.NewDocument()
+			doc.Set("from", from)
+			doc.Set("to", to)
+			doc.Set("amount", amount)
+			return tx.Insert("transfers", doc)
+		}
+
+		balance := func(name string) interface{} {
+			return db.Query("accounts").FindById(name).Get("balance")
+		}
+
+		require.NoError(t, db.Tx(func(tx *c.Tx) error {
+			return transfer(tx, "alice", "bob", 30)
+		}))
+		require.Equal(t, float64(70), balance("alice"))
+		require.Equal(t, float64(130), balance("bob"))
+		require.Equal(t, 1, db.Query("transfers").Count())
+
+		err := db.Tx(func(tx *c.Tx) error {
+			require.NoError(t, transfer(tx, "alice", "bob", 50))
+			require.Equal(t, float64(20), tx.Query("accounts").FindById("alice").Get("balance"))
+			require.Equal(t, 2, tx.Query("transfers").Count())
+			return transfer(tx, "alice", "bob", 50)
+		})
+		require.Error(t, err)
+		require.Equal(t, float64(70), balance("alice"))
+		require.Equal(t, 1, db.Query("transfers").Count())
+
+		tx := db.Begin()
+		require.NoError(t, transfer(tx, "bob", "alice", 10))
+		require.Equal(t, float64(130), balance("bob"))
+		require.NoError(t, tx.Query("transfers").Delete())
+		require.Equal(t, 1, db.Query("transfers").Count())
+		require.NoError(t, tx.Commit())
+		require.Equal(t, float64(120), balance("bob"))
+		require.Equal(t, 0, db.Query("transfers").Count())
+		require.ErrorIs(t, tx.Commit(), c.ErrTxDone)
+		require.ErrorIs(t, tx.Insert("transfers", c.NewDocument()), c.ErrTxDone)
+
+		tx = db.Begin()
+		require.NoError(t, transfer(tx, "bob", "alice", 10))
+		require.NoError(t, db.Insert("transfers", c.NewDocument()))
+		require.ErrorIs(t, tx.Commit(), c.ErrConflict)
+		require.Equal(t, float64(120), balance("bob"))
+
+		tx = db.Begin()
+		require.NoError(t, transfer(tx, "bob", "alice", 10))
+		tx.Rollback()
+		require.ErrorIs(t, tx.Commit(), c.ErrTxDone)
+		require.Equal(t, float64(120), balance("bob"))
+		require.Nil(t, tx.Query("myCollection"))
+	})
+}
+
+func TestExportQuery(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		q := db.Query("todos").Where(c.Field("userId").Eq(1)).Sort(c.SortOption{Field: "id", Direction: -1}).Limit(5)
+
+		buf := &bytes.Buffer{}
+		require.NoError(t, q.ExportJSON(buf))
+
+		rows := make([]map[string]interface{}, 0)
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &rows))
+
+		docs := q.FindAll()
+		require.Len(t, rows, len(docs))
+		for i, row := range rows {
+			require.Equal(t, docs[i].ObjectId(), row["_id"])
+		}
+
+		buf.Reset()
+		require.NoError(t, db.Query("todos").Where(c.Field("userId").Eq(-1)).ExportJSON(buf))
+		require.Equal(t, "[]\n", buf.String())
+
+		buf.Reset()
+		projected := q.Select("id", "title").Map(func(doc *c.Document) *c.Document {
+			doc.Set("meta.user", 1)
+			return doc
+		})
+		require.NoError(t, projected.ExportCSV(buf))
+
+		records, err := csv.NewReader(buf).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, len(docs)+1)
+		require.Equal(t, []string{"id", "meta.user", "title"}, records[0])
+		for i, doc := range docs {
+			require.Equal(t, []string{strconv.Itoa(int(doc.Get("id").(float64))), "1", doc.Get("title").(string)}, records[i+1])
+		}
+
+		buf.Reset()
+		require.NoError(t, q.ExportCSV(buf, "title", "completed_date", "missing"))
+
+		records, err = csv.NewReader(buf).ReadAll()
+		require.NoError(t, err)
+		require.Equal(t, []string{"title", "completed_date", "missing"}, records[0])
+		require.Equal(t, []string{docs[0].Get("title").(string), "", ""}, records[1])
+	})
+}
+
+type mapStorage struct {
+	snapshots map[string][]byte
+	synced    map[string]bool
+	failSave  bool
+}
+
+func (s *mapStorage) List() ([]string, error) {
+	names := make([]string, 0, len(s.snapshots))
+	for name := range s.snapshots {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *mapStorage) Load(name string) ([]byte, error) {
+	data, ok := s.snapshots[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (s *mapStorage) Save(name string, data []byte, sync bool) error {
+	if s.failSave {
+		return errors.New("save failed")
+	}
+	s.snapshots[name] = data
+	s.synced[name] = sync
+	return nil
+}
+
+func (s *mapStorage) Delete(name string) error {
+	delete(s.snapshots, name)
+	return nil
+}
+
+func (s *mapStorage) Sync(names ...string) error {
+	for _, name := range names {
+		s.synced[name] = true
+	}
+	return nil
+}
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	isCompressed := func(name string) bool {
+		data, err := ioutil.ReadFile(dir + "/" + name + ".json")
+		require.NoError(t, err)
+		return bytes.HasPrefix(data, []byte{0x1f, 0x8b})
+	}
+
+	insertDocs := func(db *c.DB, name string) {
+		docs := make([]*c.Document, 0, 500)
+		for i := 0; i < 500; i++ {
+			doc := c.NewDocument()
+			doc.Set("n", i)
+			doc.Set("text", "a quite repetitive piece of text")
+			docs = append(docs, doc)
+		}
+		require.NoError(t, db.Insert(name, docs...))
+	}
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("plain"))
+	require.NoError(t, db.CreateCollection("compressed", c.WithCollectionCompression()))
+	insertDocs(db, "plain")
+	insertDocs(db, "compressed")
+
+	plainStats, err := db.CollectionStats("plain")
+	require.NoError(t, err)
+	compressedStats, err := db.CollectionStats("compressed")
+	require.NoError(t, err)
+	require.Less(t, compressedStats.Size*3, plainStats.Size)
+	require.False(t, isCompressed("plain"))
+	require.True(t, isCompressed("compressed"))
+	require.NoError(t, db.Close())
+
+	// the setting of the collection is persisted
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	require.Equal(t, 500, db.Query("compressed").Count())
+	require.NoError(t, db.Query("compressed").Where(c.Field("n").Lt(100)).Delete())
+	require.True(t, isCompressed("compressed"))
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir, c.WithCompression())
+	require.NoError(t, err)
+	require.Equal(t, 500, db.Query("plain").Count())
+	require.NoError(t, db.Query("plain").Where(c.Field("n").Lt(100)).Delete())
+	require.True(t, isCompressed("plain"))
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, 400, db.Query("plain").Count())
+	require.Equal(t, 400, db.Query("compressed").Where(c.Field("n").GtEq(100)).Count())
+}
+
+func TestSizeLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir, c.WithMaxDocumentSize(100), c.WithMaxCollectionSize(3))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.CreateCollection("myCollection"))
+
+	large := c.NewDocument()
+	large.Set("text", strings.Repeat("a", 100))
+	err = db.Insert("myCollection", c.NewDocument(), large)
+	require.ErrorIs(t, err, c.ErrDocumentTooLarge)
+	require.Equal(t, 0, db.Query("myCollection").Count())
+
+	doc := c.NewDocument()
+	doc.Set("text", "small")
+	id, err := db.InsertOne("myCollection", doc)
+	require.NoError(t, err)
+
+	err = db.UpdateById("myCollection", id, map[string]interface{}{"text": strings.Repeat("a", 100)})
+	require.ErrorIs(t, err, c.ErrDocumentTooLarge)
+	require.Equal(t, "small", db.Query("myCollection").FindById(id).Get("text"))
+
+	require.NoError(t, db.Insert("myCollection", c.NewDocument(), c.NewDocument()))
+	err = db.Insert("myCollection", c.NewDocument())
+	require.ErrorIs(t, err, c.ErrCollectionFull)
+	require.Contains(t, err.Error(), "myCollection")
+	require.Equal(t, 3, db.Query("myCollection").Count())
+
+	// replacing documents doesn't grow the collection
+	require.NoError(t, db.Query("myCollection").Update(map[string]interface{}{"n": 1}))
+	require.NoError(t, db.DeleteById("myCollection", id))
+	require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+}
+
+func TestFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir, c.WithFileMode(0640), c.WithWriteAheadLog())
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("items"))
+	require.NoError(t, db.Checkpoint())
+	require.NoError(t, db.Close())
+
+	for _, filename := range []string{"items.json", "clover.wal"} {
+		info, err := os.Stat(dir + "/" + filename)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0640), info.Mode().Perm(), filename)
+	}
+}
+
+type failingSyncStorage struct {
+	*mapStorage
+}
+
+func (s *failingSyncStorage) Sync(names ...string) error {
+	return errors.New("disk unavailable")
+}
+
+// lockedBuffer is a bytes.Buffer which can be written by background goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+	out := &lockedBuffer{}
+	storage := &failingSyncStorage{&mapStorage{snapshots: make(map[string][]byte), synced: make(map[string]bool)}}
+
+	db, err := c.Open("", c.WithStorage(storage), c.WithSyncMode(c.SyncBatch), c.WithSyncInterval(time.Millisecond),
+		c.WithLogger(log.New(out, "", 0)))
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("items"))
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(out.String(), "clover: sync failed: disk unavailable")
+	}, time.Second, time.Millisecond)
+	require.Error(t, db.Close())
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = c.OpenReadOnly(dir + "/missing")
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + "/missing")
+	require.True(t, os.IsNotExist(err))
+
+	db, err := c.Open(dir, c.WithWriteAheadLog(), c.WithCheckpointWrites(100))
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("items"))
+	id, err := db.InsertOne("items", c.NewDocumentOf(map[string]interface{}{"n": 1}))
+	require.NoError(t, err)
+
+	// the last write is only stored in the log, which is read without being checkpointed
+	roDb, err := c.OpenReadOnly(dir, c.WithWriteAheadLog(), c.WithNoDirectoryLock())
+	require.NoError(t, err)
+	require.Equal(t, 1, roDb.Query("items").Count())
+
+	require.ErrorIs(t, roDb.CreateCollection("other"), c.ErrReadOnly)
+	require.False(t, roDb.HasCollection("other"))
+	require.NotContains(t, roDb.ListCollections(), "other")
+	require.ErrorIs(t, roDb.Insert("items", c.NewDocument()), c.ErrReadOnly)
+	require.ErrorIs(t, roDb.UpdateById("items", id, map[string]interface{}{"n": 2}), c.ErrReadOnly)
+	require.ErrorIs(t, roDb.Query("items").Delete(), c.ErrReadOnly)
+	require.ErrorIs(t, roDb.DropCollection("items"), c.ErrReadOnly)
+	require.ErrorIs(t, roDb.CreateIndex("items", "n"), c.ErrReadOnly)
+	require.ErrorIs(t, roDb.Compact("items"), c.ErrReadOnly)
+	require.ErrorIs(t, roDb.Tx(func(tx *c.Tx) error {
+		return tx.Insert("items", c.NewDocument())
+	}), c.ErrReadOnly)
+	require.NoError(t, roDb.Tx(func(tx *c.Tx) error {
+		require.Equal(t, 1, tx.Query("items").Count())
+		return nil
+	}))
+	require.NoError(t, roDb.Close())
+
+	info, err := os.Stat(dir + "/clover.wal")
+	require.NoError(t, err)
+	require.NotZero(t, info.Size())
+
+	require.NoError(t, db.Close())
+}
+
+func TestHooks(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		errProtected := errors.New("protected document")
+		history := make([]string, 0)
+
+		hooks := c.Hooks{
+			BeforeInsert: func(doc *c.Document) error {
+				doc.Set("version", 1)
+				return nil
+			},
+			BeforeUpdate: func(doc *c.Document) error {
+				doc.Set("version", doc.Get("version").(float64)+1)
+				return nil
+			},
+			BeforeDelete: func(doc *c.Document) error {
+				if doc.Get("protected") == true {
+					return errProtected
+				}
+				return nil
+			},
+			AfterInsert: func(doc *c.Document) { history = append(history, "insert "+doc.Get("name").(string)) },
+			AfterUpdate: func(doc *c.Document) { history = append(history, "update "+doc.Get("name").(string)) },
+			AfterDelete: func(doc *c.Document) { history = append(history, "delete "+doc.Get("name").(string)) },
+		}
+		require.NoError(t, db.CreateCollection("items", c.WithHooks(hooks)))
+		require.NoError(t, db.CreateIndex("items", "version"))
+
+		id, err := db.InsertOne("items", c.NewDocumentOf(map[string]interface{}{"name": "a"}))
+		require.NoError(t, err)
+		require.NoError(t, db.Insert("items", c.NewDocumentOf(map[string]interface{}{"name": "b", "protected": true})))
+
+		doc, err := db.FindById("items", id)
+		require.NoError(t, err)
+		require.Equal(t, float64(1), doc.Get("version"))
+
+		require.NoError(t, db.UpdateById("items", id, map[string]interface{}{"name": "c"}))
+		doc, err = db.FindById("items", id)
+		require.NoError(t, err)
+		require.Equal(t, float64(2), doc.Get("version"))
+
+		// documents modified by hooks are indexed
+		require.Equal(t, 1, db.Query("items").Where(c.Field("version").Eq(2)).Count())
+		require.Equal(t, []string{"version"}, db.Query("items").Where(c.Field("version").Eq(2)).Explain().IndexFields)
+
+		require.ErrorIs(t, db.Query("items").Delete(), errProtected)
+		require.Equal(t, 2, db.Query("items").Count())
+
+		require.NoError(t, db.Tx(func(tx *c.Tx) error {
+			return tx.Query("items").Where(c.Field("protected").Eq(true).Not()).Delete()
+		}))
+		require.Equal(t, []string{"insert a", "insert b", "update c", "delete c"}, history)
+
+		require.NoError(t, db.SetHooks("items", c.Hooks{
+			BeforeInsert: func(doc *c.Document) error {
+				doc.Set("_id", "other")
+				return nil
+			},
+		}))
+		require.ErrorIs(t, db.Insert("items", c.NewDocument()), c.ErrInvalidArgument)
+		require.ErrorIs(t, db.SetHooks("missing", c.Hooks{}), c.ErrCollectionNotExist)
+	})
+}
+
+func TestAfterHooksWriteToDatabase(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("audit"))
+
+		record := func(op string) func(doc *c.Document) {
+			return func(doc *c.Document) {
+				require.NoError(t, db.Insert("audit", c.NewDocumentOf(map[string]interface{}{"op": op, "item": doc.ObjectId()})))
+			}
+		}
+		hooks := c.Hooks{AfterInsert: record("insert"), AfterUpdate: record("update"), AfterDelete: record("delete")}
+		require.NoError(t, db.CreateCollection("items", c.WithHooks(hooks)))
+
+		id, err := db.InsertOne("items", c.NewDocumentOf(map[string]interface{}{"name": "a"}))
+		require.NoError(t, err)
+		require.NoError(t, db.Tx(func(tx *c.Tx) error {
+			return tx.Query("items").Where(c.Field("_id").Eq(id)).Update(map[string]interface{}{"name": "b"})
+		}))
+		require.NoError(t, db.DeleteById("items", id))
+
+		require.Equal(t, 3, db.Query("audit").Where(c.Field("item").Eq(id)).Count())
+		require.Equal(t, 1, db.Query("audit").Where(c.Field("op").Eq("update")).Count())
+	})
+}
+
+func TestTimeComparisonsWithoutCodec(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("events"))
+
+		base := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		times := []time.Time{
+			base,
+			base.Add(500 * time.Millisecond),
+			base.Add(time.Hour).In(time.FixedZone("UTC+3", 3*3600)),
+		}
+		for i, tm := range times {
+			require.NoError(t, db.Insert("events", c.NewDocumentOf(map[string]interface{}{"n": i, "at": tm})))
+		}
+
+		// as strings, "12:00:00.5Z" < "12:00:00Z" and "16:00:00+03:00" > "13:00:00Z"
+		require.Equal(t, 2, db.Query("events").Where(c.Field("at").Gt(base)).Count())
+		require.Equal(t, 3, db.Query("events").Where(c.Field("at").GtEq(base)).Count())
+		require.Equal(t, 2, db.Query("events").Where(c.Field("at").Lt(base.Add(time.Second))).Count())
+		require.Equal(t, 3, db.Query("events").Where(c.Field("at").LtEq(base.Add(time.Hour))).Count())
+		require.Equal(t, 1, db.Query("events").Where(c.Field("at").Eq(base.Add(time.Hour))).Count())
+
+		doc := db.Query("events").Where(c.Field("n").Eq(2)).FindFirst()
+		at, ok := doc.GetTime("at")
+		require.True(t, ok)
+		require.True(t, at.Equal(times[2]))
+
+		_, ok = doc.GetTime("n")
+		require.False(t, ok)
+	})
+}
+
+func TestNumericGetters(t *testing.T) {
+	for _, opts := range [][]c.Option{nil, {c.WithPreserveIntegers()}} {
+		db, err := c.OpenInMemory(opts...)
+		require.NoError(t, err)
+		require.NoError(t, db.CreateCollection("items"))
+
+		id, err := db.InsertOne("items", c.NewDocumentOf(map[string]interface{}{"id": 7, "ratio": 0.5, "name": "x"}))
+		require.NoError(t, err)
+
+		doc, err := db.FindById("items", id)
+		require.NoError(t, err)
+
+		n, ok := doc.GetInt("id")
+		require.True(t, ok)
+		require.Equal(t, int64(7), n)
+
+		_, ok = doc.GetInt("ratio")
+		require.False(t, ok)
+		_, ok = doc.GetInt("name")
+		require.False(t, ok)
+
+		f, ok := doc.GetFloat("id")
+		require.True(t, ok)
+		require.Equal(t, float64(7), f)
+
+		f, ok = doc.GetFloat("ratio")
+		require.True(t, ok)
+		require.Equal(t, 0.5, f)
+
+		_, ok = doc.GetFloat("missing")
+		require.False(t, ok)
+
+		require.Equal(t, 1, db.Query("items").Where(c.Field("id").Eq(int64(7))).Count())
+		require.Equal(t, 1, db.Query("items").Where(c.Field("id").Eq(7.0)).Count())
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestExportAndImportCollection(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		dir, err := ioutil.TempDir("", "clover-export")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		path := dir + "/todos.json"
+		require.NoError(t, db.ExportCollection("todos", path))
+		require.ErrorIs(t, db.ExportCollection("myCollection", path+".bak"), c.ErrCollectionNotExist)
+
+		other, err := c.Open(dir + "/db")
+		require.NoError(t, err)
+		require.NoError(t, other.ImportCollection("todos", path))
+
+		expected := db.Query("todos").Sort().FindAll()
+		imported := other.Query("todos").Sort().FindAll()
+		require.Len(t, imported, len(expected))
+		for i := range expected {
+			require.Equal(t, expected[i].ObjectId(), imported[i].ObjectId())
+			require.Equal(t, expected[i].Get("title"), imported[i].Get("title"))
+			require.Equal(t, expected[i].Get("userId"), imported[i].Get("userId"))
+		}
+
+		require.ErrorIs(t, other.ImportCollection("todos", path), c.ErrDuplicateKey)
+		require.Equal(t, len(expected), other.Query("todos").Count())
+
+		require.NoError(t, ioutil.WriteFile(dir+"/invalid.json", []byte(`{"rows": []}`), 0666))
+		require.ErrorIs(t, other.ImportCollection("invalid", dir+"/invalid.json"), c.ErrInvalidArgument)
+		require.Error(t, other.ImportCollection("invalid", dir+"/missing.json"))
+		require.False(t, other.HasCollection("invalid"))
+	})
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the database is never closed, to simulate a crash, so it must not keep the directory locked
+	db, err := c.Open(dir, c.WithWriteAheadLog(), c.WithCheckpointWrites(100), c.WithNoDirectoryLock())
+	require.NoError(t, err)
+
+	require.NoError(t, db.CreateCollection("todos"))
+	require.NoError(t, db.CreateCollection("tmp"))
+	require.NoError(t, db.CreateIndex("todos", "priority"))
+	for i := 0; i < 10; i++ {
+		_, err := db.InsertOne("todos", c.NewDocumentOf(map[string]interface{}{"priority": i, "done": false}))
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Query("todos").Where(c.Field("priority").Lt(3)).Update(map[string]interface{}{"done": true}))
+	require.NoError(t, db.Query("todos").Where(c.Field("priority").GtEq(8)).Delete())
+	require.NoError(t, db.DropCollection("tmp"))
+
+	require.NoError(t, db.Tx(func(tx *c.Tx) error {
+		return tx.Query("todos").Where(c.Field("priority").Eq(5)).Delete()
+	}))
+
+	// writes are only recorded in the log until the next checkpoint
+	_, err = os.Stat(dir + "/todos.json")
+	require.True(t, os.IsNotExist(err))
+
+	// simulate a crash, leaving a partially written record at the end of the log
+	file, err := os.OpenFile(dir+"/clover.wal", os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.WriteString(`1234abcd {"collections": [{"name": "todos", "res`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	check := func(db *c.DB) {
+		require.True(t, db.HasCollection("todos"))
+		require.False(t, db.HasCollection("tmp"))
+		require.Equal(t, 7, db.Query("todos").Count())
+		require.Equal(t, 3, db.Query("todos").Where(c.Field("done").Eq(true)).Count())
+		require.Equal(t, []string{"priority"}, db.Query("todos").Where(c.Field("priority").Eq(1)).Explain().IndexFields)
+	}
+
+	db, err = c.Open(dir, c.WithWriteAheadLog())
+	require.NoError(t, err)
+	check(db)
+
+	// the log has been checkpointed when the database was opened
+	_, err = db.InsertOne("todos", c.NewDocumentOf(map[string]interface{}{"priority": 20}))
+	require.NoError(t, err)
+	require.NoError(t, db.Query("todos").Where(c.Field("priority").Eq(20)).Delete())
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	check(db)
+
+	_, err = c.OpenInMemory(c.WithWriteAheadLog())
+	require.ErrorIs(t, err, c.ErrInvalidArgument)
+}
+
+func TestWriteAheadLogCorruptedCollection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir, c.WithWriteAheadLog(), c.WithNoDirectoryLock())
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("items"))
+	require.NoError(t, db.Insert("items", c.NewDocument(), c.NewDocument()))
+	require.NoError(t, db.Checkpoint())
+
+	// the last insert is only recorded in the log when the collection is damaged (and the database crashes)
+	require.NoError(t, db.Insert("items", c.NewDocument()))
+	data, err := ioutil.ReadFile(dir + "/items.json")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(dir+"/items.json", data[:len(data)/2], 0666))
+
+	db, err = c.Open(dir, c.WithWriteAheadLog())
+	require.NoError(t, err)
+	require.Contains(t, db.CorruptedCollections(), "items")
+	require.ErrorIs(t, db.Checkpoint(), c.ErrCorruptedCollection)
+	require.NoError(t, db.Close())
+
+	// the log is kept, so the damaged file can be fixed and the logged insert is replayed
+	require.NoError(t, ioutil.WriteFile(dir+"/items.json", data, 0666))
+	db, err = c.Open(dir, c.WithWriteAheadLog())
+	require.NoError(t, err)
+	require.Empty(t, db.CorruptedCollections())
+	require.Equal(t, 3, db.Query("items").Count())
+	require.NoError(t, db.Close())
+}
+
+func TestWriteAheadLogCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir, c.WithWriteAheadLog(), c.WithCheckpointWrites(3))
+	require.NoError(t, err)
+
+	require.NoError(t, db.CreateCollection("todos"))
+	_, err = db.InsertOne("todos", c.NewDocument())
+	require.NoError(t, err)
+
+	_, err = os.Stat(dir + "/todos.json")
+	require.True(t, os.IsNotExist(err))
+
+	_, err = db.InsertOne("todos", c.NewDocument())
+	require.NoError(t, err)
+
+	info, err := os.Stat(dir + "/clover.wal")
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	other, err := c.OpenReadOnly(dir, c.WithNoDirectoryLock())
+	require.NoError(t, err)
+	require.Equal(t, 2, other.Query("todos").Count())
+
+	_, err = db.InsertOne("todos", c.NewDocument())
+	require.NoError(t, err)
+	require.NoError(t, db.Checkpoint())
+
+	other, err = c.OpenReadOnly(dir, c.WithNoDirectoryLock())
+	require.NoError(t, err)
+	require.Equal(t, 3, other.Query("todos").Count())
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-concurrency")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("counters"))
+
+	const writers = 8
+	ids := make([]string, writers)
+	for i := range ids {
+		ids[i], err = db.InsertOne("counters", c.NewDocument())
+		require.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*2)
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+
+		// each writer updates a different document: writes to the same collection must not be lost
+		go func(id string) {
+			defer wg.Done()
+			for n := 1; n <= 20; n++ {
+				if err := db.Query("counters").Where(c.Field("_id").Eq(id)).Update(map[string]interface{}{"n": n}); err != nil {
+					errs <- err
+					return
+				}
+
+				if _, err := db.InsertOne("counters", c.NewDocumentOf(map[string]interface{}{"owner": id})); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(ids[i])
+
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				q := db.Query("counters")
+				if q.Count() != len(q.FindAll()) {
+					errs <- errors.New("inconsistent read")
+					return
+				}
+				db.HasCollection("counters")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	check := func(db *c.DB) {
+		require.Equal(t, writers*21, db.Query("counters").Count())
+		for _, id := range ids {
+			doc := db.Query("counters").FindById(id)
+			require.NotNil(t, doc)
+			require.Equal(t, float64(20), doc.Get("n"))
+			require.Equal(t, 20, db.Query("counters").Where(c.Field("owner").Eq(id)).Count())
+		}
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	check(db)
+}
+
+func TestUpsert(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("users"))
+
+		byEmail := func(email string) *c.Query {
+			return db.Query("users").Where(c.Field("email").Eq(email))
+		}
+
+		doc := c.NewDocumentOf(map[string]interface{}{"email": "alice@example.com", "name": "Alice", "visits": 1})
+		require.NoError(t, byEmail("alice@example.com").Upsert(doc))
+		require.Equal(t, 1, db.Query("users").Count())
+
+		inserted := byEmail("alice@example.com").FindFirst()
+		require.NotNil(t, inserted)
+		require.Equal(t, doc.ObjectId(), inserted.ObjectId())
+
+		update := c.NewDocumentOf(map[string]interface{}{"email": "alice@example.com", "visits": 2, "_id": "ignored"})
+		require.NoError(t, byEmail("alice@example.com").Upsert(update))
+		require.Equal(t, 1, db.Query("users").Count())
+
+		updated := byEmail("alice@example.com").FindFirst()
+		require.Equal(t, inserted.ObjectId(), updated.ObjectId())
+		require.Equal(t, "Alice", updated.Get("name"))
+		require.Equal(t, float64(2), updated.Get("visits"))
+
+		require.NoError(t, byEmail("bob@example.com").Upsert(c.NewDocumentOf(map[string]interface{}{"email": "bob@example.com"})))
+		require.Equal(t, 2, db.Query("users").Count())
+
+		require.NoError(t, db.CreateView("bobs", "users", c.Field("email").Eq("bob@example.com")))
+		require.ErrorIs(t, db.Query("bobs").Upsert(c.NewDocument()), c.ErrReadOnly)
+	})
+}
+
+func TestReplaceById(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("users"))
+		require.ErrorIs(t, db.ReplaceById("missing", "a", c.NewDocument()), c.ErrCollectionNotExist)
+
+		events, cancel := db.Watch("users")
+		defer cancel()
+
+		require.NoError(t, db.ReplaceById("users", "a", c.NewDocumentOf(map[string]interface{}{"name": "Alice", "age": 30})))
+		require.Equal(t, c.OpInsert, (<-events).Op)
+
+		require.NoError(t, db.ReplaceById("users", "a", c.NewDocumentOf(map[string]interface{}{"name": "Alicia", "_id": "a"})))
+		require.Equal(t, c.OpUpdate, (<-events).Op)
+
+		doc, err := db.FindById("users", "a")
+		require.NoError(t, err)
+		require.Equal(t, "Alicia", doc.Get("name"))
+		require.False(t, doc.Has("age"))
+		require.Equal(t, 1, db.Query("users").Count())
+
+		require.ErrorIs(t, db.ReplaceById("users", "a", c.NewDocumentOf(map[string]interface{}{"_id": "b"})), c.ErrInvalidArgument)
+		require.ErrorIs(t, db.ReplaceById("users", "", c.NewDocument()), c.ErrInvalidArgument)
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("orders"))
+
+		orders := []map[string]interface{}{
+			{"userId": 1, "amount": 10, "item": "b"},
+			{"userId": 1, "amount": 25.5, "item": "a"},
+			{"userId": 2, "amount": 7, "item": "c"},
+			{"userId": 2, "amount": "n/a"},
+			{"userId": 3},
+		}
+		for _, order := range orders {
+			_, err := db.InsertOne("orders", c.NewDocumentOf(order))
+			require.NoError(t, err)
+		}
+
+		groups := db.Query("orders").GroupBy("userId").Aggregate(
+			c.Count(), c.Sum("amount"), c.Avg("amount").As("mean"), c.Min("item"), c.Max("amount"))
+		require.Len(t, groups, 3)
+
+		require.Equal(t, float64(1), groups[0].Get("userId"))
+		require.Equal(t, float64(2), groups[0].Get("count"))
+		require.Equal(t, 35.5, groups[0].Get("sum_amount"))
+		require.Equal(t, 17.75, groups[0].Get("mean"))
+		require.Equal(t, "a", groups[0].Get("min_item"))
+		require.Equal(t, 25.5, groups[0].Get("max_amount"))
+
+		// strings are ordered after numbers, as when sorting
+		require.Equal(t, float64(2), groups[1].Get("count"))
+		require.Equal(t, float64(7), groups[1].Get("sum_amount"))
+		require.Equal(t, float64(7), groups[1].Get("mean"))
+		require.Equal(t, "n/a", groups[1].Get("max_amount"))
+
+		require.Equal(t, float64(1), groups[2].Get("count"))
+		require.Equal(t, float64(0), groups[2].Get("sum_amount"))
+		require.Nil(t, groups[2].Get("mean"))
+		require.True(t, groups[2].Has("min_item"))
+		require.Nil(t, groups[2].Get("min_item"))
+
+		filtered := db.Query("orders").Where(c.Field("amount").Gt(8)).GroupBy("userId").Aggregate(c.Count())
+		require.Len(t, filtered, 1)
+		require.Equal(t, float64(2), filtered[0].Get("count"))
+		require.Equal(t, db.Query("orders").Pipeline().Group("userId").Count(), db.Query("orders").GroupBy("userId").Aggregate(c.Count()))
+	})
+}
+
+func TestExclude(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("docs"))
+
+		doc := c.NewDocumentOf(map[string]interface{}{
+			"title": "a",
+			"body":  "long text",
+			"meta":  map[string]interface{}{"author": "bob", "tags": []interface{}{map[string]interface{}{"name": "x", "score": 1}}},
+		})
+		id, err := db.InsertOne("docs", doc)
+		require.NoError(t, err)
+
+		res := db.Query("docs").Exclude("body", "meta.author", "meta.tags.0.score", "missing", "meta.missing.field").FindFirst()
+		require.NotNil(t, res)
+		require.Equal(t, id, res.ObjectId())
+		require.Equal(t, "a", res.Get("title"))
+		require.False(t, res.Has("body"))
+		require.False(t, res.Has("meta.author"))
+		require.Equal(t, "x", res.Get("meta.tags.0.name"))
+		require.False(t, res.Has("meta.tags.0.score"))
+
+		// the stored document is not affected
+		stored, err := db.FindById("docs", id)
+		require.NoError(t, err)
+		require.Equal(t, "long text", stored.Get("body"))
+		require.Equal(t, "bob", stored.Get("meta.author"))
+		require.Equal(t, float64(1), stored.Get("meta.tags.0.score"))
+
+		res = db.Query("docs").Exclude("_id").FindFirst()
+		require.False(t, res.Has("_id"))
+		res.Set("title", "b")
+		require.Equal(t, "a", db.Query("docs").FindFirst().Get("title"))
+
+		res = db.Query("docs").Select("title", "body").Exclude("body").FindFirst()
+		require.Equal(t, "a", res.Get("title"))
+		require.False(t, res.Has("body"))
+		require.False(t, res.Has("_id"))
+	})
+}
+
+func TestExpiringDocuments(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("sessions"))
+
+		expired := c.NewDocument()
+		expired.SetExpiresAt(time.Now().Add(-time.Minute))
+		require.NoError(t, db.Insert("sessions", expired))
+
+		expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+		valid := c.NewDocument()
+		valid.SetExpiresAt(expiresAt)
+		require.NoError(t, db.Insert("sessions", valid, c.NewDocument()))
+
+		doc, err := db.FindById("sessions", valid.ObjectId())
+		require.NoError(t, err)
+		t1, ok := doc.ExpiresAt()
+		require.True(t, ok)
+		require.True(t, expiresAt.Equal(t1))
+
+		_, ok = c.NewDocument().ExpiresAt()
+		require.False(t, ok)
+
+		require.Equal(t, 3, db.Query("sessions").Count())
+		require.Equal(t, 2, db.Query("sessions").Where(c.NotExpired()).Count())
+
+		n, err := db.DeleteExpired()
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		require.Equal(t, 2, db.Query("sessions").Count())
+		require.Nil(t, db.Query("sessions").FindById(expired.ObjectId()))
+
+		n, err = db.DeleteExpired()
+		require.NoError(t, err)
+		require.Zero(t, n)
+	})
+}
+
+func TestExpirationJanitor(t *testing.T) {
+	db, err := c.OpenInMemory(c.WithExpirationInterval(10 * time.Millisecond))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.CreateCollection("cache"))
+
+	doc := c.NewDocument()
+	doc.SetExpiresAt(time.Now().Add(50 * time.Millisecond))
+	require.NoError(t, db.Insert("cache", doc, c.NewDocument()))
+
+	require.Eventually(t, func() bool {
+		return db.Query("cache").Count() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Nil(t, db.Query("cache").FindById(doc.ObjectId()))
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-compact")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir, c.WithWriteAheadLog())
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("todos"))
+
+	for i := 0; i < 20; i++ {
+		_, err := db.InsertOne("todos", c.NewDocumentOf(map[string]interface{}{"n": i}))
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Query("todos").Where(c.Field("n").GtEq(5)).Delete())
+
+	info, err := os.Stat(dir + "/clover.wal")
+	require.NoError(t, err)
+	require.NotZero(t, info.Size())
+
+	require.NoError(t, db.Compact("todos"))
+	require.ErrorIs(t, db.Compact("missing"), c.ErrCollectionNotExist)
+
+	info, err = os.Stat(dir + "/clover.wal")
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	other, err := c.OpenReadOnly(dir, c.WithNoDirectoryLock())
+	require.NoError(t, err)
+	require.Equal(t, 5, other.Query("todos").Count())
+
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("todos"))
+		require.NoError(t, db.Insert("todos", c.NewDocument()))
+		require.NoError(t, db.Compact("todos"))
+		require.Equal(t, 1, db.Query("todos").Count())
+	})
+}
+
+func TestWatchFunc(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("todos"))
+
+		received := make(chan c.ChangeEvent, 10)
+		cancel := db.WatchFunc("todos", func(event c.ChangeEvent) {
+			received <- event
+		})
+
+		id, err := db.InsertOne("todos", c.NewDocumentOf(map[string]interface{}{"title": "a"}))
+		require.NoError(t, err)
+		require.NoError(t, db.UpdateById("todos", id, map[string]interface{}{"title": "b"}))
+		require.NoError(t, db.DeleteById("todos", id))
+
+		for _, op := range []c.ChangeOp{c.OpInsert, c.OpUpdate, c.OpDelete} {
+			select {
+			case e := <-received:
+				require.Equal(t, op, e.Op)
+				require.Equal(t, id, e.Id)
+			case <-time.After(5 * time.Second):
+				require.Fail(t, "event not delivered")
+			}
+		}
+
+		cancel()
+		cancel()
+		require.NoError(t, db.Insert("todos", c.NewDocument()))
+
+		select {
+		case e := <-received:
+			require.Fail(t, "unexpected event", "%v", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestCollectionValidator(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		errNoEmail := errors.New("missing email")
+		validator := func(doc *c.Document) error {
+			if _, ok := doc.Get("email").(string); !ok {
+				return errNoEmail
+			}
+			return nil
+		}
+		require.NoError(t, db.CreateCollection("users", c.WithValidator(validator)))
+
+		id, err := db.InsertOne("users", c.NewDocumentOf(map[string]interface{}{"email": "alice@example.com"}))
+		require.NoError(t, err)
+
+		err = db.Insert("users", c.NewDocumentOf(map[string]interface{}{"email": "bob@example.com"}), c.NewDocumentOf(map[string]interface{}{"name": "eve"}))
+		require.ErrorIs(t, err, c.ErrInvalidDocument)
+		require.Contains(t, err.Error(), errNoEmail.Error())
+		require.Equal(t, 1, db.Query("users").Count())
+
+		require.ErrorIs(t, db.UpdateById("users", id, map[string]interface{}{"email": 1}), c.ErrInvalidDocument)
+		require.ErrorIs(t, db.Query("users").Update(map[string]interface{}{"email": nil}), c.ErrInvalidDocument)
+		require.ErrorIs(t, db.Tx(func(tx *c.Tx) error {
+			return tx.Insert("users", c.NewDocument())
+		}), c.ErrInvalidDocument)
+		require.NoError(t, db.UpdateById("users", id, map[string]interface{}{"name": "alice"}))
+		require.NoError(t, db.Query("users").Delete())
+
+		require.NoError(t, db.SetValidator("users", nil))
+		require.NoError(t, db.Insert("users", c.NewDocument()))
+		require.ErrorIs(t, db.SetValidator("missing", validator), c.ErrCollectionNotExist)
+
+		// existing documents are not validated, but they can't be modified into invalid documents
+		require.NoError(t, db.SetValidator("users", validator))
+		require.Equal(t, 1, db.Query("users").Count())
+		require.NoError(t, db.Insert("users", c.NewDocumentOf(map[string]interface{}{"email": "carl@example.com"})))
+	})
+}
+
+func TestCollectionIDGenerator(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		n := 0
+		sequence := func() string {
+			n++
+			return "user-" + strconv.Itoa(n)
+		}
+		require.NoError(t, db.CreateCollection("users", c.WithCollectionIDGenerator(sequence)))
+		require.NoError(t, db.CreateCollection("other"))
+
+		id, err := db.InsertOne("users", c.NewDocument())
+		require.NoError(t, err)
+		require.Equal(t, "user-1", id)
+
+		doc := c.NewDocument()
+		doc.Set("_id", "custom")
+		id, err = db.InsertOne("users", doc)
+		require.NoError(t, err)
+		require.Equal(t, "custom", id)
+
+		id, err = db.InsertOne("other", c.NewDocument())
+		require.NoError(t, err)
+		require.NotContains(t, id, "user-")
+
+		require.NoError(t, db.SetIDGenerator("users", nil))
+		id, err = db.InsertOne("users", c.NewDocument())
+		require.NoError(t, err)
+		require.NotContains(t, id, "user-")
+		require.ErrorIs(t, db.SetIDGenerator("missing", sequence), c.ErrCollectionNotExist)
+	})
+}
+
+func TestCountWithSkipAndLimit(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		total := db.Query("todos").Count()
+		completed := db.Query("todos").Where(c.Field("completed").Eq(true)).Count()
+		require.Equal(t, len(db.Query("todos").FindAll()), total)
+
+		require.Equal(t, 10, db.Query("todos").Limit(10).Count())
+		require.Equal(t, total-5, db.Query("todos").Skip(5).Count())
+		require.Equal(t, 0, db.Query("todos").Skip(total+1).Count())
+		require.Equal(t, 0, db.Query("todos").Limit(0).Count())
+		require.Equal(t, 3, db.Query("todos").Sort(c.SortOption{Field: "title"}).Skip(total-3).Limit(10).Count())
+
+		q := db.Query("todos").Where(c.Field("completed").Eq(true))
+		require.Equal(t, len(q.Skip(2).Limit(5).FindAll()), q.Skip(2).Limit(5).Count())
+		require.Equal(t, completed-2, q.Skip(2).Count())
+		require.Equal(t, 1, q.Skip(completed-1).Limit(5).Count())
+
+		// skip+limit overflows
+		maxInt := int(^uint(0) >> 1)
+		require.Equal(t, completed-1, q.Skip(1).Limit(maxInt).Count())
+	})
+}
+
+func TestInsertBatch(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("items"))
+		require.ErrorIs(t, db.InsertBatch("items", 0, c.NewDocument()), c.ErrInvalidArgument)
+
+		docs := make([]*c.Document, 0, 25)
+		for i := 0; i < 25; i++ {
+			docs = append(docs, c.NewDocumentOf(map[string]interface{}{"n": i}))
+		}
+		require.NoError(t, db.InsertBatch("items", 10, docs...))
+		require.Equal(t, 25, db.Query("items").Count())
+
+		// batches which precede a failing one are kept
+		dup := c.NewDocument()
+		dup.Set("_id", docs[0].ObjectId())
+		err := db.InsertBatch("items", 2, c.NewDocument(), c.NewDocument(), dup, c.NewDocument())
+		require.ErrorIs(t, err, c.ErrDuplicateKey)
+		require.Equal(t, 27, db.Query("items").Count())
+
+		require.ErrorIs(t, db.InsertBatch("missing", 10, c.NewDocument()), c.ErrCollectionNotExist)
+	})
+}
+
+func TestTextIndex(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("articles"))
+
+		bodies := []string{
+			"Go is an open source programming language.",
+			"The Go gopher: a mascot for the Go language!",
+			"Rust is a systems programming language.",
+			"Gardening tips for the spring",
+		}
+		for i, body := range bodies {
+			doc := c.NewDocumentOf(map[string]interface{}{"n": i, "body": body})
+			require.NoError(t, db.Insert("articles", doc))
+		}
+
+		search := func() *c.Query {
+			return db.Query("articles").Where(c.Field("body").Search("GO language"))
+		}
+
+		require.Equal(t, 2, search().Count())
+		require.Empty(t, search().Explain().TextIndexField)
+
+		require.NoError(t, db.CreateTextIndex("articles", "body"))
+		require.ErrorIs(t, db.CreateTextIndex("articles", "body"), c.ErrIndexExist)
+		require.ErrorIs(t, db.CreateTextIndex("missing", "body"), c.ErrCollectionNotExist)
+		require.Equal(t, "body", search().Explain().TextIndexField)
+		require.Equal(t, 2, search().Count())
+
+		// the document repeating the searched words is the most relevant one
+		docs := search().SortByScore().FindAll()
+		require.Len(t, docs, 2)
+		require.Equal(t, float64(1), docs[0].Get("n"))
+
+		require.Equal(t, 0, db.Query("articles").Where(c.Field("body").Search("  ")).Count())
+		require.Equal(t, 2, db.Query("articles").Where(c.Field("body").Search("programming")).Count())
+
+		// the index is kept up to date by writes, and restored when the database is reopened
+		require.NoError(t, db.Query("articles").Where(c.Field("n").Eq(0)).Update(map[string]interface{}{"body": "gardening"}))
+		require.NoError(t, db.Insert("articles", c.NewDocumentOf(map[string]interface{}{"n": 4, "body": "language of Go"})))
+		require.Equal(t, 2, search().Count())
+		require.Equal(t, 2, db.Query("articles").Where(c.Field("body").Search("gardening")).Count())
+
+		snapshot, err := db.Snapshot()
+		require.NoError(t, err)
+		require.NoError(t, db.Query("articles").Delete())
+		require.Equal(t, 0, search().Count())
+		require.Equal(t, 2, snapshot.Query("articles").Where(c.Field("body").Search("go language")).Count())
+
+		require.NoError(t, db.DropTextIndex("articles", "body"))
+		require.ErrorIs(t, db.DropTextIndex("articles", "body"), c.ErrIndexNotExist)
+	})
+}
+
+func TestTextIndexReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("articles"))
+	require.NoError(t, db.CreateTextIndex("articles", "tags"))
+	require.NoError(t, db.Insert("articles", c.NewDocumentOf(map[string]interface{}{"tags": []string{"Go", "db"}})))
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	q := db.Query("articles").Where(c.Field("tags").Search("go"))
+	require.Equal(t, "tags", q.Explain().TextIndexField)
+	require.Equal(t, 1, q.Count())
+}
+
+func TestUpdateOperators(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("items"))
+		id, err := db.InsertOne("items", c.NewDocumentOf(map[string]interface{}{
+			"counter": 1,
+			"name":    "item",
+			"tags":    []string{"a", "b", "a"},
+			"nested":  map[string]interface{}{"x": 1, "y": 2},
+		}))
+		require.NoError(t, err)
+
+		q := db.Query("items").Where(c.Field("_id").Eq(id))
+		require.NoError(t, q.UpdateWith(
+			c.Inc("counter", 2),
+			c.Inc("nested.z", 0.5),
+			c.Push("tags", "c"),
+			c.Push("other", "x", "y"),
+			c.Pull("tags", "a"),
+			c.Pull("missing", "a"),
+			c.Unset("nested.y"),
+			c.Unset("name"),
+		))
+
+		doc, err := db.FindById("items", id)
+		require.NoError(t, err)
+		require.Equal(t, float64(3), doc.Get("counter"))
+		require.Equal(t, 0.5, doc.Get("nested.z"))
+		require.Equal(t, []interface{}{"b", "c"}, doc.Get("tags"))
+		require.Equal(t, []interface{}{"x", "y"}, doc.Get("other"))
+		require.False(t, doc.Has("nested.y"))
+		require.True(t, doc.Has("nested.x"))
+		require.False(t, doc.Has("name"))
+		require.False(t, doc.Has("missing"))
+
+		// a failing operation leaves all the documents untouched
+		require.ErrorIs(t, q.UpdateWith(c.Inc("counter", 1), c.Inc("tags", 1)), c.ErrInvalidArgument)
+		require.ErrorIs(t, q.UpdateWith(c.Push("counter", 1)), c.ErrInvalidArgument)
+		require.ErrorIs(t, q.UpdateWith(c.Pull("counter", 1)), c.ErrInvalidArgument)
+		require.ErrorIs(t, q.UpdateWith(c.Inc("counter", "1")), c.ErrInvalidArgument)
+		require.ErrorIs(t, q.UpdateWith(c.Unset("_id")), c.ErrInvalidArgument)
+		doc, err = db.FindById("items", id)
+		require.NoError(t, err)
+		require.Equal(t, float64(3), doc.Get("counter"))
+
+		// increments are applied atomically
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					require.NoError(t, db.Query("items").UpdateWith(c.Inc("counter", 1)))
+				}
+			}()
+		}
+		wg.Wait()
+
+		doc, err = db.FindById("items", id)
+		require.NoError(t, err)
+		require.Equal(t, float64(103), doc.Get("counter"))
+	})
+}
+
+func TestCustomStorage(t *testing.T) {
+	storage := &mapStorage{snapshots: make(map[string][]byte), synced: make(map[string]bool)}
+
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(dir))
+
+	db, err := c.Open(dir, c.WithStorage(storage))
+	require.NoError(t, err)
+
+	require.NoError(t, db.CreateCollection("myCollection"))
+	doc := c.NewDocument()
+	doc.Set("hello", "clover")
+	docId, err := db.InsertOne("myCollection", doc)
+	require.NoError(t, err)
+
+	require.Contains(t, storage.snapshots, "myCollection")
+	require.False(t, storage.synced["myCollection"])
+	require.NoError(t, db.Close())
+	require.True(t, storage.synced["myCollection"])
+
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+
+	db, err = c.Open(dir, c.WithStorage(storage))
+	require.NoError(t, err)
+	require.True(t, db.HasCollection("myCollection"))
+	require.Equal(t, "clover", db.Query("myCollection").FindById(docId).Get("hello"))
+
+	storage.failSave = true
+	_, err = db.InsertOne("myCollection", c.NewDocument())
+	require.Error(t, err)
+	require.Equal(t, 1, db.Query("myCollection").Count())
+
+	storage.failSave = false
+	require.NoError(t, db.DropCollection("myCollection"))
+	require.Empty(t, storage.snapshots)
+}
+
+type closableStorage struct {
+	*mapStorage
+	closed int
+}
+
+func (s *closableStorage) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestClosableStorage(t *testing.T) {
+	storage := &closableStorage{mapStorage: &mapStorage{snapshots: make(map[string][]byte), synced: make(map[string]bool)}}
+
+	db, err := c.Open("", c.WithStorage(storage))
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("myCollection"))
+	require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+	require.Zero(t, storage.closed)
+
+	require.NoError(t, db.Close())
+	require.Equal(t, 1, storage.closed)
+	require.True(t, storage.synced["myCollection"])
+}
+
+func TestOpenInMemory(t *testing.T) {
+	db, err := c.OpenInMemory()
+	require.NoError(t, err)
+
+	require.NoError(t, db.CreateCollection("myCollection"))
+	require.NoError(t, db.CreateIndex("myCollection", "n"))
+	for i := 0; i < 10; i++ {
+		doc := c.NewDocument()
+		doc.Set("n", i)
+		require.NoError(t, db.Insert("myCollection", doc))
+	}
+	require.Equal(t, 5, db.Query("myCollection").Where(c.Field("n").GtEq(5)).Count())
+	require.NoError(t, db.Query("myCollection").Where(c.Field("n").Lt(3)).Delete())
+	require.Equal(t, 7, db.Query("myCollection").Count())
+	require.NoError(t, db.Close())
+
+	db, err = c.OpenInMemory()
+	require.NoError(t, err)
+	require.False(t, db.HasCollection("myCollection"))
+
+	storage := c.NewMemoryStorage()
+	db, err = c.Open("", c.WithStorage(storage))
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("myCollection"))
+	require.NoError(t, db.CreateIndex("myCollection", "n"))
+	require.NoError(t, db.Insert("myCollection", c.NewDocument()))
+	require.NoError(t, db.Close())
+
+	db, err = c.Open("", c.WithStorage(storage))
+	require.NoError(t, err)
+	require.Equal(t, 1, db.Query("myCollection").Count())
+	require.Equal(t, []string{"n"}, db.Query("myCollection").Where(c.Field("n").Eq(1)).Explain().IndexFields)
+	require.NoError(t, db.DropCollection("myCollection"))
+	require.ErrorIs(t, db.DropCollection("myCollection"), c.ErrCollectionNotExist)
+}
+
+func TestCursor(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		err := copyCollection(db, "todos", "todos-temp")
+		require.NoError(t, err)
+
+		defer func() {
+			require.NoError(t, db.DropCollection("todos-temp"))
+		}()
+
+		q := db.Query("todos-temp").Where(c.Field("completed").Eq(true)).Sort(c.SortOption{Field: "id", Direction: 1})
+		expected := q.FindAll()
+
+		cur1 := q.Cursor()
+		cur2 := q.Cursor()
+
+		first, ok := cur1.Next()
+		require.True(t, ok)
+		require.Equal(t, expected[0].ObjectId(), first.ObjectId())
+
+		require.NoError(t, db.Query("todos-temp").Delete())
+		require.Equal(t, 0, db.Query("todos-temp").Count())
+
+		n := 1
+		for doc, ok := cur1.Next(); ok; doc, ok = cur1.Next() {
+			require.Equal(t, expected[n].ObjectId(), doc.ObjectId())
+			n++
+		}
+		require.Equal(t, len(expected), n)
+
+		var wg sync.WaitGroup
+		counts := make([]int, 4)
+		for i := range counts {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for _, ok := cur2.Next(); ok; _, ok = cur2.Next() {
+					counts[i]++
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		total := 0
+		for _, count := range counts {
+			total += count
+		}
+		require.Equal(t, len(expected), total)
+
+		cur3 := q.Cursor()
+		cur3.Close()
+		_, ok = cur3.Next()
+		require.False(t, ok)
+	})
+}
+
+func TestExprCriteria(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("orders"))
+
+		orders := []map[string]interface{}{
+			{"price": 10, "quantity": 5},
+			{"price": 30, "quantity": 4},
+			{"price": 2.5, "quantity": 100},
+			{"price": 50},
+			{"price": "100", "quantity": 2},
+			{"price": 7, "quantity": 0},
+		}
+
+		docs := make([]*c.Document, 0, len(orders))
+		for _, order := range orders {
+			doc := c.NewDocument()
+			for k, v := range order {
+				doc.Set(k, v)
+			}
+			docs = append(docs, doc)
+		}
+		require.NoError(t, db.Insert("orders", docs...))
+
+		q := db.Query("orders")
+		require.Equal(t, 2, q.Where(c.Field("price").Mul(c.Field("quantity")).Gt(100)).Count())
+		require.Equal(t, 3, q.Where(c.Field("price").Mul(c.Field("quantity")).GtEq(50)).Count())
+		require.Equal(t, 1, q.Where(c.Field("price").Mul(c.Field("quantity")).Eq(120)).Count())
+		require.Equal(t, 1, q.Where(c.Field("price").Add(c.Field("quantity")).Sub(2).Lt(7)).Count())
+		require.Equal(t, 1, q.Where(c.Field("price").Div(c.Field("quantity")).Eq(2)).Count())
+		require.Equal(t, 5, q.Where(c.Field("price").Mul(2).Neq(c.Field("price"))).Count())
+
+		criteria := c.Field("price").Mul(c.Field("quantity")).Gt(100).Or(c.Field("price").Eq(50))
+		require.Equal(t, 3, q.Where(criteria).Count())
+		require.Equal(t, 3, q.Where(criteria.Not()).Count())
+	})
+}
+
+func TestDocumentClone(t *testing.T) {
+	doc := c.NewDocument()
+	doc.Set("name", "clover")
+	doc.Set("meta.tags", []interface{}{"db", map[string]interface{}{"lang": "go"}})
+
+	clone := doc.Clone()
+	require.Equal(t, doc.Get("meta"), clone.Get("meta"))
+
+	clone.Set("name", "other")
+	clone.Set("meta.version", 2)
+	tags := clone.Get("meta.tags").([]interface{})
+	tags[0] = "kv"
+	tags[1].(map[string]interface{})["lang"] = "rust"
+
+	require.Equal(t, "clover", doc.Get("name"))
+	require.False(t, doc.Has("meta.version"))
+	require.Equal(t, []interface{}{"db", map[string]interface{}{"lang": "go"}}, doc.Get("meta.tags"))
+}
+
+func TestResultsCopyOnWrite(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("items"))
+
+		doc := c.NewDocument()
+		doc.Set("name", "clover")
+		doc.Set("meta.lang", "go")
+		doc.Set("orders", []interface{}{map[string]interface{}{"amount": 1}})
+		id, err := db.InsertOne("items", doc)
+		require.NoError(t, err)
+
+		events, cancel := db.Watch("items")
+		defer cancel()
+		require.NoError(t, db.UpdateById("items", id, map[string]interface{}{"name": "updated"}))
+
+		e := <-events
+		e.Doc.Set("name", "event")
+		e.Doc.Set("orders.0.amount", 2)
+
+		cached := db.Query("items").Cached()
+		for _, q := range []*c.Query{db.Query("items"), cached, cached} {
+			result := q.FindFirst()
+			result.Set("name", "changed")
+			result.Set("meta.lang", "rust")
+			result.Set("orders.0.amount", 99)
+
+			for _, found := range q.FindAll() {
+				found.Set("meta.lang", "rust")
+				found.Set("orders.0.amount", 99)
+			}
+		}
+
+		stored := db.Query("items").FindById(id)
+		require.Equal(t, "updated", stored.Get("name"))
+		require.Equal(t, "go", stored.Get("meta.lang"))
+		require.Equal(t, float64(1), stored.Get("orders.0.amount"))
+		require.Equal(t, "updated", cached.FindFirst().Get("name"))
+		require.Equal(t, float64(1), cached.FindFirst().Get("orders.0.amount"))
+		require.Equal(t, 1, db.Query("items").Where(c.Field("meta.lang").Eq("go")).Count())
+	})
+}
+
+func TestCountDistinct(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		users := make(map[float64]bool)
+		completedUsers := make(map[float64]bool)
+		for _, doc := range db.Query("todos").FindAll() {
+			users[doc.Get("userId").(float64)] = true
+			if doc.Get("completed") == true {
+				completedUsers[doc.Get("userId").(float64)] = true
+			}
+		}
+
+		n, err := db.Query("todos").CountDistinct("userId")
+		require.NoError(t, err)
+		require.Equal(t, len(users), n)
+
+		n, err = db.Query("todos").Where(c.Field("completed").Eq(true)).CountDistinct("userId")
+		require.NoError(t, err)
+		require.Equal(t, len(completedUsers), n)
+
+		n, err = db.Query("todos").CountDistinct("missing")
+		require.NoError(t, err)
+		require.Equal(t, 0, n)
+
+		_, err = db.Query("todos").CountDistinct("")
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+	})
+
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("values"))
+		for _, v := range []interface{}{1, 1.0, int64(1), "1", nil, nil, 2.5} {
+			doc := c.NewDocument()
+			doc.Set("v", v)
+			_, err := db.InsertOne("values", doc)
+			require.NoError(t, err)
+		}
+
+		n, err := db.Query("values").CountDistinct("v")
+		require.NoError(t, err)
+		require.Equal(t, 4, n)
+	})
+}
+
+func TestDistinct(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		completedUsers := make(map[float64]bool)
+		for _, doc := range db.Query("todos").Where(c.Field("completed").Eq(true)).FindAll() {
+			completedUsers[doc.Get("userId").(float64)] = true
+		}
+
+		values, err := db.Query("todos").Where(c.Field("completed").Eq(true)).Distinct("userId")
+		require.NoError(t, err)
+		require.Len(t, values, len(completedUsers))
+		for i, v := range values {
+			require.True(t, completedUsers[v.(float64)])
+			if i > 0 {
+				require.Less(t, values[i-1].(float64), v.(float64))
+			}
+		}
+
+		values, err = db.Query("todos").Distinct("missing")
+		require.NoError(t, err)
+		require.Empty(t, values)
+
+		_, err = db.Query("todos").Distinct("")
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+	})
+
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("values"))
+		for _, v := range []interface{}{"b", 2.5, 1, nil, "a", 1.0, nil} {
+			doc := c.NewDocument()
+			doc.Set("v", v)
+			_, err := db.InsertOne("values", doc)
+			require.NoError(t, err)
+		}
+
+		values, err := db.Query("values").Distinct("v")
+		require.NoError(t, err)
+		require.Equal(t, []interface{}{nil, float64(1), 2.5, "a", "b"}, values)
+	})
+}
+
+type celsius float64
+
+func TestCodecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := []c.Option{
+		c.WithTimeCodec(),
+		c.WithBytesCodec(),
+		c.WithCodec("celsius", celsius(0),
+			func(v interface{}) (interface{}, error) {
+				return float64(v.(celsius)), nil
+			},
+			func(data interface{}) (interface{}, error) {
+				return celsius(data.(float64)), nil
+			}),
+	}
+
+	db, err := c.Open(dir, opts...)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("events"))
+
+	start := time.Date(2022, 1, 1, 10, 0, 0, 123456789, time.FixedZone("CET", 3600))
+	for i := 0; i < 10; i++ {
+		doc := c.NewDocument()
+		doc.Set("n", i)
+		doc.Set("at", start.Add(time.Duration(i)*time.Hour))
+		doc.Set("payload", []byte{byte(i), 0, 255})
+		doc.Set("meta", map[string]interface{}{"temp": celsius(20 + i), "history": []interface{}{start}})
+		_, err := db.InsertOne("events", doc)
+		require.NoError(t, err)
+	}
+
+	check := func(db *c.DB) {
+		q := db.Query("events")
+		require.Equal(t, 4, q.Where(c.Field("at").Gt(start.Add(5*time.Hour))).Count())
+		require.Equal(t, 1, q.Where(c.Field("at").Eq(start.Add(2*time.Hour).UTC())).Count())
+		require.Equal(t, 1, q.Where(c.Field("payload").Eq([]byte{3, 0, 255})).Count())
+		require.Equal(t, 1, q.Where(c.Field("meta.temp").Eq(celsius(27))).Count())
+
+		docs := q.Sort(c.SortOption{Field: "at", Direction: -1}).FindAll()
+		require.Len(t, docs, 10)
+		for i, doc := range docs {
+			at, isTime := doc.Get("at").(time.Time)
+			require.True(t, isTime)
+			require.True(t, at.Equal(start.Add(time.Duration(9-i)*time.Hour)))
+			require.Equal(t, []byte{byte(9 - i), 0, 255}, doc.Get("payload"))
+			require.Equal(t, celsius(29-i), doc.Get("meta.temp"))
+			require.True(t, start.Equal(doc.Get("meta.history").([]interface{})[0].(time.Time)))
+		}
+
+	}
+
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir, opts...)
+	require.NoError(t, err)
+	check(db)
+
+	require.NoError(t, db.Query("events").Where(c.Field("n").Eq(0)).Update(map[string]interface{}{"at": start.Add(-time.Hour)}))
+	require.Equal(t, 1, db.Query("events").Where(c.Field("at").Lt(start)).Count())
+	require.NoError(t, db.Close())
+
+	// without codecs, values are converted through their JSON representation
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+
+	doc := db.Query("events").Where(c.Field("n").Eq(1)).FindAll()[0]
+	require.Equal(t, "time", doc.Get("at.$type"))
+}
+
+func TestCorruptedCollection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+
+	for _, name := range []string{"healthy", "damaged", "garbage"} {
+		require.NoError(t, db.CreateCollection(name))
+
+		docs := make([]*c.Document, 0, 10)
+		for i := 0; i < 10; i++ {
+			doc := c.NewDocument()
+			doc.Set("n", i)
+			docs = append(docs, doc)
+		}
+		require.NoError(t, db.Insert(name, docs...))
+	}
+	require.NoError(t, db.Close())
+
+	data, err := ioutil.ReadFile(dir + "/damaged.json")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(dir+"/damaged.json", data[:len(data)/2], 0666))
+	// a damaged gzip header makes the whole content unreadable
+	require.NoError(t, ioutil.WriteFile(dir+"/garbage.json", []byte("\x1f\x8bnot json"), 0666))
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+
+	require.True(t, db.HasCollection("healthy"))
+	require.False(t, db.HasCollection("damaged"))
+	require.Nil(t, db.Query("damaged"))
+
+	corrupted := db.CorruptedCollections()
+	require.Len(t, corrupted, 2)
+	require.ErrorIs(t, corrupted["damaged"], c.ErrCorruptedCollection)
+	require.ErrorIs(t, corrupted["garbage"], c.ErrCorruptedCollection)
+	require.ErrorIs(t, db.CreateCollection("damaged"), c.ErrCorruptedCollection)
+
+	require.NoError(t, db.Repair("healthy"))
+	require.ErrorIs(t, db.Repair("myCollection"), c.ErrCollectionNotExist)
+
+	require.NoError(t, db.Repair("damaged"))
+	require.True(t, db.HasCollection("damaged"))
+	n := db.Query("damaged").Count()
+	require.Greater(t, n, 0)
+	require.Less(t, n, 10)
+
+	require.Error(t, db.Repair("garbage"))
+	require.Contains(t, db.CorruptedCollections(), "garbage")
+	garbage, err := ioutil.ReadFile(dir + "/garbage.json")
+	require.NoError(t, err)
+	require.Equal(t, []byte("\x1f\x8bnot json"), garbage)
+
+	require.NoError(t, db.DropCollection("garbage"))
+	require.Empty(t, db.CorruptedCollections())
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	require.Empty(t, db.CorruptedCollections())
+	require.Equal(t, n, db.Query("damaged").Count())
+	require.Equal(t, 10, db.Query("healthy").Count())
+	require.False(t, db.HasCollection("garbage"))
+}
+
+func TestForEachBatch(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		err := copyCollection(db, "todos", "todos-temp")
+		require.NoError(t, err)
+
+		defer func() {
+			require.NoError(t, db.DropCollection("todos-temp"))
+		}()
+
+		q := db.Query("todos-temp").Where(c.Field("completed").Eq(false))
+		n := q.Count()
+
+		err = q.ForEachBatch(0, nil)
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+
+		batches := 0
+		err = q.ForEachBatch(7, func(batch []*c.Document) ([]*c.Document, error) {
+			require.LessOrEqual(t, len(batch), 7)
+			batches++
+
+			for _, doc := range batch {
+				doc.Set("completed", true)
+				doc.Set("migrated", true)
+			}
+			return batch, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, (n+6)/7, batches)
+
+		require.Equal(t, 0, db.Query("todos-temp").Where(c.Field("completed").Eq(false)).Count())
+		require.Equal(t, n, db.Query("todos-temp").Where(c.Field("migrated").Eq(true)).Count())
+
+		processed := 0
+		errStop := errors.New("stop")
+		err = db.Query("todos-temp").ForEachBatch(10, func(batch []*c.Document) ([]*c.Document, error) {
+			if processed > 0 {
+				return nil, errStop
+			}
+			processed += len(batch)
+
+			for _, doc := range batch {
+				doc.Set("migrated", false)
+			}
+			return batch, nil
+		})
+		require.ErrorIs(t, err, errStop)
+		require.Equal(t, 10, db.Query("todos-temp").Where(c.Field("migrated").Eq(false)).Count())
+
+		snapshot, err := db.Snapshot()
+		require.NoError(t, err)
+		err = snapshot.Query("todos-temp").ForEachBatch(10, func(batch []*c.Document) ([]*c.Document, error) {
+			return batch, nil
+		})
+		require.ErrorIs(t, err, c.ErrReadOnly)
+	})
+}
+
+func TestCollectionMetadataPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, db.CreateCollection("todos"))
+	for i := 0; i < 20; i++ {
+		doc := c.NewDocument()
+		doc.Set("userId", i%4)
+		doc.Set("id", i)
+		_, err := db.InsertOne("todos", doc)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, db.CreateIndex("todos", "userId", "id"))
+	require.NoError(t, db.CreateIndex("todos", "id"))
+	require.NoError(t, db.DropIndex("todos", "id"))
+	require.NoError(t, db.Close())
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+
+	q := db.Query("todos").Where(c.Field("userId").Eq(1).And(c.Field("id").Gt(10)))
+	require.Equal(t, []string{"userId", "id"}, q.Explain().IndexFields)
+	require.Equal(t, 2, q.Count())
+	require.Nil(t, db.Query("todos").Where(c.Field("id").Eq(1)).Explain().IndexFields)
+
+	require.ErrorIs(t, db.CreateIndex("todos", "userId", "id"), c.ErrIndexExist)
+}
+
+func genRandomFieldName() string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	size := rand.Intn(100) + 1
+
+	fName := ""
+	for i := 0; i < size; i++ {
+		fName += "." + string(letters[rand.Intn(len(letters))])
+	}
+	return fName
+}
+
+func TestDocument(t *testing.T) {
+	doc := c.NewDocument()
+
+	nTests := 1000
+	for i := 0; i < nTests; i++ {
+		fieldName := genRandomFieldName()
+		doc.Set(fieldName, i)
+		require.True(t, doc.Has(fieldName))
+		require.Equal(t, doc.Get(fieldName), i)
+	}
+}
+
+func TestNestedFields(t *testing.T) {
+	doc := c.NewDocument()
+	doc.Set("address.city", "Rome")
+	doc.Set("tags", []interface{}{"a", map[string]interface{}{"name": "b"}})
+	doc.Set(`file\.ext`, "txt")
+	doc.Set(`a\\b`, 1)
+
+	require.Equal(t, "Rome", doc.Get("address.city"))
+	require.Equal(t, "a", doc.Get("tags.0"))
+	require.Equal(t, "b", doc.Get("tags.1.name"))
+	require.True(t, doc.Has("tags.1"))
+	require.False(t, doc.Has("tags.2"))
+	require.False(t, doc.Has("tags.-1"))
+	require.False(t, doc.Has("tags.first"))
+	require.False(t, doc.Has("address.city.name"))
+	require.Equal(t, "txt", doc.Get(`file\.ext`))
+	require.False(t, doc.Has("file.ext"))
+	require.Equal(t, 1, doc.Get(`a\b`))
+
+	tags := doc.Get("tags").([]interface{})
+	doc.Set("tags.1.name", "c")
+	doc.Set("tags.3", "d")
+	require.Equal(t, []interface{}{"a", map[string]interface{}{"name": "c"}, nil, "d"}, doc.Get("tags"))
+	require.Len(t, tags, 2)
+	require.Equal(t, "a", tags[0])
+
+	// objects inside arrays are shared by copies, so they must be copied as well
+	withOrders := c.NewDocument()
+	withOrders.Set("orders", []interface{}{map[string]interface{}{"amount": 1}})
+	copied := withOrders.Copy()
+	copied.Set("orders.0.amount", 2)
+	require.Equal(t, 1, withOrders.Get("orders.0.amount"))
+	require.Equal(t, 2, copied.Get("orders.0.amount"))
+
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("users"))
+
+		for i, city := range []string{"Rome", "Milan", "Rome"} {
+			doc := c.NewDocument()
+			doc.Set("address.city", city)
+			doc.Set("orders", []interface{}{map[string]interface{}{"amount": i * 10}})
+			doc.Set(`version\.major`, i)
+			require.NoError(t, db.Insert("users", doc))
+		}
+
+		require.Equal(t, 2, db.Query("users").Where(c.Field("address.city").Eq("Rome")).Count())
+		require.Equal(t, 2, db.Query("users").Where(c.Field("orders.0.amount").Gt(5)).Count())
+		require.Equal(t, 0, db.Query("users").Where(c.Field("orders.1.amount").Exists()).Count())
+		require.Equal(t, 1, db.Query("users").Where(c.Field(`version\.major`).Eq(2)).Count())
+
+		before := db.Query("users")
+		require.NoError(t, db.Query("users").Where(c.Field("address.city").Eq("Milan")).Update(map[string]interface{}{"orders.0.amount": 100}))
+		require.Equal(t, 1, db.Query("users").Where(c.Field("orders.0.amount").Eq(100)).Count())
+		require.Equal(t, 1, db.Query("users").Where(c.Field("orders.0.amount").Eq(0)).Count())
+		require.Equal(t, 0, before.Where(c.Field("orders.0.amount").Eq(100)).Count())
+		require.Equal(t, 1, before.Where(c.Field("orders.0.amount").Eq(10)).Count())
+	})
+}
+
+func TestDocumentUnmarshal(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		require.True(t, db.HasCollection("todos"))
+		require.NotNil(t, db.Query("todos"))
+
+		docs := db.Query("todos").FindAll()
+
+		todo := &struct {
+			Completed bool   `json:"completed"`
+			Title     string `json:"title"`
+			UserId    int    `json:"userId"`
+		}{}
+
+		require.Greater(t, len(docs), 0)
+		for _, doc := range docs {
+			err := doc.Unmarshal(todo)
+			require.NoError(t, err)
+		}
+	})
+}
+
+type address struct {
+	City string `json:"city"`
+	Zip  string `json:"zip,omitempty"`
+}
+
+type user struct {
+	Id       string    `json:"_id,omitempty"`
+	Name     string    `json:"name"`
+	Age      int       `json:"age"`
+	Score    int64     `json:"score"`
+	Ratio    float32   `json:"ratio"`
+	Created  time.Time `json:"created"`
+	Address  address   `json:"address"`
+	Previous *address  `json:"previous,omitempty"`
+	Tags     []string  `json:"tags"`
+	ignored  string
+}
+
+func TestInsertStruct(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("users"))
+
+		u := user{
+			Name:    "alice",
+			Age:     30,
+			Score:   1 << 40,
+			Ratio:   0.5,
+			Created: time.Date(2022, 2, 1, 12, 30, 0, 0, time.UTC),
+			Address: address{City: "Rome"},
+			Tags:    []string{"admin", "dev"},
+			ignored: "secret",
+		}
+
+		id, err := db.InsertStruct("users", u)
+		require.NoError(t, err)
+
+		doc, err := db.FindById("users", id)
+		require.NoError(t, err)
+		require.Equal(t, "Rome", doc.Get("address.city"))
+		require.False(t, doc.Has("address.zip"))
+		require.False(t, doc.Has("previous"))
+		require.False(t, doc.Has("ignored"))
+		require.Equal(t, 1, db.Query("users").Where(c.Field("age").Eq(30)).Count())
+
+		decoded := user{}
+		require.NoError(t, doc.Unmarshal(&decoded))
+
+		u.Id, u.ignored = id, ""
+		require.Equal(t, u, decoded)
+
+		u.Id = "bob"
+		u.Previous = &address{City: "Milan", Zip: "20100"}
+		id, err = db.InsertStruct("users", &u)
+		require.NoError(t, err)
+		require.Equal(t, "bob", id)
+		require.Equal(t, "20100", db.Query("users").FindById("bob").Get("previous.zip"))
+
+		_, err = db.InsertStruct("users", []string{"not", "an", "object"})
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+		require.Nil(t, c.NewDocumentOf(10))
+	})
+}
+
+func TestDocumentJSON(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		docs := db.Query("todos").FindAll()
+		require.Greater(t, len(docs), 0)
+
+		for _, doc := range docs {
+			data, err := json.Marshal(doc)
+			require.NoError(t, err)
+
+			decoded := &c.Document{}
+			require.NoError(t, json.Unmarshal(data, decoded))
+			require.Equal(t, decoded.ObjectId(), doc.ObjectId())
+			require.Equal(t, decoded.Get("userId"), doc.Get("userId"))
+			require.Equal(t, decoded.Get("title"), doc.Get("title"))
+
+			n := db.Query("todos").Where(c.Field("userId").Eq(decoded.Get("userId"))).Count()
+			require.Greater(t, n, 0)
+		}
+	})
+
+	doc := c.NewDocument()
+	doc.Set("a.b", []interface{}{1, "x", map[string]interface{}{"c": true}})
+
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+
+	decoded := c.NewDocument()
+	require.NoError(t, json.Unmarshal(data, decoded))
+	require.Equal(t, decoded.Get("a.b"), []interface{}{float64(1), "x", map[string]interface{}{"c": true}})
+
+	require.Error(t, json.Unmarshal([]byte("[1, 2]"), decoded))
+}
+
+func TestCriteriaJSON(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		criteria := []*c.Criteria{
+			c.Field("completed").Eq(true),
+			c.Field("userId").Gt(3).And(c.Field("userId").LtEq(7)).And(c.Field("completed").Eq(false)),
+			c.Field("userId").In(1, 5, 9).Or(c.Field("title").StartsWith("DELECTUS", c.IgnoreCase)),
+			c.Field("userId").GtEq(5).Not(),
+			c.Field("title").Like("%aut%").And(c.Field("title").Regex("^q")),
+			c.Field("notes").Exists().Or(c.Field("id").Lt(10)),
+			c.Field("title").EndsWith("est").And(c.Field("completed").IsNotNull()),
+		}
+
+		for _, cond := range criteria {
+			data, err := json.Marshal(cond)
+			require.NoError(t, err)
+
+			parsed, err := c.ParseCriteria(data)
+			require.NoError(t, err)
+			require.Equal(t, db.Query("todos").Where(cond).Count(), db.Query("todos").Where(parsed).Count(), string(data))
+
+			decoded := &c.Criteria{}
+			require.NoError(t, json.Unmarshal(data, decoded))
+			require.Equal(t, db.Query("todos").Where(cond).Count(), db.Query("todos").Where(decoded).Count(), string(data))
+		}
+
+		parsed, err := c.ParseCriteria([]byte(`{"userId": 1, "completed": {"$ne": true}, "$or": [{"id": {"$lt": 5}}, {"id": {"$gte": 18}}]}`))
+		require.NoError(t, err)
+		expected := c.Field("userId").Eq(1).And(c.Field("completed").Neq(true)).And(c.Field("id").Lt(5).Or(c.Field("id").GtEq(18)))
+		require.Equal(t, db.Query("todos").Where(expected).Count(), db.Query("todos").Where(parsed).Count())
+
+		parsed, err = c.ParseCriteria([]byte(`{}`))
+		require.NoError(t, err)
+		require.Equal(t, db.Query("todos").Count(), db.Query("todos").Where(parsed).Count())
+
+		_, err = json.Marshal(c.Field("completed").Eq(true).And(c.Func(func(_ *c.Document) bool { return true })))
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+
+		for _, filter := range []string{`{"id": {"$foo": 1}}`, `{"$foo": []}`, `{"title": {"$regex": "("}}`, `{"tags": {"$size": 1.5}}`, `[1]`} {
+			_, err = c.ParseCriteria([]byte(filter))
+			require.ErrorIs(t, err, c.ErrInvalidArgument, filter)
+		}
+	})
+}
+
+func TestFieldMatches(t *testing.T) {
+	runCloverTest(t, "test-data/todos", func(t *testing.T, db *c.DB) {
+		isEven := c.Field("userId").Matches(func(v interface{}) bool {
+			n, isNumber := v.(float64)
+			return isNumber && int(n)%2 == 0
+		})
+
+		expected := db.Query("todos").Where(c.Field("userId").In(2, 4, 6, 8, 10)).Count()
+		require.Greater(t, expected, 0)
+		require.Equal(t, expected, db.Query("todos").Where(isEven).Count())
+
+		combined := isEven.And(c.Field("completed").Eq(true)).Or(c.Field("userId").Eq(1))
+		expected = db.Query("todos").Where(c.Field("userId").In(2, 4, 6, 8, 10).And(c.Field("completed").Eq(true)).Or(c.Field("userId").Eq(1))).Count()
+		require.Equal(t, expected, db.Query("todos").Where(combined).Count())
+		require.Equal(t, db.Query("todos").Count()-db.Query("todos").Where(isEven).Count(), db.Query("todos").Where(isEven.Not()).Count())
+
+		called := false
+		n := db.Query("todos").Where(c.Field("missing").Matches(func(_ interface{}) bool {
+			called = true
+			return true
+		})).Count()
+		require.Zero(t, n)
+		require.False(t, called)
+
+		_, err := json.Marshal(isEven)
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+	})
+}
+
+func TestFieldTypeCriteria(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("items"))
+		for _, v := range []interface{}{nil, true, 1, 2.5, "a", []interface{}{1}, map[string]interface{}{"b": 1}} {
+			doc := c.NewDocument()
+			doc.Set("v", v)
+			_, err := db.InsertOne("items", doc)
+			require.NoError(t, err)
+		}
+		_, err := db.InsertOne("items", c.NewDocument())
+		require.NoError(t, err)
+
+		count := func(q *c.Criteria) int {
+			return db.Query("items").Where(q).Count()
+		}
+
+		require.Equal(t, 1, count(c.Field("v").NotExists()))
+		require.Equal(t, 7, count(c.Field("v").Exists()))
+		require.Equal(t, 1, count(c.Field("v").IsNil()))
+		require.Equal(t, 1, count(c.Field("v").IsType(c.KindNull)))
+		require.Equal(t, 1, count(c.Field("v").IsType(c.KindBool)))
+		require.Equal(t, 2, count(c.Field("v").IsType(c.KindNumber)))
+		require.Equal(t, 1, count(c.Field("v").IsType(c.KindString)))
+		require.Equal(t, 1, count(c.Field("v").IsType(c.KindArray)))
+		require.Equal(t, 1, count(c.Field("v").IsType(c.KindObject)))
+		require.Equal(t, 0, count(c.Field("v").IsType(c.KindTime)))
+		require.Equal(t, 5, count(c.Field("v").IsType(c.KindNumber).Not().And(c.Field("v").Exists())))
+
+		for _, q := range []*c.Criteria{c.Field("v").NotExists(), c.Field("v").IsType(c.KindNumber)} {
+			data, err := json.Marshal(q)
+			require.NoError(t, err)
+
+			parsed, err := c.ParseCriteria(data)
+			require.NoError(t, err)
+			require.Equal(t, count(q), count(parsed))
+		}
+
+		_, err = c.ParseCriteria([]byte(`{"v": {"$type": "integer"}}`))
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+	})
+}
+
+func TestIgnoreCaseEquality(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("users"))
+		for _, name := range []interface{}{"Alice", "ALICE", "alice", "Bob", "carol", 1} {
+			doc := c.NewDocument()
+			doc.Set("name", name)
+			_, err := db.InsertOne("users", doc)
+			require.NoError(t, err)
+		}
+
+		count := func(q *c.Criteria) int {
+			return db.Query("users").Where(q).Count()
+		}
+
+		require.Equal(t, 1, count(c.Field("name").Eq("alice")))
+		require.Equal(t, 3, count(c.Field("name").EqIgnoreCase("aLiCe")))
+		require.Equal(t, 0, count(c.Field("name").EqIgnoreCase("ali")))
+		require.Equal(t, 4, count(c.Field("name").InIgnoreCase("alice", "BOB", "dave")))
+		require.Equal(t, 2, count(c.Field("name").InIgnoreCase("alice", "bob").Not()))
+
+		for _, q := range []*c.Criteria{c.Field("name").EqIgnoreCase("ALICE"), c.Field("name").InIgnoreCase("bob", "Carol")} {
+			data, err := json.Marshal(q)
+			require.NoError(t, err)
+
+			parsed, err := c.ParseCriteria(data)
+			require.NoError(t, err)
+			require.Equal(t, count(q), count(parsed), string(data))
+		}
+
+		_, err := c.ParseCriteria([]byte(`{"name": {"$eq": 1, "$ignoreCase": true}}`))
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+
+		for _, op := range []string{"$ne", "$gt", "$gte", "$lt", "$lte"} {
+			_, err := c.ParseCriteria([]byte(`{"name": {"` + op + `": "alice", "$ignoreCase": true}}`))
+			require.ErrorIs(t, err, c.ErrInvalidArgument, op)
+		}
+
+		for _, op := range []string{"$containsAll", "$containsAny"} {
+			_, err := c.ParseCriteria([]byte(`{"tags": {"` + op + `": ["a"], "$ignoreCase": true}}`))
+			require.ErrorIs(t, err, c.ErrInvalidArgument, op)
+		}
+
+		_, err = c.ParseCriteria([]byte(`{"name": {"$ne": "alice", "$ignoreCase": false}}`))
+		require.NoError(t, err)
+	})
+}
+
+func TestBulkWrite(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("items"))
+
+		existing := c.NewDocument()
+		existing.Set("n", 0)
+		existingId, err := db.InsertOne("items", existing)
+		require.NoError(t, err)
+
+		inserted := c.NewDocument()
+		inserted.Set("n", 1)
+
+		replacement := c.NewDocument()
+		replacement.Set("n", 2)
+
+		results, err := db.BulkWrite("items", []*c.WriteOp{
+			c.InsertOp(inserted),
+			c.UpdateByIdOp(existingId, map[string]interface{}{"n": 10}),
+			c.ReplaceByIdOp("new", replacement),
+			c.UpdateByIdOp("new", map[string]interface{}{"updated": true}),
+			c.DeleteByIdOp(existingId),
+		})
+		require.NoError(t, err)
+		require.Len(t, results, 5)
+		require.Equal(t, c.WriteResult{Op: c.OpInsert, Id: inserted.ObjectId()}, results[0])
+		require.NotEmpty(t, inserted.ObjectId())
+		require.Equal(t, c.WriteResult{Op: c.OpUpdate, Id: existingId}, results[1])
+		require.Equal(t, c.WriteResult{Op: c.OpInsert, Id: "new"}, results[2])
+		require.Equal(t, c.WriteResult{Op: c.OpUpdate, Id: "new"}, results[3])
+		require.Equal(t, c.WriteResult{Op: c.OpDelete, Id: existingId}, results[4])
+
+		require.Equal(t, 2, db.Query("items").Count())
+		doc, err := db.FindById("items", "new")
+		require.NoError(t, err)
+		require.Equal(t, true, doc.Get("updated"))
+		require.Nil(t, db.Query("items").FindById(existingId))
+
+		// a failing operation discards the whole batch
+		other := c.NewDocument()
+		other.Set("n", 3)
+		_, err = db.BulkWrite("items", []*c.WriteOp{
+			c.InsertOp(other),
+			c.DeleteByIdOp("new"),
+			c.DeleteByIdOp("missing"),
+		})
+		require.ErrorIs(t, err, c.ErrDocumentNotFound)
+		require.Equal(t, 2, db.Query("items").Count())
+		require.NotNil(t, db.Query("items").FindById("new"))
+
+		dup := c.NewDocument()
+		dup.Set("_id", "new")
+		_, err = db.BulkWrite("items", []*c.WriteOp{c.InsertOp(dup)})
+		require.ErrorIs(t, err, c.ErrDuplicateKey)
+
+		_, err = db.BulkWrite("missing", []*c.WriteOp{c.DeleteByIdOp("new")})
+		require.ErrorIs(t, err, c.ErrCollectionNotExist)
+	})
+}
+
+func TestDocumentVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("accounts", c.WithVersioning()))
+	require.NoError(t, db.CreateCollection("plain"))
+
+	doc := c.NewDocument()
+	doc.Set("balance", 100)
+	id, err := db.InsertOne("accounts", doc)
+	require.NoError(t, err)
+
+	version := func() int64 {
+		doc, err := db.FindById("accounts", id)
+		require.NoError(t, err)
+		return doc.Version()
+	}
+	require.Equal(t, int64(1), version())
+
+	require.NoError(t, db.UpdateById("accounts", id, map[string]interface{}{"balance": 90}, c.WithExpectedVersion(1)))
+	require.Equal(t, int64(2), version())
+
+	// a stale version is rejected, and nothing is written
+	err = db.UpdateById("accounts", id, map[string]interface{}{"balance": 80}, c.WithExpectedVersion(1))
+	require.ErrorIs(t, err, c.ErrConflict)
+	found, err := db.FindById("accounts", id)
+	require.NoError(t, err)
+	require.Equal(t, float64(90), found.Get("balance"))
+	require.Equal(t, int64(2), found.Version())
+
+	// versions can't be overwritten by updates
+	require.NoError(t, db.Query("accounts").Update(map[string]interface{}{"_version": 100}))
+	require.Equal(t, int64(3), version())
+
+	replacement := c.NewDocument()
+	replacement.Set("balance", 0)
+	require.ErrorIs(t, db.ReplaceById("accounts", id, replacement, c.WithExpectedVersion(2)), c.ErrConflict)
+	require.NoError(t, db.ReplaceById("accounts", id, replacement, c.WithExpectedVersion(3)))
+	require.Equal(t, int64(4), version())
+
+	// zero means that the document must not exist
+	require.ErrorIs(t, db.ReplaceById("accounts", id, c.NewDocument(), c.WithExpectedVersion(0)), c.ErrConflict)
+	require.NoError(t, db.ReplaceById("accounts", "other", c.NewDocument(), c.WithExpectedVersion(0)))
+
+	results, err := db.BulkWrite("accounts", []*c.WriteOp{
+		c.UpdateByIdOp("other", map[string]interface{}{"a": 1}),
+		c.UpdateByIdOp("other", map[string]interface{}{"b": 2}),
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	other, err := db.FindById("accounts", "other")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), other.Version())
+
+	require.ErrorIs(t, db.DeleteById("accounts", "other", c.WithExpectedVersion(2)), c.ErrConflict)
+	require.NoError(t, db.DeleteById("accounts", "other", c.WithExpectedVersion(3)))
+
+	plainId, err := db.InsertOne("plain", c.NewDocument())
+	require.NoError(t, err)
+	found, err = db.FindById("plain", plainId)
+	require.NoError(t, err)
+	require.Zero(t, found.Version())
+	require.ErrorIs(t, db.UpdateById("plain", plainId, map[string]interface{}{"a": 1}, c.WithExpectedVersion(0)), c.ErrInvalidArgument)
+	require.NoError(t, db.Close())
+
+	// the setting of the collection is persisted
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Equal(t, int64(4), version())
+	require.NoError(t, db.UpdateById("accounts", id, map[string]interface{}{"balance": 10}, c.WithExpectedVersion(4)))
+	require.Equal(t, int64(5), version())
+}
+
+func TestDirectoryLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateCollection("items"))
+
+	_, err = c.Open(dir)
+	require.ErrorIs(t, err, c.ErrDatabaseLocked)
+
+	_, err = c.OpenReadOnly(dir)
+	require.ErrorIs(t, err, c.ErrDatabaseLocked)
+
+	unlocked, err := c.Open(dir, c.WithNoDirectoryLock())
+	require.NoError(t, err)
+	require.True(t, unlocked.HasCollection("items"))
+
+	require.NoError(t, db.Close())
+
+	// read-only databases share the lock, which prevents the database from being opened for writing
+	roDb, err := c.OpenReadOnly(dir)
+	require.NoError(t, err)
+	require.True(t, roDb.HasCollection("items"))
+
+	other, err := c.OpenReadOnly(dir)
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+
+	_, err = c.Open(dir)
+	require.ErrorIs(t, err, c.ErrDatabaseLocked)
+	require.NoError(t, roDb.Close())
+
+	db, err = c.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestReplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	primary, err := c.Open(dir, c.WithWriteAheadLog())
+	require.NoError(t, err)
+	defer primary.Close()
+
+	require.NoError(t, primary.CreateCollection("todos"))
+	require.NoError(t, primary.CreateIndex("todos", "n"))
+	for i := 0; i < 10; i++ {
+		_, err := primary.InsertOne("todos", c.NewDocumentOf(map[string]interface{}{"n": i}))
+		require.NoError(t, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	served := make(chan error, 1)
+	go func() { served <- primary.ServeReplication(l) }()
+
+	replica, err := c.OpenReplica(l.Addr().String())
+	require.NoError(t, err)
+
+	// the current content is received before OpenReplica returns
+	require.Equal(t, 10, replica.Query("todos").Count())
+	require.Equal(t, []string{"n"}, replica.Query("todos").Where(c.Field("n").Eq(1)).Explain().IndexFields)
+
+	require.NoError(t, primary.Query("todos").Where(c.Field("n").Lt(5)).Delete())
+	require.NoError(t, primary.CreateCollection("other"))
+	_, err = primary.InsertOne("other", c.NewDocument())
+	require.NoError(t, err)
+	require.NoError(t, primary.RenameCollection("other", "renamed"))
+
+	require.Eventually(t, func() bool {
+		return replica.Query("todos").Count() == 5 && replica.HasCollection("renamed") && !replica.HasCollection("other")
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, replica.Query("renamed").Count())
+
+	require.ErrorIs(t, replica.Insert("todos", c.NewDocument()), c.ErrReadOnly)
+	require.NoError(t, replica.Close())
+
+	require.NoError(t, l.Close())
+	require.Error(t, <-served)
+
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.ErrorIs(t, db.ServeReplication(l), c.ErrInvalidArgument)
+	})
+
+	_, err = c.OpenReplica(l.Addr().String())
+	require.Error(t, err)
+}
+
+func TestQueryIsolation(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("items"))
+		for i := 0; i < 100; i++ {
+			doc := c.NewDocumentOf(map[string]interface{}{"n": i, "tags": []interface{}{map[string]interface{}{"v": i}}})
+			_, err := db.InsertOne("items", doc)
+			require.NoError(t, err)
+		}
+
+		q := db.Query("items").Where(c.Field("n").GtEq(50))
+		tagged := db.Query("items").Where(c.Field("tags.0.v").GtEq(50))
+
+		done := make(chan struct{})
+		errs := make(chan error, 1)
+		go func() {
+			defer close(done)
+			for i := 100; i < 300; i++ {
+				if _, err := db.InsertOne("items", c.NewDocumentOf(map[string]interface{}{"n": i})); err != nil {
+					errs <- err
+					return
+				}
+
+				if err := db.Query("items").Where(c.Field("n").Eq(i - 100)).Delete(); err != nil {
+					errs <- err
+					return
+				}
+
+				// updates of nested fields never modify the documents seen by existing queries
+				if err := db.Query("items").Where(c.Field("tags").Exists()).Update(map[string]interface{}{"tags.0.v": -i}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+
+			require.Equal(t, 50, q.Count())
+			require.Len(t, q.FindAll(), 50)
+			require.Equal(t, 50, tagged.Count())
+		}
+		require.Empty(t, errs)
+
+		require.Equal(t, 50, q.Count())
+		require.Equal(t, 50, tagged.Count())
+		require.Equal(t, 100, db.Query("items").Where(c.Field("n").GtEq(50)).Count())
+		require.Equal(t, 0, db.Query("items").Where(c.Field("tags.0.v").GtEq(0)).Count())
+	})
+}
+
+func TestLazyLoading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+
+	for _, name := range []string{"first", "second", "garbage"} {
+		require.NoError(t, db.CreateCollection(name))
+
+		docs := make([]*c.Document, 0, 10)
+		for i := 0; i < 10; i++ {
+			doc := c.NewDocument()
+			doc.Set("n", i)
+			docs = append(docs, doc)
+		}
+		require.NoError(t, db.Insert(name, docs...))
+	}
+	require.NoError(t, db.CreateIndex("second", "n"))
+	require.NoError(t, db.Close())
+	require.NoError(t, ioutil.WriteFile(dir+"/garbage.json", []byte("not json"), 0666))
+
+	db, err = c.Open(dir, c.WithLazyLoading())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Equal(t, []string{"first", "garbage", "second"}, db.ListCollections())
+	require.True(t, db.HasCollection("garbage"))
+	require.Empty(t, db.CorruptedCollections())
+	require.ErrorIs(t, db.CreateCollection("first"), c.ErrCollectionExist)
+
+	require.Equal(t, 10, db.Query("first").Count())
+	require.NoError(t, db.Insert("second", c.NewDocument()))
+	require.Equal(t, 11, db.Query("second").Count())
+	require.Equal(t, 1, db.Query("second").Where(c.Field("n").Eq(3)).Count())
+
+	require.ErrorIs(t, db.Preload("missing"), c.ErrCollectionNotExist)
+	require.ErrorIs(t, db.Preload(), c.ErrCorruptedCollection)
+	require.False(t, db.HasCollection("garbage"))
+	require.Contains(t, db.CorruptedCollections(), "garbage")
+	require.NoError(t, db.Preload("first", "second"))
+}
+
+func TestPagedReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, db.CreateCollection("items"))
+	require.NoError(t, db.CreateCollection("compressed", c.WithCollectionCompression()))
+	require.NoError(t, db.CreateCollection("garbage"))
+	for _, name := range []string{"items", "compressed"} {
+		docs := make([]*c.Document, 0, 100)
+		for i := 0; i < 100; i++ {
+			docs = append(docs, c.NewDocumentOf(map[string]interface{}{"n": i}))
+		}
+		require.NoError(t, db.Insert(name, docs...))
+	}
+	require.NoError(t, db.CreateIndex("items", "n"))
+	id := db.Query("items").Where(c.Field("n").Eq(42)).FindFirst().ObjectId()
+	require.NoError(t, db.Close())
+	require.NoError(t, ioutil.WriteFile(dir+"/garbage.json", []byte("not json"), 0666))
+
+	_, err = c.Open(dir, c.WithPagedReads())
+	require.ErrorIs(t, err, c.ErrInvalidArgument)
+	_, err = c.OpenReadOnly(dir, c.WithPagedReads(), c.WithWriteAheadLog())
+	require.ErrorIs(t, err, c.ErrInvalidArgument)
+	_, err = c.OpenReadOnly("", c.WithPagedReads(), c.WithStorage(c.NewMemoryStorage()))
+	require.ErrorIs(t, err, c.ErrInvalidArgument)
+
+	db, err = c.OpenReadOnly(dir, c.WithPagedReads())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Equal(t, []string{"compressed", "items"}, db.ListCollections())
+	require.Contains(t, db.CorruptedCollections(), "garbage")
+
+	for _, name := range []string{"items", "compressed"} {
+		require.Equal(t, 100, db.Query(name).Count())
+		require.Equal(t, 10, db.Query(name).Where(c.Field("n").GtEq(90)).Count())
+
+		docs := db.Query(name).Sort(c.SortOption{Field: "n", Direction: -1}).Limit(3).FindAll()
+		require.Len(t, docs, 3)
+		for i, doc := range docs {
+			require.Equal(t, float64(99-i), doc.Get("n"))
+		}
+	}
+
+	doc, err := db.FindById("items", id)
+	require.NoError(t, err)
+	require.Equal(t, 42.0, doc.Get("n"))
+	_, err = db.FindById("items", "missing")
+	require.ErrorIs(t, err, c.ErrDocumentNotFound)
+
+	// indexes are not built, so every query scans the whole collection
+	require.Nil(t, db.Query("items").Where(c.Field("n").Eq(42)).Explain().IndexFields)
+	require.Equal(t, 100, db.Query("items").Where(c.Field("n").Eq(42)).Explain().Candidates)
+
+	stats, err := db.CollectionStats("items")
+	require.NoError(t, err)
+	require.Equal(t, 100, stats.Documents)
+	require.Empty(t, stats.Indexes)
+
+	require.ErrorIs(t, db.Insert("items", c.NewDocument()), c.ErrReadOnly)
+	require.ErrorIs(t, db.DeleteById("items", id), c.ErrReadOnly)
+
+	// backups contain the stored snapshots, indexes included
+	backup := &bytes.Buffer{}
+	require.NoError(t, db.Backup(backup))
+
+	restoreDir, err := ioutil.TempDir("", "clover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+	require.NoError(t, c.Restore(backup, restoreDir))
+
+	restored, err := c.Open(restoreDir)
+	require.NoError(t, err)
+	defer restored.Close()
+
+	require.Equal(t, 100, restored.Query("compressed").Count())
+	require.Equal(t, []string{"n"}, restored.Query("items").Where(c.Field("n").Eq(42)).Explain().IndexFields)
+}
+
+func TestQueryPage(t *testing.T) {
+	runCloverTest(t, "", func(t *testing.T, db *c.DB) {
+		require.NoError(t, db.CreateCollection("items"))
+
+		docs := make([]*c.Document, 0, 100)
+		for i := 0; i < 100; i++ {
+			docs = append(docs, c.NewDocumentOf(map[string]interface{}{"n": i % 10}))
+		}
+		require.NoError(t, db.Insert("items", docs...))
+
+		_, err := db.Query("items").Page("", 0)
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+		_, err = db.Query("items").Page("not a cursor", 10)
+		require.ErrorIs(t, err, c.ErrInvalidArgument)
+
+		seen := make(map[string]bool)
+		lastN := 10.0
+		cursor := ""
+		inserted := 0
+		for {
+			page, err := db.Query("items").Sort(c.SortOption{Field: "n", Direction: -1}).Skip(5).Page(cursor, 7)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(page.Docs), 7)
+
+			for _, doc := range page.Docs {
+				require.False(t, seen[doc.ObjectId()])
+				seen[doc.ObjectId()] = true
+
+				n := doc.Get("n").(float64)
+				require.LessOrEqual(t, n, lastN)
+				lastN = n
+			}
+
+			if page.Next == "" {
+				break
+			}
+			cursor = page.Next
+
+			// documents inserted before the cursor are never returned, while the ones inserted after it don't shift pages
+			require.NoError(t, db.Insert("items", c.NewDocumentOf(map[string]interface{}{"n": 10}), c.NewDocumentOf(map[string]interface{}{"n": -1 - inserted})))
+			inserted++
+		}
+
+		for _, doc := range docs {
+			require.True(t, seen[doc.ObjectId()])
+		}
+		require.Len(t, seen, 100+inserted)
+
+		page, err := db.Query("items").Where(c.Field("n").Eq(3)).Select("n").Page("", 100)
+		require.NoError(t, err)
+		require.Len(t, page.Docs, 10)
+		require.Empty(t, page.Next)
+		for _, doc := range page.Docs {
+			require.False(t, doc.Has("_id"))
+			require.Equal(t, 3.0, doc.Get("n"))
+		}
+
+		page, err = db.Query("items").Page("", int(^uint(0)>>1))
+		require.NoError(t, err)
+		require.Len(t, page.Docs, 100+2*inserted)
+		require.Empty(t, page.Next)
+	})
+}
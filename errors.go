@@ -0,0 +1,89 @@
+package clover
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Database errors
+var (
+	ErrDatabaseLocked = errors.New("database locked")
+)
+
+// Collection errors
+var (
+	ErrCollectionExist     = errors.New("collection already exist")
+	ErrCollectionNotExist  = errors.New("no such collection")
+	ErrViewNotExist        = errors.New("no such view")
+	ErrCorruptedCollection = errors.New("corrupted collection")
+	ErrCollectionFull      = errors.New("collection full")
+)
+
+// Query errors
+var (
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrReadOnly        = errors.New("read-only")
+)
+
+// Index errors
+var (
+	ErrIndexExist    = errors.New("index already exist")
+	ErrIndexNotExist = errors.New("no such index")
+)
+
+// Document errors
+var (
+	ErrDuplicateKey     = errors.New("duplicate key")
+	ErrDocumentNotFound = errors.New("no such document")
+	ErrInvalidDocument  = errors.New("invalid document")
+	ErrDocumentTooLarge = errors.New("document too large")
+)
+
+// Transaction errors
+var (
+	ErrConflict = errors.New("write conflict")
+	ErrTxDone   = errors.New("transaction already committed or rolled back")
+)
+
+// The following helpers wrap the sentinel errors with the name of the involved collection or document,
+// so that callers can both read a descriptive message and check the kind of error with errors.Is.
+
+func collectionExistError(name string) error {
+	return fmt.Errorf("%w: %s", ErrCollectionExist, name)
+}
+
+func collectionNotExistError(name string) error {
+	return fmt.Errorf("%w: %s", ErrCollectionNotExist, name)
+}
+
+func corruptedCollectionError(name string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrCorruptedCollection, name, err)
+}
+
+func duplicateKeyError(collectionName string, id string) error {
+	return fmt.Errorf("%w: id %s in collection %s", ErrDuplicateKey, id, collectionName)
+}
+
+func uniqueIndexError(collectionName string, indexName string, key []interface{}) error {
+	return fmt.Errorf("%w: value %v for unique index %s in collection %s", ErrDuplicateKey, key, indexName, collectionName)
+}
+
+func indexExistError(collectionName string, indexName string) error {
+	return fmt.Errorf("%w: %s in collection %s", ErrIndexExist, indexName, collectionName)
+}
+
+func indexNotExistError(collectionName string, indexName string) error {
+	return fmt.Errorf("%w: %s in collection %s", ErrIndexNotExist, indexName, collectionName)
+}
+
+func documentNotFoundError(collectionName string, id string) error {
+	return fmt.Errorf("%w: id %s in collection %s", ErrDocumentNotFound, id, collectionName)
+}
+
+func invalidDocumentError(collectionName string, id string, err error) error {
+	return fmt.Errorf("%w: id %s in collection %s: %v", ErrInvalidDocument, id, collectionName, err)
+}
+
+func readOnlyDatabaseError() error {
+	return fmt.Errorf("%w: the database has been opened in read-only mode", ErrReadOnly)
+}
@@ -0,0 +1,223 @@
+package clover
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// ExportJSON writes the documents selected by q to w as a JSON array, one document per line.
+// Documents are written as they are produced, taking into account criteria, sort, skip, limit and projections.
+func (q *Query) ExportJSON(w io.Writer) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	first := true
+	err := q.forEachResult(func(doc *Document) error {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+
+		sep := ",\n"
+		if first {
+			sep, first = "\n", false
+		}
+
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	end := "\n]\n"
+	if first {
+		end = "]\n"
+	}
+	_, err = io.WriteString(w, end)
+	return err
+}
+
+// ExportCSV writes the documents selected by q to w in CSV format, preceded by a header line.
+// Columns are given by fields, which can be nested (using dot). If no field is supplied, the header is the sorted union
+// of the fields of the selected documents, where nested objects are flattened into dotted column names: in this case,
+// all the results are collected before being written. Missing and null values are written as empty cells, while arrays
+// are written as JSON.
+func (q *Query) ExportCSV(w io.Writer, fields ...string) error {
+	writer := csv.NewWriter(w)
+
+	if len(fields) == 0 {
+		rows := make([]map[string]interface{}, 0)
+		columns := make(map[string]bool)
+		err := q.forEachResult(func(doc *Document) error {
+			row := make(map[string]interface{})
+			flattenFields("", doc.fields, row)
+			for column := range row {
+				columns[column] = true
+			}
+			rows = append(rows, row)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for column := range columns {
+			fields = append(fields, column)
+		}
+		sort.Strings(fields)
+
+		if err := writer.Write(fields); err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			if err := writeCSVRecord(writer, fields, func(field string) interface{} { return row[field] }); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := writer.Write(fields); err != nil {
+			return err
+		}
+
+		err := q.forEachResult(func(doc *Document) error {
+			return writeCSVRecord(writer, fields, doc.Get)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// flattenFields stores in out each non-object value reachable from fields, keyed by its dotted path.
+func flattenFields(prefix string, fields map[string]interface{}, out map[string]interface{}) {
+	for key, value := range fields {
+		path := prefix + key
+		if m, isMap := value.(map[string]interface{}); isMap && len(m) > 0 {
+			flattenFields(path+".", m, out)
+		} else {
+			out[path] = value
+		}
+	}
+}
+
+func writeCSVRecord(writer *csv.Writer, fields []string, get func(field string) interface{}) error {
+	record := make([]string, 0, len(fields))
+	for _, field := range fields {
+		cell, err := formatCSVValue(get(field))
+		if err != nil {
+			return err
+		}
+		record = append(record, cell)
+	}
+	return writer.Write(record)
+}
+
+func formatCSVValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// ExportCollection writes all the documents of a collection to the file with the given path, as a JSON array
+// (see Query.ExportJSON). Documents are streamed to the file, which is created or truncated.
+func (db *DB) ExportCollection(collectionName string, path string) (err error) {
+	q := db.Query(collectionName)
+	if q == nil {
+		return collectionNotExistError(collectionName)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return q.ExportJSON(file)
+}
+
+// ImportCollection inserts into a collection the documents contained in the file with the given path, which must hold
+// a JSON array of objects, such as the ones written by ExportCollection. The collection is created if it doesn't exist.
+// Documents keep their ids: as for Insert, the whole import fails if any id is already used.
+func (db *DB) ImportCollection(collectionName string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	docs, err := db.readJSONDocuments(file)
+	if err != nil {
+		return err
+	}
+
+	if !db.HasCollection(collectionName) {
+		if err := db.CreateCollection(collectionName); err != nil {
+			return err
+		}
+	}
+	return db.Insert(collectionName, docs...)
+}
+
+// readJSONDocuments decodes, one at a time, the objects of the JSON array read from r, as it happens for collection files.
+func (db *DB) readJSONDocuments(r io.Reader) ([]*Document, error) {
+	decoder := json.NewDecoder(r)
+	if db.preserveInts {
+		decoder.UseNumber()
+	}
+
+	if tok, err := decoder.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, fmt.Errorf("%w: expected a JSON array", ErrInvalidArgument)
+	}
+
+	docs := make([]*Document, 0)
+	for decoder.More() {
+		fields := make(map[string]interface{})
+		if err := decoder.Decode(&fields); err != nil {
+			return nil, err
+		}
+		convertNumbers(fields)
+
+		if _, err := db.codecs.decode(fields); err != nil {
+			return nil, err
+		}
+
+		doc := db.newDocument()
+		doc.fields = fields
+		docs = append(docs, doc)
+	}
+
+	_, err := decoder.Token()
+	return docs, err
+}
@@ -0,0 +1,181 @@
+package clover
+
+// Expr is an arithmetic expression over the fields of a document and numeric literals, evaluated on each document.
+// Comparing an expression with a value (see Expr.Gt, Expr.Eq, ...) produces a Criteria, which can be combined with other criteria as usual.
+type Expr struct {
+	eval func(doc *Document) (interface{}, bool)
+}
+
+type arithOp int
+
+const (
+	opAdd arithOp = iota
+	opSub
+	opMul
+	opDiv
+)
+
+// operandExpr converts v (a field, an expression or a numeric literal) to an expression.
+func operandExpr(v interface{}) *Expr {
+	switch operand := v.(type) {
+	case *Expr:
+		return operand
+	case *field:
+		return operand.expr()
+	}
+
+	normValue, err := normalize(v, true)
+	return &Expr{
+		eval: func(_ *Document) (interface{}, bool) {
+			return normValue, err == nil && isNumber(normValue)
+		},
+	}
+}
+
+func (r *field) expr() *Expr {
+	return &Expr{
+		eval: func(doc *Document) (interface{}, bool) {
+			v := doc.Get(r.name)
+			return v, isNumber(v)
+		},
+	}
+}
+
+func applyArithOp(op arithOp, v1 interface{}, v2 interface{}) (interface{}, bool) {
+	i1, isInt1 := v1.(int64)
+	i2, isInt2 := v2.(int64)
+	if isInt1 && isInt2 && op != opDiv {
+		switch op {
+		case opAdd:
+			return i1 + i2, true
+		case opSub:
+			return i1 - i2, true
+		}
+		return i1 * i2, true
+	}
+
+	f1, _ := toFloat64(v1)
+	f2, _ := toFloat64(v2)
+	switch op {
+	case opAdd:
+		return f1 + f2, true
+	case opSub:
+		return f1 - f2, true
+	case opMul:
+		return f1 * f2, true
+	}
+
+	if f2 == 0 {
+		return nil, false
+	}
+	return f1 / f2, true
+}
+
+func (e *Expr) arith(op arithOp, operand interface{}) *Expr {
+	other := operandExpr(operand)
+	return &Expr{
+		eval: func(doc *Document) (interface{}, bool) {
+			v1, ok := e.eval(doc)
+			if !ok {
+				return nil, false
+			}
+
+			v2, ok := other.eval(doc)
+			if !ok {
+				return nil, false
+			}
+			return applyArithOp(op, v1, v2)
+		},
+	}
+}
+
+// Add returns an expression computing the sum of e and operand, which can be a field, an expression or a number.
+func (e *Expr) Add(operand interface{}) *Expr {
+	return e.arith(opAdd, operand)
+}
+
+// Sub returns an expression computing the difference between e and operand.
+func (e *Expr) Sub(operand interface{}) *Expr {
+	return e.arith(opSub, operand)
+}
+
+// Mul returns an expression computing the product of e and operand.
+func (e *Expr) Mul(operand interface{}) *Expr {
+	return e.arith(opMul, operand)
+}
+
+// Div returns an expression computing the quotient of e and operand. Division by zero makes the expression undefined.
+func (e *Expr) Div(operand interface{}) *Expr {
+	return e.arith(opDiv, operand)
+}
+
+// Add returns an expression computing the sum of the field and operand, which can be a field, an expression or a number.
+// Documents where any operand is missing or not a number never match criteria built on the expression.
+func (r *field) Add(operand interface{}) *Expr {
+	return r.expr().Add(operand)
+}
+
+// Sub returns an expression computing the difference between the field and operand.
+func (r *field) Sub(operand interface{}) *Expr {
+	return r.expr().Sub(operand)
+}
+
+// Mul returns an expression computing the product of the field and operand.
+func (r *field) Mul(operand interface{}) *Expr {
+	return r.expr().Mul(operand)
+}
+
+// Div returns an expression computing the quotient of the field and operand.
+func (r *field) Div(operand interface{}) *Expr {
+	return r.expr().Div(operand)
+}
+
+func (e *Expr) compare(value interface{}, cmp func(res int) bool) *Criteria {
+	other := operandExpr(value)
+	return &Criteria{
+		p: func(doc *Document) bool {
+			v1, ok := e.eval(doc)
+			if !ok {
+				return false
+			}
+
+			v2, ok := other.eval(doc)
+			if !ok {
+				return false
+			}
+
+			res, _ := compareNumbers(v1, v2)
+			return cmp(res)
+		},
+	}
+}
+
+// Eq matches documents where the value of the expression is equal to value, which can be a field, an expression or a number.
+func (e *Expr) Eq(value interface{}) *Criteria {
+	return e.compare(value, func(res int) bool { return res == 0 })
+}
+
+// Neq matches documents where the value of the expression is defined and different from value.
+func (e *Expr) Neq(value interface{}) *Criteria {
+	return e.compare(value, func(res int) bool { return res != 0 })
+}
+
+// Gt matches documents where the value of the expression is greater than value.
+func (e *Expr) Gt(value interface{}) *Criteria {
+	return e.compare(value, func(res int) bool { return res > 0 })
+}
+
+// GtEq matches documents where the value of the expression is greater or equal than value.
+func (e *Expr) GtEq(value interface{}) *Criteria {
+	return e.compare(value, func(res int) bool { return res >= 0 })
+}
+
+// Lt matches documents where the value of the expression is less than value.
+func (e *Expr) Lt(value interface{}) *Criteria {
+	return e.compare(value, func(res int) bool { return res < 0 })
+}
+
+// LtEq matches documents where the value of the expression is less or equal than value.
+func (e *Expr) LtEq(value interface{}) *Criteria {
+	return e.compare(value, func(res int) bool { return res <= 0 })
+}
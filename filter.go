@@ -0,0 +1,387 @@
+package clover
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// withSpec sets the JSON representation of q to a condition on field using the operator op.
+func (q *Criteria) withSpec(field string, op string, value interface{}) *Criteria {
+	q.spec = map[string]interface{}{field: map[string]interface{}{op: value}}
+	return q
+}
+
+// withStringOptions adds the supplied options to the JSON representation of q, which must be a condition on field.
+func (q *Criteria) withStringOptions(field string, opts []StringOption) *Criteria {
+	if hasStringOption(opts, IgnoreCase) {
+		q.spec[field].(map[string]interface{})["$ignoreCase"] = true
+	}
+	return q
+}
+
+// combineSpecs returns the JSON representation of the conjunction (or disjunction, depending on op) of two criteria,
+// flattening nested combinations with the same operator. It returns nil if any of the criteria can't be serialized.
+func combineSpecs(op string, spec1 map[string]interface{}, spec2 map[string]interface{}) map[string]interface{} {
+	if spec1 == nil || spec2 == nil {
+		return nil
+	}
+
+	operands := make([]interface{}, 0, 2)
+	for _, spec := range []map[string]interface{}{spec1, spec2} {
+		if nested, isCombination := spec[op].([]interface{}); isCombination && len(spec) == 1 {
+			operands = append(operands, nested...)
+		} else {
+			operands = append(operands, spec)
+		}
+	}
+	return map[string]interface{}{op: operands}
+}
+
+// MarshalJSON encodes the criteria as a JSON filter, which can be decoded by ParseCriteria. Criteria built from
+// functions (such as Func, MatchPredicate and expressions), or combining such criteria, can't be encoded: in this case,
+// MarshalJSON fails with ErrInvalidArgument.
+func (q *Criteria) MarshalJSON() ([]byte, error) {
+	if q.spec == nil {
+		return nil, fmt.Errorf("%w: criteria built from functions cannot be serialized", ErrInvalidArgument)
+	}
+	return json.Marshal(q.spec)
+}
+
+// UnmarshalJSON replaces q with the criteria described by a JSON filter (see ParseCriteria).
+func (q *Criteria) UnmarshalJSON(data []byte) error {
+	criteria, err := ParseCriteria(data)
+	if err != nil {
+		return err
+	}
+	*q = *criteria
+	return nil
+}
+
+// ParseCriteria returns the criteria described by a JSON filter, as produced by Criteria.MarshalJSON. Filters only
+// contain values and operators (never code), so that filters received from untrusted sources can be safely executed.
+// Invalid filters, such as the ones using unknown operators, are rejected with ErrInvalidArgument.
+//
+// Filters are written in a syntax similar to the one of MongoDB. A filter is an object mapping each
+// field to a condition, where all the conditions must be satisfied: a condition is either a value, which the field must
+// be equal to, or an object of operators, such as {"age": {"$gte": 18, "$lt": 65}}. The supported field operators are:
+//
+//	$eq, $ne, $gt, $gte, $lt, $lte   comparisons (see Eq, Neq, Gt, GtEq, Lt and LtEq)
+//	$in                              an array of values (see In)
+//	$exists, $isNull                 booleans (see Exists, NotExists, IsNull and IsNotNull)
+//	$type                            a kind, such as "string" or "null" (see IsType)
+//	$containsAll, $containsAny       arrays of values (see ContainsAll and ContainsAny)
+//	$size, $sizeGt, $sizeLt          array sizes (see SizeEq, SizeGt and SizeLt)
+//	$startsWith, $endsWith, $like    strings, which are compared ignoring case if "$ignoreCase" is true
+//	                                 (also supported by $eq and $in, see EqIgnoreCase and InIgnoreCase, while
+//	                                 the other comparisons, $containsAll and $containsAny reject it)
+//	$regex                           a regular expression (see Regex)
+//	$elemMatch                       a filter (see ElemMatch)
+//	$search                          a text (see Search)
+//	$near                            an object with the lat, lon and radius fields (see Near)
+//	$within                          an array of points, each one with the lat and lon fields (see Within)
+//
+// Filters can be combined with the $and and $or operators, which take an array of filters, and negated with $not,
+// such as {"$or": [{"status": "active"}, {"$not": {"age": {"$lt": 18}}}]}. The empty filter selects all the documents.
+func ParseCriteria(data []byte) (*Criteria, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	filter := make(map[string]interface{})
+	if err := decoder.Decode(&filter); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+	return parseFilter(convertNumbers(filter).(map[string]interface{}))
+}
+
+func matchAll() *Criteria {
+	return &Criteria{
+		p:    func(_ *Document) bool { return true },
+		spec: map[string]interface{}{},
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func andCriteria(criteria *Criteria, other *Criteria) *Criteria {
+	if criteria == nil {
+		return other
+	}
+	return criteria.And(other)
+}
+
+func parseFilter(filter map[string]interface{}) (*Criteria, error) {
+	var criteria *Criteria
+	for _, key := range sortedKeys(filter) {
+		cond, err := parseCondition(key, filter[key])
+		if err != nil {
+			return nil, err
+		}
+		criteria = andCriteria(criteria, cond)
+	}
+
+	if criteria == nil {
+		return matchAll(), nil
+	}
+	return criteria, nil
+}
+
+func parseFilters(op string, value interface{}) ([]*Criteria, error) {
+	filters, isArray := value.([]interface{})
+	if !isArray || len(filters) == 0 {
+		return nil, fmt.Errorf("%w: %s requires a non empty array of filters", ErrInvalidArgument, op)
+	}
+
+	criteria := make([]*Criteria, 0, len(filters))
+	for _, item := range filters {
+		filter, isMap := item.(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("%w: %s requires a non empty array of filters", ErrInvalidArgument, op)
+		}
+
+		cond, err := parseFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		criteria = append(criteria, cond)
+	}
+	return criteria, nil
+}
+
+func parseCondition(key string, value interface{}) (*Criteria, error) {
+	switch key {
+	case "$and", "$or":
+		operands, err := parseFilters(key, value)
+		if err != nil {
+			return nil, err
+		}
+
+		criteria := operands[0]
+		for _, cond := range operands[1:] {
+			if key == "$and" {
+				criteria = criteria.And(cond)
+			} else {
+				criteria = criteria.Or(cond)
+			}
+		}
+		return criteria, nil
+	case "$not":
+		filter, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("%w: $not requires a filter", ErrInvalidArgument)
+		}
+
+		cond, err := parseFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		return cond.Not(), nil
+	}
+
+	if strings.HasPrefix(key, "$") {
+		return nil, fmt.Errorf("%w: unknown operator %s", ErrInvalidArgument, key)
+	}
+
+	ops, isMap := value.(map[string]interface{})
+	if !isMap || !hasOperators(ops) {
+		return Field(key).Eq(value), nil
+	}
+
+	var opts []StringOption
+	if ignoreCase, ok := ops["$ignoreCase"]; ok {
+		if ignoreCase, isBool := ignoreCase.(bool); !isBool {
+			return nil, fmt.Errorf("%w: $ignoreCase requires a boolean", ErrInvalidArgument)
+		} else if ignoreCase {
+			opts = append(opts, IgnoreCase)
+		}
+	}
+
+	var criteria *Criteria
+	for _, name := range sortedKeys(ops) {
+		if name == "$ignoreCase" {
+			continue
+		}
+
+		cond, err := parseOperator(Field(key), name, ops[name], opts)
+		if err != nil {
+			return nil, err
+		}
+		criteria = andCriteria(criteria, cond)
+	}
+
+	if criteria == nil {
+		return nil, fmt.Errorf("%w: no operator for field %s", ErrInvalidArgument, key)
+	}
+	return criteria, nil
+}
+
+func hasOperators(m map[string]interface{}) bool {
+	for key := range m {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func parseOperator(field *field, name string, value interface{}, opts []StringOption) (*Criteria, error) {
+	switch name {
+	case "$ne", "$gt", "$gte", "$lt", "$lte", "$containsAll", "$containsAny":
+		// these operators always compare values exactly, so the option would be silently ignored
+		if hasStringOption(opts, IgnoreCase) {
+			return nil, fmt.Errorf("%w: %s doesn't support $ignoreCase", ErrInvalidArgument, name)
+		}
+	}
+
+	switch name {
+	case "$eq":
+		if hasStringOption(opts, IgnoreCase) {
+			s, isString := value.(string)
+			if !isString {
+				return nil, fmt.Errorf("%w: $eq requires a string when $ignoreCase is set", ErrInvalidArgument)
+			}
+			return field.EqIgnoreCase(s), nil
+		}
+		return field.Eq(value), nil
+	case "$ne":
+		return field.Neq(value), nil
+	case "$gt":
+		return field.Gt(value), nil
+	case "$gte":
+		return field.GtEq(value), nil
+	case "$lt":
+		return field.Lt(value), nil
+	case "$lte":
+		return field.LtEq(value), nil
+	case "$in", "$containsAll", "$containsAny":
+		values, isArray := value.([]interface{})
+		if !isArray {
+			return nil, fmt.Errorf("%w: %s requires an array", ErrInvalidArgument, name)
+		}
+
+		switch {
+		case name == "$in" && hasStringOption(opts, IgnoreCase):
+			strs := make([]string, 0, len(values))
+			for _, v := range values {
+				s, isString := v.(string)
+				if !isString {
+					return nil, fmt.Errorf("%w: $in requires an array of strings when $ignoreCase is set", ErrInvalidArgument)
+				}
+				strs = append(strs, s)
+			}
+			return field.InIgnoreCase(strs...), nil
+		case name == "$in":
+			return field.In(values...), nil
+		case name == "$containsAll":
+			return field.ContainsAll(values...), nil
+		}
+		return field.ContainsAny(values...), nil
+	case "$exists", "$isNull":
+		flag, isBool := value.(bool)
+		if !isBool {
+			return nil, fmt.Errorf("%w: %s requires a boolean", ErrInvalidArgument, name)
+		}
+
+		if name == "$isNull" {
+			if flag {
+				return field.IsNull(), nil
+			}
+			return field.IsNotNull(), nil
+		}
+
+		if flag {
+			return field.Exists(), nil
+		}
+		return field.NotExists(), nil
+	case "$size", "$sizeGt", "$sizeLt":
+		n, isInt := value.(int64)
+		if !isInt {
+			return nil, fmt.Errorf("%w: %s requires an integer", ErrInvalidArgument, name)
+		}
+
+		switch name {
+		case "$size":
+			return field.SizeEq(int(n)), nil
+		case "$sizeGt":
+			return field.SizeGt(int(n)), nil
+		}
+		return field.SizeLt(int(n)), nil
+	case "$type":
+		kind, _ := value.(string)
+		switch Kind(kind) {
+		case KindNull, KindBool, KindNumber, KindString, KindArray, KindObject, KindTime, KindBytes:
+			return field.IsType(Kind(kind)), nil
+		}
+		return nil, fmt.Errorf("%w: $type requires a kind", ErrInvalidArgument)
+	case "$startsWith", "$endsWith", "$like", "$regex", "$search":
+		s, isString := value.(string)
+		if !isString {
+			return nil, fmt.Errorf("%w: %s requires a string", ErrInvalidArgument, name)
+		}
+
+		switch name {
+		case "$startsWith":
+			return field.StartsWith(s, opts...), nil
+		case "$endsWith":
+			return field.EndsWith(s, opts...), nil
+		case "$like":
+			return field.Like(s, opts...), nil
+		case "$search":
+			return field.Search(s), nil
+		}
+
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+		return field.regexCriteria(re).withSpec(field.name, "$regex", s), nil
+	case "$elemMatch":
+		filter, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("%w: $elemMatch requires a filter", ErrInvalidArgument)
+		}
+
+		cond, err := parseFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		return field.ElemMatch(cond), nil
+	case "$near":
+		m, isMap := value.(map[string]interface{})
+		lat, isLat := toFloat64(m["lat"])
+		lon, isLon := toFloat64(m["lon"])
+		radius, isRadius := toFloat64(m["radius"])
+		if !isMap || !isLat || !isLon || !isRadius {
+			return nil, fmt.Errorf("%w: $near requires an object with the lat, lon and radius fields", ErrInvalidArgument)
+		}
+		return field.Near(lat, lon, radius), nil
+	case "$within":
+		items, isArray := value.([]interface{})
+		if !isArray {
+			return nil, fmt.Errorf("%w: $within requires an array of points", ErrInvalidArgument)
+		}
+
+		polygon := make([]GeoPoint, 0, len(items))
+		for _, item := range items {
+			m, _ := item.(map[string]interface{})
+			lat, isLat := toFloat64(m["lat"])
+			lon, isLon := toFloat64(m["lon"])
+			if !isLat || !isLon {
+				return nil, fmt.Errorf("%w: $within requires an array of points", ErrInvalidArgument)
+			}
+			polygon = append(polygon, GeoPoint{Lat: lat, Lon: lon})
+		}
+		return field.Within(polygon), nil
+	}
+	return nil, fmt.Errorf("%w: unknown operator %s", ErrInvalidArgument, name)
+}
@@ -0,0 +1,403 @@
+package clover
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// earthRadius is the mean radius of the Earth, in meters.
+const earthRadius = 6371008.8
+
+// GeoPoint is a location on the Earth, given by its latitude and longitude in degrees. Documents store points as
+// objects having a lat and a lon field, which is how Document.Set stores a GeoPoint.
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Distance returns the great-circle distance between p and other, in meters.
+func (p GeoPoint) Distance(other GeoPoint) float64 {
+	lat1, lat2 := p.Lat*math.Pi/180, other.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (other.Lon - p.Lon) * math.Pi / 180
+
+	// haversine formula
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// geoPointOf returns the point stored in value, which must be an object with valid lat and lon fields.
+func geoPointOf(value interface{}) (GeoPoint, bool) {
+	m, isMap := value.(map[string]interface{})
+	if !isMap {
+		return GeoPoint{}, false
+	}
+
+	lat, isLatNumber := toFloat64(m["lat"])
+	lon, isLonNumber := toFloat64(m["lon"])
+	if !isLatNumber || !isLonNumber || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return GeoPoint{}, false
+	}
+	return GeoPoint{Lat: lat, Lon: lon}, true
+}
+
+// geoBox is a range of latitudes and longitudes, in degrees.
+type geoBox struct {
+	minLat, maxLat float64
+	minLon, maxLon float64
+}
+
+// boxMargin widens the boxes computed for geo criteria, so that rounding errors never exclude matching points.
+const boxMargin = 1e-6
+
+func (box geoBox) expand(margin float64) geoBox {
+	return geoBox{
+		minLat: math.Max(box.minLat-margin, -90),
+		maxLat: math.Min(box.maxLat+margin, 90),
+		minLon: math.Max(box.minLon-margin, -180),
+		maxLon: math.Min(box.maxLon+margin, 180),
+	}
+}
+
+// nearBox returns a box containing all the points within radius meters from center.
+func nearBox(center GeoPoint, radius float64) geoBox {
+	d := radius / earthRadius // angular radius, in radians
+	dLat := d * 180 / math.Pi
+
+	box := geoBox{minLat: center.Lat - dLat, maxLat: center.Lat + dLat, minLon: -180, maxLon: 180}
+
+	// longitudes are only restricted when the circle contains no pole and doesn't cross the antimeridian
+	if box.minLat > -90 && box.maxLat < 90 {
+		if s := math.Sin(d) / math.Cos(center.Lat*math.Pi/180); d < math.Pi/2 && s < 1 {
+			dLon := math.Asin(s) * 180 / math.Pi
+			if center.Lon-dLon > -180 && center.Lon+dLon < 180 {
+				box.minLon, box.maxLon = center.Lon-dLon, center.Lon+dLon
+			}
+		}
+	}
+	return box.expand(boxMargin)
+}
+
+// polygonBox returns the smallest box containing polygon.
+func polygonBox(polygon []GeoPoint) geoBox {
+	box := geoBox{minLat: 90, maxLat: -90, minLon: 180, maxLon: -180}
+	for _, p := range polygon {
+		box.minLat, box.maxLat = math.Min(box.minLat, p.Lat), math.Max(box.maxLat, p.Lat)
+		box.minLon, box.maxLon = math.Min(box.minLon, p.Lon), math.Max(box.maxLon, p.Lon)
+	}
+	return box.expand(boxMargin)
+}
+
+// polygonContains returns true if p lies inside polygon, whose edges are straight lines in latitude and longitude.
+func polygonContains(polygon []GeoPoint, p GeoPoint) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) && p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// geoSearch describes a Near or Within criteria, which can be answered using a geo index on field: all the matching
+// points lie inside box.
+type geoSearch struct {
+	field string
+	box   geoBox
+}
+
+// Near selects the documents where the field holds a point (see GeoPoint) within radius meters from the point with the
+// given latitude and longitude. If the collection has a geo index on the field (see CreateGeoIndex), it is used to find
+// the matching documents without scanning the whole collection.
+func (r *field) Near(lat float64, lon float64, radius float64) *Criteria {
+	center := GeoPoint{Lat: lat, Lon: lon}
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			p, isPoint := geoPointOf(doc.Get(r.name))
+			return isPoint && p.Distance(center) <= radius
+		},
+		geoSearches: []geoSearch{{field: r.name, box: nearBox(center, radius)}},
+	}).withSpec(r.name, "$near", map[string]interface{}{"lat": lat, "lon": lon, "radius": radius})
+}
+
+// Within selects the documents where the field holds a point (see GeoPoint) lying inside polygon, given by its vertices.
+// Edges are straight lines in latitude and longitude, so polygons crossing the antimeridian are not supported.
+// A polygon with less than three vertices matches nothing. As for Near, a geo index on the field is used, if any.
+func (r *field) Within(polygon []GeoPoint) *Criteria {
+	vertices := append([]GeoPoint{}, polygon...)
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			p, isPoint := geoPointOf(doc.Get(r.name))
+			return isPoint && len(vertices) >= 3 && polygonContains(vertices, p)
+		},
+		geoSearches: []geoSearch{{field: r.name, box: polygonBox(vertices)}},
+	}).withSpec(r.name, "$within", vertices)
+}
+
+// Points are indexed by their geohash, which is obtained by interleaving the bits of the indexes of the cells containing
+// the point, in a grid dividing longitudes and latitudes into powers of two cells. Points inside the same cell share
+// a prefix of their geohash, so that the points inside a box are found by scanning the prefixes of the cells covering it.
+const (
+	geohashPrecision = 12
+	geohashAlphabet  = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	// maxGeoCells is the maximum number of cells scanned to find the points inside a box
+	maxGeoCells = 32
+)
+
+// geohashBits returns the number of bits used to encode the longitude and the latitude in a geohash of the given length.
+func geohashBits(precision int) (lonBits uint, latBits uint) {
+	bits := uint(5 * precision)
+	return (bits + 1) / 2, bits / 2
+}
+
+// cellIndex returns the index of the cell containing v, when the range [min, max] is divided into 2^bits cells.
+func cellIndex(v float64, min float64, max float64, bits uint) uint64 {
+	if v <= min {
+		return 0
+	}
+
+	n := uint64(1) << bits
+	i := uint64((v - min) / (max - min) * float64(n))
+	if i >= n {
+		i = n - 1
+	}
+	return i
+}
+
+// geohash returns the geohash of the given length of the cell with the given longitude and latitude indexes.
+func geohash(lonIdx uint64, latIdx uint64, precision int) string {
+	lonBits, latBits := geohashBits(precision)
+
+	var sb strings.Builder
+	ch := 0
+	for i := 0; i < 5*precision; i++ {
+		var bit uint64
+		if i%2 == 0 {
+			lonBits--
+			bit = (lonIdx >> lonBits) & 1
+		} else {
+			latBits--
+			bit = (latIdx >> latBits) & 1
+		}
+
+		ch = ch<<1 | int(bit)
+		if i%5 == 4 {
+			sb.WriteByte(geohashAlphabet[ch])
+			ch = 0
+		}
+	}
+	return sb.String()
+}
+
+func pointGeohash(p GeoPoint) string {
+	lonBits, latBits := geohashBits(geohashPrecision)
+	return geohash(cellIndex(p.Lon, -180, 180, lonBits), cellIndex(p.Lat, -90, 90, latBits), geohashPrecision)
+}
+
+// cellRanges returns the ranges of the indexes of the cells of the given precision covering box.
+func (box geoBox) cellRanges(precision int) (minLon, maxLon, minLat, maxLat uint64) {
+	lonBits, latBits := geohashBits(precision)
+	return cellIndex(box.minLon, -180, 180, lonBits), cellIndex(box.maxLon, -180, 180, lonBits),
+		cellIndex(box.minLat, -90, 90, latBits), cellIndex(box.maxLat, -90, 90, latBits)
+}
+
+// cells returns the geohashes of the cells covering box, using the longest geohashes for which there are at most
+// maxGeoCells of them.
+func (box geoBox) cells() []string {
+	if box.minLat > box.maxLat || box.minLon > box.maxLon {
+		return nil
+	}
+
+	precision := 1
+	for precision < geohashPrecision {
+		minLon, maxLon, minLat, maxLat := box.cellRanges(precision + 1)
+		if (maxLon-minLon+1)*(maxLat-minLat+1) > maxGeoCells {
+			break
+		}
+		precision++
+	}
+
+	cells := make([]string, 0, maxGeoCells)
+	minLon, maxLon, minLat, maxLat := box.cellRanges(precision)
+	for lonIdx := minLon; lonIdx <= maxLon; lonIdx++ {
+		for latIdx := minLat; latIdx <= maxLat; latIdx++ {
+			cells = append(cells, geohash(lonIdx, latIdx, precision))
+		}
+	}
+	return cells
+}
+
+type geoEntry struct {
+	hash string
+	id   string
+}
+
+// geoIndex keeps the ids of the documents of a collection sorted by the geohash of the point stored in a field.
+// Documents not having a valid point in the field are not indexed. As the other indexes, it is copy-on-write.
+type geoIndex struct {
+	field   string
+	entries []geoEntry
+}
+
+func newGeoIndex(field string) *geoIndex {
+	return &geoIndex{field: field, entries: make([]geoEntry, 0)}
+}
+
+func (idx *geoIndex) clone() *geoIndex {
+	entries := make([]geoEntry, len(idx.entries))
+	copy(entries, idx.entries)
+	return &geoIndex{field: idx.field, entries: entries}
+}
+
+func (idx *geoIndex) entryOf(doc *Document) (geoEntry, bool) {
+	p, isPoint := geoPointOf(doc.Get(idx.field))
+	if !isPoint {
+		return geoEntry{}, false
+	}
+	return geoEntry{hash: pointGeohash(p), id: doc.ObjectId()}, true
+}
+
+func (idx *geoIndex) position(e geoEntry) int {
+	return sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].hash > e.hash || (idx.entries[i].hash == e.hash && idx.entries[i].id >= e.id)
+	})
+}
+
+func (idx *geoIndex) add(doc *Document) {
+	e, ok := idx.entryOf(doc)
+	if !ok {
+		return
+	}
+
+	i := idx.position(e)
+	idx.entries = append(idx.entries, geoEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = e
+}
+
+func (idx *geoIndex) remove(doc *Document) {
+	e, ok := idx.entryOf(doc)
+	if !ok {
+		return
+	}
+
+	i := idx.position(e)
+	if i < len(idx.entries) && idx.entries[i] == e {
+		idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+	}
+}
+
+func (idx *geoIndex) build(docs map[string]*Document) {
+	for _, doc := range docs {
+		if e, ok := idx.entryOf(doc); ok {
+			idx.entries = append(idx.entries, e)
+		}
+	}
+
+	sort.Slice(idx.entries, func(i, j int) bool {
+		e1, e2 := idx.entries[i], idx.entries[j]
+		return e1.hash < e2.hash || (e1.hash == e2.hash && e1.id < e2.id)
+	})
+}
+
+func (idx *geoIndex) truncate() {
+	idx.entries = idx.entries[:0]
+}
+
+// search returns, in sorted order, the ids of the documents whose point lies in one of the cells covering box.
+func (idx *geoIndex) search(box geoBox) []string {
+	ids := make([]string, 0)
+	for _, cell := range box.cells() {
+		start := sort.Search(len(idx.entries), func(i int) bool {
+			return idx.entries[i].hash >= cell
+		})
+
+		for i := start; i < len(idx.entries) && strings.HasPrefix(idx.entries[i].hash, cell); i++ {
+			ids = append(ids, idx.entries[i].id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (c *collection) getGeoIndex(field string) *geoIndex {
+	for _, idx := range c.geoIndexes {
+		if idx.field == field {
+			return idx
+		}
+	}
+	return nil
+}
+
+// geoPlan returns the geo index which can be used to answer q, along with the corresponding search.
+func (q *Query) geoPlan() (*geoIndex, *geoSearch) {
+	if q.criteria == nil {
+		return nil, nil
+	}
+
+	for i, search := range q.criteria.geoSearches {
+		if idx := q.collection.getGeoIndex(search.field); idx != nil {
+			return idx, &q.criteria.geoSearches[i]
+		}
+	}
+	return nil, nil
+}
+
+// CreateGeoIndex creates a geospatial index on a field of a collection, which is used by Near and Within criteria on
+// the same field. As for the other indexes, its definition is persisted, so that the index is rebuilt when the database is reopened.
+func (db *DB) CreateGeoIndex(collectionName string, field string) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	if field == "" {
+		return ErrInvalidArgument
+	}
+
+	if c.getGeoIndex(field) != nil {
+		return indexExistError(collectionName, field)
+	}
+
+	idx := newGeoIndex(field)
+	idx.build(c.docs)
+
+	newCollection := c.clone()
+	newCollection.geoIndexes = append(newCollection.geoIndexes, idx)
+	return db.commit(newCollection)
+}
+
+// DropGeoIndex removes the geospatial index on a field of a collection.
+func (db *DB) DropGeoIndex(collectionName string, field string) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	if c.getGeoIndex(field) == nil {
+		return indexNotExistError(collectionName, field)
+	}
+
+	newCollection := c.clone()
+	geoIndexes := make([]*geoIndex, 0, len(c.geoIndexes))
+	for _, idx := range newCollection.geoIndexes {
+		if idx.field != field {
+			geoIndexes = append(geoIndexes, idx)
+		}
+	}
+	newCollection.geoIndexes = geoIndexes
+	return db.commit(newCollection)
+}
@@ -0,0 +1,135 @@
+package clover
+
+import "fmt"
+
+// Hooks are functions invoked on the documents written to a collection, such as for maintaining timestamps or derived
+// fields, or for audit logging. Any of them can be nil.
+//
+// BeforeInsert and BeforeUpdate receive a copy of each document about to be inserted or updated, which they are free to
+// modify (except for its id): the modified document is the one being stored, and it is checked against the validator
+// and the unique indexes of the collection. BeforeDelete receives each document about to be deleted. If any of these
+// functions returns an error, the whole write fails with that error and nothing is written. Hooks are called for each
+// document written by any operation, including transactions, but not when a collection is dropped.
+//
+// Before hooks are called while the database is locked for writing, so they must not access the database. After hooks
+// are invoked once the write has been committed and the lock has been released: they are free to access the database,
+// for example to record the write in an audit collection, but concurrent writes may be committed in the meantime.
+type Hooks struct {
+	BeforeInsert func(doc *Document) error
+	BeforeUpdate func(doc *Document) error
+	BeforeDelete func(doc *Document) error
+
+	AfterInsert func(doc *Document)
+	AfterUpdate func(doc *Document)
+	AfterDelete func(doc *Document)
+}
+
+// WithHooks registers the supplied hooks on the collection. As for validators, hooks are not stored on disk,
+// so they must be registered again (see SetHooks) each time the database is opened.
+func WithHooks(hooks Hooks) CollectionOption {
+	return func(opts *collectionOptions) {
+		opts.hooks = hooks
+	}
+}
+
+// SetHooks replaces the hooks of an existing collection (see WithHooks). Passing an empty Hooks removes them.
+func (db *DB) SetHooks(collectionName string, hooks Hooks) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	newCollection := c.clone()
+	newCollection.hooks = hooks
+	db.collections[collectionName] = newCollection
+	return nil
+}
+
+// runBeforeHooks invokes the before hooks of c on the documents of the supplied events, which describe the changes
+// turning the previous version of the collection into c. Documents modified by hooks replace the original ones,
+// both in c and in events.
+func (c *collection) runBeforeHooks(events []ChangeEvent) error {
+	for i, e := range events {
+		var hook func(doc *Document) error
+		switch e.Op {
+		case OpInsert:
+			hook = c.hooks.BeforeInsert
+		case OpUpdate:
+			hook = c.hooks.BeforeUpdate
+		case OpDelete:
+			if c.hooks.BeforeDelete != nil {
+				if err := c.hooks.BeforeDelete(e.Doc.Copy()); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if hook == nil {
+			continue
+		}
+
+		hookDoc := e.Doc.Copy()
+		hookDoc.fields = deepCopy(e.Doc.fields).(map[string]interface{})
+		if err := hook(hookDoc); err != nil {
+			return err
+		}
+
+		if hookDoc.ObjectId() != e.Id {
+			return fmt.Errorf("%w: hooks cannot change the id of document %s", ErrInvalidArgument, e.Id)
+		}
+
+		// hooks can set values of any type, like Document.Set
+		fields, err := c.db.codecs.normalize(hookDoc.fields, c.db.preserveInts)
+		if err != nil {
+			return err
+		}
+		hookDoc.fields = fields.(map[string]interface{})
+
+		c.put(hookDoc)
+		events[i].Doc = hookDoc
+	}
+	return nil
+}
+
+// queueAfterHooks schedules the after hooks of the collections affected by the supplied (committed) events, which are
+// invoked as soon as db.mu is released (see unlock). It must be called holding db.mu for writing.
+func (db *DB) queueAfterHooks(events []ChangeEvent) {
+	for _, e := range events {
+		c, ok := db.collections[e.Collection]
+		if !ok {
+			continue
+		}
+
+		var hook func(doc *Document)
+		switch e.Op {
+		case OpInsert:
+			hook = c.hooks.AfterInsert
+		case OpUpdate:
+			hook = c.hooks.AfterUpdate
+		case OpDelete:
+			hook = c.hooks.AfterDelete
+		}
+
+		if hook != nil {
+			doc := e.Doc
+			db.afterHooks = append(db.afterHooks, func() { hook(doc) })
+		}
+	}
+}
+
+// unlock releases db.mu, held for writing, and then invokes the after hooks of the writes committed in the meantime.
+func (db *DB) unlock() {
+	hooks := db.afterHooks
+	db.afterHooks = nil
+	db.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+}
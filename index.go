@@ -0,0 +1,489 @@
+package clover
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+type indexEntry struct {
+	key []interface{}
+	id  string
+}
+
+// index keeps the ids of the documents of a collection sorted by the values of one or more fields.
+// As collections, indexes are never modified once committed: each write operates on a clone.
+type index struct {
+	fields  []string
+	unique  bool
+	entries []indexEntry
+}
+
+func newIndex(fields []string, unique bool) *index {
+	return &index{fields: fields, unique: unique, entries: make([]indexEntry, 0)}
+}
+
+func (idx *index) name() string {
+	return strings.Join(idx.fields, ",")
+}
+
+func (idx *index) clone() *index {
+	entries := make([]indexEntry, len(idx.entries))
+	copy(entries, idx.entries)
+	return &index{fields: idx.fields, unique: idx.unique, entries: entries}
+}
+
+// missingValue is the key component used for documents not having an indexed field.
+type missingValue struct{}
+
+// rankBound is a key component which compares lower (or greater, if end is true) than any value of the given type rank.
+// It is used to scan all the values of a given type, as typeRank groups values of the same type together.
+type rankBound struct {
+	rank int
+	end  bool
+}
+
+func valueRank(v interface{}) int {
+	if _, isMissing := v.(missingValue); isMissing {
+		return typeRank(nil, false)
+	}
+	return typeRank(v, true)
+}
+
+func compareIndexValues(v1 interface{}, v2 interface{}) int {
+	if b, isBound := v2.(rankBound); isBound {
+		return -compareIndexValues(b, v1)
+	}
+
+	if b, isBound := v1.(rankBound); isBound {
+		rank := valueRank(v2)
+		if b.rank != rank {
+			return b.rank - rank
+		}
+		if b.end {
+			return 1
+		}
+		return -1
+	}
+
+	rank1, rank2 := valueRank(v1), valueRank(v2)
+	if rank1 != rank2 {
+		return rank1 - rank2
+	}
+
+	res, _ := compareValues(v1, v2)
+	return res
+}
+
+// compareKeys compares the first len(k2) components of k1 with k2.
+func compareKeys(k1 []interface{}, k2 []interface{}) int {
+	for i := range k2 {
+		if res := compareIndexValues(k1[i], k2[i]); res != 0 {
+			return res
+		}
+	}
+	return 0
+}
+
+func (idx *index) keyOf(doc *Document) []interface{} {
+	key := make([]interface{}, 0, len(idx.fields))
+	for _, field := range idx.fields {
+		if doc.Has(field) {
+			key = append(key, doc.Get(field))
+		} else {
+			key = append(key, missingValue{})
+		}
+	}
+	return key
+}
+
+func compareEntries(e1 indexEntry, e2 indexEntry) int {
+	if res := compareKeys(e1.key, e2.key); res != 0 {
+		return res
+	}
+	return strings.Compare(e1.id, e2.id)
+}
+
+func (idx *index) search(e indexEntry) int {
+	return sort.Search(len(idx.entries), func(i int) bool {
+		return compareEntries(idx.entries[i], e) >= 0
+	})
+}
+
+func (idx *index) add(doc *Document) {
+	e := indexEntry{key: idx.keyOf(doc), id: doc.ObjectId()}
+	i := idx.search(e)
+	idx.entries = append(idx.entries, indexEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = e
+}
+
+// build fills the index with the supplied documents, sorting all the entries at once.
+func (idx *index) build(docs map[string]*Document) {
+	for _, doc := range docs {
+		idx.entries = append(idx.entries, indexEntry{key: idx.keyOf(doc), id: doc.ObjectId()})
+	}
+
+	sort.Slice(idx.entries, func(i, j int) bool {
+		return compareEntries(idx.entries[i], idx.entries[j]) < 0
+	})
+}
+
+// duplicateKey returns the first key shared by more than one entry, ignoring keys with missing components.
+func (idx *index) duplicateKey() ([]interface{}, bool) {
+	for i := 1; i < len(idx.entries); i++ {
+		key := idx.entries[i].key
+		if compareKeys(idx.entries[i-1].key, key) == 0 && !hasMissingValue(key) {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func hasMissingValue(key []interface{}) bool {
+	for _, v := range key {
+		if _, isMissing := v.(missingValue); isMissing {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConstraints returns an error if c, which is a new version of prev (or a new collection, if prev is nil),
+// violates any unique index or size limit, or contains an added or modified document which is rejected by the validator of c.
+func (c *collection) checkConstraints(prev *collection) error {
+	if err := c.checkUniqueIndexes(); err != nil {
+		return err
+	}
+
+	if err := c.checkSizeLimits(prev); err != nil {
+		return err
+	}
+
+	if c.validator == nil {
+		return nil
+	}
+
+	for id, doc := range c.docs {
+		if prev != nil && prev.docs[id] == doc {
+			continue
+		}
+
+		if err := c.validator(doc); err != nil {
+			return invalidDocumentError(c.name, id, err)
+		}
+	}
+	return nil
+}
+
+// checkUniqueIndexes returns an error if any unique index of c contains a duplicate key.
+func (c *collection) checkUniqueIndexes() error {
+	for _, idx := range c.indexes {
+		if !idx.unique {
+			continue
+		}
+
+		if key, ok := idx.duplicateKey(); ok {
+			return uniqueIndexError(c.name, idx.name(), key)
+		}
+	}
+	return nil
+}
+
+func (idx *index) remove(doc *Document) {
+	e := indexEntry{key: idx.keyOf(doc), id: doc.ObjectId()}
+	i := idx.search(e)
+	if i < len(idx.entries) && idx.entries[i].id == e.id {
+		idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+	}
+}
+
+type keyBound struct {
+	key       []interface{}
+	inclusive bool
+}
+
+// scan returns the ids of the entries whose key lies between lower and upper.
+func (idx *index) scan(lower keyBound, upper keyBound) []string {
+	start := sort.Search(len(idx.entries), func(i int) bool {
+		res := compareKeys(idx.entries[i].key, lower.key)
+		return res > 0 || (res == 0 && lower.inclusive)
+	})
+
+	end := sort.Search(len(idx.entries), func(i int) bool {
+		res := compareKeys(idx.entries[i].key, upper.key)
+		return res > 0 || (res == 0 && !upper.inclusive)
+	})
+
+	ids := make([]string, 0)
+	for i := start; i < end; i++ {
+		ids = append(ids, idx.entries[i].id)
+	}
+	return ids
+}
+
+type condOp int
+
+const (
+	opEq condOp = iota
+	opGt
+	opGtEq
+	opLt
+	opLtEq
+)
+
+// fieldCond describes a comparison between a field and a value, which can be answered by scanning an index.
+type fieldCond struct {
+	field string
+	op    condOp
+	value interface{}
+}
+
+func newFieldConds(field string, op condOp, value interface{}) []fieldCond {
+	// values of named types may be preserved by a codec, so that they wouldn't match the normalized value
+	if value == nil || reflect.TypeOf(value).PkgPath() != "" {
+		return nil
+	}
+
+	normValue, err := normalize(value, true)
+	if err != nil {
+		return nil
+	}
+
+	// null values, objects and arrays are not supported by index scans
+	switch normValue.(type) {
+	case int64, float64, string, bool:
+		return []fieldCond{{field: field, op: op, value: normValue}}
+	}
+	return nil
+}
+
+// indexPlan describes how a query can be answered using an index.
+type indexPlan struct {
+	index *index
+	lower keyBound
+	upper keyBound
+}
+
+func findCond(conds []fieldCond, field string, ops ...condOp) *fieldCond {
+	for i, cond := range conds {
+		if cond.field != field {
+			continue
+		}
+
+		for _, op := range ops {
+			if cond.op == op {
+				return &conds[i]
+			}
+		}
+	}
+	return nil
+}
+
+// planIndex returns the plan for the index which matches the longest prefix of the supplied conditions, if any.
+// An index matches a prefix of length p when the first p fields are compared for equality: in addition,
+// a range comparison on the next field can be used to further restrict the scan.
+func planIndex(indexes []*index, conds []fieldCond) *indexPlan {
+	var bestPlan *indexPlan
+	bestScore := 0
+	for _, idx := range indexes {
+		eqKey := make([]interface{}, 0)
+		for _, field := range idx.fields {
+			cond := findCond(conds, field, opEq)
+			if cond == nil {
+				break
+			}
+			eqKey = append(eqKey, cond.value)
+		}
+
+		score := 2 * len(eqKey)
+		plan := &indexPlan{
+			index: idx,
+			lower: keyBound{key: eqKey, inclusive: true},
+			upper: keyBound{key: eqKey, inclusive: true},
+		}
+
+		if len(eqKey) < len(idx.fields) {
+			field := idx.fields[len(eqKey)]
+			lowerCond := findCond(conds, field, opGt, opGtEq)
+			upperCond := findCond(conds, field, opLt, opLtEq)
+
+			if lowerCond != nil || upperCond != nil {
+				score++
+
+				var lowerValue, upperValue interface{}
+				if lowerCond != nil {
+					lowerValue = lowerCond.value
+					plan.lower.inclusive = lowerCond.op == opGtEq
+				} else {
+					lowerValue = rankBound{rank: valueRank(upperCond.value)}
+				}
+
+				if upperCond != nil {
+					upperValue = upperCond.value
+					plan.upper.inclusive = upperCond.op == opLtEq
+				} else {
+					upperValue = rankBound{rank: valueRank(lowerCond.value), end: true}
+				}
+
+				plan.lower.key = append(append([]interface{}{}, eqKey...), lowerValue)
+				plan.upper.key = append(append([]interface{}{}, eqKey...), upperValue)
+			}
+		}
+
+		if score > bestScore {
+			bestPlan, bestScore = plan, score
+		}
+	}
+	return bestPlan
+}
+
+// QueryPlan describes how a query is executed.
+type QueryPlan struct {
+	// IndexFields contains the fields of the index used to answer the query, or nil if the whole collection is scanned.
+	IndexFields []string
+
+	// TextIndexField contains the field of the text index used to answer the query, if any (see Search).
+	TextIndexField string
+
+	// GeoIndexField contains the field of the geo index used to answer the query, if any (see Near and Within).
+	GeoIndexField string
+
+	// Candidates is the number of documents scanned to answer the query, that is, the number of documents in the range
+	// of the index, the number of matches of the text index, the number of points in the cells of the geo index
+	// covering the searched area, or the size of the collection if no index is used.
+	Candidates int
+
+	// Documents is the number of documents selected by the query, and Duration the time spent executing it.
+	// They are only set by ExplainAnalyze.
+	Documents int
+	Duration  time.Duration
+}
+
+// IndexUsed returns true if the query is answered using an index (either a regular or a text one).
+func (p *QueryPlan) IndexUsed() bool {
+	return p.IndexFields != nil || p.TextIndexField != "" || p.GeoIndexField != ""
+}
+
+// Explain returns the plan used to execute q, without executing it.
+func (q *Query) Explain() *QueryPlan {
+	plan := q.plan()
+	if plan == nil {
+		if idx, search := q.textPlan(); idx != nil {
+			return &QueryPlan{TextIndexField: idx.field, Candidates: len(idx.search(search.terms))}
+		}
+
+		if idx, search := q.geoPlan(); idx != nil {
+			return &QueryPlan{GeoIndexField: idx.field, Candidates: len(idx.search(search.box))}
+		}
+		return &QueryPlan{Candidates: q.collection.Count()}
+	}
+
+	return &QueryPlan{
+		IndexFields: append([]string{}, plan.index.fields...),
+		Candidates:  len(plan.index.scan(plan.lower, plan.upper)),
+	}
+}
+
+// ExplainAnalyze executes q, and returns its plan (see Explain) along with the number of selected documents and the
+// time spent selecting them, including sorting and projections. The query cache (see Cached) is not used.
+func (q *Query) ExplainAnalyze() *QueryPlan {
+	plan := q.Explain()
+
+	start := time.Now()
+	q.forEach(func(doc *Document) bool {
+		q.project(doc)
+		plan.Documents++
+		return true
+	})
+	plan.Duration = time.Since(start)
+	return plan
+}
+
+func (q *Query) plan() *indexPlan {
+	if q.criteria == nil {
+		return nil
+	}
+	return planIndex(q.collection.indexes, q.criteria.conds)
+}
+
+func (c *collection) getIndex(fields []string) *index {
+	name := strings.Join(fields, ",")
+	for _, idx := range c.indexes {
+		if idx.name() == name {
+			return idx
+		}
+	}
+	return nil
+}
+
+// CreateIndex creates an index on the supplied fields of a collection. If more than one field is given, a compound index
+// is created, sorting documents by the values of the fields in the given order. An index is automatically used by
+// queries comparing for equality a prefix of its fields, optionally followed by a range comparison on the next field.
+// Index definitions are persisted, so that indexes are rebuilt when the database is reopened.
+func (db *DB) CreateIndex(collectionName string, fields ...string) error {
+	return db.createIndex(collectionName, fields, false)
+}
+
+// CreateUniqueIndex creates an index which, in addition, prevents two documents from having the same values for
+// the supplied fields. Any write which would violate the constraint fails with ErrDuplicateKey, as does creating the
+// index if the collection already contains duplicates. Documents missing any of the fields are not constrained.
+func (db *DB) CreateUniqueIndex(collectionName string, fields ...string) error {
+	return db.createIndex(collectionName, fields, true)
+}
+
+func (db *DB) createIndex(collectionName string, fields []string, unique bool) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	if len(fields) == 0 {
+		return ErrInvalidArgument
+	}
+
+	if c.getIndex(fields) != nil {
+		return indexExistError(collectionName, strings.Join(fields, ","))
+	}
+
+	idx := newIndex(append([]string{}, fields...), unique)
+	idx.build(c.docs)
+
+	newCollection := c.clone()
+	newCollection.indexes = append(newCollection.indexes, idx)
+	return db.commit(newCollection)
+}
+
+// DropIndex removes the index on the supplied fields of a collection.
+func (db *DB) DropIndex(collectionName string, fields ...string) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	idx := c.getIndex(fields)
+	if idx == nil {
+		return indexNotExistError(collectionName, strings.Join(fields, ","))
+	}
+
+	newCollection := c.clone()
+	indexes := make([]*index, 0, len(c.indexes))
+	for _, other := range newCollection.indexes {
+		if other.name() != idx.name() {
+			indexes = append(indexes, other)
+		}
+	}
+	newCollection.indexes = indexes
+	return db.commit(newCollection)
+}
@@ -0,0 +1,107 @@
+package clover
+
+import "sort"
+
+// WithLazyLoading makes Open only list the stored collections, without reading them: each collection is loaded the
+// first time it is accessed (for example, by Query or Insert), so that the time taken by Open doesn't depend on the
+// size of the database. Use DB.Preload to load some collections in advance.
+//
+// Since collections are only decoded when loaded, a corrupted collection is reported by HasCollection and
+// ListCollections until the first access, and only then by CorruptedCollections. DeleteExpired only considers the
+// collections already loaded.
+func WithLazyLoading() Option {
+	return func(opts *options) {
+		opts.lazy = true
+	}
+}
+
+// Preload loads the collections with the given names, or all the stored collections if no name is supplied, unless
+// they have already been loaded (see WithLazyLoading). It fails if any of the collections doesn't exist or cannot be
+// loaded: in the latter case, the collection is reported by CorruptedCollections.
+func (db *DB) Preload(names ...string) error {
+	db.mu.Lock()
+	defer db.unlock()
+
+	if len(names) == 0 {
+		names = db.unloadedCollections()
+	}
+
+	for _, name := range names {
+		db.loadCollection(name)
+
+		if err, ok := db.corrupted[name]; ok {
+			return err
+		}
+
+		if !db.hasCollection(name) {
+			return collectionNotExistError(name)
+		}
+	}
+	return nil
+}
+
+// ensureLoaded loads the collections with the given names (or the sources of the views with such names), or all the
+// collections if no name is supplied, unless they have already been loaded. It must be called without holding db.mu.
+func (db *DB) ensureLoaded(names ...string) {
+	if !db.lazy {
+		return
+	}
+
+	db.mu.RLock()
+	pending := db.pendingCollections(names)
+	db.mu.RUnlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	for _, name := range pending {
+		db.loadCollection(name)
+	}
+}
+
+func (db *DB) pendingCollections(names []string) []string {
+	if len(names) == 0 {
+		return db.unloadedCollections()
+	}
+
+	pending := make([]string, 0)
+	for _, name := range names {
+		for v, ok := db.views[name]; ok; v, ok = db.views[name] {
+			name = v.source
+		}
+
+		if db.unloaded[name] {
+			pending = append(pending, name)
+		}
+	}
+	return pending
+}
+
+func (db *DB) unloadedCollections() []string {
+	names := make([]string, 0, len(db.unloaded))
+	for name := range db.unloaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadCollection reads the stored collection with the given name, unless it has already been loaded. Collections which
+// cannot be loaded are recorded as corrupted. It must be called holding db.mu for writing.
+func (db *DB) loadCollection(name string) {
+	if !db.unloaded[name] {
+		return
+	}
+	delete(db.unloaded, name)
+
+	c, err := db.readCollection(name)
+	if err != nil {
+		db.corrupted[name] = corruptedCollectionError(name, err)
+		return
+	}
+	db.collections[name] = c
+}
@@ -0,0 +1,66 @@
+package clover
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// WithMaxDocumentSize limits the size of the documents of the database to n bytes, measured on their JSON encoding
+// as stored in collection files. Any write adding or changing a larger document fails with ErrDocumentTooLarge,
+// and nothing is written. Documents already stored are not checked. By default, documents can have any size.
+func WithMaxDocumentSize(n int) Option {
+	return func(opts *options) {
+		opts.maxDocumentSize = n
+	}
+}
+
+// WithMaxCollectionSize limits the number of documents of each collection of the database to n. Any write which would
+// make a collection grow beyond the limit fails with ErrCollectionFull, and nothing is written, while writes removing
+// documents are always allowed. By default, collections can have any number of documents.
+func WithMaxCollectionSize(n int) Option {
+	return func(opts *options) {
+		opts.maxCollectionSize = n
+	}
+}
+
+func documentTooLargeError(collectionName string, id string, size int, max int) error {
+	return fmt.Errorf("%w: id %s in collection %s has %d bytes (maximum %d)", ErrDocumentTooLarge, id, collectionName, size, max)
+}
+
+func collectionFullError(collectionName string, max int) error {
+	return fmt.Errorf("%w: %s cannot contain more than %d documents", ErrCollectionFull, collectionName, max)
+}
+
+// checkSizeLimits returns an error if c, which is a new version of prev (or a new collection, if prev is nil),
+// exceeds the limits of the database on the number of documents or on the size of the added or modified documents.
+func (c *collection) checkSizeLimits(prev *collection) error {
+	db := c.db
+	if max := db.maxCollectionSize; max > 0 && len(c.docs) > max && (prev == nil || len(c.docs) > len(prev.docs)) {
+		return collectionFullError(c.name, max)
+	}
+
+	if db.maxDocumentSize <= 0 {
+		return nil
+	}
+
+	for id, doc := range c.docs {
+		if prev != nil && prev.docs[id] == doc {
+			continue
+		}
+
+		fields, err := db.codecs.encode(doc.fields)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+
+		if len(data) > db.maxDocumentSize {
+			return documentTooLargeError(c.name, id, len(data), db.maxDocumentSize)
+		}
+	}
+	return nil
+}
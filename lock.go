@@ -0,0 +1,47 @@
+package clover
+
+import (
+	"fmt"
+	"os"
+)
+
+// WithNoDirectoryLock makes Open skip locking the database directory (see Open), for file systems which don't support
+// locks, such as some network file systems. The caller is then responsible for never opening the database for
+// writing from multiple processes at the same time, and for not reading it in read-only mode while it is written.
+func WithNoDirectoryLock() Option {
+	return func(opts *options) {
+		opts.noLock = true
+	}
+}
+
+// lockDir locks the database stored in dir until the returned file is closed. Exclusive locks, taken by databases
+// opened for writing, prevent other processes from opening the database at all, while shared locks, taken by read-only
+// databases, only prevent it from being opened for writing. The directory itself is locked, so that no lock file has
+// to be created inside it. If a conflicting lock is held by another process (or by another database opened on dir by
+// the same process), it fails with ErrDatabaseLocked.
+func lockDir(dir string, exclusive bool) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flock(f, exclusive); err != nil {
+		f.Close()
+		if err == errLockHeld {
+			return nil, fmt.Errorf("%w: %s is used by another process", ErrDatabaseLocked, dir)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// unlockDir releases the lock on the database directory, if any, so that the database can be opened again.
+func (db *DB) unlockDir() error {
+	if db.dirLock == nil {
+		return nil
+	}
+
+	err := db.dirLock.Close()
+	db.dirLock = nil
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package clover
+
+import (
+	"errors"
+	"os"
+)
+
+var errLockHeld = errors.New("lock held")
+
+// flock has no effect on platforms without flock(2): databases are not protected from concurrent processes, as
+// documented by Open.
+func flock(_ *os.File, _ bool) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package clover
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errLockHeld = errors.New("lock held")
+
+// flock acquires an advisory lock on f, which is shared if exclusive is false, without waiting for it to be released
+// if a conflicting lock is held elsewhere.
+func flock(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLockHeld
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package clover
+
+import "strings"
+
+// collectionMetadata holds the settings of a collection which are stored along with its documents,
+// so that they are restored when the database is reopened.
+type collectionMetadata struct {
+	Indexes    []indexMetadata `json:"indexes,omitempty"`
+	Compressed bool            `json:"compressed,omitempty"`
+	Versioned  bool            `json:"versioned,omitempty"`
+}
+
+type indexMetadata struct {
+	Fields []string `json:"fields"`
+	Unique bool     `json:"unique,omitempty"`
+
+	// Text is true for full-text indexes, which always have a single field.
+	Text bool `json:"text,omitempty"`
+
+	// Geo is true for geospatial indexes, which always have a single field.
+	Geo bool `json:"geo,omitempty"`
+}
+
+// metadata returns the metadata of c, or nil if the collection has default settings.
+func (c *collection) metadata() *collectionMetadata {
+	if len(c.indexes) == 0 && len(c.textIndexes) == 0 && len(c.geoIndexes) == 0 && !c.compressed && !c.versioned {
+		return nil
+	}
+
+	m := &collectionMetadata{Compressed: c.compressed, Versioned: c.versioned}
+	for _, idx := range c.indexes {
+		m.Indexes = append(m.Indexes, indexMetadata{Fields: idx.fields, Unique: idx.unique})
+	}
+
+	for _, idx := range c.textIndexes {
+		m.Indexes = append(m.Indexes, indexMetadata{Fields: []string{idx.field}, Text: true})
+	}
+
+	for _, idx := range c.geoIndexes {
+		m.Indexes = append(m.Indexes, indexMetadata{Fields: []string{idx.field}, Geo: true})
+	}
+	return m
+}
+
+// applyMetadata restores the settings described by m, building the indexes on the current documents of c.
+func (c *collection) applyMetadata(m *collectionMetadata) {
+	if m == nil {
+		return
+	}
+
+	c.compressed = c.compressed || m.Compressed
+	c.versioned = c.versioned || m.Versioned
+	for _, im := range m.Indexes {
+		if im.Text {
+			if len(im.Fields) == 1 && c.getTextIndex(im.Fields[0]) == nil {
+				idx := newTextIndex(im.Fields[0])
+				idx.build(c.docs)
+				c.textIndexes = append(c.textIndexes, idx)
+			}
+			continue
+		}
+
+		if im.Geo {
+			if len(im.Fields) == 1 && c.getGeoIndex(im.Fields[0]) == nil {
+				idx := newGeoIndex(im.Fields[0])
+				idx.build(c.docs)
+				c.geoIndexes = append(c.geoIndexes, idx)
+			}
+			continue
+		}
+
+		if len(im.Fields) == 0 || c.getIndex(im.Fields) != nil {
+			continue
+		}
+
+		idx := newIndex(im.Fields, im.Unique)
+		idx.build(c.docs)
+		c.indexes = append(c.indexes, idx)
+	}
+}
+
+// replaceMetadata makes the settings of c match the ones described by m, dropping the indexes which m doesn't contain.
+func (c *collection) replaceMetadata(m *collectionMetadata) {
+	indexes := make([]*index, 0, len(c.indexes))
+	for _, idx := range c.indexes {
+		if m.hasIndex(idx) {
+			indexes = append(indexes, idx)
+		}
+	}
+	c.indexes = indexes
+
+	textIndexes := make([]*textIndex, 0, len(c.textIndexes))
+	for _, idx := range c.textIndexes {
+		if m.hasTextIndex(idx) {
+			textIndexes = append(textIndexes, idx)
+		}
+	}
+	c.textIndexes = textIndexes
+
+	geoIndexes := make([]*geoIndex, 0, len(c.geoIndexes))
+	for _, idx := range c.geoIndexes {
+		if m.hasGeoIndex(idx) {
+			geoIndexes = append(geoIndexes, idx)
+		}
+	}
+	c.geoIndexes = geoIndexes
+	c.applyMetadata(m)
+}
+
+func (m *collectionMetadata) hasIndex(idx *index) bool {
+	if m == nil {
+		return false
+	}
+
+	for _, im := range m.Indexes {
+		if !im.Text && !im.Geo && im.Unique == idx.unique && strings.Join(im.Fields, ",") == idx.name() {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *collectionMetadata) hasTextIndex(idx *textIndex) bool {
+	if m == nil {
+		return false
+	}
+
+	for _, im := range m.Indexes {
+		if im.Text && len(im.Fields) == 1 && im.Fields[0] == idx.field {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *collectionMetadata) hasGeoIndex(idx *geoIndex) bool {
+	if m == nil {
+		return false
+	}
+
+	for _, im := range m.Indexes {
+		if im.Geo && len(im.Fields) == 1 && im.Fields[0] == idx.field {
+			return true
+		}
+	}
+	return false
+}
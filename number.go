@@ -0,0 +1,149 @@
+package clover
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"time"
+)
+
+// convertNumbers replaces each json.Number contained in v with an int64, if it represents an integer which fits into 64 bits, or with a float64 otherwise.
+func convertNumbers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range value {
+			value[k] = convertNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = convertNumbers(item)
+		}
+	}
+	return v
+}
+
+// intsToFloats replaces in place each int64 contained in v with the corresponding float64.
+func intsToFloats(v interface{}) interface{} {
+	switch value := v.(type) {
+	case int64:
+		return float64(value)
+	case map[string]interface{}:
+		for k, item := range value {
+			value[k] = intsToFloats(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = intsToFloats(item)
+		}
+	}
+	return v
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+// compareNumbers compares two numbers, each of which can either be an int64 or a float64, without losing precision when both are integers.
+func compareNumbers(v1 interface{}, v2 interface{}) (int, bool) {
+	i1, isInt1 := v1.(int64)
+	i2, isInt2 := v2.(int64)
+	if isInt1 && isInt2 {
+		switch {
+		case i1 < i2:
+			return -1, true
+		case i1 > i2:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	f1, ok := toFloat64(v1)
+	if !ok {
+		return 0, false
+	}
+
+	f2, ok := toFloat64(v2)
+	if !ok {
+		return 0, false
+	}
+
+	// an integer and an integral float are compared as integers, so that precision is preserved
+	if isInt1 && isIntegral(f2) {
+		return compareNumbers(i1, int64(f2))
+	}
+	if isInt2 && isIntegral(f1) {
+		return compareNumbers(int64(f1), i2)
+	}
+
+	switch {
+	case f1 < f2:
+		return -1, true
+	case f1 > f2:
+		return 1, true
+	}
+	return 0, true
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func isIntegral(f float64) bool {
+	return f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64
+}
+
+// equalValues reports whether v1 and v2 are deeply equal, considering equal an int64 and a float64 representing the same number.
+func equalValues(v1 interface{}, v2 interface{}) bool {
+	if isNumber(v1) && isNumber(v2) {
+		res, _ := compareNumbers(v1, v2)
+		return res == 0
+	}
+
+	switch value1 := v1.(type) {
+	case time.Time:
+		value2, isTime := v2.(time.Time)
+		return isTime && value1.Equal(value2)
+	case map[string]interface{}:
+		value2, isMap := v2.(map[string]interface{})
+		if !isMap || len(value1) != len(value2) {
+			return false
+		}
+
+		for k, item1 := range value1 {
+			item2, ok := value2[k]
+			if !ok || !equalValues(item1, item2) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		value2, isSlice := v2.([]interface{})
+		if !isSlice || len(value1) != len(value2) {
+			return false
+		}
+
+		for i := range value1 {
+			if !equalValues(value1[i], value2[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(v1, v2)
+}
@@ -0,0 +1,162 @@
+package clover
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Option configures a DB when it is opened.
+type Option func(opts *options)
+
+type options struct {
+	idField      string
+	idGenerator  func() string
+	preserveInts bool
+	syncMode     SyncMode
+	syncInterval time.Duration
+	cacheSize    int
+	storage      Storage
+	codecs       []codecOption
+
+	wal              bool
+	checkpointWrites int
+
+	expirationInterval time.Duration
+
+	fileMode os.FileMode
+	logger   *log.Logger
+	readOnly bool
+	noLock   bool
+	lazy     bool
+	paged    bool
+
+	compression bool
+
+	maxDocumentSize   int
+	maxCollectionSize int
+}
+
+func defaultOptions() options {
+	return options{
+		idField:      objectIdField,
+		idGenerator:  newObjectId,
+		syncMode:     SyncNever,
+		syncInterval: defaultSyncInterval,
+		cacheSize:    defaultQueryCacheSize,
+
+		checkpointWrites: defaultCheckpointWrites,
+	}
+}
+
+// WithIDField sets the name of the field where document ids are stored (default "_id").
+// All the by-id helpers (FindById, DeleteById, ...) refer to this field.
+func WithIDField(name string) Option {
+	return func(opts *options) {
+		opts.idField = name
+	}
+}
+
+// WithIDGenerator sets the function used to generate the id of each inserted document (default is a random UUID).
+// The generator is invoked once per document: if it returns an id which is already in use, the insertion fails with ErrDuplicateKey.
+func WithIDGenerator(fn func() string) Option {
+	return func(opts *options) {
+		opts.idGenerator = fn
+	}
+}
+
+// WithPreserveIntegers makes the database store integer numbers as int64, rather than converting every number to float64.
+// This avoids losing precision for integers greater than 2^53, such as large ids or timestamps in nanoseconds.
+// Criteria compare int64 and float64 values numerically, so queries work the same way in both modes.
+func WithPreserveIntegers() Option {
+	return func(opts *options) {
+		opts.preserveInts = true
+	}
+}
+
+// WithSyncMode sets the policy used to flush written collection files to stable storage (default SyncNever).
+// See SyncMode for the durability guarantees of each mode. Whatever the mode, DB.Sync forces a flush on demand.
+func WithSyncMode(mode SyncMode) Option {
+	return func(opts *options) {
+		opts.syncMode = mode
+	}
+}
+
+// WithSyncInterval sets how often modified files are flushed when using the SyncBatch mode (default one second).
+func WithSyncInterval(interval time.Duration) Option {
+	return func(opts *options) {
+		opts.syncInterval = interval
+	}
+}
+
+// WithQueryCacheSize sets the maximum number of query results memoized by cached queries (default 128).
+// Since each entry holds the whole result of a query, the memory used by the cache grows with the size of the results.
+// A value less or equal to zero disables caching.
+func WithQueryCacheSize(n int) Option {
+	return func(opts *options) {
+		opts.cacheSize = n
+	}
+}
+
+// WithStorage makes the database persist its collections through the supplied storage, instead of using
+// the default file layout. In this case, the directory passed to Open is ignored.
+func WithStorage(s Storage) Option {
+	return func(opts *options) {
+		opts.storage = s
+	}
+}
+
+// WithWriteAheadLog makes the database record each write in an append-only log (the clover.wal file inside the
+// database directory), which is flushed to stable storage before the write returns, instead of rewriting the whole
+// collection file. Changes are periodically copied to the collection files (see Checkpoint and WithCheckpointWrites)
+// and, after a crash, the log is replayed when the database is opened. Writes spanning multiple collections (see Tx)
+// are recorded atomically.
+//
+// With a write-ahead log, every acknowledged write survives crashes, whatever the sync mode. A database which has been
+// using a log must always be opened with this option, since collection files may lack the writes of the last session.
+func WithWriteAheadLog() Option {
+	return func(opts *options) {
+		opts.wal = true
+	}
+}
+
+// WithCheckpointWrites sets the number of writes recorded in the write-ahead log after which a checkpoint is
+// performed (default 1000). A smaller value keeps the log short, making reopens faster, at the cost of more frequent
+// rewrites of the collection files.
+func WithCheckpointWrites(n int) Option {
+	return func(opts *options) {
+		opts.checkpointWrites = n
+	}
+}
+
+// WithExpirationInterval makes the database remove expired documents (see Document.SetExpiresAt) every interval,
+// using a background goroutine which is stopped by Close. By default, expired documents are only removed by DeleteExpired.
+func WithExpirationInterval(interval time.Duration) Option {
+	return func(opts *options) {
+		opts.expirationInterval = interval
+	}
+}
+
+// WithFileMode sets the permission bits of the files created by the database (collection files and write-ahead log).
+// By default, collection files are only accessible by their owner. It has no effect on databases using WithStorage.
+func WithFileMode(mode os.FileMode) Option {
+	return func(opts *options) {
+		opts.fileMode = mode
+	}
+}
+
+// WithLogger makes the database report through logger the errors of the work performed in background, such as
+// periodic flushes (see SyncBatch), automatic checkpoints and removals of expired documents, which would otherwise be
+// silently retried. By default, nothing is logged.
+func WithLogger(logger *log.Logger) Option {
+	return func(opts *options) {
+		opts.logger = logger
+	}
+}
+
+// WithReadOnly opens the database in read-only mode (see OpenReadOnly).
+func WithReadOnly() Option {
+	return func(opts *options) {
+		opts.readOnly = true
+	}
+}
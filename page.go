@@ -0,0 +1,129 @@
+package clover
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Page is a page of the documents selected by a query (see Query.Page).
+type Page struct {
+	Docs []*Document
+
+	// Next is the cursor of the following page, or the empty string if there are no more documents.
+	Next string
+}
+
+// Page returns at most size documents selected by q, following the document identified by cursor, which is either
+// the Next cursor of the previous page or the empty string, to obtain the first page.
+//
+// Unlike Skip, cursors identify the last returned document by its sort key (see Sort), rather than by its position:
+// pages don't shift when documents are inserted or removed between two calls, so that, while paginating, no document
+// is returned twice, and only the documents inserted (or moved) before the cursor in the meantime are missed.
+// Documents are sorted by id if the query has no sort options, and ties are always broken by id. Pages should be
+// requested on a fresh query (see DB.Query) to observe the most recent writes. Skip and Limit of q are ignored, while
+// sorting by text score (see Query.SortByScore) isn't supported.
+func (q *Query) Page(cursor string, size int) (*Page, error) {
+	if size <= 0 || q.sortByScore {
+		return nil, ErrInvalidArgument
+	}
+
+	pageQuery := q.copy()
+	pageQuery.skip = 0
+	pageQuery.limit = addInts(size, 1)
+	pageQuery.cached = false
+	if len(pageQuery.sortOpts) == 0 {
+		pageQuery.sortOpts = []SortOption{{Field: q.collection.db.idField, Direction: 1}}
+	}
+
+	if cursor != "" {
+		last, err := q.decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		sortOpts := pageQuery.sortOpts
+		pageQuery = pageQuery.Where(Func(func(doc *Document) bool {
+			return lessDocuments(last, doc, sortOpts)
+		}))
+	}
+
+	docs := make([]*Document, 0)
+	pageQuery.forEach(func(doc *Document) bool {
+		docs = append(docs, doc)
+		return true
+	})
+
+	page := &Page{}
+	if len(docs) > size {
+		docs = docs[:size]
+
+		next, err := pageQuery.encodeCursor(docs[size-1])
+		if err != nil {
+			return nil, err
+		}
+		page.Next = next
+	}
+
+	page.Docs = make([]*Document, 0, len(docs))
+	for _, doc := range docs {
+		page.Docs = append(page.Docs, q.project(doc))
+	}
+	return page, nil
+}
+
+// encodeCursor returns the cursor identifying doc, made of its id and of the fields q is sorted by.
+func (q *Query) encodeCursor(doc *Document) (string, error) {
+	db := q.collection.db
+
+	key := db.newDocument()
+	for _, opt := range q.sortOpts {
+		if doc.Has(opt.Field) {
+			key.Set(opt.Field, doc.Get(opt.Field))
+		}
+	}
+	key.Set(db.idField, doc.ObjectId())
+
+	fields, err := db.codecs.encode(key.fields)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor returns a document holding the sort key encoded by cursor (see encodeCursor).
+func (q *Query) decodeCursor(cursor string) (*Document, error) {
+	db := q.collection.db
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidArgument)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	fields := make(map[string]interface{})
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidArgument)
+	}
+
+	convertNumbers(fields)
+	if !db.preserveInts {
+		intsToFloats(fields)
+	}
+
+	if _, err := db.codecs.decode(fields); err != nil {
+		return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidArgument)
+	}
+
+	key := db.newDocument()
+	key.fields = fields
+	return key, nil
+}
@@ -0,0 +1,148 @@
+package clover
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// WithPagedReads makes a read-only database (see OpenReadOnly) keep the documents of its collections on disk: instead
+// of being loaded in memory, each collection file is read again, 64 KiB at a time, every time the collection is
+// scanned, so that collections much larger than the available RAM can be opened and queried.
+// When opened, collections are read once to count and validate their documents, so that corrupted collections are
+// reported by CorruptedCollections as usual.
+//
+// Since documents are never held in memory, indexes are neither built nor reported by CollectionStats and Explain, and
+// every query (including FindById) scans the whole collection file, stopping as soon as enough documents are found.
+// Queries reading the documents after a failure of the storage, which can only happen if the directory isn't locked
+// (see WithNoDirectoryLock), return the documents read up to that point, and the failure is reported to the logger
+// (see WithLogger). Only the documents returned by a query are held in memory, along with the ones which need to be
+// sorted and, for cached queries (see Query.Cached), the results kept by the cache.
+//
+// Paged reads require the database to be stored in a directory, and they can't be combined with WithWriteAheadLog,
+// since the writes found in the log would have to be applied in memory: otherwise, Open fails with ErrInvalidArgument.
+func WithPagedReads() Option {
+	return func(opts *options) {
+		opts.paged = true
+	}
+}
+
+func (opts *options) checkPagedReads() error {
+	if !opts.paged {
+		return nil
+	}
+
+	if !opts.readOnly {
+		return fmt.Errorf("%w: paged reads require a read-only database", ErrInvalidArgument)
+	}
+
+	if opts.wal {
+		return fmt.Errorf("%w: paged reads can't be combined with the write-ahead log", ErrInvalidArgument)
+	}
+
+	if _, ok := opts.storage.(snapshotOpener); opts.storage != nil && !ok {
+		return fmt.Errorf("%w: paged reads require the database to be stored in a directory", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// pagedSource reads the documents of a collection from its stored snapshot (see WithPagedReads).
+type pagedSource struct {
+	db     *DB
+	name   string
+	opener snapshotOpener
+
+	// count is the number of documents of the collection, computed when the collection is opened
+	count int
+}
+
+var errStopRead = errors.New("stop reading")
+
+// openPagedCollection returns a collection whose documents are read from its stored snapshot on each scan. The snapshot
+// is read once, to count its documents and to make sure that it can be decoded.
+func (db *DB) openPagedCollection(name string, opener snapshotOpener) (*collection, error) {
+	src := &pagedSource{db: db, name: name, opener: opener}
+
+	jFile := &jsonFile{}
+	err := src.read(jFile, func(doc *Document) bool {
+		src.count++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := newCollection(db, name, nil)
+	c.source = src
+	if m := jFile.Metadata; m != nil {
+		c.applyMetadata(&collectionMetadata{Compressed: m.Compressed, Versioned: m.Versioned})
+	}
+	return c, nil
+}
+
+// read decodes the stored snapshot, calling fn on each document, until fn returns false.
+func (src *pagedSource) read(jFile *jsonFile, fn func(doc *Document) bool) error {
+	r, err := src.opener.open(src.name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	content, err := snapshotContent(bufio.NewReaderSize(r, snapshotBufferSize))
+	if err != nil {
+		return err
+	}
+
+	err = src.db.scanJSONFile(content, jFile, func(row map[string]interface{}) error {
+		if _, err := src.db.codecs.decode(row); err != nil {
+			return err
+		}
+
+		doc := src.db.newDocument()
+		doc.fields = row
+		if !fn(doc) {
+			return errStopRead
+		}
+		return nil
+	})
+
+	if err == errStopRead {
+		return nil
+	}
+	return err
+}
+
+// forEach calls fn on each document of the collection, until fn returns false.
+func (src *pagedSource) forEach(fn func(doc *Document) bool) {
+	if err := src.read(&jsonFile{}, fn); err != nil {
+		src.db.logf("reading collection %s failed: %v", src.name, err)
+	}
+}
+
+// get returns the document with the given id, scanning the stored snapshot.
+func (src *pagedSource) get(id string) (*Document, bool) {
+	var found *Document
+	src.forEach(func(doc *Document) bool {
+		if doc.ObjectId() == id {
+			found = doc
+		}
+		return found == nil
+	})
+	return found, found != nil
+}
+
+// content returns the JSON content of the stored snapshot.
+func (src *pagedSource) content() ([]byte, error) {
+	r, err := src.opener.open(src.name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	content, err := snapshotContent(bufio.NewReaderSize(r, snapshotBufferSize))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(content)
+}
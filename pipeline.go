@@ -0,0 +1,310 @@
+package clover
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type stage func(docs []*Document) []*Document
+
+// Pipeline represents a sequence of transformations applied to the documents selected by a query.
+// Stages are lazy: they are only evaluated when a terminal method (such as FindAll or Count) is called.
+type Pipeline struct {
+	query  *Query
+	stages []stage
+}
+
+// Pipeline returns a new Pipeline whose input is the set of documents selected by q.
+func (q *Query) Pipeline() *Pipeline {
+	return &Pipeline{query: q}
+}
+
+func (p *Pipeline) addStage(s stage) *Pipeline {
+	stages := make([]stage, 0, len(p.stages)+1)
+	stages = append(stages, p.stages...)
+	return &Pipeline{
+		query:  p.query,
+		stages: append(stages, s),
+	}
+}
+
+// Match returns a new Pipeline which discards the documents not satisfying the supplied criteria.
+func (p *Pipeline) Match(c *Criteria) *Pipeline {
+	return p.addStage(func(docs []*Document) []*Document {
+		matching := make([]*Document, 0, len(docs))
+		for _, doc := range docs {
+			if c.p(doc) {
+				matching = append(matching, doc)
+			}
+		}
+		return matching
+	})
+}
+
+// Sort returns a new Pipeline which sorts the documents according to the supplied options.
+func (p *Pipeline) Sort(opts ...SortOption) *Pipeline {
+	return p.addStage(func(docs []*Document) []*Document {
+		sorted := append([]*Document{}, docs...)
+		sortDocuments(sorted, opts)
+		return sorted
+	})
+}
+
+// Limit returns a new Pipeline which keeps at most n documents.
+func (p *Pipeline) Limit(n int) *Pipeline {
+	return p.addStage(func(docs []*Document) []*Document {
+		if n >= 0 && n < len(docs) {
+			return docs[:n]
+		}
+		return docs
+	})
+}
+
+// Lookup returns a new Pipeline which joins each document with the documents of the collection from whose foreignField
+// is equal to the localField of the document. Matching documents are embedded, as an array, in the as field of a copy
+// of the document: the array is empty if there is no match or if the document doesn't have localField. If localField
+// holds an array, documents matching any of its elements are embedded. The collection from is scanned only once, when
+// the pipeline is evaluated, using its most recent version: if it doesn't exist, no documents match. As for the nested
+// objects of the documents returned by FindAll, embedded documents are shared with the collection, and must not be
+// modified in place.
+func (p *Pipeline) Lookup(from string, localField string, foreignField string, as string) *Pipeline {
+	db := p.query.collection.db
+	return p.addStage(func(docs []*Document) []*Document {
+		foreignDocs := make(map[string][]interface{})
+		if q := db.Query(from); q != nil {
+			q.ForEach(func(doc *Document) bool {
+				if doc.Has(foreignField) {
+					if key, err := valueKey(doc.Get(foreignField)); err == nil {
+						foreignDocs[key] = append(foreignDocs[key], doc.fields)
+					}
+				}
+				return true
+			})
+		}
+
+		joined := make([]*Document, 0, len(docs))
+		for _, doc := range docs {
+			matches := make([]interface{}, 0)
+			if doc.Has(localField) {
+				values, isArray := doc.Get(localField).([]interface{})
+				if !isArray {
+					values = []interface{}{doc.Get(localField)}
+				}
+
+				for _, value := range values {
+					if key, err := valueKey(value); err == nil {
+						matches = append(matches, foreignDocs[key]...)
+					}
+				}
+			}
+
+			joinedDoc := doc.Copy()
+			joinedDoc.Set(as, matches)
+			joined = append(joined, joinedDoc)
+		}
+		return joined
+	})
+}
+
+// FindAll evaluates the pipeline and returns the resulting documents.
+func (p *Pipeline) FindAll() []*Document {
+	docs := p.query.FindAll()
+	for _, s := range p.stages {
+		docs = s(docs)
+	}
+	return docs
+}
+
+// Count evaluates the pipeline and returns the number of resulting documents.
+func (p *Pipeline) Count() int {
+	return len(p.FindAll())
+}
+
+// Group returns a GroupStage which partitions the documents of the pipeline by the value of the supplied field.
+func (p *Pipeline) Group(field string) *GroupStage {
+	return &GroupStage{pipeline: p, field: field}
+}
+
+// GroupStage represents a grouping of the documents of a pipeline by the value of a field.
+type GroupStage struct {
+	pipeline *Pipeline
+	field    string
+}
+
+type group struct {
+	key  interface{}
+	docs []*Document
+}
+
+// valueKey returns a string uniquely identifying value, so that equal values (including numbers of different types) have the same key.
+func valueKey(value interface{}) (string, error) {
+	keyBytes, err := json.Marshal(value)
+	return string(keyBytes), err
+}
+
+// groupDocuments partitions docs according to the value of field, preserving the order in which groups are first encountered.
+// Documents not having the field are grouped under the nil key.
+func groupDocuments(docs []*Document, field string) []*group {
+	groups := make([]*group, 0)
+	groupsByKey := make(map[string]*group)
+	for _, doc := range docs {
+		value := doc.Get(field)
+
+		key, err := valueKey(value)
+		if err != nil {
+			continue
+		}
+
+		g, ok := groupsByKey[key]
+		if !ok {
+			g = &group{key: value}
+			groupsByKey[key] = g
+			groups = append(groups, g)
+		}
+		g.docs = append(g.docs, doc)
+	}
+	return groups
+}
+
+// Count evaluates the pipeline and returns a document for each group, sorted by group value.
+// Each document contains the value of the grouping field and the number of documents of the group, stored in the "count" field.
+func (g *GroupStage) Count() []*Document {
+	groups := groupDocuments(g.pipeline.FindAll(), g.field)
+
+	results := make([]*Document, 0, len(groups))
+	for _, gr := range groups {
+		doc := NewDocument()
+		doc.Set(g.field, gr.key)
+		doc.Set("count", float64(len(gr.docs)))
+		results = append(results, doc)
+	}
+	sortDocuments(results, []SortOption{{Field: g.field, Direction: 1}})
+	return results
+}
+
+// GroupBy returns a GroupStage which partitions the documents selected by q by the value of the supplied field.
+// It is a shorthand for q.Pipeline().Group(field).
+func (q *Query) GroupBy(field string) *GroupStage {
+	return q.Pipeline().Group(field)
+}
+
+// Accumulator computes a value from the documents of each group (see GroupStage.Aggregate).
+type Accumulator struct {
+	name string
+	fn   func(docs []*Document) interface{}
+}
+
+// As returns a copy of the accumulator storing its value in the field with the given name.
+func (acc *Accumulator) As(name string) *Accumulator {
+	return &Accumulator{name: name, fn: acc.fn}
+}
+
+func accumulatorName(op string, field string) string {
+	return op + "_" + strings.ReplaceAll(field, ".", "_")
+}
+
+// Count returns an accumulator counting the documents of each group, stored in the "count" field.
+func Count() *Accumulator {
+	return &Accumulator{
+		name: "count",
+		fn: func(docs []*Document) interface{} {
+			return float64(len(docs))
+		},
+	}
+}
+
+// Sum returns an accumulator computing the sum of the numeric values of field, stored in the "sum_<field>" field
+// (where dots are replaced by underscores). Missing and non-numeric values are ignored.
+func Sum(field string) *Accumulator {
+	return &Accumulator{
+		name: accumulatorName("sum", field),
+		fn: func(docs []*Document) interface{} {
+			var sum interface{}
+			for _, doc := range docs {
+				v := doc.Get(field)
+				if !isNumber(v) {
+					continue
+				}
+
+				if sum == nil {
+					sum = v
+				} else {
+					sum, _ = applyArithOp(opAdd, sum, v)
+				}
+			}
+
+			if sum == nil {
+				return float64(0)
+			}
+			return sum
+		},
+	}
+}
+
+// Avg returns an accumulator computing the mean of the numeric values of field, stored in the "avg_<field>" field.
+// Missing and non-numeric values are ignored: if there are no numeric values, the result is null.
+func Avg(field string) *Accumulator {
+	return &Accumulator{
+		name: accumulatorName("avg", field),
+		fn: func(docs []*Document) interface{} {
+			sum, n := float64(0), 0
+			for _, doc := range docs {
+				if f, ok := toFloat64(doc.Get(field)); ok {
+					sum += f
+					n++
+				}
+			}
+
+			if n == 0 {
+				return nil
+			}
+			return sum / float64(n)
+		},
+	}
+}
+
+func extremeAccumulator(op string, field string, better func(res int) bool) *Accumulator {
+	return &Accumulator{
+		name: accumulatorName(op, field),
+		fn: func(docs []*Document) interface{} {
+			var result interface{}
+			for _, doc := range docs {
+				v := doc.Get(field)
+				if v != nil && (result == nil || better(compareOrdered(v, true, result, true))) {
+					result = v
+				}
+			}
+			return result
+		},
+	}
+}
+
+// Min returns an accumulator computing the minimum value of field, stored in the "min_<field>" field. Values are
+// compared as when sorting, so values of different types are allowed. Missing and null values are ignored.
+func Min(field string) *Accumulator {
+	return extremeAccumulator("min", field, func(res int) bool { return res < 0 })
+}
+
+// Max returns an accumulator computing the maximum value of field, stored in the "max_<field>" field.
+// Values are compared as when sorting. Missing and null values are ignored.
+func Max(field string) *Accumulator {
+	return extremeAccumulator("max", field, func(res int) bool { return res > 0 })
+}
+
+// Aggregate evaluates the pipeline and returns a document for each group, sorted by group value. Each document contains
+// the value of the grouping field, along with the value computed by each accumulator.
+func (g *GroupStage) Aggregate(accs ...*Accumulator) []*Document {
+	groups := groupDocuments(g.pipeline.FindAll(), g.field)
+
+	results := make([]*Document, 0, len(groups))
+	for _, gr := range groups {
+		doc := NewDocument()
+		doc.Set(g.field, gr.key)
+		for _, acc := range accs {
+			doc.Set(acc.name, acc.fn(gr.docs))
+		}
+		results = append(results, doc)
+	}
+	sortDocuments(results, []SortOption{{Field: g.field, Direction: 1}})
+	return results
+}
@@ -0,0 +1,131 @@
+package clover
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// CorruptedCollections returns the collections which could not be loaded when the database was opened, mapped to the
+// corresponding errors (each one wrapping ErrCorruptedCollection). Corrupted collections are not accessible until
+// they are repaired (see Repair) or dropped.
+func (db *DB) CorruptedCollections() map[string]error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	corrupted := make(map[string]error, len(db.corrupted))
+	for name, err := range db.corrupted {
+		corrupted[name] = err
+	}
+	return corrupted
+}
+
+// Repair salvages the readable documents of a corrupted collection, replacing its damaged snapshot with a new one.
+// Documents are recovered up to the first unreadable one: rows following the damaged point, as well as rows without a
+// valid id, are discarded. Repairing a collection which is not corrupted has no effect.
+func (db *DB) Repair(name string) error {
+	db.ensureLoaded(name)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	if _, ok := db.corrupted[name]; !ok {
+		if db.hasCollection(name) {
+			return nil
+		}
+		return collectionNotExistError(name)
+	}
+
+	data, err := db.storage.Load(name)
+	if err != nil {
+		return err
+	}
+
+	// a damaged compressed snapshot still yields the rows preceding the damaged point, unless its header is damaged:
+	// in this case, nothing is written, so that the snapshot can still be recovered by other means
+	decoded, err := decodeSnapshot(data)
+	if decoded == nil && err != nil {
+		return corruptedCollectionError(name, err)
+	}
+	data = decoded
+
+	rows, metadata := db.salvageRows(data)
+
+	docs := make([]*Document, 0)
+	ids := make(map[string]bool)
+	for _, row := range rows {
+		if _, err := db.codecs.decode(row); err != nil {
+			continue
+		}
+
+		doc := db.newDocument()
+		doc.fields = row
+
+		id := doc.ObjectId()
+		if id == "" || ids[id] {
+			continue
+		}
+		ids[id] = true
+		docs = append(docs, doc)
+	}
+
+	c := newCollection(db, name, docs)
+	c.applyMetadata(metadata)
+	if err := db.commit(c); err != nil {
+		return err
+	}
+	delete(db.corrupted, name)
+	db.forgetSkipped(name)
+	return nil
+}
+
+// salvageRows decodes, one at a time, the rows of a possibly damaged collection file, stopping at the first error.
+// The collection metadata is returned as well, if it precedes the damaged point.
+func (db *DB) salvageRows(data []byte) (rows []map[string]interface{}, metadata *collectionMetadata) {
+	rows = make([]map[string]interface{}, 0)
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if db.preserveInts {
+		decoder.UseNumber()
+	}
+
+	if tok, err := decoder.Token(); err != nil || tok != json.Delim('{') {
+		return rows, metadata
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return rows, metadata
+		}
+
+		if key == "metadata" {
+			if err := decoder.Decode(&metadata); err != nil {
+				return rows, nil
+			}
+			continue
+		}
+
+		if key != "rows" {
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return rows, metadata
+			}
+			continue
+		}
+
+		if tok, err := decoder.Token(); err != nil || tok != json.Delim('[') {
+			return rows, metadata
+		}
+
+		for decoder.More() {
+			row := make(map[string]interface{})
+			if err := decoder.Decode(&row); err != nil {
+				return rows, metadata
+			}
+			convertNumbers(row)
+			rows = append(rows, row)
+		}
+		return rows, metadata
+	}
+	return rows, metadata
+}
@@ -0,0 +1,383 @@
+package clover
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// number of records buffered for each replica: replicas falling further behind are disconnected, and sync again
+	replicaBufferRecords = 4096
+
+	// maximum time allowed to send a message to a replica before disconnecting it
+	replicaWriteTimeout = 10 * time.Second
+
+	// time waited by replicas before connecting again to the primary after a failure
+	replicaRetryInterval = time.Second
+)
+
+var errReplicaStopped = errors.New("replica stopped")
+
+// replicationMessage is sent by the primary to its replicas, one per line. A replica first receives the snapshots of
+// all the collections, followed by a message with Synced set, and then the records of the subsequent writes.
+type replicationMessage struct {
+	Snapshot *backupEntry    `json:"snapshot,omitempty"`
+	Synced   bool            `json:"synced,omitempty"`
+	Record   json.RawMessage `json:"record,omitempty"`
+}
+
+// follower is a replica connected to the primary, whose pending records are buffered in records.
+type follower struct {
+	records chan []byte
+}
+
+// followers holds the replicas connected to the primary. It is guarded by its own mutex, since it is updated while
+// holding db.mu for reading.
+type followers struct {
+	mu  sync.Mutex
+	set map[*follower]bool
+}
+
+func (fs *followers) add() *follower {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.set == nil {
+		fs.set = make(map[*follower]bool)
+	}
+
+	f := &follower{records: make(chan []byte, replicaBufferRecords)}
+	fs.set[f] = true
+	return f
+}
+
+// remove disconnects f, closing its channel, unless it has already been removed.
+func (fs *followers) remove(f *follower) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.set[f] {
+		delete(fs.set, f)
+		close(f.records)
+	}
+}
+
+// broadcast sends the data of a record to all the replicas, disconnecting the ones which are not keeping up.
+func (fs *followers) broadcast(data []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for f := range fs.set {
+		select {
+		case f.records <- data:
+		default:
+			delete(fs.set, f)
+			close(f.records)
+		}
+	}
+}
+
+func (fs *followers) removeAll() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for f := range fs.set {
+		delete(fs.set, f)
+		close(f.records)
+	}
+}
+
+// ServeReplication makes the database act as the primary of the replicas connecting to l (see OpenReplica), streaming
+// to each of them a snapshot of all the collections followed by every subsequent write, as recorded in the write-ahead
+// log. It requires the database to be opened with WithWriteAheadLog. Like http.Serve, it blocks until l is closed (or
+// fails), returning the error of l. Replicas are disconnected when the database is closed, or if they fall too far
+// behind: in this case, they connect again and receive a fresh snapshot.
+//
+// Replicas are not authenticated, and the content of the database is sent in clear, so that anyone able to connect to
+// l can read all of it: l must only be reachable by trusted replicas, for example on a private network, or accept
+// TLS connections authenticating the clients (see tls.NewListener, with tls.RequireAndVerifyClientCert).
+func (db *DB) ServeReplication(l net.Listener) error {
+	db.mu.Lock()
+	if db.wal == nil {
+		db.unlock()
+		return fmt.Errorf("%w: replication requires the write-ahead log", ErrInvalidArgument)
+	}
+	db.wal.onAppend = db.followers.broadcast
+	db.unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go db.serveReplica(conn)
+	}
+}
+
+func (db *DB) serveReplica(conn net.Conn) {
+	defer conn.Close()
+	db.ensureLoaded()
+
+	// records appended after the snapshot is taken (which requires db.mu) are buffered until the snapshot is sent
+	db.mu.RLock()
+	collections := make([]*collection, 0, len(db.collections))
+	for _, c := range db.collections {
+		collections = append(collections, c)
+	}
+	f := db.followers.add()
+	db.mu.RUnlock()
+	defer db.followers.remove(f)
+
+	// replicas never send anything, so reads only return once the connection is closed: the replica is removed as soon
+	// as it disconnects, rather than when the next record fails to be sent, which may never happen
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		db.followers.remove(f)
+	}()
+
+	w := bufio.NewWriter(conn)
+	encoder := json.NewEncoder(w)
+	send := func(msg *replicationMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(replicaWriteTimeout))
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	for _, c := range collections {
+		data, err := db.encodeCollection(c)
+		if err == nil {
+			err = send(&replicationMessage{Snapshot: &backupEntry{Name: c.name, Snapshot: data}})
+		}
+
+		if err != nil {
+			db.logf("replication to %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	if err := send(&replicationMessage{Synced: true}); err != nil {
+		db.logf("replication to %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	for data := range f.records {
+		if err := send(&replicationMessage{Record: data}); err != nil {
+			db.logf("replication to %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// replica connects a database to its primary (see OpenReplica).
+type replica struct {
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// replicaStream is a connection to the primary.
+type replicaStream struct {
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+func (r *replica) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *replica) dial() (*replicaStream, error) {
+	conn, err := net.Dial("tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped() {
+		conn.Close()
+		return nil, errReplicaStopped
+	}
+
+	r.conn = conn
+	return &replicaStream{conn: conn, decoder: json.NewDecoder(bufio.NewReader(conn))}, nil
+}
+
+// OpenReplica opens a read-only, in-memory database which replicates the content of the primary database listening at
+// addr (see ServeReplication), so that it can serve queries in its place. OpenReplica returns as soon as the replica
+// has received the current content of the primary. Writes applied afterwards to the primary are then streamed to the
+// replica in background, and become visible with a small delay. If the connection to the primary is lost, the replica
+// keeps serving the last received content, while trying to connect again.
+//
+// Any attempt to write to the replica fails with ErrReadOnly. The replica must be opened with the same options of
+// the primary affecting how documents are stored, such as WithIDField, WithPreserveIntegers and codecs. Settings which
+// are not stored on disk, such as validators, hooks and views, are not replicated, and Watch doesn't report the
+// replicated writes.
+func OpenReplica(addr string, opts ...Option) (*DB, error) {
+	db, err := Open("", append(opts, WithStorage(NewMemoryStorage()), WithReadOnly())...)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &replica{addr: addr, stop: make(chan struct{}), done: make(chan struct{})}
+	stream, err := r.dial()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := db.syncReplica(stream); err != nil {
+		stream.conn.Close()
+		db.Close()
+		return nil, err
+	}
+
+	db.replica = r
+	go db.runReplica(r, stream)
+	return db, nil
+}
+
+// runReplica applies the records received from the primary, connecting again whenever the connection is lost.
+func (db *DB) runReplica(r *replica, stream *replicaStream) {
+	defer close(r.done)
+
+	for {
+		err := db.followPrimary(stream)
+		stream.conn.Close()
+		if r.stopped() {
+			return
+		}
+		db.logf("replication from %s interrupted: %v", r.addr, err)
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(replicaRetryInterval):
+			}
+
+			if stream, err = r.dial(); err == nil {
+				if err = db.syncReplica(stream); err == nil {
+					break
+				}
+				stream.conn.Close()
+			}
+
+			if r.stopped() {
+				return
+			}
+			db.logf("replication from %s failed: %v", r.addr, err)
+		}
+	}
+}
+
+// syncReplica replaces all the collections of the database with the snapshots sent by the primary.
+func (db *DB) syncReplica(stream *replicaStream) error {
+	collections := make(map[string]*collection)
+	for {
+		msg := &replicationMessage{}
+		if err := stream.decoder.Decode(msg); err != nil {
+			return err
+		}
+
+		if msg.Synced {
+			break
+		}
+
+		if msg.Snapshot == nil {
+			return fmt.Errorf("%w: unexpected replication message", ErrInvalidArgument)
+		}
+
+		c, err := db.decodeCollection(msg.Snapshot.Name, msg.Snapshot.Snapshot)
+		if err != nil {
+			return err
+		}
+		collections[c.name] = c
+	}
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	db.collections = collections
+	db.corrupted = make(map[string]error)
+	db.unloaded = make(map[string]bool)
+	db.queryCache.clear()
+	return nil
+}
+
+// followPrimary applies the records sent by the primary, until the connection fails.
+func (db *DB) followPrimary(stream *replicaStream) error {
+	for {
+		msg := &replicationMessage{}
+		if err := stream.decoder.Decode(msg); err != nil {
+			return err
+		}
+
+		if len(msg.Record) == 0 {
+			return fmt.Errorf("%w: unexpected replication message", ErrInvalidArgument)
+		}
+
+		rec, err := db.decodeWALRecord(msg.Record)
+		if err != nil {
+			return err
+		}
+
+		if err := db.applyReplicated(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func (db *DB) applyReplicated(rec *walRecord) error {
+	db.mu.Lock()
+	defer db.unlock()
+
+	if err := db.applyWALRecord(rec); err != nil {
+		return err
+	}
+
+	for _, name := range rec.Dropped {
+		db.queryCache.invalidate(name)
+	}
+
+	for _, entry := range rec.Collections {
+		db.queryCache.invalidate(entry.Name)
+	}
+	return nil
+}
+
+// stopReplica disconnects the database from its primary, if it is a replica.
+func (db *DB) stopReplica() {
+	r := db.replica
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	close(r.stop)
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.mu.Unlock()
+
+	<-r.done
+	db.replica = nil
+}
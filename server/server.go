@@ -0,0 +1,328 @@
+// Package server exposes a clover database through an HTTP/JSON API, so that it can be used as a standalone document
+// store by clients written in any language.
+//
+// The API provides the following endpoints, where documents are always exchanged as JSON objects:
+//
+//	PUT    /collections/{name}                  create a collection
+//	DELETE /collections/{name}                  drop a collection
+//	GET    /collections/{name}/documents        list the documents (supports the skip, limit and sort parameters)
+//	POST   /collections/{name}/documents        insert a document, or an array of documents, returning their ids
+//	GET    /collections/{name}/documents/{id}   get a document
+//	PUT    /collections/{name}/documents/{id}   replace (or insert) a document
+//	PATCH  /collections/{name}/documents/{id}   update some fields of a document
+//	DELETE /collections/{name}/documents/{id}   delete a document
+//	POST   /collections/{name}/query            run a query (see QueryRequest)
+//
+// Errors are reported as a JSON object with a single "error" field, using a status code derived from the error
+// returned by the database: for example, 404 for ErrCollectionNotExist and ErrDocumentNotFound, and 409 for ErrDuplicateKey.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	c "github.com/ostafen/clover"
+)
+
+// DefaultMaxBodySize is the maximum size of request bodies accepted by the servers returned by New.
+const DefaultMaxBodySize = 16 << 20
+
+// Server is an http.Handler serving the API over a database.
+type Server struct {
+	// MaxBodySize is the maximum size, in bytes, of a request body: requests with larger bodies fail with status 413,
+	// without reading more than MaxBodySize bytes. If zero or negative, request bodies are not limited.
+	MaxBodySize int64
+
+	db *c.DB
+}
+
+// New returns a Server exposing db, accepting request bodies of at most DefaultMaxBodySize bytes. The database is not
+// closed by the server.
+func New(db *c.DB) *Server {
+	return &Server{db: db, MaxBodySize: DefaultMaxBodySize}
+}
+
+// QueryRequest is the body of a query request. Filter is a JSON filter (see clover.ParseCriteria), which maps field
+// names to the values they must be equal to or, using an object of operators, to the conditions they must satisfy, as
+// in {"age": {"$gte": 18}, "name": "alice"}. Sort lists the fields to sort by, each one optionally prefixed by a minus
+// sign to sort in descending order.
+type QueryRequest struct {
+	Filter *c.Criteria `json:"filter"`
+	Sort   []string    `json:"sort"`
+	Skip   int         `json:"skip"`
+	Limit  *int        `json:"limit"`
+}
+
+var (
+	errMethodNotAllowed = errors.New("method not allowed")
+	errBodyTooLarge     = errors.New("request body too large")
+)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "collections" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	collectionName := parts[1]
+	switch {
+	case len(parts) == 2:
+		s.serveCollection(w, r, collectionName)
+	case len(parts) == 3 && parts[2] == "documents":
+		s.serveDocuments(w, r, collectionName)
+	case len(parts) == 4 && parts[2] == "documents" && parts[3] != "":
+		s.serveDocument(w, r, collectionName, parts[3])
+	case len(parts) == 3 && parts[2] == "query":
+		s.serveQuery(w, r, collectionName)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveCollection(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodPut:
+		writeResult(w, http.StatusCreated, nil, s.db.CreateCollection(name))
+	case http.MethodDelete:
+		writeResult(w, http.StatusNoContent, nil, s.db.DropCollection(name))
+	default:
+		writeError(w, errMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveDocuments(w http.ResponseWriter, r *http.Request, collectionName string) {
+	switch r.Method {
+	case http.MethodGet:
+		req := QueryRequest{}
+		params := r.URL.Query()
+		if sort := params.Get("sort"); sort != "" {
+			req.Sort = strings.Split(sort, ",")
+		}
+
+		var err error
+		if req.Skip, err = intParam(params.Get("skip"), 0); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		limit, err := intParam(params.Get("limit"), -1)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		req.Limit = &limit
+
+		docs, err := s.query(r.Context(), collectionName, &req)
+		writeResult(w, http.StatusOK, docs, err)
+	case http.MethodPost:
+		var value interface{}
+		if err := s.readBody(w, r, &value); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		docs, err := toDocuments(value)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if err := s.db.Insert(collectionName, docs...); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		ids := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			ids = append(ids, doc.ObjectId())
+		}
+		writeResult(w, http.StatusCreated, map[string]interface{}{"ids": ids}, nil)
+	default:
+		writeError(w, errMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveDocument(w http.ResponseWriter, r *http.Request, collectionName string, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		doc, err := s.db.FindById(collectionName, id)
+		writeResult(w, http.StatusOK, doc, err)
+	case http.MethodPut:
+		fields := make(map[string]interface{})
+		if err := s.readBody(w, r, &fields); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, http.StatusNoContent, nil, s.db.ReplaceById(collectionName, id, c.NewDocumentOf(fields)))
+	case http.MethodPatch:
+		updates := make(map[string]interface{})
+		if err := s.readBody(w, r, &updates); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResult(w, http.StatusNoContent, nil, s.db.UpdateById(collectionName, id, updates))
+	case http.MethodDelete:
+		writeResult(w, http.StatusNoContent, nil, s.db.DeleteById(collectionName, id))
+	default:
+		writeError(w, errMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveQuery(w http.ResponseWriter, r *http.Request, collectionName string) {
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodNotAllowed)
+		return
+	}
+
+	req := QueryRequest{}
+	if err := s.readBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	docs, err := s.query(r.Context(), collectionName, &req)
+	writeResult(w, http.StatusOK, docs, err)
+}
+
+// query runs the query described by req, which is interrupted if ctx (the context of the request) is done.
+func (s *Server) query(ctx context.Context, collectionName string, req *QueryRequest) ([]*c.Document, error) {
+	q := s.db.Query(collectionName)
+	if q == nil {
+		return nil, fmt.Errorf("%w: %s", c.ErrCollectionNotExist, collectionName)
+	}
+
+	if req.Filter != nil {
+		q = q.Where(req.Filter)
+	}
+
+	for _, field := range req.Sort {
+		opt := c.SortOption{Field: field, Direction: 1}
+		if strings.HasPrefix(field, "-") {
+			opt = c.SortOption{Field: field[1:], Direction: -1}
+		}
+		q = q.Sort(opt)
+	}
+
+	if req.Skip < 0 {
+		return nil, fmt.Errorf("%w: negative skip", c.ErrInvalidArgument)
+	}
+	q = q.Skip(req.Skip)
+
+	if req.Limit != nil {
+		q = q.Limit(*req.Limit)
+	}
+	return q.FindAllContext(ctx)
+}
+
+func toDocuments(value interface{}) ([]*c.Document, error) {
+	objects, isArray := value.([]interface{})
+	if !isArray {
+		objects = []interface{}{value}
+	}
+
+	docs := make([]*c.Document, 0, len(objects))
+	for _, obj := range objects {
+		fields, isMap := obj.(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("%w: expected a JSON object, got %T", c.ErrInvalidArgument, obj)
+		}
+		docs = append(docs, c.NewDocumentOf(fields))
+	}
+	return docs, nil
+}
+
+func intParam(s string, defaultValue int) (int, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", c.ErrInvalidArgument, err)
+	}
+	return n, nil
+}
+
+// bodyReader records the number of bytes read from a request body, and the error which interrupted the reads, if any.
+type bodyReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// readBody decodes the JSON body of r into v, reading at most s.MaxBodySize bytes.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body := &bodyReader{r: r.Body}
+	if s.MaxBodySize > 0 {
+		body.r = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	}
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		if body.err != nil && s.MaxBodySize > 0 && body.n >= s.MaxBodySize {
+			// MaxBytesReader fails once the whole limit has been read
+			return fmt.Errorf("%w: %v", errBodyTooLarge, body.err)
+		}
+		return fmt.Errorf("%w: %v", c.ErrInvalidArgument, err)
+	}
+	return nil
+}
+
+func writeResult(w http.ResponseWriter, status int, v interface{}, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusOf(err), map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusOf returns the HTTP status code describing err.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, errMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, c.ErrCollectionNotExist), errors.Is(err, c.ErrViewNotExist), errors.Is(err, c.ErrDocumentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, c.ErrCollectionExist), errors.Is(err, c.ErrDuplicateKey), errors.Is(err, c.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, c.ErrInvalidArgument), errors.Is(err, c.ErrInvalidDocument):
+		return http.StatusBadRequest
+	case errors.Is(err, c.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, c.ErrDocumentTooLarge), errors.Is(err, errBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, c.ErrCollectionFull):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
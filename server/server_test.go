@@ -0,0 +1,137 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	c "github.com/ostafen/clover"
+	"github.com/ostafen/clover/server"
+	"github.com/stretchr/testify/require"
+)
+
+func request(t *testing.T, srv *httptest.Server, method string, path string, body string) (int, interface{}) {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var value interface{}
+	if resp.StatusCode != http.StatusNoContent {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&value))
+	}
+	return resp.StatusCode, value
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-server")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	srv := httptest.NewServer(server.New(db))
+	defer srv.Close()
+
+	status, _ := request(t, srv, http.MethodPut, "/collections/users", "")
+	require.Equal(t, http.StatusCreated, status)
+
+	status, _ = request(t, srv, http.MethodPut, "/collections/users", "")
+	require.Equal(t, http.StatusConflict, status)
+
+	status, body := request(t, srv, http.MethodPost, "/collections/users/documents",
+		`[{"name": "alice", "age": 30}, {"name": "bob", "age": 17}, {"name": "carl", "age": 45}]`)
+	require.Equal(t, http.StatusCreated, status)
+	ids := body.(map[string]interface{})["ids"].([]interface{})
+	require.Len(t, ids, 3)
+
+	aliceId := ids[0].(string)
+	status, body = request(t, srv, http.MethodGet, "/collections/users/documents/"+aliceId, "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "alice", body.(map[string]interface{})["name"])
+
+	status, body = request(t, srv, http.MethodPost, "/collections/users/query",
+		`{"filter": {"age": {"$gte": 18}}, "sort": ["-age"]}`)
+	require.Equal(t, http.StatusOK, status)
+	docs := body.([]interface{})
+	require.Len(t, docs, 2)
+	require.Equal(t, "carl", docs[0].(map[string]interface{})["name"])
+
+	status, body = request(t, srv, http.MethodPost, "/collections/users/query",
+		`{"filter": {"$or": [{"name": "bob"}, {"age": {"$gt": 40}}]}, "sort": ["name"]}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, body.([]interface{}), 2)
+
+	status, _ = request(t, srv, http.MethodPost, "/collections/users/query", `{"filter": {"age": {"$foo": 1}}}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = request(t, srv, http.MethodPatch, "/collections/users/documents/"+aliceId, `{"age": 31}`)
+	require.Equal(t, http.StatusNoContent, status)
+	doc, err := db.FindById("users", aliceId)
+	require.NoError(t, err)
+	require.Equal(t, float64(31), doc.Get("age"))
+
+	status, _ = request(t, srv, http.MethodPut, "/collections/users/documents/"+aliceId, `{"name": "alice"}`)
+	require.Equal(t, http.StatusNoContent, status)
+	doc, err = db.FindById("users", aliceId)
+	require.NoError(t, err)
+	require.False(t, doc.Has("age"))
+
+	status, _ = request(t, srv, http.MethodDelete, "/collections/users/documents/"+aliceId, "")
+	require.Equal(t, http.StatusNoContent, status)
+
+	status, _ = request(t, srv, http.MethodGet, "/collections/users/documents/"+aliceId, "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, body = request(t, srv, http.MethodGet, "/collections/users/documents?sort=name&limit=1", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, body.([]interface{}), 1)
+	require.Equal(t, "bob", body.([]interface{})[0].(map[string]interface{})["name"])
+
+	status, _ = request(t, srv, http.MethodDelete, "/collections/users", "")
+	require.Equal(t, http.StatusNoContent, status)
+
+	status, _ = request(t, srv, http.MethodGet, "/collections/users/documents", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestServerMaxBodySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clover-server")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := c.Open(dir)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.CreateCollection("users"))
+
+	s := server.New(db)
+	require.Equal(t, int64(server.DefaultMaxBodySize), s.MaxBodySize)
+	s.MaxBodySize = 64
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	status, _ := request(t, srv, http.MethodPost, "/collections/users/documents", `{"name": "alice"}`)
+	require.Equal(t, http.StatusCreated, status)
+
+	large := `{"name": "` + strings.Repeat("a", 64) + `"}`
+	status, _ = request(t, srv, http.MethodPost, "/collections/users/documents", large)
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	status, _ = request(t, srv, http.MethodPost, "/collections/users/documents", `{"name": `)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, 1, db.Query("users").Count())
+
+	s.MaxBodySize = 0
+	status, _ = request(t, srv, http.MethodPost, "/collections/users/documents", large)
+	require.Equal(t, http.StatusCreated, status)
+}
@@ -0,0 +1,56 @@
+package clover
+
+// Snapshot is a read-only view of a database, frozen at the time it was taken.
+// Writes applied to the database after the snapshot was taken are not visible through it.
+type Snapshot struct {
+	collections map[string]*collection
+}
+
+// Snapshot captures the current state of all the collections of the database.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.ensureLoaded()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	collections := make(map[string]*collection, len(db.collections))
+	for name, c := range db.collections {
+		collections[name] = c
+	}
+	return &Snapshot{collections: collections}, nil
+}
+
+// HasCollection returns true if and only if the snapshot contains a collection with the given name.
+func (s *Snapshot) HasCollection(name string) bool {
+	_, ok := s.collections[name]
+	return ok
+}
+
+// Query returns a read-only query over the collection with the supplied name, as it was when the snapshot was taken.
+// It returns nil if such a collection doesn't exist or if the snapshot has been released.
+// Any attempt to modify documents through the returned query fails with ErrReadOnly.
+func (s *Snapshot) Query(name string) *Query {
+	c, ok := s.collections[name]
+	if !ok {
+		return nil
+	}
+
+	q := newQuery(c)
+	q.readOnly = true
+	q.snapshot = true
+	return q
+}
+
+// Count returns the number of documents the collection with the supplied name contained when the snapshot was taken.
+func (s *Snapshot) Count(name string) (int, error) {
+	c, ok := s.collections[name]
+	if !ok {
+		return 0, collectionNotExistError(name)
+	}
+	return c.Count(), nil
+}
+
+// Release frees the resources held by the snapshot. The snapshot must not be used afterwards.
+func (s *Snapshot) Release() {
+	s.collections = nil
+}
@@ -0,0 +1,115 @@
+package clover
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// SortOption is used to specify sorting options to the Sort method.
+// It consists of a field name and a sorting direction (1 for ascending and -1 for descending).
+// Any negative direction sorts in descending order, any other value in ascending order.
+type SortOption struct {
+	Field     string
+	Direction int
+}
+
+// typeRank returns the position of the type of v in the ordering used when comparing values of different types.
+// Missing fields come first, followed by null, numbers, strings, objects, arrays and booleans.
+func typeRank(v interface{}, exists bool) int {
+	if !exists {
+		return 0
+	}
+
+	switch v.(type) {
+	case nil:
+		return 1
+	case int64, float64:
+		return 2
+	case string:
+		return 3
+	case map[string]interface{}:
+		return 4
+	case []interface{}:
+		return 5
+	case bool:
+		return 6
+	}
+	return 7
+}
+
+func compareFields(doc1 *Document, doc2 *Document, name string) int {
+	return compareOrdered(doc1.Get(name), doc1.Has(name), doc2.Get(name), doc2.Has(name))
+}
+
+// compareOrdered compares two values according to the order used to sort documents, where values of different types are ordered by typeRank.
+func compareOrdered(v1 interface{}, exists1 bool, v2 interface{}, exists2 bool) int {
+	rank1, rank2 := typeRank(v1, exists1), typeRank(v2, exists2)
+	if rank1 != rank2 {
+		return rank1 - rank2
+	}
+
+	res, _ := compareValues(v1, v2)
+	return res
+}
+
+func lessDocuments(doc1 *Document, doc2 *Document, opts []SortOption) bool {
+	for _, opt := range opts {
+		res := compareFields(doc1, doc2, opt.Field)
+		if res != 0 {
+			if opt.Direction < 0 {
+				return res > 0
+			}
+			return res < 0
+		}
+	}
+	// break ties using ids, so that the order doesn't depend on the collection iteration order
+	return doc1.ObjectId() < doc2.ObjectId()
+}
+
+func sortDocuments(docs []*Document, opts []SortOption) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		return lessDocuments(docs[i], docs[j], opts)
+	})
+}
+
+// topDocuments keeps the first k documents according to the sort options, without sorting all the supplied documents.
+type topDocuments struct {
+	k    int
+	opts []SortOption
+	docs []*Document // max-heap: the greatest kept document is at the root
+}
+
+func newTopDocuments(k int, opts []SortOption) *topDocuments {
+	return &topDocuments{k: k, opts: opts, docs: make([]*Document, 0)}
+}
+
+func (top *topDocuments) Len() int { return len(top.docs) }
+
+func (top *topDocuments) Less(i, j int) bool {
+	return lessDocuments(top.docs[j], top.docs[i], top.opts)
+}
+
+func (top *topDocuments) Swap(i, j int) { top.docs[i], top.docs[j] = top.docs[j], top.docs[i] }
+
+func (top *topDocuments) Push(x interface{}) { top.docs = append(top.docs, x.(*Document)) }
+
+func (top *topDocuments) Pop() interface{} {
+	doc := top.docs[len(top.docs)-1]
+	top.docs = top.docs[:len(top.docs)-1]
+	return doc
+}
+
+func (top *topDocuments) add(doc *Document) {
+	if len(top.docs) < top.k {
+		heap.Push(top, doc)
+	} else if lessDocuments(doc, top.docs[0], top.opts) {
+		top.docs[0] = doc
+		heap.Fix(top, 0)
+	}
+}
+
+// sorted returns the kept documents, in ascending order.
+func (top *topDocuments) sorted() []*Document {
+	sortDocuments(top.docs, top.opts)
+	return top.docs
+}
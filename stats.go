@@ -0,0 +1,113 @@
+package clover
+
+import (
+	"os"
+	"sort"
+)
+
+// IndexInfo describes an index of a collection.
+type IndexInfo struct {
+	Fields []string
+	Unique bool
+
+	// Text is true for full-text indexes (see CreateTextIndex).
+	Text bool
+
+	// Geo is true for geospatial indexes (see CreateGeoIndex).
+	Geo bool
+}
+
+// CollectionStats holds information about a collection, as returned by DB.CollectionStats.
+type CollectionStats struct {
+	Name      string
+	Documents int
+
+	// Size is the size in bytes of the stored snapshot of the collection. When the write-ahead log is enabled,
+	// it is the size of the snapshot written by the last checkpoint, which doesn't include the most recent writes.
+	Size int64
+
+	Indexes []IndexInfo
+}
+
+// sizer is implemented by storages which can report the size of a snapshot without reading it.
+type sizer interface {
+	size(name string) (int64, error)
+}
+
+func (s *fileStorage) size(name string) (int64, error) {
+	info, err := os.Stat(s.dir + "/" + s.filename(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// snapshotSize returns the size of the stored snapshot of the collection with the given name, or zero if the
+// collection has not been stored yet. It must be called holding db.mu for writing, since storages are not safe for concurrent use.
+func (db *DB) snapshotSize(name string) (int64, error) {
+	var size int64
+	var err error
+	if s, ok := db.storage.(sizer); ok {
+		size, err = s.size(name)
+	} else {
+		var data []byte
+		data, err = db.storage.Load(name)
+		size = int64(len(data))
+	}
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// ListCollections returns the names of all the collections of the database, in sorted order.
+// Views and corrupted collections (see CorruptedCollections) are not included.
+func (db *DB) ListCollections() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	names := make([]string, 0, len(db.collections)+len(db.unloaded))
+	for name := range db.collections {
+		names = append(names, name)
+	}
+
+	for name := range db.unloaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CollectionStats returns the number of documents, the on-disk size and the indexes of the collection with the given name.
+func (db *DB) CollectionStats(name string) (*CollectionStats, error) {
+	db.ensureLoaded(name)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[name]
+	if !ok {
+		return nil, collectionNotExistError(name)
+	}
+
+	size, err := db.snapshotSize(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &CollectionStats{Name: name, Documents: c.Count(), Size: size, Indexes: make([]IndexInfo, 0)}
+	for _, idx := range c.indexes {
+		fields := append([]string(nil), idx.fields...)
+		stats.Indexes = append(stats.Indexes, IndexInfo{Fields: fields, Unique: idx.unique})
+	}
+
+	for _, idx := range c.textIndexes {
+		stats.Indexes = append(stats.Indexes, IndexInfo{Fields: []string{idx.field}, Text: true})
+	}
+
+	for _, idx := range c.geoIndexes {
+		stats.Indexes = append(stats.Indexes, IndexInfo{Fields: []string{idx.field}, Geo: true})
+	}
+	return stats, nil
+}
@@ -0,0 +1,152 @@
+package clover
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Storage persists the snapshots of the collections of a database. Each snapshot is an opaque blob, encoding
+// both the documents and the metadata of a collection, which is always replaced as a whole.
+//
+// The default implementation stores each collection in a JSON file inside the database directory (see NewFileStorage),
+// while NewMemoryStorage keeps collections in memory. Other backends (such as key-value stores or object storage)
+// can be plugged in through WithStorage. Implementations don't need to be safe for concurrent use, since they are only
+// accessed while writing collections. Storages holding resources (connections, file handles, ...) can implement
+// io.Closer as well: in this case, DB.Close closes the storage after flushing all pending writes.
+type Storage interface {
+	// List returns the names of all the stored collections.
+	List() ([]string, error)
+
+	// Load returns the snapshot of the collection with the given name.
+	Load(name string) ([]byte, error)
+
+	// Save atomically replaces the snapshot of the collection with the given name. If sync is true,
+	// the snapshot must be written to stable storage before Save returns.
+	Save(name string, data []byte, sync bool) error
+
+	// Delete removes the snapshot of the collection with the given name.
+	Delete(name string) error
+
+	// Sync writes to stable storage the snapshots of the given collections, previously saved without syncing.
+	Sync(names ...string) error
+}
+
+const collectionFileExt = ".json"
+
+// size of the buffer used to read snapshots from storages implementing snapshotOpener
+const snapshotBufferSize = 64 * 1024
+
+// snapshotOpener is implemented by storages which can stream the snapshot of a collection: such snapshots are decoded
+// while being read, instead of being loaded in memory as a whole before decoding.
+type snapshotOpener interface {
+	open(name string) (io.ReadCloser, error)
+}
+
+type fileStorage struct {
+	dir  string
+	mode os.FileMode
+}
+
+// NewFileStorage returns a Storage keeping each collection in a JSON file inside dir.
+// If such a folder doesn't exist, it is automatically created.
+func NewFileStorage(dir string) (Storage, error) {
+	return newFileStorage(dir, 0)
+}
+
+// newFileStorage returns a file storage creating files with the given permissions, or with the default ones if mode is zero.
+func newFileStorage(dir string, mode os.FileMode) (*fileStorage, error) {
+	if err := makeDirIfNotExists(dir); err != nil {
+		return nil, err
+	}
+	return &fileStorage{dir: dir, mode: mode}, nil
+}
+
+func (s *fileStorage) filename(name string) string {
+	return name + collectionFileExt
+}
+
+func (s *fileStorage) List() ([]string, error) {
+	filenames, err := listDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		if filepath.Ext(filename) == collectionFileExt {
+			names = append(names, getBasename(filename))
+		}
+	}
+	return names, nil
+}
+
+func (s *fileStorage) Load(name string) ([]byte, error) {
+	return ioutil.ReadFile(s.dir + "/" + s.filename(name))
+}
+
+func (s *fileStorage) open(name string) (io.ReadCloser, error) {
+	return os.Open(s.dir + "/" + s.filename(name))
+}
+
+func (s *fileStorage) Save(name string, data []byte, sync bool) error {
+	return saveToFile(s.dir, s.filename(name), data, s.mode, sync)
+}
+
+func (s *fileStorage) Delete(name string) error {
+	return os.Remove(s.dir + "/" + s.filename(name))
+}
+
+func (s *fileStorage) Sync(names ...string) error {
+	for _, name := range names {
+		if err := syncFile(s.dir + "/" + s.filename(name)); err != nil {
+			return err
+		}
+	}
+	return syncFile(s.dir)
+}
+
+type memoryStorage struct {
+	snapshots map[string][]byte
+}
+
+// NewMemoryStorage returns a Storage keeping all the collections in memory. The content of the storage is lost
+// when the process exits, but it survives closing the database: a database opened again with the same storage
+// finds all the collections written before.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{snapshots: make(map[string][]byte)}
+}
+
+func (s *memoryStorage) List() ([]string, error) {
+	names := make([]string, 0, len(s.snapshots))
+	for name := range s.snapshots {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *memoryStorage) Load(name string) ([]byte, error) {
+	data, ok := s.snapshots[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (s *memoryStorage) Save(name string, data []byte, sync bool) error {
+	s.snapshots[name] = data
+	return nil
+}
+
+func (s *memoryStorage) Delete(name string) error {
+	if _, ok := s.snapshots[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.snapshots, name)
+	return nil
+}
+
+func (s *memoryStorage) Sync(names ...string) error {
+	return nil
+}
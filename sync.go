@@ -0,0 +1,129 @@
+package clover
+
+import (
+	"sync"
+	"time"
+)
+
+// SyncMode controls when written collection files are flushed to stable storage (fsync).
+//
+// Collection files are always replaced atomically, so a crash of the process never leaves a partially written file,
+// whatever the mode. The mode only matters when the whole machine crashes (or loses power) before the operating
+// system writes its buffers to disk.
+type SyncMode int
+
+// Supported sync modes
+const (
+	// SyncNever never flushes files explicitly, relying on the operating system.
+	// After a machine crash, any write performed in the last few seconds may be lost.
+	SyncNever SyncMode = iota
+
+	// SyncAlways flushes each collection file (and its directory) before a write returns.
+	// Acknowledged writes survive machine crashes, at the cost of slower writes.
+	SyncAlways
+
+	// SyncBatch flushes modified collection files periodically (see WithSyncInterval), or as soon as
+	// syncBatchWrites writes are pending. After a machine crash, writes performed since the last flush may be lost.
+	SyncBatch
+)
+
+// number of pending writes triggering a flush in SyncBatch mode
+const syncBatchWrites = 100
+
+const defaultSyncInterval = time.Second
+
+type syncer struct {
+	mu      sync.Mutex
+	pending int
+	dirty   map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (db *DB) startSyncer(interval time.Duration) {
+	db.syncer.dirty = make(map[string]bool)
+	if db.syncMode != SyncBatch {
+		return
+	}
+
+	db.syncer.stop = make(chan struct{})
+	db.syncer.done = make(chan struct{})
+
+	go func() {
+		defer close(db.syncer.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := db.Sync(); err != nil {
+					db.logf("sync failed: %v", err)
+				}
+			case <-db.syncer.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) stopSyncer() {
+	if db.syncer.stop != nil {
+		close(db.syncer.stop)
+		<-db.syncer.done
+		db.syncer.stop = nil
+	}
+}
+
+// markDirty records that the given collection has been written without being flushed.
+func (db *DB) markDirty(name string) error {
+	db.syncer.mu.Lock()
+	db.syncer.dirty[name] = true
+	db.syncer.pending++
+	flush := db.syncMode == SyncBatch && db.syncer.pending >= syncBatchWrites
+	db.syncer.mu.Unlock()
+
+	if flush {
+		return db.sync()
+	}
+	return nil
+}
+
+func (db *DB) forgetDirty(name string) {
+	db.syncer.mu.Lock()
+	defer db.syncer.mu.Unlock()
+
+	delete(db.syncer.dirty, name)
+}
+
+// Sync flushes to stable storage every collection written since the last flush, regardless of the sync mode.
+func (db *DB) Sync() error {
+	db.mu.Lock()
+	defer db.unlock()
+
+	return db.sync()
+}
+
+func (db *DB) sync() error {
+	db.syncer.mu.Lock()
+	defer db.syncer.mu.Unlock()
+
+	if len(db.syncer.dirty) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(db.syncer.dirty))
+	for name := range db.syncer.dirty {
+		names = append(names, name)
+	}
+
+	if err := db.storage.Sync(names...); err != nil {
+		return err
+	}
+
+	db.syncer.dirty = make(map[string]bool)
+	db.syncer.pending = 0
+	return nil
+}
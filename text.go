@@ -0,0 +1,325 @@
+package clover
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// tokenize splits s into lowercase terms, made of letters and digits.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// termCounts returns the number of occurrences of each term of value, which can be a string or an array of strings.
+// Values of other types contain no terms.
+func termCounts(value interface{}) map[string]int {
+	counts := make(map[string]int)
+	switch v := value.(type) {
+	case string:
+		for _, term := range tokenize(v) {
+			counts[term]++
+		}
+	case []interface{}:
+		for _, item := range v {
+			if s, isString := item.(string); isString {
+				for _, term := range tokenize(s) {
+					counts[term]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// textSearch describes a Search criteria, which can be answered using a text index on field.
+type textSearch struct {
+	field string
+	terms []string
+}
+
+// Search selects the documents where the field contains all the words of text, ignoring case and punctuation.
+// The field can be a string or an array of strings. If the collection has a text index on the field (see CreateTextIndex),
+// it is used to find the matching documents without scanning the whole collection. A text with no words matches nothing.
+// Results can be ordered by relevance using Query.SortByScore.
+func (r *field) Search(text string) *Criteria {
+	terms := make([]string, 0)
+	for term := range termCounts(text) {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	return (&Criteria{
+		p: func(doc *Document) bool {
+			if len(terms) == 0 {
+				return false
+			}
+
+			counts := termCounts(doc.Get(r.name))
+			for _, term := range terms {
+				if counts[term] == 0 {
+					return false
+				}
+			}
+			return true
+		},
+		searches: []textSearch{{field: r.name, terms: terms}},
+	}).withSpec(r.name, "$search", text)
+}
+
+// textIndex is an inverted index, mapping each term of a field to the documents containing it.
+// As the other indexes, it is copy-on-write: posting lists are shared between versions until they are modified.
+type textIndex struct {
+	field    string
+	postings map[string]map[string]int // term -> document id -> occurrences
+
+	// owned contains the terms whose posting lists are not shared with other versions of the index
+	owned map[string]bool
+}
+
+func newTextIndex(field string) *textIndex {
+	return &textIndex{field: field, postings: make(map[string]map[string]int), owned: make(map[string]bool)}
+}
+
+func (idx *textIndex) clone() *textIndex {
+	postings := make(map[string]map[string]int, len(idx.postings))
+	for term, docs := range idx.postings {
+		postings[term] = docs
+	}
+	return &textIndex{field: idx.field, postings: postings, owned: make(map[string]bool)}
+}
+
+// writablePostings returns the posting list of term, copying it first if it is shared with other versions.
+func (idx *textIndex) writablePostings(term string) map[string]int {
+	docs := idx.postings[term]
+	if idx.owned[term] {
+		return docs
+	}
+
+	newDocs := make(map[string]int, len(docs)+1)
+	for id, n := range docs {
+		newDocs[id] = n
+	}
+	idx.postings[term] = newDocs
+	idx.owned[term] = true
+	return newDocs
+}
+
+func (idx *textIndex) add(doc *Document) {
+	for term, n := range termCounts(doc.Get(idx.field)) {
+		idx.writablePostings(term)[doc.ObjectId()] = n
+	}
+}
+
+func (idx *textIndex) remove(doc *Document) {
+	for term := range termCounts(doc.Get(idx.field)) {
+		docs := idx.writablePostings(term)
+		delete(docs, doc.ObjectId())
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+}
+
+func (idx *textIndex) build(docs map[string]*Document) {
+	for _, doc := range docs {
+		idx.add(doc)
+	}
+}
+
+func (idx *textIndex) truncate() {
+	idx.postings = make(map[string]map[string]int)
+	idx.owned = make(map[string]bool)
+}
+
+// search returns, in sorted order, the ids of the documents containing all the supplied terms.
+func (idx *textIndex) search(terms []string) []string {
+	ids := make([]string, 0)
+	if len(terms) == 0 {
+		return ids
+	}
+
+	// start from the rarest term, so that the intersection is computed on the shortest posting list
+	rarest := terms[0]
+	for _, term := range terms[1:] {
+		if len(idx.postings[term]) < len(idx.postings[rarest]) {
+			rarest = term
+		}
+	}
+
+	for id := range idx.postings[rarest] {
+		matches := true
+		for _, term := range terms {
+			if _, ok := idx.postings[term][id]; !ok {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (c *collection) getTextIndex(field string) *textIndex {
+	for _, idx := range c.textIndexes {
+		if idx.field == field {
+			return idx
+		}
+	}
+	return nil
+}
+
+// textPlan returns the text index which can be used to answer q, along with the corresponding search.
+func (q *Query) textPlan() (*textIndex, *textSearch) {
+	if q.criteria == nil {
+		return nil, nil
+	}
+
+	for i, search := range q.criteria.searches {
+		if idx := q.collection.getTextIndex(search.field); idx != nil {
+			return idx, &q.criteria.searches[i]
+		}
+	}
+	return nil, nil
+}
+
+// SortByScore returns a new Query which sorts the selected documents by relevance to the Search criteria of q, from the
+// most to the least relevant one. The score of a document is the sum, over each searched word, of the frequency of the
+// word in the field, weighted by the inverse of the fraction of documents of the collection containing it (TF-IDF).
+// Documents having the same score are sorted by id. Other sort options are ignored, as is SortByScore when the query
+// has no Search criteria.
+func (q *Query) SortByScore() *Query {
+	newQuery := q.copy()
+	newQuery.sortByScore = true
+	return newQuery
+}
+
+// scoreSearches returns the Search criteria of q used to compute the score of documents, if they must be sorted by score.
+func (q *Query) scoreSearches() []textSearch {
+	if !q.sortByScore || q.criteria == nil {
+		return nil
+	}
+	return q.criteria.searches
+}
+
+// sortDocumentsByScore sorts docs by decreasing relevance to the supplied searches.
+func (q *Query) sortDocumentsByScore(docs []*Document, searches []textSearch) {
+	c := q.collection
+
+	// inverse document frequencies of the searched terms
+	idfs := make([]map[string]float64, len(searches))
+	for i, search := range searches {
+		df := make(map[string]int, len(search.terms))
+		if idx := c.getTextIndex(search.field); idx != nil {
+			for _, term := range search.terms {
+				df[term] = len(idx.postings[term])
+			}
+		} else {
+			c.forEachDoc(func(doc *Document) bool {
+				counts := termCounts(doc.Get(search.field))
+				for _, term := range search.terms {
+					if counts[term] > 0 {
+						df[term]++
+					}
+				}
+				return true
+			})
+		}
+
+		idfs[i] = make(map[string]float64, len(search.terms))
+		for _, term := range search.terms {
+			idfs[i][term] = math.Log(1 + float64(c.Count())/float64(df[term]+1))
+		}
+	}
+
+	scores := make(map[*Document]float64, len(docs))
+	for _, doc := range docs {
+		score := 0.0
+		for i, search := range searches {
+			counts := termCounts(doc.Get(search.field))
+
+			total := 0
+			for _, n := range counts {
+				total += n
+			}
+
+			for _, term := range search.terms {
+				if counts[term] > 0 {
+					score += float64(counts[term]) / float64(total) * idfs[i][term]
+				}
+			}
+		}
+		scores[doc] = score
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		if scores[docs[i]] != scores[docs[j]] {
+			return scores[docs[i]] > scores[docs[j]]
+		}
+		return docs[i].ObjectId() < docs[j].ObjectId()
+	})
+}
+
+// CreateTextIndex creates a full-text index on a field of a collection, which is used by Search criteria on the same field.
+// The index maps each word of a string field (or of the strings of an array) to the documents containing it.
+// As for the other indexes, its definition is persisted, so that the index is rebuilt when the database is reopened.
+func (db *DB) CreateTextIndex(collectionName string, field string) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	if field == "" {
+		return ErrInvalidArgument
+	}
+
+	if c.getTextIndex(field) != nil {
+		return indexExistError(collectionName, field)
+	}
+
+	idx := newTextIndex(field)
+	idx.build(c.docs)
+
+	newCollection := c.clone()
+	newCollection.textIndexes = append(newCollection.textIndexes, idx)
+	return db.commit(newCollection)
+}
+
+// DropTextIndex removes the full-text index on a field of a collection.
+func (db *DB) DropTextIndex(collectionName string, field string) error {
+	db.ensureLoaded(collectionName)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	c, ok := db.collections[collectionName]
+	if !ok {
+		return collectionNotExistError(collectionName)
+	}
+
+	if c.getTextIndex(field) == nil {
+		return indexNotExistError(collectionName, field)
+	}
+
+	newCollection := c.clone()
+	textIndexes := make([]*textIndex, 0, len(c.textIndexes))
+	for _, idx := range newCollection.textIndexes {
+		if idx.field != field {
+			textIndexes = append(textIndexes, idx)
+		}
+	}
+	newCollection.textIndexes = textIndexes
+	return db.commit(newCollection)
+}
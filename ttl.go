@@ -0,0 +1,112 @@
+package clover
+
+import "time"
+
+// ExpiresAtField is the name of the field holding the expiration time of a document, as milliseconds since the Unix epoch.
+const ExpiresAtField = "_expiresAt"
+
+// SetExpiresAt makes the document expire at the given time. Expired documents are removed by DeleteExpired, which is
+// periodically invoked by the database when WithExpirationInterval is used. Until they are removed, expired documents
+// are still returned by queries: use NotExpired to exclude them.
+func (doc *Document) SetExpiresAt(t time.Time) {
+	doc.Set(ExpiresAtField, t.UnixNano()/int64(time.Millisecond))
+}
+
+// ExpiresAt returns the expiration time of the document, and true, or the zero time and false if the document never expires.
+func (doc *Document) ExpiresAt() (time.Time, bool) {
+	ms, ok := toFloat64(doc.Get(ExpiresAtField))
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)), true
+}
+
+func (doc *Document) expired(now time.Time) bool {
+	t, ok := doc.ExpiresAt()
+	return ok && !t.After(now)
+}
+
+// NotExpired returns a Criteria selecting the documents which don't have an expiration time, or which haven't expired yet.
+func NotExpired() *Criteria {
+	return &Criteria{
+		p: func(doc *Document) bool {
+			return !doc.expired(time.Now())
+		},
+	}
+}
+
+// DeleteExpired removes from all the collections the documents whose expiration time (see Document.SetExpiresAt) has passed.
+// It returns the number of removed documents.
+func (db *DB) DeleteExpired() (int, error) {
+	db.mu.Lock()
+	defer db.unlock()
+
+	now := time.Now()
+	n := 0
+	for name, c := range db.collections {
+		var newCollection *collection
+		events := make([]ChangeEvent, 0)
+		c.forEachDoc(func(doc *Document) bool {
+			if !doc.expired(now) {
+				return true
+			}
+
+			if newCollection == nil {
+				newCollection = c.clone()
+			}
+			newCollection.remove(doc.ObjectId())
+			events = append(events, newChangeEvent(OpDelete, name, doc))
+			return true
+		})
+
+		if newCollection == nil {
+			continue
+		}
+
+		if err := db.commit(newCollection, events...); err != nil {
+			return n, err
+		}
+		n += len(events)
+	}
+	return n, nil
+}
+
+type janitor struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (db *DB) startJanitor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	db.janitor.stop = make(chan struct{})
+	db.janitor.done = make(chan struct{})
+
+	go func() {
+		defer close(db.janitor.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := db.DeleteExpired(); err != nil {
+					db.logf("removal of expired documents failed: %v", err)
+				}
+			case <-db.janitor.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) stopJanitor() {
+	if db.janitor.stop != nil {
+		close(db.janitor.stop)
+		<-db.janitor.done
+		db.janitor.stop = nil
+	}
+}
@@ -0,0 +1,188 @@
+package clover
+
+// Tx groups writes to one or more collections, which are applied all together when the transaction is committed,
+// or discarded when it is rolled back. Writes performed inside a transaction are only visible to the queries of the
+// transaction itself (see Tx.Query) until Commit returns.
+//
+// Transactions are optimistic: if a collection read or written by the transaction is modified outside of it before
+// the commit, Commit fails with ErrConflict. A transaction must not be used by multiple goroutines at the same time.
+type Tx struct {
+	db          *DB
+	base        map[string]*collection // versions of the collections when first accessed by the transaction
+	collections map[string]*collection // versions written by the transaction
+	events      []ChangeEvent
+	done        bool
+}
+
+// Begin starts a new transaction.
+func (db *DB) Begin() *Tx {
+	return &Tx{
+		db:          db,
+		base:        make(map[string]*collection),
+		collections: make(map[string]*collection),
+	}
+}
+
+// Tx runs fn inside a new transaction, which is committed if fn returns nil and rolled back otherwise.
+func (db *DB) Tx(fn func(tx *Tx) error) error {
+	tx := db.Begin()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (tx *Tx) getCollection(name string) (*collection, bool) {
+	if c, ok := tx.collections[name]; ok {
+		return c, true
+	}
+
+	tx.db.ensureLoaded(name)
+
+	tx.db.mu.RLock()
+	c, ok := tx.db.collections[name]
+	tx.db.mu.RUnlock()
+
+	if ok {
+		if _, accessed := tx.base[name]; !accessed {
+			tx.base[name] = c
+		}
+	}
+	return c, ok
+}
+
+// lock has no effect, since the writes of a transaction are only applied to the database by Commit.
+func (tx *Tx) lock() func() {
+	return func() {}
+}
+
+func (tx *Tx) commit(c *collection, events ...ChangeEvent) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	if err := c.runBeforeHooks(events); err != nil {
+		return err
+	}
+
+	prev, _ := tx.getCollection(c.name)
+	c.assignVersions(prev, events)
+	if err := c.checkConstraints(prev); err != nil {
+		return err
+	}
+	tx.collections[c.name] = c
+	tx.events = append(tx.events, events...)
+	return nil
+}
+
+// Query returns a query over the collection with the given name, as seen by the transaction.
+// Writes performed through the returned query (Update, Delete, ...) become part of the transaction.
+// It returns nil if the collection doesn't exist.
+func (tx *Tx) Query(name string) *Query {
+	c, ok := tx.getCollection(name)
+	if !ok {
+		return nil
+	}
+
+	q := newQuery(c)
+	q.tx = tx
+	return q
+}
+
+// Insert adds the supplied documents to a collection, as part of the transaction (see DB.Insert).
+func (tx *Tx) Insert(collectionName string, docs ...*Document) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.db.insert(tx, collectionName, docs)
+}
+
+// InsertOne inserts a single document to a collection, as part of the transaction. It returns the id of the inserted document.
+func (tx *Tx) InsertOne(collectionName string, doc *Document) (string, error) {
+	err := tx.Insert(collectionName, doc)
+	return doc.ObjectId(), err
+}
+
+// Commit applies all the writes of the transaction. Either all the modified collections are replaced, or none of them is.
+//
+// Atomicity across crashes requires a write-ahead log (see WithWriteAheadLog), which records all the changes of the
+// transaction at once. Without a log, the modified collections are saved one at a time: if saving a collection fails,
+// Commit restores the collections it has already saved to their previous content, but a crash of the process (or a
+// failed restore) in the middle of a commit leaves the transaction partially applied on disk.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	db := tx.db
+	db.mu.Lock()
+	defer db.unlock()
+
+	if db.readOnly && len(tx.collections) > 0 {
+		return readOnlyDatabaseError()
+	}
+
+	for name, c := range tx.base {
+		if db.collections[name] != c {
+			return ErrConflict
+		}
+	}
+
+	if err := tx.save(); err != nil {
+		return err
+	}
+
+	for name, c := range tx.collections {
+		db.collections[name] = c
+		db.queryCache.invalidate(name)
+	}
+	db.notify(tx.events...)
+	db.queueAfterHooks(tx.events)
+	db.maybeCheckpoint()
+	return nil
+}
+
+// save persists the collections written by the transaction. With a write-ahead log, all the changes are recorded
+// atomically; otherwise, if saving a collection fails, the collections already saved are restored.
+func (tx *Tx) save() error {
+	db := tx.db
+	if db.wal != nil {
+		collections := make([]*collection, 0, len(tx.collections))
+		for _, c := range tx.collections {
+			collections = append(collections, c)
+		}
+		return db.logCollections(collections...)
+	}
+
+	saved := make([]string, 0, len(tx.collections))
+	for name, c := range tx.collections {
+		if err := db.save(c); err != nil {
+			for _, savedName := range saved {
+				if restoreErr := db.restore(savedName); restoreErr != nil {
+					db.logf("restoring collection %s after a failed commit failed: %v", savedName, restoreErr)
+				}
+			}
+			return err
+		}
+		saved = append(saved, name)
+	}
+	return nil
+}
+
+// restore saves again the current version of the collection with the given name, or deletes its snapshot, if the
+// collection didn't exist before the transaction.
+func (db *DB) restore(name string) error {
+	if c, ok := db.collections[name]; ok {
+		return db.save(c)
+	}
+	return db.storage.Delete(name)
+}
+
+// Rollback discards all the writes of the transaction. Calling Rollback on a committed transaction has no effect.
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.collections = nil
+	tx.events = nil
+}
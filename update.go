@@ -0,0 +1,157 @@
+package clover
+
+import "fmt"
+
+type updateOpKind int
+
+const (
+	updateInc updateOpKind = iota
+	updatePush
+	updatePull
+	updateUnset
+)
+
+// UpdateOp describes a modification of a single field of a document, computed from the current value of the field.
+// Operations are applied by Query.UpdateWith.
+type UpdateOp struct {
+	kind   updateOpKind
+	field  string
+	values []interface{}
+}
+
+// Inc adds amount, which must be a number, to the value of the field. A missing field is set to amount, while
+// incrementing a field which is not a number fails with ErrInvalidArgument.
+func Inc(field string, amount interface{}) *UpdateOp {
+	return &UpdateOp{kind: updateInc, field: field, values: []interface{}{amount}}
+}
+
+// Push appends values to the array stored in the field. A missing field is set to an array containing values, while
+// pushing to a field which is not an array fails with ErrInvalidArgument.
+func Push(field string, values ...interface{}) *UpdateOp {
+	return &UpdateOp{kind: updatePush, field: field, values: values}
+}
+
+// Pull removes from the array stored in the field all the elements equal to any of values. A missing field is left
+// untouched, while pulling from a field which is not an array fails with ErrInvalidArgument.
+func Pull(field string, values ...interface{}) *UpdateOp {
+	return &UpdateOp{kind: updatePull, field: field, values: values}
+}
+
+// Unset removes the field from the document, if present.
+func Unset(field string) *UpdateOp {
+	return &UpdateOp{kind: updateUnset, field: field}
+}
+
+// UpdateWith applies the supplied operations, in order, to all the documents selected by q, and persists the collection.
+// Since each operation is computed from the current value of the field while holding the write lock, concurrent
+// updates (such as incrementing a counter) never overwrite each other. If an operation fails on any document, nothing
+// is updated. As for Update, the id field cannot be modified.
+func (q *Query) UpdateWith(ops ...*UpdateOp) error {
+	defer q.committer().lock()()
+
+	q, err := q.latest()
+	if err != nil {
+		return err
+	}
+
+	db := q.collection.db
+	normOps := make([]*UpdateOp, 0, len(ops))
+	for _, op := range ops {
+		if op.field == "" || op.field == db.idField {
+			return ErrInvalidArgument
+		}
+
+		values := make([]interface{}, 0, len(op.values))
+		for _, value := range op.values {
+			normValue, err := db.codecs.normalize(value, db.preserveInts)
+			if err != nil {
+				return err
+			}
+			values = append(values, normValue)
+		}
+
+		if op.kind == updateInc && !isNumber(values[0]) {
+			return fmt.Errorf("%w: Inc requires a number, got %T", ErrInvalidArgument, op.values[0])
+		}
+		normOps = append(normOps, &UpdateOp{kind: op.kind, field: op.field, values: values})
+	}
+
+	newCollection := q.collection.clone()
+	events := make([]ChangeEvent, 0)
+	q.forEach(func(doc *Document) bool {
+		updateDoc := doc.Copy()
+		for _, op := range normOps {
+			if err = op.apply(updateDoc); err != nil {
+				return false
+			}
+		}
+
+		newCollection.put(updateDoc)
+		events = append(events, newChangeEvent(OpUpdate, q.collection.name, updateDoc))
+		return true
+	})
+
+	if err != nil {
+		return err
+	}
+	return q.committer().commit(newCollection, events...)
+}
+
+func (op *UpdateOp) apply(doc *Document) error {
+	path := splitFieldPath(op.field)
+	value, exists := lookupField(doc.fields, path)
+
+	switch op.kind {
+	case updateInc:
+		if !exists {
+			doc.Set(op.field, op.values[0])
+			return nil
+		}
+
+		if !isNumber(value) {
+			return fmt.Errorf("%w: cannot increment field %s of document %s, which is not a number", ErrInvalidArgument, op.field, doc.ObjectId())
+		}
+
+		sum, _ := applyArithOp(opAdd, value, op.values[0])
+		doc.Set(op.field, sum)
+	case updatePush:
+		arr, isArray := value.([]interface{})
+		if exists && !isArray {
+			return fmt.Errorf("%w: cannot push to field %s of document %s, which is not an array", ErrInvalidArgument, op.field, doc.ObjectId())
+		}
+
+		// arrays are shared with the original document, so a new one is always allocated
+		newArr := make([]interface{}, 0, len(arr)+len(op.values))
+		doc.Set(op.field, append(append(newArr, arr...), op.values...))
+	case updatePull:
+		if !exists {
+			return nil
+		}
+
+		arr, isArray := value.([]interface{})
+		if !isArray {
+			return fmt.Errorf("%w: cannot pull from field %s of document %s, which is not an array", ErrInvalidArgument, op.field, doc.ObjectId())
+		}
+
+		newArr := make([]interface{}, 0, len(arr))
+		for _, item := range arr {
+			if !containsValue(op.values, item) {
+				newArr = append(newArr, item)
+			}
+		}
+		doc.Set(op.field, newArr)
+	case updateUnset:
+		fields, _ := withoutField(doc.fields, path)
+		doc.fields = fields.(map[string]interface{})
+	}
+	return nil
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, value := range values {
+		if equalValues(value, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -34,18 +34,68 @@ func getBasename(filename string) string {
 	return strings.TrimSuffix(baseName, filepath.Ext(baseName))
 }
 
-func saveToFile(path string, filename string, data []byte) error {
-	file, err := ioutil.TempFile("", filename)
+// saveToFile atomically replaces the content of the file with the given data. If mode is not zero, it sets the
+// permissions of the file. If sync is true, both the file and its directory are flushed to stable storage before returning.
+func saveToFile(path string, filename string, data []byte, mode os.FileMode, sync bool) error {
+	// the temporary file must be on the same filesystem as the destination, so that it can be atomically renamed
+	file, err := ioutil.TempFile(path, filename+".*.tmp")
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(file.Name())
+		}
+	}()
+
+	if mode != 0 {
+		if err := file.Chmod(mode); err != nil {
+			return err
+		}
+	}
+
 	if _, err := file.Write(data); err != nil {
 		return err
 	}
 
-	return os.Rename(file.Name(), path+"/"+filename)
+	if sync {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(file.Name(), path+"/"+filename); err != nil {
+		return err
+	}
+	renamed = true
+
+	if sync {
+		return syncFile(path)
+	}
+	return nil
+}
+
+// syncFile flushes the file (or directory) with the given path to stable storage.
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// addInts returns a+b, where a and b are non-negative, or maxInt if the sum overflows.
+func addInts(a, b int) int {
+	if a > maxInt-b {
+		return maxInt
+	}
+	return a + b
 }
 
 func copyMap(m map[string]interface{}) map[string]interface{} {
@@ -60,3 +110,22 @@ func copyMap(m map[string]interface{}) map[string]interface{} {
 	}
 	return mapCopy
 }
+
+// deepCopy returns a copy of v, recursively copying maps and slices.
+func deepCopy(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		mapCopy := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			mapCopy[k] = deepCopy(item)
+		}
+		return mapCopy
+	case []interface{}:
+		sliceCopy := make([]interface{}, len(value))
+		for i, item := range value {
+			sliceCopy[i] = deepCopy(item)
+		}
+		return sliceCopy
+	}
+	return v
+}
@@ -0,0 +1,102 @@
+package clover
+
+import "fmt"
+
+// versionField holds the version of the documents of versioned collections (see WithVersioning).
+const versionField = "_version"
+
+// WithVersioning makes the collection keep a version number in the "_version" field of each document: inserted
+// documents have version 1, and the version is incremented each time a document is updated or replaced, regardless
+// of the value written by the update. Combined with WithExpectedVersion, versions enable safe read-modify-write cycles
+// from concurrent goroutines or processes. Unlike validators, the setting is stored along with the collection.
+func WithVersioning() CollectionOption {
+	return func(opts *collectionOptions) {
+		opts.versioned = true
+	}
+}
+
+// Version returns the version of the document (see WithVersioning), or zero if the document has no version.
+func (doc *Document) Version() int64 {
+	v, _ := toFloat64(doc.Get(versionField))
+	return int64(v)
+}
+
+// WriteOption customizes a write of a single document, such as DB.UpdateById.
+type WriteOption func(opts *writeOptions)
+
+type writeOptions struct {
+	expectedVersion *int64
+}
+
+// WithExpectedVersion makes the write fail with ErrConflict, without modifying anything, unless the current version
+// of the document is equal to version: this happens if another write modified the document after it was read.
+// It can only be used on versioned collections (see WithVersioning). With ReplaceById, an expected version of zero
+// makes sure that the document doesn't exist yet.
+func WithExpectedVersion(version int64) WriteOption {
+	return func(opts *writeOptions) {
+		opts.expectedVersion = &version
+	}
+}
+
+// checkVersion checks that doc, the current version of the document of c having the given id (or nil, if the document
+// doesn't exist), satisfies the supplied options. Missing documents are considered to have version zero.
+func (c *collection) checkVersion(id string, doc *Document, opts []WriteOption) error {
+	writeOpts := writeOptions{}
+	for _, opt := range opts {
+		opt(&writeOpts)
+	}
+
+	if writeOpts.expectedVersion == nil {
+		return nil
+	}
+
+	if !c.versioned {
+		return fmt.Errorf("%w: collection %s is not versioned", ErrInvalidArgument, c.name)
+	}
+
+	var version int64
+	if doc != nil {
+		version = doc.Version()
+	}
+
+	if version != *writeOpts.expectedVersion {
+		return fmt.Errorf("%w: document %s has version %d, expected %d", ErrConflict, id, version, *writeOpts.expectedVersion)
+	}
+	return nil
+}
+
+// assignVersions sets the version of the documents inserted or updated by events, which are about to be committed
+// to c, starting from the versions they had in prev (the previous version of the collection, if any).
+func (c *collection) assignVersions(prev *collection, events []ChangeEvent) {
+	if !c.versioned {
+		return
+	}
+
+	versions := make(map[string]int64)
+	for i, e := range events {
+		if e.Op == OpDelete {
+			continue
+		}
+
+		version, seen := versions[e.Id]
+		if !seen && prev != nil {
+			if prevDoc, ok := prev.docs[e.Id]; ok {
+				version = prevDoc.Version()
+			}
+		}
+		version++
+		versions[e.Id] = version
+
+		versionedDoc := e.Doc.Copy()
+		if c.db.preserveInts {
+			versionedDoc.Set(versionField, version)
+		} else {
+			versionedDoc.Set(versionField, float64(version))
+		}
+
+		if c.docs[e.Id] == e.Doc {
+			c.put(versionedDoc)
+		}
+		events[i].Doc = versionedDoc
+	}
+}
@@ -0,0 +1,64 @@
+package clover
+
+type view struct {
+	source   string
+	criteria *Criteria
+}
+
+// CreateView registers a named, read-only view over the source collection (or view), filtered by the supplied criteria.
+// Querying the view with db.Query(name) is equivalent to querying the source with criteria, so views always reflect
+// the current state of their source. Since criteria can't be stored on disk, views only live as long as the DB object.
+func (db *DB) CreateView(name string, source string, criteria *Criteria) error {
+	db.mu.Lock()
+	defer db.unlock()
+
+	if db.hasCollection(name) || db.hasView(name) {
+		return collectionExistError(name)
+	}
+
+	if !db.hasCollection(source) && !db.hasView(source) {
+		return collectionNotExistError(source)
+	}
+
+	db.views[name] = &view{source: source, criteria: criteria}
+	return nil
+}
+
+// HasView returns true if and only if the database contains a view with the given name.
+func (db *DB) HasView(name string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.hasView(name)
+}
+
+func (db *DB) hasView(name string) bool {
+	_, ok := db.views[name]
+	return ok
+}
+
+// DropView removes the view with the given name. Its source collection is not affected.
+func (db *DB) DropView(name string) error {
+	db.mu.Lock()
+	defer db.unlock()
+
+	if !db.hasView(name) {
+		return ErrViewNotExist
+	}
+
+	delete(db.views, name)
+	return nil
+}
+
+func (db *DB) queryView(v *view) *Query {
+	q := db.query(v.source)
+	if q == nil {
+		return nil
+	}
+
+	if v.criteria != nil {
+		q = q.Where(v.criteria)
+	}
+	q.readOnly = true
+	return q
+}
@@ -0,0 +1,473 @@
+package clover
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+const walFileName = "clover.wal"
+
+const defaultCheckpointWrites = 1000
+
+// walRecord describes the changes applied by a committed write, possibly spanning multiple collections (see Tx).
+// Replaying the records of the log, in order, on top of the collections saved at the last checkpoint restores the latest state of the database.
+type walRecord struct {
+	Collections []walEntry `json:"collections,omitempty"`
+	Dropped     []string   `json:"dropped,omitempty"`
+}
+
+type walEntry struct {
+	Name string `json:"name"`
+
+	// Reset is true when the entry replaces the whole content of the collection (as for a new collection).
+	Reset    bool                     `json:"reset,omitempty"`
+	Metadata *collectionMetadata      `json:"metadata,omitempty"`
+	Rows     []map[string]interface{} `json:"rows,omitempty"`
+	Deleted  []string                 `json:"deleted,omitempty"`
+}
+
+// wal is an append-only log of the writes committed since the last checkpoint. Each record is stored on a separate line,
+// preceded by its checksum, so that a record left partially written by a crash is detected and discarded.
+type wal struct {
+	file             *os.File
+	size             int64
+	records          int
+	checkpointWrites int
+
+	// collections written or dropped since the last checkpoint
+	dirty map[string]bool
+
+	// corrupted collections whose records could not be replayed: checkpoints, which would discard them, are
+	// postponed until these collections are repaired or dropped
+	skipped map[string]bool
+
+	// onAppend, if not nil, receives the data of each appended record (see ServeReplication)
+	onAppend func(data []byte)
+}
+
+func openWAL(dir string, checkpointWrites int, mode os.FileMode) (*wal, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("%w: the write-ahead log requires a database directory", ErrInvalidArgument)
+	}
+
+	if err := makeDirIfNotExists(dir); err != nil {
+		return nil, err
+	}
+
+	if mode == 0 {
+		mode = 0666
+	}
+
+	file, err := os.OpenFile(dir+"/"+walFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if checkpointWrites <= 0 {
+		checkpointWrites = defaultCheckpointWrites
+	}
+	return &wal{file: file, checkpointWrites: checkpointWrites, dirty: make(map[string]bool), skipped: make(map[string]bool)}, nil
+}
+
+// append durably writes rec at the end of the log.
+func (w *wal) append(rec *walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)
+	if _, err := w.file.WriteString(line); err != nil {
+		// remove the partial line, which would hide the records appended after it
+		w.file.Truncate(w.size)
+		return err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	w.size += int64(len(line))
+	w.records++
+	if w.onAppend != nil {
+		w.onAppend(data)
+	}
+	return nil
+}
+
+// readRecords returns the data of the records stored in the log, up to the first incomplete or damaged one.
+func (w *wal) readRecords() ([][]byte, error) {
+	if _, err := w.file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadAll(w.file)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([][]byte, 0)
+	for len(content) > 0 {
+		end := bytes.IndexByte(content, '\n')
+		if end < 0 {
+			break
+		}
+
+		line := content[:end]
+		content = content[end+1:]
+
+		if len(line) < 9 || line[8] != ' ' {
+			break
+		}
+
+		checksum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+		if err != nil || uint32(checksum) != crc32.ChecksumIEEE(line[9:]) {
+			break
+		}
+		records = append(records, line[9:])
+	}
+	return records, nil
+}
+
+func (w *wal) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	w.size = 0
+	w.records = 0
+	w.dirty = make(map[string]bool)
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// walEntry describes the changes turning the current version of the collection with the same name as c into c.
+func (db *DB) walEntry(c *collection) (walEntry, error) {
+	entry := walEntry{Name: c.name, Metadata: c.metadata()}
+
+	prev, ok := db.collections[c.name]
+	if !ok {
+		entry.Reset = true
+		prev = newCollection(db, c.name, nil)
+	}
+
+	// collections are copy-on-write, so unchanged documents are shared with the previous version
+	for id, doc := range c.docs {
+		if prev.docs[id] == doc {
+			continue
+		}
+
+		fields, err := db.codecs.encode(doc.fields)
+		if err != nil {
+			return entry, err
+		}
+		entry.Rows = append(entry.Rows, fields.(map[string]interface{}))
+	}
+
+	for id := range prev.docs {
+		if _, ok := c.docs[id]; !ok {
+			entry.Deleted = append(entry.Deleted, id)
+		}
+	}
+	return entry, nil
+}
+
+// logCollections appends to the log a single record containing the changes applied to all the supplied collections.
+func (db *DB) logCollections(collections ...*collection) error {
+	rec := &walRecord{}
+	for _, c := range collections {
+		entry, err := db.walEntry(c)
+		if err != nil {
+			return err
+		}
+		rec.Collections = append(rec.Collections, entry)
+	}
+
+	if err := db.wal.append(rec); err != nil {
+		return err
+	}
+
+	for _, c := range collections {
+		db.wal.dirty[c.name] = true
+	}
+	return nil
+}
+
+func (db *DB) logDrop(name string) error {
+	if err := db.wal.append(&walRecord{Dropped: []string{name}}); err != nil {
+		return err
+	}
+	db.wal.dirty[name] = true
+	return nil
+}
+
+// persist saves c, either by rewriting its snapshot or, if the database has a write-ahead log, by logging its changes.
+func (db *DB) persist(c *collection) error {
+	if db.readOnly {
+		return readOnlyDatabaseError()
+	}
+
+	if db.wal != nil {
+		return db.logCollections(c)
+	}
+	return db.save(c)
+}
+
+// maybeCheckpoint performs a checkpoint if enough records have been appended to the log.
+// A failed checkpoint leaves the log untouched, so that it is simply retried after the next write.
+func (db *DB) maybeCheckpoint() {
+	if db.wal != nil && db.wal.records >= db.wal.checkpointWrites && db.checkpointBlocked() == nil {
+		if err := db.checkpoint(); err != nil {
+			db.logf("checkpoint failed: %v", err)
+		}
+	}
+}
+
+// Checkpoint writes to the collection files all the changes recorded in the write-ahead log, which is then emptied.
+// Checkpoints are performed automatically (see WithCheckpointWrites), as well as when the database is opened and closed.
+// It has no effect if the database doesn't use a write-ahead log.
+//
+// If the log holds changes of a collection which could not be loaded (see CorruptedCollections), checkpoints are
+// postponed, so that the log is kept along with those changes, and Checkpoint fails with ErrCorruptedCollection until
+// the collection is repaired or dropped. Note that Repair salvages the stored snapshot: the logged changes which could
+// not be applied to the collection are discarded.
+func (db *DB) Checkpoint() error {
+	db.mu.Lock()
+	defer db.unlock()
+
+	return db.checkpoint()
+}
+
+func (db *DB) checkpoint() error {
+	if db.wal == nil {
+		return nil
+	}
+
+	if err := db.checkpointBlocked(); err != nil {
+		return err
+	}
+
+	for name := range db.wal.dirty {
+		c, ok := db.collections[name]
+		if !ok {
+			if err := db.storage.Delete(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		data, err := db.encodeSnapshot(c)
+		if err != nil {
+			return err
+		}
+
+		if err := db.storage.Save(name, data, true); err != nil {
+			return err
+		}
+		db.forgetDirty(name)
+	}
+	return db.wal.reset()
+}
+
+// Compact rewrites the stored snapshot of a collection from its current content, flushing it to stable storage.
+// Since snapshots are always replaced as a whole, they never contain deleted documents: space is only held by the
+// write-ahead log, if any, which keeps every write since the last checkpoint. In this case, Compact performs a
+// checkpoint, which empties the log. Checkpoints are also performed automatically, according to WithCheckpointWrites.
+func (db *DB) Compact(name string) error {
+	db.ensureLoaded(name)
+
+	db.mu.Lock()
+	defer db.unlock()
+
+	if db.readOnly {
+		return readOnlyDatabaseError()
+	}
+
+	c, ok := db.collections[name]
+	if !ok {
+		return collectionNotExistError(name)
+	}
+
+	if db.wal != nil {
+		return db.checkpoint()
+	}
+
+	data, err := db.encodeSnapshot(c)
+	if err != nil {
+		return err
+	}
+
+	if err := db.storage.Save(name, data, true); err != nil {
+		return err
+	}
+	db.forgetDirty(name)
+	return nil
+}
+
+// recoverWAL opens the write-ahead log inside dir, replays it and performs a checkpoint, so that the log is empty,
+// unless it holds changes of corrupted collections (see Checkpoint).
+func (db *DB) recoverWAL(dir string, checkpointWrites int, mode os.FileMode) error {
+	wal, err := openWAL(dir, checkpointWrites, mode)
+	if err != nil {
+		return err
+	}
+	db.wal = wal
+
+	if err := db.replayWAL(); err != nil {
+		wal.close()
+		return err
+	}
+
+	if err := db.checkpointBlocked(); err != nil {
+		db.logf("checkpoint postponed: %v", err)
+		return nil
+	}
+
+	if err := db.checkpoint(); err != nil {
+		wal.close()
+		return err
+	}
+	return nil
+}
+
+// loadWAL replays the write-ahead log inside dir, if any, without modifying it: it is used by read-only databases.
+func (db *DB) loadWAL(dir string) error {
+	if dir == "" {
+		return fmt.Errorf("%w: the write-ahead log requires a database directory", ErrInvalidArgument)
+	}
+
+	file, err := os.Open(dir + "/" + walFileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	db.wal = &wal{file: file, dirty: make(map[string]bool), skipped: make(map[string]bool)}
+	defer func() { db.wal = nil }()
+	return db.replayWAL()
+}
+
+// replayWAL applies to the loaded collections the records of the log, stopping at the first damaged one.
+func (db *DB) replayWAL() error {
+	records, err := db.wal.readRecords()
+	if err != nil {
+		return err
+	}
+
+	for _, data := range records {
+		rec, err := db.decodeWALRecord(data)
+		if err != nil {
+			return err
+		}
+
+		if err := db.applyWALRecord(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) decodeWALRecord(data []byte) (*walRecord, error) {
+	rec := &walRecord{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if db.preserveInts {
+		decoder.UseNumber()
+	}
+	if err := decoder.Decode(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// markReplayed records that the collection with the given name has been modified by a replayed record, so that the
+// next checkpoint saves it. Replicas (see OpenReplica) apply records without having a log.
+func (db *DB) markReplayed(name string) {
+	if db.wal != nil {
+		db.wal.dirty[name] = true
+		delete(db.wal.skipped, name)
+	}
+}
+
+// forgetSkipped records that the records of the collection with the given name which could not be replayed are no
+// longer needed, since the collection has been repaired or dropped.
+func (db *DB) forgetSkipped(name string) {
+	if db.wal != nil {
+		delete(db.wal.skipped, name)
+	}
+}
+
+// checkpointBlocked returns a non-nil error if the log holds records which could not be replayed, since they belong to
+// a corrupted collection: in this case, the log must not be emptied.
+func (db *DB) checkpointBlocked() error {
+	for name := range db.wal.skipped {
+		return fmt.Errorf("%w: %s: the write-ahead log holds changes of the collection, and is kept until the collection is repaired or dropped",
+			ErrCorruptedCollection, name)
+	}
+	return nil
+}
+
+func (db *DB) applyWALRecord(rec *walRecord) error {
+	for _, name := range rec.Dropped {
+		delete(db.collections, name)
+		delete(db.unloaded, name)
+		delete(db.corrupted, name)
+		db.markReplayed(name)
+	}
+
+	for _, entry := range rec.Collections {
+		for _, row := range entry.Rows {
+			convertNumbers(row)
+		}
+
+		if err := db.decodeRows(entry.Rows); err != nil {
+			return err
+		}
+
+		if entry.Reset {
+			delete(db.unloaded, entry.Name)
+		} else {
+			db.loadCollection(entry.Name)
+		}
+
+		c, ok := db.collections[entry.Name]
+		if entry.Reset {
+			c = newCollection(db, entry.Name, nil)
+		} else if !ok {
+			// the collection could not be loaded from its snapshot: the record must be kept
+			if _, corrupted := db.corrupted[entry.Name]; corrupted && db.wal != nil {
+				db.wal.skipped[entry.Name] = true
+			}
+			continue
+		} else {
+			c = c.clone()
+		}
+
+		for _, id := range entry.Deleted {
+			c.remove(id)
+		}
+		c.addDocuments(db.rowsToDocuments(entry.Rows)...)
+		c.replaceMetadata(entry.Metadata)
+
+		db.collections[entry.Name] = c
+		delete(db.corrupted, entry.Name)
+		db.markReplayed(entry.Name)
+	}
+	return nil
+}
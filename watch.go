@@ -0,0 +1,130 @@
+package clover
+
+import (
+	"sync"
+)
+
+// ChangeOp identifies the kind of operation described by a ChangeEvent.
+type ChangeOp int
+
+// Supported change operations
+const (
+	OpInsert ChangeOp = iota
+	OpUpdate
+	OpDelete
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case OpInsert:
+		return "insert"
+	case OpUpdate:
+		return "update"
+	case OpDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// ChangeEvent describes a modification of a single document of a collection.
+// For inserts and updates, Doc holds the new version of the document, while for deletes it holds the removed document.
+// As for the documents returned by queries (see Query.FindAll), Doc is copy-on-write.
+// Dropped reports how many events were discarded, since the previous delivered one, because the watcher was not keeping up.
+type ChangeEvent struct {
+	Op         ChangeOp
+	Collection string
+	Id         string
+	Doc        *Document
+	Dropped    int
+}
+
+// size of the buffer of each watch channel
+const watchBufferSize = 128
+
+type watcher struct {
+	collection string
+	ch         chan ChangeEvent
+	dropped    int
+}
+
+type watchers struct {
+	mu     sync.Mutex
+	nextId int
+	all    map[int]*watcher
+}
+
+// Watch returns a channel receiving the changes applied to the given collection, and a function to stop watching.
+// Events are delivered only after the corresponding write has been saved.
+// The channel is buffered: writers never block on slow consumers, and events which don't fit in the buffer are discarded.
+// Discarded events are signalled through the Dropped field of the next delivered event.
+// Calling the cancel function closes the channel.
+func (db *DB) Watch(collectionName string) (<-chan ChangeEvent, func()) {
+	db.watchers.mu.Lock()
+	defer db.watchers.mu.Unlock()
+
+	if db.watchers.all == nil {
+		db.watchers.all = make(map[int]*watcher)
+	}
+
+	id := db.watchers.nextId
+	db.watchers.nextId++
+
+	w := &watcher{collection: collectionName, ch: make(chan ChangeEvent, watchBufferSize)}
+	db.watchers.all[id] = w
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			db.watchers.mu.Lock()
+			defer db.watchers.mu.Unlock()
+
+			delete(db.watchers.all, id)
+			close(w.ch)
+		})
+	}
+	return w.ch, cancel
+}
+
+// WatchFunc calls fn for each change applied to the given collection, as delivered by Watch. Events are passed to fn
+// in order, one at a time, by a dedicated goroutine: a slow callback never blocks writers, but it may miss events
+// (see ChangeEvent.Dropped). Calling the returned function stops watching: events already buffered are still delivered.
+func (db *DB) WatchFunc(collectionName string, fn func(event ChangeEvent)) (cancel func()) {
+	events, cancel := db.Watch(collectionName)
+	go func() {
+		for e := range events {
+			fn(e)
+		}
+	}()
+	return cancel
+}
+
+func (db *DB) notify(events ...ChangeEvent) {
+	db.watchers.mu.Lock()
+	defer db.watchers.mu.Unlock()
+
+	for _, w := range db.watchers.all {
+		for _, e := range events {
+			if e.Collection != w.collection {
+				continue
+			}
+
+			e.Dropped = w.dropped
+			e.Doc = e.Doc.share()
+			select {
+			case w.ch <- e:
+				w.dropped = 0
+			default:
+				w.dropped++
+			}
+		}
+	}
+}
+
+func newChangeEvent(op ChangeOp, collectionName string, doc *Document) ChangeEvent {
+	return ChangeEvent{
+		Op:         op,
+		Collection: collectionName,
+		Id:         doc.ObjectId(),
+		Doc:        doc,
+	}
+}